@@ -22,6 +22,51 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// groupId is optional, new users are added to the group if it's set
+type InviteCodeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	GroupId       uint64                 `protobuf:"varint,1,opt,name=groupId,proto3" json:"groupId,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InviteCodeRequest) Reset() {
+	*x = InviteCodeRequest{}
+	mi := &file_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InviteCodeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InviteCodeRequest) ProtoMessage() {}
+
+func (x *InviteCodeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InviteCodeRequest.ProtoReflect.Descriptor instead.
+func (*InviteCodeRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *InviteCodeRequest) GetGroupId() uint64 {
+	if x != nil {
+		return x.GroupId
+	}
+	return 0
+}
+
 type IvniteCodeReply struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Code          string                 `protobuf:"bytes,1,opt,name=code,proto3" json:"code,omitempty"`
@@ -31,7 +76,7 @@ type IvniteCodeReply struct {
 
 func (x *IvniteCodeReply) Reset() {
 	*x = IvniteCodeReply{}
-	mi := &file_admin_proto_msgTypes[0]
+	mi := &file_admin_proto_msgTypes[1]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -43,7 +88,7 @@ func (x *IvniteCodeReply) String() string {
 func (*IvniteCodeReply) ProtoMessage() {}
 
 func (x *IvniteCodeReply) ProtoReflect() protoreflect.Message {
-	mi := &file_admin_proto_msgTypes[0]
+	mi := &file_admin_proto_msgTypes[1]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -56,7 +101,7 @@ func (x *IvniteCodeReply) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use IvniteCodeReply.ProtoReflect.Descriptor instead.
 func (*IvniteCodeReply) Descriptor() ([]byte, []int) {
-	return file_admin_proto_rawDescGZIP(), []int{0}
+	return file_admin_proto_rawDescGZIP(), []int{1}
 }
 
 func (x *IvniteCodeReply) GetCode() string {
@@ -71,13 +116,14 @@ type ImportRequest struct {
 	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
 	Password      string                 `protobuf:"bytes,2,opt,name=password,proto3" json:"password,omitempty"`
 	UserId        uint64                 `protobuf:"varint,3,opt,name=userId,proto3" json:"userId,omitempty"`
+	DryRun        bool                   `protobuf:"varint,4,opt,name=dryRun,proto3" json:"dryRun,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *ImportRequest) Reset() {
 	*x = ImportRequest{}
-	mi := &file_admin_proto_msgTypes[1]
+	mi := &file_admin_proto_msgTypes[2]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -89,7 +135,7 @@ func (x *ImportRequest) String() string {
 func (*ImportRequest) ProtoMessage() {}
 
 func (x *ImportRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_admin_proto_msgTypes[1]
+	mi := &file_admin_proto_msgTypes[2]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -102,7 +148,7 @@ func (x *ImportRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ImportRequest.ProtoReflect.Descriptor instead.
 func (*ImportRequest) Descriptor() ([]byte, []int) {
-	return file_admin_proto_rawDescGZIP(), []int{1}
+	return file_admin_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *ImportRequest) GetUsername() string {
@@ -126,20 +172,589 @@ func (x *ImportRequest) GetUserId() uint64 {
 	return 0
 }
 
+func (x *ImportRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+// importer is one of csv, json, amazon, microdata or vistes. data is the
+// file for the ones that read one, username and password the login for the
+// ones that fetch it. listId 0 is the user's default list.
+type GenericImportRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Importer      string                 `protobuf:"bytes,1,opt,name=importer,proto3" json:"importer,omitempty"`
+	UserId        uint64                 `protobuf:"varint,2,opt,name=userId,proto3" json:"userId,omitempty"`
+	Data          []byte                 `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Username      string                 `protobuf:"bytes,4,opt,name=username,proto3" json:"username,omitempty"`
+	Password      string                 `protobuf:"bytes,5,opt,name=password,proto3" json:"password,omitempty"`
+	ListId        uint64                 `protobuf:"varint,6,opt,name=listId,proto3" json:"listId,omitempty"`
+	DryRun        bool                   `protobuf:"varint,7,opt,name=dryRun,proto3" json:"dryRun,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GenericImportRequest) Reset() {
+	*x = GenericImportRequest{}
+	mi := &file_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GenericImportRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenericImportRequest) ProtoMessage() {}
+
+func (x *GenericImportRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenericImportRequest.ProtoReflect.Descriptor instead.
+func (*GenericImportRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GenericImportRequest) GetImporter() string {
+	if x != nil {
+		return x.Importer
+	}
+	return ""
+}
+
+func (x *GenericImportRequest) GetUserId() uint64 {
+	if x != nil {
+		return x.UserId
+	}
+	return 0
+}
+
+func (x *GenericImportRequest) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *GenericImportRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *GenericImportRequest) GetPassword() string {
+	if x != nil {
+		return x.Password
+	}
+	return ""
+}
+
+func (x *GenericImportRequest) GetListId() uint64 {
+	if x != nil {
+		return x.ListId
+	}
+	return 0
+}
+
+func (x *GenericImportRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+// an item as the importer read it
+type ImportedItem struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Row         uint32                 `protobuf:"varint,1,opt,name=row,proto3" json:"row,omitempty"`
+	ExternalId  string                 `protobuf:"bytes,2,opt,name=externalId,proto3" json:"externalId,omitempty"`
+	Description string                 `protobuf:"bytes,3,opt,name=description,proto3" json:"description,omitempty"`
+	Source      string                 `protobuf:"bytes,4,opt,name=source,proto3" json:"source,omitempty"`
+	Cost        string                 `protobuf:"bytes,5,opt,name=cost,proto3" json:"cost,omitempty"`
+	OwnerNotes  string                 `protobuf:"bytes,6,opt,name=ownerNotes,proto3" json:"ownerNotes,omitempty"`
+	Tags        []string               `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty"`
+	// it was imported before, and isn't added again
+	AlreadyImported bool `protobuf:"varint,8,opt,name=alreadyImported,proto3" json:"alreadyImported,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *ImportedItem) Reset() {
+	*x = ImportedItem{}
+	mi := &file_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImportedItem) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImportedItem) ProtoMessage() {}
+
+func (x *ImportedItem) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImportedItem.ProtoReflect.Descriptor instead.
+func (*ImportedItem) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ImportedItem) GetRow() uint32 {
+	if x != nil {
+		return x.Row
+	}
+	return 0
+}
+
+func (x *ImportedItem) GetExternalId() string {
+	if x != nil {
+		return x.ExternalId
+	}
+	return ""
+}
+
+func (x *ImportedItem) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *ImportedItem) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *ImportedItem) GetCost() string {
+	if x != nil {
+		return x.Cost
+	}
+	return ""
+}
+
+func (x *ImportedItem) GetOwnerNotes() string {
+	if x != nil {
+		return x.OwnerNotes
+	}
+	return ""
+}
+
+func (x *ImportedItem) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *ImportedItem) GetAlreadyImported() bool {
+	if x != nil {
+		return x.AlreadyImported
+	}
+	return false
+}
+
+// ids are the items added, none for a dry run. added is how many were or
+// would be, skipped how many were already imported.
+type ImportReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ids           []uint64               `protobuf:"varint,1,rep,packed,name=ids,proto3" json:"ids,omitempty"`
+	Added         uint32                 `protobuf:"varint,2,opt,name=added,proto3" json:"added,omitempty"`
+	Skipped       uint32                 `protobuf:"varint,3,opt,name=skipped,proto3" json:"skipped,omitempty"`
+	Items         []*ImportedItem        `protobuf:"bytes,4,rep,name=items,proto3" json:"items,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ImportReply) Reset() {
+	*x = ImportReply{}
+	mi := &file_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImportReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImportReply) ProtoMessage() {}
+
+func (x *ImportReply) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImportReply.ProtoReflect.Descriptor instead.
+func (*ImportReply) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ImportReply) GetIds() []uint64 {
+	if x != nil {
+		return x.Ids
+	}
+	return nil
+}
+
+func (x *ImportReply) GetAdded() uint32 {
+	if x != nil {
+		return x.Added
+	}
+	return 0
+}
+
+func (x *ImportReply) GetSkipped() uint32 {
+	if x != nil {
+		return x.Skipped
+	}
+	return 0
+}
+
+func (x *ImportReply) GetItems() []*ImportedItem {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+type CreateGroupRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateGroupRequest) Reset() {
+	*x = CreateGroupRequest{}
+	mi := &file_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateGroupRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateGroupRequest) ProtoMessage() {}
+
+func (x *CreateGroupRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateGroupRequest.ProtoReflect.Descriptor instead.
+func (*CreateGroupRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CreateGroupRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type CreateGroupReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	GroupId       uint64                 `protobuf:"varint,1,opt,name=groupId,proto3" json:"groupId,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateGroupReply) Reset() {
+	*x = CreateGroupReply{}
+	mi := &file_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateGroupReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateGroupReply) ProtoMessage() {}
+
+func (x *CreateGroupReply) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateGroupReply.ProtoReflect.Descriptor instead.
+func (*CreateGroupReply) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CreateGroupReply) GetGroupId() uint64 {
+	if x != nil {
+		return x.GroupId
+	}
+	return 0
+}
+
+// role is "admin" or "member", adding an existing member changes their role
+type GroupMemberRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	GroupId       uint64                 `protobuf:"varint,1,opt,name=groupId,proto3" json:"groupId,omitempty"`
+	UserId        uint64                 `protobuf:"varint,2,opt,name=userId,proto3" json:"userId,omitempty"`
+	Role          string                 `protobuf:"bytes,3,opt,name=role,proto3" json:"role,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GroupMemberRequest) Reset() {
+	*x = GroupMemberRequest{}
+	mi := &file_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GroupMemberRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GroupMemberRequest) ProtoMessage() {}
+
+func (x *GroupMemberRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GroupMemberRequest.ProtoReflect.Descriptor instead.
+func (*GroupMemberRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *GroupMemberRequest) GetGroupId() uint64 {
+	if x != nil {
+		return x.GroupId
+	}
+	return 0
+}
+
+func (x *GroupMemberRequest) GetUserId() uint64 {
+	if x != nil {
+		return x.UserId
+	}
+	return 0
+}
+
+func (x *GroupMemberRequest) GetRole() string {
+	if x != nil {
+		return x.Role
+	}
+	return ""
+}
+
+// site admins can debug visibility by viewing the site as other users
+type SiteAdminRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UserId        uint64                 `protobuf:"varint,1,opt,name=userId,proto3" json:"userId,omitempty"`
+	Admin         bool                   `protobuf:"varint,2,opt,name=admin,proto3" json:"admin,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SiteAdminRequest) Reset() {
+	*x = SiteAdminRequest{}
+	mi := &file_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SiteAdminRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SiteAdminRequest) ProtoMessage() {}
+
+func (x *SiteAdminRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SiteAdminRequest.ProtoReflect.Descriptor instead.
+func (*SiteAdminRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SiteAdminRequest) GetUserId() uint64 {
+	if x != nil {
+		return x.UserId
+	}
+	return 0
+}
+
+func (x *SiteAdminRequest) GetAdmin() bool {
+	if x != nil {
+		return x.Admin
+	}
+	return false
+}
+
+type ExchangeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ExchangeId    uint64                 `protobuf:"varint,1,opt,name=exchangeId,proto3" json:"exchangeId,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExchangeRequest) Reset() {
+	*x = ExchangeRequest{}
+	mi := &file_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExchangeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExchangeRequest) ProtoMessage() {}
+
+func (x *ExchangeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExchangeRequest.ProtoReflect.Descriptor instead.
+func (*ExchangeRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *ExchangeRequest) GetExchangeId() uint64 {
+	if x != nil {
+		return x.ExchangeId
+	}
+	return 0
+}
+
 var File_admin_proto protoreflect.FileDescriptor
 
 const file_admin_proto_rawDesc = "" +
 	"\n" +
-	"\vadmin.proto\x12\x05admin\x1a\x1bgoogle/protobuf/empty.proto\"%\n" +
+	"\vadmin.proto\x12\x05admin\x1a\x1bgoogle/protobuf/empty.proto\"-\n" +
+	"\x11InviteCodeRequest\x12\x18\n" +
+	"\agroupId\x18\x01 \x01(\x04R\agroupId\"%\n" +
 	"\x0fIvniteCodeReply\x12\x12\n" +
-	"\x04code\x18\x01 \x01(\tR\x04code\"_\n" +
+	"\x04code\x18\x01 \x01(\tR\x04code\"w\n" +
 	"\rImportRequest\x12\x1a\n" +
 	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
 	"\bpassword\x18\x02 \x01(\tR\bpassword\x12\x16\n" +
-	"\x06userId\x18\x03 \x01(\x04R\x06userId2\x97\x01\n" +
-	"\rWishlistAdmin\x12F\n" +
-	"\x12GenerateInviteCode\x12\x16.google.protobuf.Empty\x1a\x16.admin.IvniteCodeReply\"\x00\x12>\n" +
-	"\fVistesImport\x12\x14.admin.ImportRequest\x1a\x16.google.protobuf.Empty\"\x00B\rZ\v./admin_rpcb\x06proto3"
+	"\x06userId\x18\x03 \x01(\x04R\x06userId\x12\x16\n" +
+	"\x06dryRun\x18\x04 \x01(\bR\x06dryRun\"\xc6\x01\n" +
+	"\x14GenericImportRequest\x12\x1a\n" +
+	"\bimporter\x18\x01 \x01(\tR\bimporter\x12\x16\n" +
+	"\x06userId\x18\x02 \x01(\x04R\x06userId\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\x12\x1a\n" +
+	"\busername\x18\x04 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x05 \x01(\tR\bpassword\x12\x16\n" +
+	"\x06listId\x18\x06 \x01(\x04R\x06listId\x12\x16\n" +
+	"\x06dryRun\x18\a \x01(\bR\x06dryRun\"\xec\x01\n" +
+	"\fImportedItem\x12\x10\n" +
+	"\x03row\x18\x01 \x01(\rR\x03row\x12\x1e\n" +
+	"\n" +
+	"externalId\x18\x02 \x01(\tR\n" +
+	"externalId\x12 \n" +
+	"\vdescription\x18\x03 \x01(\tR\vdescription\x12\x16\n" +
+	"\x06source\x18\x04 \x01(\tR\x06source\x12\x12\n" +
+	"\x04cost\x18\x05 \x01(\tR\x04cost\x12\x1e\n" +
+	"\n" +
+	"ownerNotes\x18\x06 \x01(\tR\n" +
+	"ownerNotes\x12\x12\n" +
+	"\x04tags\x18\a \x03(\tR\x04tags\x12(\n" +
+	"\x0falreadyImported\x18\b \x01(\bR\x0falreadyImported\"z\n" +
+	"\vImportReply\x12\x10\n" +
+	"\x03ids\x18\x01 \x03(\x04R\x03ids\x12\x14\n" +
+	"\x05added\x18\x02 \x01(\rR\x05added\x12\x18\n" +
+	"\askipped\x18\x03 \x01(\rR\askipped\x12)\n" +
+	"\x05items\x18\x04 \x03(\v2\x13.admin.ImportedItemR\x05items\"(\n" +
+	"\x12CreateGroupRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\",\n" +
+	"\x10CreateGroupReply\x12\x18\n" +
+	"\agroupId\x18\x01 \x01(\x04R\agroupId\"Z\n" +
+	"\x12GroupMemberRequest\x12\x18\n" +
+	"\agroupId\x18\x01 \x01(\x04R\agroupId\x12\x16\n" +
+	"\x06userId\x18\x02 \x01(\x04R\x06userId\x12\x12\n" +
+	"\x04role\x18\x03 \x01(\tR\x04role\"@\n" +
+	"\x10SiteAdminRequest\x12\x16\n" +
+	"\x06userId\x18\x01 \x01(\x04R\x06userId\x12\x14\n" +
+	"\x05admin\x18\x02 \x01(\bR\x05admin\"1\n" +
+	"\x0fExchangeRequest\x12\x1e\n" +
+	"\n" +
+	"exchangeId\x18\x01 \x01(\x04R\n" +
+	"exchangeId2\xe5\x03\n" +
+	"\rWishlistAdmin\x12H\n" +
+	"\x12GenerateInviteCode\x12\x18.admin.InviteCodeRequest\x1a\x16.admin.IvniteCodeReply\"\x00\x12:\n" +
+	"\fVistesImport\x12\x14.admin.ImportRequest\x1a\x12.admin.ImportReply\"\x00\x12C\n" +
+	"\vCreateGroup\x12\x19.admin.CreateGroupRequest\x1a\x17.admin.CreateGroupReply\"\x00\x12E\n" +
+	"\x0eAddGroupMember\x12\x19.admin.GroupMemberRequest\x1a\x16.google.protobuf.Empty\"\x00\x12A\n" +
+	"\fSetSiteAdmin\x12\x17.admin.SiteAdminRequest\x1a\x16.google.protobuf.Empty\"\x00\x12B\n" +
+	"\x0eRedrawExchange\x12\x16.admin.ExchangeRequest\x1a\x16.google.protobuf.Empty\"\x00\x12;\n" +
+	"\x06Import\x12\x1b.admin.GenericImportRequest\x1a\x12.admin.ImportReply\"\x00B\rZ\v./admin_rpcb\x06proto3"
 
 var (
 	file_admin_proto_rawDescOnce sync.Once
@@ -153,22 +768,42 @@ func file_admin_proto_rawDescGZIP() []byte {
 	return file_admin_proto_rawDescData
 }
 
-var file_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_admin_proto_goTypes = []any{
-	(*IvniteCodeReply)(nil), // 0: admin.IvniteCodeReply
-	(*ImportRequest)(nil),   // 1: admin.ImportRequest
-	(*emptypb.Empty)(nil),   // 2: google.protobuf.Empty
+	(*InviteCodeRequest)(nil),    // 0: admin.InviteCodeRequest
+	(*IvniteCodeReply)(nil),      // 1: admin.IvniteCodeReply
+	(*ImportRequest)(nil),        // 2: admin.ImportRequest
+	(*GenericImportRequest)(nil), // 3: admin.GenericImportRequest
+	(*ImportedItem)(nil),         // 4: admin.ImportedItem
+	(*ImportReply)(nil),          // 5: admin.ImportReply
+	(*CreateGroupRequest)(nil),   // 6: admin.CreateGroupRequest
+	(*CreateGroupReply)(nil),     // 7: admin.CreateGroupReply
+	(*GroupMemberRequest)(nil),   // 8: admin.GroupMemberRequest
+	(*SiteAdminRequest)(nil),     // 9: admin.SiteAdminRequest
+	(*ExchangeRequest)(nil),      // 10: admin.ExchangeRequest
+	(*emptypb.Empty)(nil),        // 11: google.protobuf.Empty
 }
 var file_admin_proto_depIdxs = []int32{
-	2, // 0: admin.WishlistAdmin.GenerateInviteCode:input_type -> google.protobuf.Empty
-	1, // 1: admin.WishlistAdmin.VistesImport:input_type -> admin.ImportRequest
-	0, // 2: admin.WishlistAdmin.GenerateInviteCode:output_type -> admin.IvniteCodeReply
-	2, // 3: admin.WishlistAdmin.VistesImport:output_type -> google.protobuf.Empty
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	4,  // 0: admin.ImportReply.items:type_name -> admin.ImportedItem
+	0,  // 1: admin.WishlistAdmin.GenerateInviteCode:input_type -> admin.InviteCodeRequest
+	2,  // 2: admin.WishlistAdmin.VistesImport:input_type -> admin.ImportRequest
+	6,  // 3: admin.WishlistAdmin.CreateGroup:input_type -> admin.CreateGroupRequest
+	8,  // 4: admin.WishlistAdmin.AddGroupMember:input_type -> admin.GroupMemberRequest
+	9,  // 5: admin.WishlistAdmin.SetSiteAdmin:input_type -> admin.SiteAdminRequest
+	10, // 6: admin.WishlistAdmin.RedrawExchange:input_type -> admin.ExchangeRequest
+	3,  // 7: admin.WishlistAdmin.Import:input_type -> admin.GenericImportRequest
+	1,  // 8: admin.WishlistAdmin.GenerateInviteCode:output_type -> admin.IvniteCodeReply
+	5,  // 9: admin.WishlistAdmin.VistesImport:output_type -> admin.ImportReply
+	7,  // 10: admin.WishlistAdmin.CreateGroup:output_type -> admin.CreateGroupReply
+	11, // 11: admin.WishlistAdmin.AddGroupMember:output_type -> google.protobuf.Empty
+	11, // 12: admin.WishlistAdmin.SetSiteAdmin:output_type -> google.protobuf.Empty
+	11, // 13: admin.WishlistAdmin.RedrawExchange:output_type -> google.protobuf.Empty
+	5,  // 14: admin.WishlistAdmin.Import:output_type -> admin.ImportReply
+	8,  // [8:15] is the sub-list for method output_type
+	1,  // [1:8] is the sub-list for method input_type
+	1,  // [1:1] is the sub-list for extension type_name
+	1,  // [1:1] is the sub-list for extension extendee
+	0,  // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_admin_proto_init() }
@@ -182,7 +817,7 @@ func file_admin_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_admin_proto_rawDesc), len(file_admin_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -22,14 +22,24 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	WishlistAdmin_GenerateInviteCode_FullMethodName = "/admin.WishlistAdmin/GenerateInviteCode"
 	WishlistAdmin_VistesImport_FullMethodName       = "/admin.WishlistAdmin/VistesImport"
+	WishlistAdmin_CreateGroup_FullMethodName        = "/admin.WishlistAdmin/CreateGroup"
+	WishlistAdmin_AddGroupMember_FullMethodName     = "/admin.WishlistAdmin/AddGroupMember"
+	WishlistAdmin_SetSiteAdmin_FullMethodName       = "/admin.WishlistAdmin/SetSiteAdmin"
+	WishlistAdmin_RedrawExchange_FullMethodName     = "/admin.WishlistAdmin/RedrawExchange"
+	WishlistAdmin_Import_FullMethodName             = "/admin.WishlistAdmin/Import"
 )
 
 // WishlistAdminClient is the client API for WishlistAdmin service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type WishlistAdminClient interface {
-	GenerateInviteCode(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*IvniteCodeReply, error)
-	VistesImport(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	GenerateInviteCode(ctx context.Context, in *InviteCodeRequest, opts ...grpc.CallOption) (*IvniteCodeReply, error)
+	VistesImport(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportReply, error)
+	CreateGroup(ctx context.Context, in *CreateGroupRequest, opts ...grpc.CallOption) (*CreateGroupReply, error)
+	AddGroupMember(ctx context.Context, in *GroupMemberRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	SetSiteAdmin(ctx context.Context, in *SiteAdminRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	RedrawExchange(ctx context.Context, in *ExchangeRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Import(ctx context.Context, in *GenericImportRequest, opts ...grpc.CallOption) (*ImportReply, error)
 }
 
 type wishlistAdminClient struct {
@@ -40,7 +50,7 @@ func NewWishlistAdminClient(cc grpc.ClientConnInterface) WishlistAdminClient {
 	return &wishlistAdminClient{cc}
 }
 
-func (c *wishlistAdminClient) GenerateInviteCode(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*IvniteCodeReply, error) {
+func (c *wishlistAdminClient) GenerateInviteCode(ctx context.Context, in *InviteCodeRequest, opts ...grpc.CallOption) (*IvniteCodeReply, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(IvniteCodeReply)
 	err := c.cc.Invoke(ctx, WishlistAdmin_GenerateInviteCode_FullMethodName, in, out, cOpts...)
@@ -50,9 +60,9 @@ func (c *wishlistAdminClient) GenerateInviteCode(ctx context.Context, in *emptyp
 	return out, nil
 }
 
-func (c *wishlistAdminClient) VistesImport(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+func (c *wishlistAdminClient) VistesImport(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportReply, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	out := new(emptypb.Empty)
+	out := new(ImportReply)
 	err := c.cc.Invoke(ctx, WishlistAdmin_VistesImport_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
@@ -60,12 +70,67 @@ func (c *wishlistAdminClient) VistesImport(ctx context.Context, in *ImportReques
 	return out, nil
 }
 
+func (c *wishlistAdminClient) CreateGroup(ctx context.Context, in *CreateGroupRequest, opts ...grpc.CallOption) (*CreateGroupReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CreateGroupReply)
+	err := c.cc.Invoke(ctx, WishlistAdmin_CreateGroup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wishlistAdminClient) AddGroupMember(ctx context.Context, in *GroupMemberRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, WishlistAdmin_AddGroupMember_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wishlistAdminClient) SetSiteAdmin(ctx context.Context, in *SiteAdminRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, WishlistAdmin_SetSiteAdmin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wishlistAdminClient) RedrawExchange(ctx context.Context, in *ExchangeRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, WishlistAdmin_RedrawExchange_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wishlistAdminClient) Import(ctx context.Context, in *GenericImportRequest, opts ...grpc.CallOption) (*ImportReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ImportReply)
+	err := c.cc.Invoke(ctx, WishlistAdmin_Import_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // WishlistAdminServer is the server API for WishlistAdmin service.
 // All implementations must embed UnimplementedWishlistAdminServer
 // for forward compatibility.
 type WishlistAdminServer interface {
-	GenerateInviteCode(context.Context, *emptypb.Empty) (*IvniteCodeReply, error)
-	VistesImport(context.Context, *ImportRequest) (*emptypb.Empty, error)
+	GenerateInviteCode(context.Context, *InviteCodeRequest) (*IvniteCodeReply, error)
+	VistesImport(context.Context, *ImportRequest) (*ImportReply, error)
+	CreateGroup(context.Context, *CreateGroupRequest) (*CreateGroupReply, error)
+	AddGroupMember(context.Context, *GroupMemberRequest) (*emptypb.Empty, error)
+	SetSiteAdmin(context.Context, *SiteAdminRequest) (*emptypb.Empty, error)
+	RedrawExchange(context.Context, *ExchangeRequest) (*emptypb.Empty, error)
+	Import(context.Context, *GenericImportRequest) (*ImportReply, error)
 	mustEmbedUnimplementedWishlistAdminServer()
 }
 
@@ -76,12 +141,27 @@ type WishlistAdminServer interface {
 // pointer dereference when methods are called.
 type UnimplementedWishlistAdminServer struct{}
 
-func (UnimplementedWishlistAdminServer) GenerateInviteCode(context.Context, *emptypb.Empty) (*IvniteCodeReply, error) {
+func (UnimplementedWishlistAdminServer) GenerateInviteCode(context.Context, *InviteCodeRequest) (*IvniteCodeReply, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GenerateInviteCode not implemented")
 }
-func (UnimplementedWishlistAdminServer) VistesImport(context.Context, *ImportRequest) (*emptypb.Empty, error) {
+func (UnimplementedWishlistAdminServer) VistesImport(context.Context, *ImportRequest) (*ImportReply, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method VistesImport not implemented")
 }
+func (UnimplementedWishlistAdminServer) CreateGroup(context.Context, *CreateGroupRequest) (*CreateGroupReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateGroup not implemented")
+}
+func (UnimplementedWishlistAdminServer) AddGroupMember(context.Context, *GroupMemberRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddGroupMember not implemented")
+}
+func (UnimplementedWishlistAdminServer) SetSiteAdmin(context.Context, *SiteAdminRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSiteAdmin not implemented")
+}
+func (UnimplementedWishlistAdminServer) RedrawExchange(context.Context, *ExchangeRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RedrawExchange not implemented")
+}
+func (UnimplementedWishlistAdminServer) Import(context.Context, *GenericImportRequest) (*ImportReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Import not implemented")
+}
 func (UnimplementedWishlistAdminServer) mustEmbedUnimplementedWishlistAdminServer() {}
 func (UnimplementedWishlistAdminServer) testEmbeddedByValue()                       {}
 
@@ -104,7 +184,7 @@ func RegisterWishlistAdminServer(s grpc.ServiceRegistrar, srv WishlistAdminServe
 }
 
 func _WishlistAdmin_GenerateInviteCode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(emptypb.Empty)
+	in := new(InviteCodeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -116,7 +196,7 @@ func _WishlistAdmin_GenerateInviteCode_Handler(srv interface{}, ctx context.Cont
 		FullMethod: WishlistAdmin_GenerateInviteCode_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(WishlistAdminServer).GenerateInviteCode(ctx, req.(*emptypb.Empty))
+		return srv.(WishlistAdminServer).GenerateInviteCode(ctx, req.(*InviteCodeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -139,6 +219,96 @@ func _WishlistAdmin_VistesImport_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _WishlistAdmin_CreateGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateGroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WishlistAdminServer).CreateGroup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WishlistAdmin_CreateGroup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WishlistAdminServer).CreateGroup(ctx, req.(*CreateGroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WishlistAdmin_AddGroupMember_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GroupMemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WishlistAdminServer).AddGroupMember(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WishlistAdmin_AddGroupMember_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WishlistAdminServer).AddGroupMember(ctx, req.(*GroupMemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WishlistAdmin_SetSiteAdmin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SiteAdminRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WishlistAdminServer).SetSiteAdmin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WishlistAdmin_SetSiteAdmin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WishlistAdminServer).SetSiteAdmin(ctx, req.(*SiteAdminRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WishlistAdmin_RedrawExchange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExchangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WishlistAdminServer).RedrawExchange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WishlistAdmin_RedrawExchange_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WishlistAdminServer).RedrawExchange(ctx, req.(*ExchangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WishlistAdmin_Import_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenericImportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WishlistAdminServer).Import(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WishlistAdmin_Import_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WishlistAdminServer).Import(ctx, req.(*GenericImportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // WishlistAdmin_ServiceDesc is the grpc.ServiceDesc for WishlistAdmin service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -154,6 +324,26 @@ var WishlistAdmin_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "VistesImport",
 			Handler:    _WishlistAdmin_VistesImport_Handler,
 		},
+		{
+			MethodName: "CreateGroup",
+			Handler:    _WishlistAdmin_CreateGroup_Handler,
+		},
+		{
+			MethodName: "AddGroupMember",
+			Handler:    _WishlistAdmin_AddGroupMember_Handler,
+		},
+		{
+			MethodName: "SetSiteAdmin",
+			Handler:    _WishlistAdmin_SetSiteAdmin_Handler,
+		},
+		{
+			MethodName: "RedrawExchange",
+			Handler:    _WishlistAdmin_RedrawExchange_Handler,
+		},
+		{
+			MethodName: "Import",
+			Handler:    _WishlistAdmin_Import_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "admin.proto",
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// most recently changed items to put in a feed, readers only care about
+// what's new
+const atomFeedSize = 100
+
+// Only the owner's side of an item's history counts as a change here,
+// otherwise the updated times would give away when things get claimed.
+// datetime() puts it in sqliteTimeFormat, items imported from vistes before
+// there was history have a creation_time with a zone on the end.
+const itemUpdatedTime = `datetime(COALESCE((SELECT MAX(creation_time) FROM wishlist_history
+	WHERE item_id = wishlist.id AND NOT buyer_side), wishlist.creation_time))`
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Id        string    `xml:"id"`
+	Title     string    `xml:"title"`
+	Published string    `xml:"published"`
+	Updated   string    `xml:"updated"`
+	Link      *atomLink `xml:"link"`
+	Content   string    `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// atomId makes a tag URI (RFC 4151), which stays the same for as long as
+// the thing it names does, unlike the feed url which changes with the token.
+func atomId(host string, created time.Time, thing string, id uint64) string {
+	host, _, _ = strings.Cut(host, ":")
+	return fmt.Sprintf("tag:%s,%s:%s/%d", host, created.UTC().Format(time.DateOnly), thing, id)
+}
+
+func parseSqliteTime(str string) (time.Time, error) {
+	return time.ParseInLocation(sqliteTimeFormat, str, time.UTC)
+}
+
+// Create a feed link for a list, replacing any existing one so old links
+// stop working. Any list but a private one can have one.
+func handleFeedTokenPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type FeedTokenResponse struct {
+			FeedToken string `json:"feed_token"`
+		}
+
+		listId, ok := checkListOwner(w, r, db, userId)
+		if !ok {
+			return
+		}
+
+		var visibility string
+		err := db.QueryRow("SELECT visibility FROM lists WHERE id = ?", listId).Scan(&visibility)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if visibility == listPrivate {
+			http.Error(w, "private lists can't have a feed", http.StatusConflict)
+			return
+		}
+
+		token := newShareToken()
+		_, err = db.Exec(`INSERT INTO feed_tokens(feed_token, list_id) VALUES(?, ?)
+			ON CONFLICT(list_id) DO UPDATE SET feed_token = excluded.feed_token,
+			creation_time = CURRENT_TIMESTAMP`, token, listId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := FeedTokenResponse{FeedToken: base64.URLEncoding.EncodeToString(token)}
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func handleFeedTokenDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		listId, ok := checkListOwner(w, r, db, userId)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM feed_tokens WHERE list_id = ?", listId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "list has no feed", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// Atom feed of a list for feed readers, with the token standing in for a
+// login. Like the public list view it has nothing buyers have done, just the
+// items and when the owner added or changed them.
+func handleAtomFeedGet(logger *log.Logger, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := base64.URLEncoding.DecodeString(r.PathValue("token"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		var listId uint64
+		var listName, firstName, lastName string
+		var listCreated time.Time
+		err = db.QueryRow(`SELECT lists.id, lists.name, lists.creation_time, users.first_name, users.last_name
+			FROM feed_tokens JOIN lists ON lists.id = feed_tokens.list_id JOIN users ON users.id = lists.user_id
+			WHERE feed_tokens.feed_token = ?`, token).Scan(&listId, &listName, &listCreated, &firstName, &lastName)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the feed changes when anything on the list does, including items
+		// that have since been archived or deleted and so aren't in it
+		modified := listCreated.UTC()
+		var lastChange sql.NullString
+		err = db.QueryRow(`SELECT datetime(MAX(wishlist_history.creation_time)) FROM wishlist_history
+			JOIN wishlist ON wishlist.id = wishlist_history.item_id
+			WHERE wishlist.list_id = ? AND NOT wishlist_history.buyer_side`, listId).Scan(&lastChange)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if lastChange.Valid {
+			changed, err := parseSqliteTime(lastChange.String)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if changed.After(modified) {
+				modified = changed
+			}
+		}
+
+		self := url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
+		if r.TLS == nil {
+			self.Scheme = "http"
+		}
+		feed := atomFeed{
+			Id:      atomId(r.Host, listCreated, "list", listId),
+			Title:   fmt.Sprintf("%s %s: %s", firstName, lastName, listName),
+			Updated: modified.Format(time.RFC3339),
+			Author:  atomPerson{Name: firstName + " " + lastName},
+			Link:    atomLink{Rel: "self", Href: self.String()},
+			Entries: []atomEntry{},
+		}
+
+		rows, err := db.Query(`SELECT id, description, source, cost, quantity_desired, creation_time,
+			`+itemUpdatedTime+` AS updated FROM wishlist WHERE list_id = ? AND `+liveItem+`
+			ORDER BY updated DESC, id DESC LIMIT ?`, listId, atomFeedSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id, quantity uint64
+			var description, source, cost, updated string
+			var created time.Time
+			err = rows.Scan(&id, &description, &source, &cost, &quantity, &created, &updated)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			updatedTime, err := parseSqliteTime(updated)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			entry := atomEntry{
+				Id:        atomId(r.Host, created, "item", id),
+				Title:     description,
+				Published: created.UTC().Format(time.RFC3339),
+				Updated:   updatedTime.Format(time.RFC3339),
+			}
+			var content []string
+			if cost != "" {
+				content = append(content, "Cost: "+cost)
+			}
+			if quantity > 1 {
+				content = append(content, fmt.Sprintf("Wants %d", quantity))
+			}
+			if source != "" {
+				content = append(content, "From: "+source)
+				if u, ok := parseSourceURL(source); ok {
+					entry.Link = &atomLink{Href: u.String()}
+				}
+			}
+			entry.Content = strings.Join(content, "\n")
+			feed.Entries = append(feed.Entries, entry)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var body bytes.Buffer
+		body.WriteString(xml.Header)
+		encoder := xml.NewEncoder(&body)
+		encoder.Indent("", "  ")
+		if err := encoder.Encode(feed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// readers poll, so let them ask whether anything changed. ServeContent
+		// takes care of If-None-Match and If-Modified-Since.
+		sum := sha256.Sum256(body.Bytes())
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "", modified, bytes.NewReader(body.Bytes()))
+	}
+}
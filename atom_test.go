@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAtomFeed(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	owner := createTestUser(t, db, "Owner")
+	member := createTestUser(t, db, "Member")
+
+	if code := doJson(t, handleWishlistPost(logger, db, hub), owner, "POST", "/api/wishlist",
+		`{"description": "strap", "source": "https://example.com/strap", "cost": "$2.95", "owner_notes": "secret"}`,
+		nil); code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+
+	listId, err := defaultListId(db, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := map[string]string{"id": fmt.Sprint(listId)}
+	var token struct {
+		FeedToken string `json:"feed_token"`
+	}
+	if code := doJsonPath(t, handleFeedTokenPost(logger, db), member, "POST", "/api/lists/feed", path, "", nil); code != http.StatusNotFound {
+		t.Errorf("member made a feed for the owner's list: %d", code)
+	}
+	if code := doJsonPath(t, handleFeedTokenPost(logger, db), owner, "POST", "/api/lists/feed", path, "", &token); code != http.StatusOK {
+		t.Fatalf("failed to create feed token: %d", code)
+	}
+
+	get := func(header string, value string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/public/feeds/"+token.FeedToken, nil)
+		req.SetPathValue("token", token.FeedToken)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		handleAtomFeedGet(logger, db)(rr, req)
+		return rr
+	}
+
+	rr := get("", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("failed to get feed: %d %s", rr.Code, rr.Body.String())
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(rr.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].Title != "strap" || feed.Entries[0].Link == nil ||
+		feed.Entries[0].Link.Href != "https://example.com/strap" || feed.Entries[0].Updated != feed.Updated {
+		t.Errorf("unexpected feed %+v", feed)
+	}
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("feed has owner notes: %s", rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	lastModified := rr.Header().Get("Last-Modified")
+
+	// what buyers do doesn't change the feed
+	if code := doJson(t, handleWishlistPatch(logger, db, hub), member, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 1, "buyer_notes": "buying one"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add buyer notes: %d", code)
+	}
+	if code := doJson(t, handleClaimPost(logger, db, hub), member, "POST", "/api/wishlist/claim",
+		`{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+	if rr := get("If-None-Match", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("expected not modified, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("If-Modified-Since", lastModified); rr.Code != http.StatusNotModified {
+		t.Errorf("expected not modified, got %d", rr.Code)
+	}
+
+	if code := doJson(t, handleWishlistPatch(logger, db, hub), owner, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 2, "description": "red strap"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to edit item: %d", code)
+	}
+	rr = get("If-None-Match", etag)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "red strap") {
+		t.Errorf("expected the edit, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if code := doJsonPath(t, handleFeedTokenDelete(logger, db), owner, "DELETE", "/api/lists/feed", path, "", nil); code != http.StatusOK {
+		t.Fatalf("failed to revoke feed token: %d", code)
+	}
+	if rr := get("", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoked feed still works: %d", rr.Code)
+	}
+
+	var secret struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleListPost(logger, db), owner, "POST", "/api/lists",
+		`{"name": "Secret", "visibility": "private"}`, &secret); code != http.StatusOK {
+		t.Fatalf("failed to create list: %d", code)
+	}
+	if code := doJsonPath(t, handleFeedTokenPost(logger, db), owner, "POST", "/api/lists/feed",
+		map[string]string{"id": fmt.Sprint(secret.Id)}, "", nil); code != http.StatusConflict {
+		t.Errorf("made a feed for a private list: %d", code)
+	}
+}
+
+// Items the old vistes import added have no history, and a creation_time in
+// go-sqlite3's format for a bound time.Time rather than sqlite's.
+func TestAtomFeedLegacyTimes(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+
+	listId, err := defaultListId(db, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	_, err = db.Exec(`INSERT INTO wishlist(creation_time, user_id, list_id, description, source, cost)
+		VALUES(?, ?, ?, 'strap', '', '$2.95')`, created, owner, listId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT CAST(creation_time AS TEXT) FROM wishlist").Scan(&stored); err != nil ||
+		stored != "2020-01-02 00:00:00+00:00" {
+		t.Fatalf("unexpected legacy creation_time %q %v", stored, err)
+	}
+
+	var token struct {
+		FeedToken string `json:"feed_token"`
+	}
+	if code := doJsonPath(t, handleFeedTokenPost(logger, db), owner, "POST", "/api/lists/feed",
+		map[string]string{"id": fmt.Sprint(listId)}, "", &token); code != http.StatusOK {
+		t.Fatalf("failed to create feed token: %d", code)
+	}
+	req := httptest.NewRequest("GET", "/api/public/feeds/"+token.FeedToken, nil)
+	req.SetPathValue("token", token.FeedToken)
+	rr := httptest.NewRecorder()
+	handleAtomFeedGet(logger, db)(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to get feed: %d %s", rr.Code, rr.Body.String())
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(rr.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].Updated != "2020-01-02T00:00:00Z" {
+		t.Errorf("unexpected feed %+v", feed)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// event dates are calendar days, with no time or zone
+	eventDateFormat     = "2006-01-02"
+	defaultReminderDays = 7
+	maxReminderDays     = 365
+)
+
+// Notification is something to tell a user about outside the app.
+type Notification struct {
+	UserId  uint64
+	Email   string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers notifications. A failed Notify is retried later, so it
+// shouldn't have half-delivered anything.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// logNotifier only logs notifications, for running locally without a mail
+// server.
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (n *logNotifier) Notify(ctx context.Context, notification Notification) error {
+	n.logger.Printf("notification for user %d <%s>: %s\n%s", notification.UserId, notification.Email,
+		notification.Subject, notification.Body)
+	return nil
+}
+
+// Create an event, e.g. a birthday. Whoever creates it is a participant, and
+// everyone else in it and every linked list has to be visible to them.
+func handleEventPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type EventRequest struct {
+			Name           string   `json:"name"`
+			Date           string   `json:"date"`
+			ReminderDays   *uint64  `json:"reminder_days"`
+			ParticipantIds []uint64 `json:"participant_ids"`
+			ListIds        []uint64 `json:"list_ids"`
+		}
+
+		type EventResponse struct {
+			Id uint64 `json:"id"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req EventRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) >= 500 {
+			http.Error(w, "event name must be between 1 and 500 characters", http.StatusBadRequest)
+			return
+		}
+		date, err := time.Parse(eventDateFormat, req.Date)
+		if err != nil {
+			http.Error(w, "date must look like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+		var reminderDays uint64 = defaultReminderDays
+		if req.ReminderDays != nil {
+			if *req.ReminderDays > maxReminderDays {
+				http.Error(w, fmt.Sprintf("reminder_days must be at most %d", maxReminderDays), http.StatusBadRequest)
+				return
+			}
+			reminderDays = *req.ReminderDays
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		result, err := tx.Exec("INSERT INTO events(owner_id, name, event_date, reminder_days) VALUES(?, ?, ?, ?)",
+			userId, req.Name, date.Format(eventDateFormat), reminderDays)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		eventId, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, participantId := range append([]uint64{userId}, req.ParticipantIds...) {
+			visible, err := canSeeUser(tx, userId, participantId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				http.Error(w, "events can only include people you share a group with", http.StatusBadRequest)
+				return
+			}
+			_, err = tx.Exec(`INSERT INTO event_participants(event_id, user_id) VALUES(?, ?)
+				ON CONFLICT DO NOTHING`, eventId, participantId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		for _, listId := range req.ListIds {
+			var visible bool
+			err = tx.QueryRow("SELECT COUNT(*) > 0 FROM lists WHERE id = ? AND "+listVisibleTo("lists.id"),
+				listId, userId).Scan(&visible)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				http.Error(w, "non-existent list", http.StatusBadRequest)
+				return
+			}
+			_, err = tx.Exec(`INSERT INTO event_lists(event_id, list_id) VALUES(?, ?)
+				ON CONFLICT DO NOTHING`, eventId, listId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(EventResponse{uint64(eventId)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Only the event's creator can delete it.
+func handleEventDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		eventId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed event id", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM events WHERE id = ? AND owner_id = ?", eventId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "non-existent event", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// The events the current user is in, from today on, soonest first. Linked
+// lists the user isn't allowed to see are left out.
+func handleEventsUpcomingGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type EventList struct {
+			Id   uint64 `json:"id"`
+			Name string `json:"name"`
+			User User   `json:"user"`
+		}
+
+		type Event struct {
+			Id           uint64      `json:"id"`
+			Name         string      `json:"name"`
+			Date         string      `json:"date"`
+			ReminderDays uint64      `json:"reminder_days"`
+			OwnerId      uint64      `json:"owner_id"`
+			Participants []User      `json:"participants"`
+			Lists        []EventList `json:"lists"`
+		}
+
+		type EventsResponse struct {
+			Events []Event `json:"events"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		today := time.Now().Format(eventDateFormat)
+		rows, err := db.Query(`SELECT events.id, events.name, events.event_date, events.reminder_days,
+			events.owner_id FROM events
+			JOIN event_participants ON event_participants.event_id = events.id
+			WHERE event_participants.user_id = ? AND events.event_date >= ?
+			ORDER BY events.event_date, events.id`, userId, today)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := EventsResponse{Events: []Event{}}
+		byId := make(map[uint64]int)
+		for rows.Next() {
+			event := Event{Participants: []User{}, Lists: []EventList{}}
+			err = rows.Scan(&event.Id, &event.Name, &event.Date, &event.ReminderDays, &event.OwnerId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			byId[event.Id] = len(response.Events)
+			response.Events = append(response.Events, event)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		participants, err := db.Query(`SELECT event_participants.event_id, users.id, users.first_name,
+			users.last_name FROM event_participants
+			JOIN users ON users.id = event_participants.user_id
+			JOIN event_participants AS mine ON mine.event_id = event_participants.event_id
+			WHERE mine.user_id = ? ORDER BY users.first_name, users.id`, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer participants.Close()
+
+		for participants.Next() {
+			var eventId uint64
+			var user User
+			err = participants.Scan(&eventId, &user.Id, &user.FirstName, &user.LastName)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if i, ok := byId[eventId]; ok {
+				response.Events[i].Participants = append(response.Events[i].Participants, user)
+			}
+		}
+		err = participants.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		lists, err := db.Query(`SELECT event_lists.event_id, lists.id, lists.name, users.id, users.first_name,
+			users.last_name FROM event_lists
+			JOIN lists ON lists.id = event_lists.list_id
+			JOIN users ON users.id = lists.user_id
+			JOIN event_participants AS mine ON mine.event_id = event_lists.event_id
+			WHERE mine.user_id = ? AND `+listVisibleTo("lists.id")+`
+			ORDER BY lists.id`, userId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer lists.Close()
+
+		for lists.Next() {
+			var eventId uint64
+			var list EventList
+			err = lists.Scan(&eventId, &list.Id, &list.Name, &list.User.Id, &list.User.FirstName, &list.User.LastName)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if i, ok := byId[eventId]; ok {
+				response.Events[i].Lists = append(response.Events[i].Lists, list)
+			}
+		}
+		err = lists.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// queueReminders nudges participants of events coming up within their
+// reminder window who haven't claimed anything on the event's lists yet.
+// Each participant is reminded at most once per event, and only if there's
+// a list on it they could buy from. Reminders go out with the rest of their
+// notifications.
+func queueReminders(ctx context.Context, logger *log.Logger, db *sql.DB, now time.Time) error {
+	type reminder struct {
+		EventId   uint64
+		EventName string
+		Date      string
+		UserId    uint64
+		FirstName string
+	}
+
+	today := now.Format(eventDateFormat)
+	rows, err := db.QueryContext(ctx, `SELECT events.id, events.name, events.event_date, users.id,
+		users.first_name FROM events
+		JOIN event_participants ON event_participants.event_id = events.id
+		JOIN users ON users.id = event_participants.user_id
+		WHERE events.event_date >= ? AND date(events.event_date, '-' || events.reminder_days || ' days') <= ?
+		AND NOT EXISTS (SELECT 1 FROM event_reminders
+			WHERE event_reminders.event_id = events.id AND event_reminders.user_id = users.id)
+		AND NOT EXISTS (SELECT 1 FROM claims
+			JOIN wishlist ON wishlist.id = claims.item_id
+			JOIN event_lists ON event_lists.list_id = wishlist.list_id
+			WHERE event_lists.event_id = events.id AND claims.user_id = users.id
+			AND wishlist.deleted_time IS NULL)
+		ORDER BY events.id, users.id`, today, today)
+	if err != nil {
+		return err
+	}
+	var due []reminder
+	for rows.Next() {
+		var r reminder
+		err = rows.Scan(&r.EventId, &r.EventName, &r.Date, &r.UserId, &r.FirstName)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range due {
+		listNames, err := reminderLists(ctx, db, r.EventId, r.UserId)
+		if err != nil {
+			return err
+		}
+		if len(listNames) == 0 {
+			continue
+		}
+
+		err = queueReminder(ctx, db, r.EventId, r.UserId,
+			fmt.Sprintf("%s is coming up on %s", r.EventName, r.Date),
+			fmt.Sprintf("Hi %s,\n\n%s is on %s and you haven't claimed anything for it yet. "+
+				"Its lists:\n\n%s\n", r.FirstName, r.EventName, r.Date, strings.Join(listNames, "\n")))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueReminder puts a reminder in the outbox and remembers that it did.
+func queueReminder(ctx context.Context, db *sql.DB, eventId uint64, userId uint64, subject string, body string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
+
+	err = enqueueNotification(tx, userId, "event_reminder", subject, body)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO event_reminders(event_id, user_id) VALUES(?, ?)", eventId, userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reminderLists names the lists on an event that a participant can see and
+// buy from, i.e. everyone else's.
+func reminderLists(ctx context.Context, db *sql.DB, eventId uint64, userId uint64) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT users.first_name || ' ' || users.last_name || ': ' || lists.name
+		FROM event_lists
+		JOIN lists ON lists.id = event_lists.list_id
+		JOIN users ON users.id = lists.user_id
+		WHERE event_lists.event_id = ? AND lists.user_id != ? AND `+listVisibleTo("lists.id")+`
+		ORDER BY lists.id`, eventId, userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, "  "+name)
+	}
+	return ret, rows.Err()
+}
+
+func runReminders(ctx context.Context, logger *log.Logger, db *sql.DB) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		err := queueReminders(ctx, logger, db, time.Now())
+		if err != nil && ctx.Err() == nil {
+			logger.Printf("error queueing event reminders: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
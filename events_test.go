@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEventReminders(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	birthdayGirl := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+
+	if code := doJson(t, handleWishlistPost(logger, db, newHub()), birthdayGirl, "POST", "/api/wishlist",
+		`{"description": "kite", "source": "", "cost": ""}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+	listId, err := defaultListId(db, birthdayGirl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Now().AddDate(0, 0, 10).Format(eventDateFormat)
+	post := handleEventPost(logger, db)
+	var event struct {
+		Id uint64 `json:"id"`
+	}
+	body := fmt.Sprintf(`{"name": "Alice's birthday", "date": %q, "reminder_days": 3,
+		"participant_ids": [%d, %d], "list_ids": [%d]}`, date, bob, carol, listId)
+	if code := doJson(t, post, birthdayGirl, "POST", "/api/events", body, &event); code != http.StatusOK {
+		t.Fatalf("failed to create event: %d", code)
+	}
+	for _, body := range []string{
+		`{"name": "x", "date": "next tuesday"}`,
+		`{"name": "x", "date": "2030-01-01", "participant_ids": [999]}`,
+		`{"name": "x", "date": "2030-01-01", "list_ids": [999]}`,
+		`{"name": "x", "date": "2030-01-01", "reminder_days": 1000}`,
+	} {
+		if code := doJson(t, post, birthdayGirl, "POST", "/api/events", body, nil); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	var upcoming struct {
+		Events []struct {
+			Id           uint64 `json:"id"`
+			Date         string `json:"date"`
+			Participants []User `json:"participants"`
+			Lists        []struct {
+				Id uint64 `json:"id"`
+			} `json:"lists"`
+		} `json:"events"`
+	}
+	if code := doJson(t, handleEventsUpcomingGet(logger, db), bob, "GET", "/api/events/upcoming", "", &upcoming); code != http.StatusOK {
+		t.Fatalf("failed to get upcoming events: %d", code)
+	}
+	if len(upcoming.Events) != 1 || upcoming.Events[0].Date != date || len(upcoming.Events[0].Participants) != 3 ||
+		len(upcoming.Events[0].Lists) != 1 || upcoming.Events[0].Lists[0].Id != listId {
+		t.Errorf("unexpected upcoming events %+v", upcoming.Events)
+	}
+
+	// bob has already claimed something, and alice has nobody else's list to buy from
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), bob, "POST", "/api/wishlist/claim",
+		`{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+
+	reminders := func() []uint64 {
+		t.Helper()
+		rows, err := db.Query("SELECT user_id FROM notification_outbox WHERE kind = 'event_reminder'")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ret []uint64
+		for rows.Next() {
+			var userId uint64
+			if err := rows.Scan(&userId); err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, userId)
+		}
+		return ret
+	}
+
+	if err := queueReminders(context.Background(), logger, db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := reminders(); len(got) != 0 {
+		t.Errorf("reminded too early: %v", got)
+	}
+
+	remindTime := time.Now().AddDate(0, 0, 8)
+	for i := 0; i < 2; i++ {
+		if err := queueReminders(context.Background(), logger, db, remindTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := reminders(); len(got) != 1 || got[0] != carol {
+		t.Errorf("expected one reminder for carol, got %v", got)
+	}
+
+	if err := queueReminders(context.Background(), logger, db, time.Now().AddDate(0, 0, 11)); err != nil {
+		t.Fatal(err)
+	}
+	if got := reminders(); len(got) != 1 {
+		t.Errorf("reminded after the event: %v", got)
+	}
+
+	remove := handleEventDelete(logger, db)
+	path := map[string]string{"id": fmt.Sprint(event.Id)}
+	if code := doJsonPath(t, remove, bob, "DELETE", "/api/events", path, "", nil); code != http.StatusNotFound {
+		t.Errorf("participant deleted the event: %d", code)
+	}
+	if code := doJsonPath(t, remove, birthdayGirl, "DELETE", "/api/events", path, "", nil); code != http.StatusOK {
+		t.Errorf("failed to delete event: %d", code)
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxExchangeParticipants = 100
+	// give up on the draw rather than spin on a hopeless set of exclusions
+	maxDrawSteps = 1_000_000
+)
+
+var (
+	errNoAssignment     = errors.New("no assignment satisfies the exclusions")
+	errExchangeRevealed = errors.New("the exchange has already been revealed")
+)
+
+// inExchange is a condition on the exchanges table for exchanges the user is
+// organizing or taking part in. Bind their id to both placeholders.
+const inExchange = `(exchanges.owner_id = ? OR exchanges.id IN
+	(SELECT exchange_id FROM exchange_participants WHERE user_id = ?))`
+
+// exchangePair is a giver and who they give to.
+type exchangePair struct {
+	Giver    uint64
+	Receiver uint64
+}
+
+// shuffleDraw is how real draws get shuffled. Tests use a seeded shuffle
+// instead so they can repeat themselves.
+func shuffleDraw(n int, swap func(i, j int)) {
+	rand.Shuffle(n, swap)
+}
+
+// drawAssignments pairs every participant with someone else to give to, so
+// that nobody gets themselves, everybody gets exactly one giver and no
+// excluded pair comes up. It's a randomized backtracking search, trying the
+// most constrained givers first, which is plenty for family-sized exchanges.
+func drawAssignments(participants []uint64, excluded map[exchangePair]bool, shuffle func(n int, swap func(i, j int))) (map[uint64]uint64, error) {
+	options := make(map[uint64][]uint64)
+	for _, giver := range participants {
+		for _, receiver := range participants {
+			if giver != receiver && !excluded[exchangePair{giver, receiver}] {
+				options[giver] = append(options[giver], receiver)
+			}
+		}
+		shuffle(len(options[giver]), func(i, j int) {
+			options[giver][i], options[giver][j] = options[giver][j], options[giver][i]
+		})
+	}
+
+	givers := append([]uint64{}, participants...)
+	shuffle(len(givers), func(i, j int) { givers[i], givers[j] = givers[j], givers[i] })
+	sort.SliceStable(givers, func(i, j int) bool {
+		return len(options[givers[i]]) < len(options[givers[j]])
+	})
+
+	assignments := make(map[uint64]uint64)
+	taken := make(map[uint64]bool)
+	steps := 0
+	var search func(i int) bool
+	search = func(i int) bool {
+		if i == len(givers) {
+			return true
+		}
+		giver := givers[i]
+		for _, receiver := range options[giver] {
+			steps++
+			if steps > maxDrawSteps {
+				return false
+			}
+			if taken[receiver] {
+				continue
+			}
+			taken[receiver] = true
+			assignments[giver] = receiver
+			if search(i + 1) {
+				return true
+			}
+			taken[receiver] = false
+			delete(assignments, giver)
+		}
+		return false
+	}
+	if len(givers) < 2 || !search(0) {
+		return nil, errNoAssignment
+	}
+	return assignments, nil
+}
+
+// drawExchange (re-)draws an exchange's assignments, replacing any earlier
+// draw. That's only allowed before the reveal date, after which people may
+// already have bought presents.
+func drawExchange(db *sql.DB, exchangeId uint64, now time.Time, shuffle func(n int, swap func(i, j int))) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
+
+	var revealDate string
+	err = tx.QueryRow("SELECT reveal_date FROM exchanges WHERE id = ?", exchangeId).Scan(&revealDate)
+	if err != nil {
+		return err
+	}
+	if now.Format(eventDateFormat) >= revealDate {
+		return errExchangeRevealed
+	}
+
+	rows, err := tx.Query("SELECT user_id FROM exchange_participants WHERE exchange_id = ? ORDER BY user_id", exchangeId)
+	if err != nil {
+		return err
+	}
+	var participants []uint64
+	for rows.Next() {
+		var userId uint64
+		err = rows.Scan(&userId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		participants = append(participants, userId)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	// last time's pairings are only avoided where possible, if they could
+	// make the draw fail then whether it does would give them away
+	excluded := make(map[exchangePair]bool)
+	avoided := make(map[exchangePair]bool)
+	rows, err = tx.Query("SELECT giver_id, receiver_id, previous FROM exchange_exclusions WHERE exchange_id = ?",
+		exchangeId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var pair exchangePair
+		var previous bool
+		err = rows.Scan(&pair.Giver, &pair.Receiver, &previous)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if previous {
+			avoided[pair] = true
+		} else {
+			excluded[pair] = true
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	// nobody should draw someone whose list they can't see
+	for _, giver := range participants {
+		for _, receiver := range participants {
+			if giver == receiver {
+				continue
+			}
+			visible, err := canSeeUser(tx, giver, receiver)
+			if err != nil {
+				return err
+			}
+			if !visible {
+				excluded[exchangePair{giver, receiver}] = true
+			}
+		}
+	}
+
+	withAvoided := make(map[exchangePair]bool)
+	for pair := range excluded {
+		withAvoided[pair] = true
+	}
+	for pair := range avoided {
+		withAvoided[pair] = true
+	}
+	assignments, err := drawAssignments(participants, withAvoided, shuffle)
+	if err == errNoAssignment {
+		assignments, err = drawAssignments(participants, excluded, shuffle)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM exchange_assignments WHERE exchange_id = ?", exchangeId)
+	if err != nil {
+		return err
+	}
+	for giver, receiver := range assignments {
+		_, err = tx.Exec("INSERT INTO exchange_assignments(exchange_id, giver_id, receiver_id) VALUES(?, ?, ?)",
+			exchangeId, giver, receiver)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE exchanges SET draw_time = ? WHERE id = ?",
+		now.UTC().Format(sqliteTimeFormat), exchangeId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Set up a gift exchange. Exclusions are givers who mustn't draw a receiver,
+// mutual ones going both ways (e.g. spouses). The organizer of a previous
+// exchange can name it to avoid last time's pairings where the draw can.
+func handleExchangePost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type Exclusion struct {
+			GiverId    uint64 `json:"giver_id"`
+			ReceiverId uint64 `json:"receiver_id"`
+			Mutual     bool   `json:"mutual"`
+		}
+
+		type ExchangeRequest struct {
+			Name               string      `json:"name"`
+			RevealDate         string      `json:"reveal_date"`
+			ParticipantIds     []uint64    `json:"participant_ids"`
+			Exclusions         []Exclusion `json:"exclusions"`
+			PreviousExchangeId *uint64     `json:"previous_exchange_id"`
+		}
+
+		type ExchangeResponse struct {
+			Id uint64 `json:"id"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req ExchangeRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) >= 500 {
+			http.Error(w, "exchange name must be between 1 and 500 characters", http.StatusBadRequest)
+			return
+		}
+		revealDate, err := time.Parse(eventDateFormat, req.RevealDate)
+		if err != nil {
+			http.Error(w, "reveal_date must look like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+		if len(req.ParticipantIds) < 2 || len(req.ParticipantIds) > maxExchangeParticipants {
+			http.Error(w, fmt.Sprintf("exchanges need between 2 and %d participants", maxExchangeParticipants),
+				http.StatusBadRequest)
+			return
+		}
+
+		participants := make(map[uint64]bool)
+		for _, participantId := range req.ParticipantIds {
+			participants[participantId] = true
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		result, err := tx.Exec("INSERT INTO exchanges(owner_id, name, reveal_date) VALUES(?, ?, ?)",
+			userId, req.Name, revealDate.Format(eventDateFormat))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		exchangeId, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for participantId := range participants {
+			visible, err := canSeeUser(tx, userId, participantId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				http.Error(w, "exchanges can only include people you share a group with", http.StatusBadRequest)
+				return
+			}
+			_, err = tx.Exec("INSERT INTO exchange_participants(exchange_id, user_id) VALUES(?, ?)",
+				exchangeId, participantId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var exclusions []exchangePair
+		for _, exclusion := range req.Exclusions {
+			if !participants[exclusion.GiverId] || !participants[exclusion.ReceiverId] ||
+				exclusion.GiverId == exclusion.ReceiverId {
+				http.Error(w, "exclusions must be between two different participants", http.StatusBadRequest)
+				return
+			}
+			exclusions = append(exclusions, exchangePair{exclusion.GiverId, exclusion.ReceiverId})
+			if exclusion.Mutual {
+				exclusions = append(exclusions, exchangePair{exclusion.ReceiverId, exclusion.GiverId})
+			}
+		}
+
+		for _, pair := range exclusions {
+			_, err = tx.Exec(`INSERT INTO exchange_exclusions(exchange_id, giver_id, receiver_id) VALUES(?, ?, ?)
+				ON CONFLICT DO NOTHING`, exchangeId, pair.Giver, pair.Receiver)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if req.PreviousExchangeId != nil {
+			// only the organizer's own exchanges, and drawExchange doesn't let
+			// them make a draw fail, so nobody can probe for anyone's pairings
+			var exists bool
+			err = tx.QueryRow("SELECT COUNT(*) > 0 FROM exchanges WHERE id = ? AND owner_id = ?",
+				*req.PreviousExchangeId, userId).Scan(&exists)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "non-existent previous exchange", http.StatusNotFound)
+				return
+			}
+
+			rows, err := tx.Query(`SELECT giver_id, receiver_id FROM exchange_assignments WHERE exchange_id = ?`,
+				*req.PreviousExchangeId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var previous []exchangePair
+			for rows.Next() {
+				var pair exchangePair
+				err = rows.Scan(&pair.Giver, &pair.Receiver)
+				if err != nil {
+					rows.Close()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if participants[pair.Giver] && participants[pair.Receiver] {
+					previous = append(previous, pair)
+				}
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// an exclusion the organizer gave wins over a previous pairing
+			for _, pair := range previous {
+				_, err = tx.Exec(`INSERT INTO exchange_exclusions(exchange_id, giver_id, receiver_id, previous)
+					VALUES(?, ?, ?, TRUE) ON CONFLICT DO NOTHING`, exchangeId, pair.Giver, pair.Receiver)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(ExchangeResponse{uint64(exchangeId)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// The organizer draws names, and can draw again until the reveal date.
+func handleExchangeDraw(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		exchangeId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed exchange id", http.StatusBadRequest)
+			return
+		}
+
+		var ownerId uint64
+		err = db.QueryRow("SELECT owner_id FROM exchanges WHERE id = ?", exchangeId).Scan(&ownerId)
+		if err == sql.ErrNoRows || (err == nil && ownerId != userId) {
+			http.Error(w, "non-existent exchange", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = drawExchange(db, exchangeId, time.Now(), shuffleDraw)
+		if err == errNoAssignment || err == errExchangeRevealed {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleExchangeDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		exchangeId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed exchange id", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM exchanges WHERE id = ? AND owner_id = ?", exchangeId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "non-existent exchange", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// The exchanges the current user is organizing or in. Everyone only ever
+// gets to see who they're giving to, never anyone else's pairing, not even
+// the organizer.
+func handleExchangesGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type Assignee struct {
+			User
+			ListURL string `json:"list_url"`
+		}
+
+		type Exchange struct {
+			Id           uint64    `json:"id"`
+			Name         string    `json:"name"`
+			RevealDate   string    `json:"reveal_date"`
+			OwnerId      uint64    `json:"owner_id"`
+			Drawn        bool      `json:"drawn"`
+			Participants []User    `json:"participants"`
+			Assignee     *Assignee `json:"assignee"`
+		}
+
+		type ExchangesResponse struct {
+			Exchanges []Exchange `json:"exchanges"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rows, err := db.Query(`SELECT exchanges.id, exchanges.name, exchanges.reveal_date, exchanges.owner_id,
+			exchanges.draw_time IS NOT NULL, users.id, users.first_name, users.last_name FROM exchanges
+			LEFT JOIN exchange_assignments ON exchange_assignments.exchange_id = exchanges.id
+				AND exchange_assignments.giver_id = ?
+			LEFT JOIN users ON users.id = exchange_assignments.receiver_id
+			WHERE `+inExchange+`
+			ORDER BY exchanges.reveal_date DESC, exchanges.id`, userId, userId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := ExchangesResponse{Exchanges: []Exchange{}}
+		byId := make(map[uint64]int)
+		for rows.Next() {
+			exchange := Exchange{Participants: []User{}}
+			var assigneeId sql.NullInt64
+			var assigneeFirst, assigneeLast sql.NullString
+			err = rows.Scan(&exchange.Id, &exchange.Name, &exchange.RevealDate, &exchange.OwnerId,
+				&exchange.Drawn, &assigneeId, &assigneeFirst, &assigneeLast)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if assigneeId.Valid {
+				exchange.Assignee = &Assignee{
+					User: User{
+						Id:        uint64(assigneeId.Int64),
+						FirstName: assigneeFirst.String,
+						LastName:  assigneeLast.String,
+					},
+					ListURL: fmt.Sprintf("/wishlist/%d", assigneeId.Int64),
+				}
+			}
+			byId[exchange.Id] = len(response.Exchanges)
+			response.Exchanges = append(response.Exchanges, exchange)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		participants, err := db.Query(`SELECT exchange_participants.exchange_id, users.id, users.first_name,
+			users.last_name FROM exchange_participants
+			JOIN users ON users.id = exchange_participants.user_id
+			JOIN exchanges ON exchanges.id = exchange_participants.exchange_id
+			WHERE `+inExchange+` ORDER BY users.first_name, users.id`, userId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer participants.Close()
+
+		for participants.Next() {
+			var exchangeId uint64
+			var user User
+			err = participants.Scan(&exchangeId, &user.Id, &user.FirstName, &user.LastName)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if i, ok := byId[exchangeId]; ok {
+				response.Exchanges[i].Participants = append(response.Exchanges[i].Participants, user)
+			}
+		}
+		err = participants.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
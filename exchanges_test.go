@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ericm1024/wishlist/admin_rpc"
+)
+
+func TestDrawAssignments(t *testing.T) {
+	shuffle := rand.New(rand.NewPCG(1, 2)).Shuffle
+	participants := []uint64{1, 2, 3, 4, 5, 6}
+
+	// three couples who can't draw each other, and nobody draws who they drew last year
+	excluded := map[exchangePair]bool{
+		{1, 2}: true, {2, 1}: true, {3, 4}: true, {4, 3}: true, {5, 6}: true, {6, 5}: true,
+		{1, 3}: true, {3, 5}: true, {5, 1}: true,
+	}
+	for i := 0; i < 100; i++ {
+		assignments, err := drawAssignments(participants, excluded, shuffle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receivers := make(map[uint64]bool)
+		for _, giver := range participants {
+			receiver, ok := assignments[giver]
+			if !ok || receiver == giver || excluded[exchangePair{giver, receiver}] || receivers[receiver] {
+				t.Fatalf("bad assignment %v", assignments)
+			}
+			receivers[receiver] = true
+		}
+	}
+
+	// two couples only have one way to go, a lone couple has none
+	excluded = map[exchangePair]bool{{1, 2}: true, {2, 1}: true, {3, 4}: true, {4, 3}: true, {1, 3}: true}
+	assignments, err := drawAssignments([]uint64{1, 2, 3, 4}, excluded, shuffle)
+	if err != nil || assignments[1] != 4 {
+		t.Errorf("unexpected assignment %v %v", assignments, err)
+	}
+	if _, err := drawAssignments([]uint64{1, 2}, map[exchangePair]bool{{1, 2}: true}, shuffle); err != errNoAssignment {
+		t.Errorf("expected no assignment, got %v", err)
+	}
+}
+
+func TestExchanges(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	var users []uint64
+	for _, name := range []string{"Alice", "Bob", "Carol", "Dave"} {
+		users = append(users, createTestUser(t, db, name))
+	}
+	alice, bob, carol, dave := users[0], users[1], users[2], users[3]
+
+	revealDate := time.Now().AddDate(0, 0, 30).Format(eventDateFormat)
+	var exchange struct {
+		Id uint64 `json:"id"`
+	}
+	body := fmt.Sprintf(`{"name": "Christmas", "reveal_date": %q, "participant_ids": [%d, %d, %d, %d],
+		"exclusions": [{"giver_id": %d, "receiver_id": %d, "mutual": true}]}`,
+		revealDate, alice, bob, carol, dave, alice, bob)
+	if code := doJson(t, handleExchangePost(logger, db), alice, "POST", "/api/exchanges", body, &exchange); code != http.StatusOK {
+		t.Fatalf("failed to create exchange: %d", code)
+	}
+	for _, body := range []string{
+		fmt.Sprintf(`{"name": "x", "reveal_date": %q, "participant_ids": [%d]}`, revealDate, alice),
+		fmt.Sprintf(`{"name": "x", "reveal_date": %q, "participant_ids": [%d, 999]}`, revealDate, alice),
+		fmt.Sprintf(`{"name": "x", "reveal_date": %q, "participant_ids": [%d, %d],
+			"exclusions": [{"giver_id": %d, "receiver_id": %d}]}`, revealDate, alice, bob, alice, carol),
+	} {
+		if code := doJson(t, handleExchangePost(logger, db), alice, "POST", "/api/exchanges", body, nil); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	path := map[string]string{"id": fmt.Sprint(exchange.Id)}
+	draw := handleExchangeDraw(logger, db)
+	if code := doJsonPath(t, draw, bob, "POST", "/api/exchanges", path, "", nil); code != http.StatusNotFound {
+		t.Errorf("non-organizer drew names: %d", code)
+	}
+	if code := doJsonPath(t, draw, alice, "POST", "/api/exchanges", path, "", nil); code != http.StatusOK {
+		t.Fatalf("failed to draw: %d", code)
+	}
+
+	type exchangesResponse struct {
+		Exchanges []struct {
+			Id           uint64 `json:"id"`
+			Drawn        bool   `json:"drawn"`
+			Participants []User `json:"participants"`
+			Assignee     *struct {
+				Id      uint64 `json:"id"`
+				ListURL string `json:"list_url"`
+			} `json:"assignee"`
+		} `json:"exchanges"`
+	}
+	assignees := func() map[uint64]uint64 {
+		t.Helper()
+		ret := make(map[uint64]uint64)
+		for _, user := range users {
+			var response exchangesResponse
+			if code := doJson(t, handleExchangesGet(logger, db), user, "GET", "/api/exchanges", "", &response); code != http.StatusOK {
+				t.Fatalf("failed to get exchanges: %d", code)
+			}
+			if len(response.Exchanges) != 1 || !response.Exchanges[0].Drawn ||
+				len(response.Exchanges[0].Participants) != 4 || response.Exchanges[0].Assignee == nil {
+				t.Fatalf("unexpected exchanges for %d: %+v", user, response.Exchanges)
+			}
+			assignee := response.Exchanges[0].Assignee
+			if assignee.ListURL != fmt.Sprintf("/wishlist/%d", assignee.Id) {
+				t.Errorf("unexpected list url %s", assignee.ListURL)
+			}
+			ret[user] = assignee.Id
+		}
+		return ret
+	}
+	first := assignees()
+	if first[alice] == bob || first[bob] == alice {
+		t.Errorf("spouses drew each other: %v", first)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM exchange_assignments").Scan(&count); err != nil || count != 4 {
+		t.Errorf("expected 4 assignments, got %d %v", count, err)
+	}
+
+	// admins can re-draw, e.g. after someone peeked
+	admin := &adminGrpcServer{Logger: logger, Db: db}
+	if _, err := admin.RedrawExchange(context.Background(), &admin_rpc.ExchangeRequest{ExchangeId: exchange.Id}); err != nil {
+		t.Fatal(err)
+	}
+	assignees()
+	if _, err := admin.RedrawExchange(context.Background(), &admin_rpc.ExchangeRequest{ExchangeId: 999}); err == nil {
+		t.Errorf("re-drew a non-existent exchange")
+	}
+
+	// but not once presents may have been bought
+	if err := drawExchange(db, exchange.Id, time.Now().AddDate(0, 0, 30), shuffleDraw); err != errExchangeRevealed {
+		t.Errorf("expected re-draw after reveal to fail, got %v", err)
+	}
+
+	// next year nobody gets who they had this year
+	body = fmt.Sprintf(`{"name": "Christmas again", "reveal_date": %q, "participant_ids": [%d, %d, %d, %d],
+		"previous_exchange_id": %d}`, revealDate, alice, bob, carol, dave, exchange.Id)
+	var next struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleExchangePost(logger, db), alice, "POST", "/api/exchanges", body, &next); code != http.StatusOK {
+		t.Fatalf("failed to create exchange: %d", code)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM exchange_exclusions WHERE exchange_id = ? AND previous",
+		next.Id).Scan(&count); err != nil || count != 4 {
+		t.Errorf("expected last year's 4 pairings avoided, got %d %v", count, err)
+	}
+	if err := drawExchange(db, next.Id, time.Now(), shuffleDraw); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM exchange_assignments AS this JOIN exchange_assignments AS last
+		ON last.giver_id = this.giver_id AND last.receiver_id = this.receiver_id
+		WHERE this.exchange_id = ? AND last.exchange_id = ?`, next.Id, exchange.Id).Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected no repeat pairings, got %d %v", count, err)
+	}
+
+	// only the organizer can carry pairings over, and a draw can't fail on
+	// them, otherwise a pair of people in a new exchange would give away
+	// whether they drew each other
+	probe := func(userId uint64) (int, uint64) {
+		t.Helper()
+		body := fmt.Sprintf(`{"name": "Probe", "reveal_date": %q, "participant_ids": [%d, %d],
+			"previous_exchange_id": %d}`, revealDate, alice, first[alice], exchange.Id)
+		var created struct {
+			Id uint64 `json:"id"`
+		}
+		code := doJson(t, handleExchangePost(logger, db), userId, "POST", "/api/exchanges", body, &created)
+		return code, created.Id
+	}
+	if code, _ := probe(bob); code != http.StatusNotFound {
+		t.Errorf("participant carried over someone else's pairings: %d", code)
+	}
+	code, probeId := probe(alice)
+	if code != http.StatusOK {
+		t.Fatalf("failed to create exchange: %d", code)
+	}
+	if code := doJsonPath(t, draw, alice, "POST", "/api/exchanges", map[string]string{"id": fmt.Sprint(probeId)},
+		"", nil); code != http.StatusOK {
+		t.Errorf("draw failed on a previous pairing: %d", code)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	activityItemAdded    = "item_added"
+	activityItemArchived = "item_archived"
+	activityListCreated  = "list_created"
+)
+
+// recordItemActivity notes something that happened to an item for the
+// owner's followers to see in their feeds. Only owner-side things go in
+// here, claims never do.
+func recordItemActivity(tx dbtx, kind string, itemId uint64) error {
+	_, err := tx.Exec(`INSERT INTO activity(user_id, kind, item_id, list_id)
+		SELECT user_id, ?, id, list_id FROM wishlist WHERE id = ?`, kind, itemId)
+	return err
+}
+
+func recordListActivity(tx dbtx, listId uint64) error {
+	_, err := tx.Exec(`INSERT INTO activity(user_id, kind, list_id)
+		SELECT user_id, ?, id FROM lists WHERE id = ?`, activityListCreated, listId)
+	return err
+}
+
+// notifyFollowers tells everyone following ownerId who can see the item's
+// list that it was added.
+func notifyFollowers(tx dbtx, ownerId uint64, itemId uint64) error {
+	var owner, description, listName string
+	var listId uint64
+	err := tx.QueryRow(`SELECT users.first_name, wishlist.description, lists.id, lists.name FROM wishlist
+		JOIN users ON users.id = wishlist.user_id JOIN lists ON lists.id = wishlist.list_id
+		WHERE wishlist.id = ?`, itemId).Scan(&owner, &description, &listId, &listName)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT follower_id FROM follows WHERE followee_id = ?", ownerId)
+	if err != nil {
+		return err
+	}
+	var followers []uint64
+	for rows.Next() {
+		var follower uint64
+		err = rows.Scan(&follower)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		followers = append(followers, follower)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, follower := range followers {
+		var visible bool
+		err = tx.QueryRow("SELECT COUNT(*) > 0 FROM lists WHERE id = ? AND "+listVisibleTo("lists.id"),
+			listId, follower).Scan(&visible)
+		if err != nil {
+			return err
+		}
+		if !visible {
+			continue
+		}
+		err = enqueueNotification(tx, follower, "followed_item",
+			fmt.Sprintf("%s added %s to %s", owner, description, listName),
+			fmt.Sprintf("%s added %s to their list %s.", owner, description, listName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Follow someone to see what they're up to in the feed. They have to be
+// someone the user can see.
+func handleFollowPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		followeeId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed user id", http.StatusBadRequest)
+			return
+		}
+		if followeeId == userId {
+			http.Error(w, "can't follow yourself", http.StatusBadRequest)
+			return
+		}
+
+		visible, err := canSeeUser(db, userId, followeeId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			http.Error(w, "non-existent user", http.StatusNotFound)
+			return
+		}
+
+		_, err = db.Exec("INSERT INTO follows(follower_id, followee_id) VALUES(?, ?) ON CONFLICT DO NOTHING",
+			userId, followeeId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleFollowDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		followeeId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed user id", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userId, followeeId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "not following this user", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// Recent activity from everyone the user follows, newest first, limited to
+// lists the user can see. Items that have since been deleted drop out.
+func handleFeedGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type FeedList struct {
+			Id   uint64 `json:"id"`
+			Name string `json:"name"`
+		}
+
+		type FeedItem struct {
+			Id          uint64 `json:"id"`
+			Description string `json:"description"`
+		}
+
+		type FeedEntry struct {
+			Id   uint64    `json:"id"`
+			Kind string    `json:"kind"`
+			Time time.Time `json:"time"`
+			User User      `json:"user"`
+			List FeedList  `json:"list"`
+			Item *FeedItem `json:"item"`
+		}
+
+		type FeedResponse struct {
+			Entries    []FeedEntry `json:"entries"`
+			NextCursor *string     `json:"next_cursor"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// always newest first, there's nothing else to sort by
+		page, err := parsePage(r.URL.Query(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page.Sort.Desc = true
+
+		query := `SELECT activity.id, activity.kind, activity.creation_time, users.id, users.first_name,
+			users.last_name, lists.id, lists.name, wishlist.id, wishlist.description, activity.id
+			FROM activity
+			JOIN follows ON follows.followee_id = activity.user_id AND follows.follower_id = ?
+			JOIN users ON users.id = activity.user_id
+			LEFT JOIN wishlist ON wishlist.id = activity.item_id
+			JOIN lists ON lists.id = COALESCE(wishlist.list_id, activity.list_id)
+			WHERE (activity.item_id IS NULL OR (wishlist.id IS NOT NULL AND wishlist.deleted_time IS NULL))
+			AND ` + listVisibleTo("lists.id")
+		query, args := page.apply(query, []interface{}{userId, userId}, "activity.id")
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := FeedResponse{Entries: []FeedEntry{}}
+		var rowCount int
+		var lastKey interface{}
+		for rows.Next() {
+			rowCount++
+			if page.Limit != 0 && rowCount > page.Limit {
+				// just checking there's more
+				continue
+			}
+
+			var entry FeedEntry
+			var itemId sql.NullInt64
+			var description sql.NullString
+			err = rows.Scan(&entry.Id, &entry.Kind, &entry.Time, &entry.User.Id, &entry.User.FirstName,
+				&entry.User.LastName, &entry.List.Id, &entry.List.Name, &itemId, &description, &lastKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if itemId.Valid {
+				entry.Item = &FeedItem{Id: uint64(itemId.Int64), Description: description.String}
+			}
+			response.Entries = append(response.Entries, entry)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(response.Entries) != 0 {
+			response.NextCursor = page.nextCursor(rowCount, response.Entries[len(response.Entries)-1].Id, lastKey)
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
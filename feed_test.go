@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testFeedEntry struct {
+	Kind string `json:"kind"`
+	User User   `json:"user"`
+	List struct {
+		Name string `json:"name"`
+	} `json:"list"`
+	Item *struct {
+		Id          uint64 `json:"id"`
+		Description string `json:"description"`
+	} `json:"item"`
+}
+
+type testFeedResponse struct {
+	Entries    []testFeedEntry `json:"entries"`
+	NextCursor *string         `json:"next_cursor"`
+}
+
+func TestFeed(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+
+	follow := func(follower, followee uint64) int {
+		t.Helper()
+		return doJsonPath(t, handleFollowPost(logger, db), follower, "POST", "/api/users/follow",
+			map[string]string{"id": fmt.Sprint(followee)}, "", nil)
+	}
+	if code := follow(bob, bob); code != http.StatusBadRequest {
+		t.Errorf("followed yourself: %d", code)
+	}
+	if code := follow(bob, 999); code != http.StatusNotFound {
+		t.Errorf("followed a non-existent user: %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := follow(bob, alice); code != http.StatusOK {
+			t.Fatalf("failed to follow: %d", code)
+		}
+	}
+	if code := follow(alice, carol); code != http.StatusOK {
+		t.Fatalf("failed to follow: %d", code)
+	}
+
+	addItem := func(body string) {
+		t.Helper()
+		if code := doJson(t, handleWishlistPost(logger, db, hub), alice, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add item: %d", code)
+		}
+	}
+	addItem(`{"description": "kite", "source": "", "cost": ""}`)
+	var secret struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleListPost(logger, db), alice, "POST", "/api/lists",
+		`{"name": "Secret", "visibility": "private"}`, &secret); code != http.StatusOK {
+		t.Fatalf("failed to create list: %d", code)
+	}
+	addItem(fmt.Sprintf(`{"description": "diary", "source": "", "cost": "", "list_id": %d}`, secret.Id))
+	if code := doJson(t, handleClaimPost(logger, db, hub), carol, "POST", "/api/wishlist/claim",
+		`{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := doJson(t, handleWishlistArchive(logger, db, hub), alice, "POST", "/api/wishlist/archive",
+			`{"ids": [1]}`, nil); code != http.StatusOK {
+			t.Fatalf("failed to archive: %d", code)
+		}
+	}
+
+	// bob sees the kite come and go, but nothing from the private list
+	var feed testFeedResponse
+	if code := doJson(t, handleFeedGet(logger, db), bob, "GET", "/api/feed", "", &feed); code != http.StatusOK {
+		t.Fatalf("failed to get feed: %d", code)
+	}
+	if len(feed.Entries) != 2 || feed.Entries[0].Kind != activityItemArchived || feed.Entries[1].Kind != activityItemAdded ||
+		feed.Entries[1].Item == nil || feed.Entries[1].Item.Description != "kite" || feed.Entries[1].User.Id != alice {
+		t.Fatalf("unexpected feed %+v", feed.Entries)
+	}
+
+	var first, second testFeedResponse
+	doJson(t, handleFeedGet(logger, db), bob, "GET", "/api/feed?limit=1", "", &first)
+	if len(first.Entries) != 1 || first.Entries[0].Kind != activityItemArchived || first.NextCursor == nil {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+	doJson(t, handleFeedGet(logger, db), bob, "GET", "/api/feed?limit=1&cursor="+*first.NextCursor, "", &second)
+	if len(second.Entries) != 1 || second.Entries[0].Kind != activityItemAdded || second.NextCursor != nil {
+		t.Errorf("unexpected second page %+v", second)
+	}
+
+	// opening the list up shows the list and what's on it
+	if code := doJsonPath(t, handleListPatch(logger, db), alice, "PATCH", "/api/lists",
+		map[string]string{"id": fmt.Sprint(secret.Id)}, `{"visibility": "members"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to update list: %d", code)
+	}
+	doJson(t, handleFeedGet(logger, db), bob, "GET", "/api/feed", "", &feed)
+	if len(feed.Entries) != 4 || feed.Entries[2].Kind != activityListCreated || feed.Entries[2].Item != nil ||
+		feed.Entries[2].List.Name != "Secret" {
+		t.Errorf("unexpected feed %+v", feed.Entries)
+	}
+
+	// carol's claim on alice's item never reaches alice
+	doJson(t, handleFeedGet(logger, db), alice, "GET", "/api/feed", "", &feed)
+	if len(feed.Entries) != 0 {
+		t.Errorf("alice saw %+v", feed.Entries)
+	}
+
+	var notified int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notification_outbox WHERE user_id = ? AND kind = 'followed_item'",
+		bob).Scan(&notified); err != nil {
+		t.Fatal(err)
+	}
+	if notified != 1 {
+		t.Errorf("expected one notification about the kite, got %d", notified)
+	}
+
+	// deleted items drop out of the feed, and stay out once they're purged
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if code := doJson(t, handleWishlistDelete(logger, db, hub), alice, "DELETE", "/api/wishlist",
+		`{"ids": [1, 2]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to delete: %d", code)
+	}
+	for _, now := range []time.Time{time.Now(), time.Now().Add(48 * time.Hour)} {
+		if err := cleanupDb(logger, db, newTestBlobStore(t), now, 24*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		doJson(t, handleFeedGet(logger, db), bob, "GET", "/api/feed", "", &feed)
+		if len(feed.Entries) != 1 || feed.Entries[0].Kind != activityListCreated {
+			t.Errorf("unexpected feed after deleting %+v", feed.Entries)
+		}
+	}
+	var itemActivity int
+	if err := db.QueryRow("SELECT COUNT(*) FROM activity WHERE item_id IS NOT NULL").Scan(&itemActivity); err != nil || itemActivity != 0 {
+		t.Errorf("expected purged items' activity to go with them, got %d %v", itemActivity, err)
+	}
+
+	var users struct {
+		Users []User `json:"users"`
+	}
+	doJson(t, handleUsersGet(logger, db), bob, "GET", "/api/users?following=true", "", &users)
+	if len(users.Users) != 1 || users.Users[0].Id != alice {
+		t.Errorf("unexpected followed users %+v", users.Users)
+	}
+
+	unfollow := handleFollowDelete(logger, db)
+	path := map[string]string{"id": fmt.Sprint(alice)}
+	if code := doJsonPath(t, unfollow, bob, "DELETE", "/api/users/follow", path, "", nil); code != http.StatusOK {
+		t.Fatalf("failed to unfollow: %d", code)
+	}
+	if code := doJsonPath(t, unfollow, bob, "DELETE", "/api/users/follow", path, "", nil); code != http.StatusNotFound {
+		t.Errorf("unfollowed twice: %d", code)
+	}
+	doJson(t, handleFeedGet(logger, db), bob, "GET", "/api/feed", "", &feed)
+	if len(feed.Entries) != 0 {
+		t.Errorf("feed kept going after unfollowing: %+v", feed.Entries)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	groupRoleAdmin  = "admin"
+	groupRoleMember = "member"
+)
+
+// the group migrateGroups put existing users in, which people whose invite
+// doesn't name a group join too
+const defaultGroupName = "Everyone"
+
+var errLastGroupAdmin = errors.New("a group must have at least one admin")
+
+// visibleTo is a condition on a user id column that holds for the viewer
+// themselves and anyone they share a group with. Bind the viewer's id to both
+// placeholders.
+func visibleTo(userColumn string) string {
+	return "(" + userColumn + " = ? OR " + userColumn + ` IN (SELECT other.user_id FROM group_members AS mine
+		JOIN group_members AS other ON other.group_id = mine.group_id WHERE mine.user_id = ?))`
+}
+
+// canSeeUser reports whether viewer is allowed to see userId's lists.
+func canSeeUser(db dbtx, viewer uint64, userId uint64) (bool, error) {
+	var visible bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM users WHERE id = ? AND "+visibleTo("id"),
+		userId, viewer, viewer).Scan(&visible)
+	return visible, err
+}
+
+func validGroupRole(role string) bool {
+	return role == groupRoleAdmin || role == groupRoleMember
+}
+
+// addGroupMember adds a user to a group, or changes their role if they're
+// already in it.
+func addGroupMember(db dbtx, groupId uint64, userId uint64, role string) error {
+	if !validGroupRole(role) {
+		return errors.New("role must be admin or member")
+	}
+	_, err := db.Exec(`INSERT INTO group_members(group_id, user_id, role) VALUES(?, ?, ?)
+		ON CONFLICT(group_id, user_id) DO UPDATE SET role = excluded.role`, groupId, userId, role)
+	return err
+}
+
+// defaultGroupId returns the id of the Everyone group, creating it if there
+// isn't one yet, e.g. on a fresh install.
+func defaultGroupId(db dbtx) (uint64, error) {
+	_, err := db.Exec(`INSERT INTO user_groups(name) SELECT ?
+		WHERE NOT EXISTS (SELECT 1 FROM user_groups WHERE name = ?)`, defaultGroupName, defaultGroupName)
+	if err != nil {
+		return 0, err
+	}
+
+	var groupId uint64
+	err = db.QueryRow("SELECT id FROM user_groups WHERE name = ? ORDER BY id LIMIT 1", defaultGroupName).Scan(&groupId)
+	return groupId, err
+}
+
+// checkLastAdmin fails if a change left a group without an admin, for
+// calling after the change inside the same transaction. previousRole is the
+// changed member's role before it. Only removing or demoting an admin can
+// do that, groups that never had one, like the Everyone group made for
+// existing users when groups came in, can still change otherwise.
+func checkLastAdmin(tx dbtx, groupId uint64, previousRole string) error {
+	if previousRole != groupRoleAdmin {
+		return nil
+	}
+	var admins, members uint64
+	err := tx.QueryRow(`SELECT COALESCE(SUM(role = 'admin'), 0), COUNT(*) FROM group_members
+		WHERE group_id = ?`, groupId).Scan(&admins, &members)
+	if err != nil {
+		return err
+	}
+	if admins == 0 && members != 0 {
+		return errLastGroupAdmin
+	}
+	return nil
+}
+
+// groupRole returns the user's role in the group named in the request path,
+// or "" if they aren't in it.
+func groupRole(db dbtx, r *http.Request, userId uint64) (uint64, string, error) {
+	groupId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+
+	role, err := memberRole(db, groupId, userId)
+	return groupId, role, err
+}
+
+// memberRole returns the user's role in a group, or "" if they aren't in it.
+func memberRole(db dbtx, groupId uint64, userId uint64) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// The groups the current user is in, with everyone else in them.
+func handleGroupsGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type GroupMember struct {
+			User
+			Role string `json:"role"`
+		}
+
+		type Group struct {
+			Id      uint64        `json:"id"`
+			Name    string        `json:"name"`
+			Role    string        `json:"role"`
+			Members []GroupMember `json:"members"`
+		}
+
+		type GroupsResponse struct {
+			Groups []*Group `json:"groups"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rows, err := db.Query(`SELECT user_groups.id, user_groups.name, mine.role, users.id, users.first_name,
+			users.last_name, members.role
+			FROM group_members AS mine
+			JOIN user_groups ON user_groups.id = mine.group_id
+			JOIN group_members AS members ON members.group_id = user_groups.id
+			JOIN users ON users.id = members.user_id
+			WHERE mine.user_id = ? ORDER BY user_groups.id, users.id`, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := GroupsResponse{Groups: []*Group{}}
+		for rows.Next() {
+			var group Group
+			var member GroupMember
+			err = rows.Scan(&group.Id, &group.Name, &group.Role, &member.Id, &member.FirstName,
+				&member.LastName, &member.Role)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(response.Groups) == 0 || response.Groups[len(response.Groups)-1].Id != group.Id {
+				response.Groups = append(response.Groups, &group)
+			}
+			last := response.Groups[len(response.Groups)-1]
+			last.Members = append(last.Members, member)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Anyone can start a group, and they're its first admin.
+func handleGroupPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type GroupRequest struct {
+			Name string `json:"name"`
+		}
+
+		type GroupResponse struct {
+			Id uint64 `json:"id"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req GroupRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) >= 500 {
+			http.Error(w, "group name must be between 1 and 500 characters", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		result, err := tx.Exec("INSERT INTO user_groups(name) VALUES(?)", req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		groupId, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = addGroupMember(tx, uint64(groupId), userId, groupRoleAdmin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(GroupResponse{uint64(groupId)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Group admins can invite people. New users sign up with the code, existing
+// ones redeem it with handleGroupJoin.
+func handleGroupInvitePost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type InviteResponse struct {
+			Code string `json:"code"`
+		}
+
+		groupId, role, err := groupRole(db, r, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if role != groupRoleAdmin {
+			http.Error(w, "only group admins can invite people", http.StatusUnauthorized)
+			return
+		}
+
+		inviteCode, err := generateInviteCodeHelper(db, sql.NullInt64{Int64: int64(userId), Valid: true},
+			sql.NullInt64{Int64: int64(groupId), Valid: true})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := InviteResponse{Code: base64.URLEncoding.EncodeToString(inviteCode)}
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Existing users join a group with an invite code for it.
+func handleGroupJoin(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type JoinRequest struct {
+			InviteCode string `json:"invite_code"`
+		}
+
+		type JoinResponse struct {
+			GroupId uint64 `json:"group_id"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req JoinRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		inviteCodeBlob, err := base64.URLEncoding.DecodeString(req.InviteCode)
+		if err != nil {
+			http.Error(w, "bad invite code", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		var groupId sql.NullInt64
+		err = tx.QueryRow("SELECT group_id FROM invite_codes WHERE invite_code = ? AND expiry_time >= ?",
+			inviteCodeBlob, time.Now()).Scan(&groupId)
+		if err == sql.ErrNoRows || (err == nil && !groupId.Valid) {
+			http.Error(w, "bad invite code", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec("DELETE FROM invite_codes WHERE invite_code = ?", inviteCodeBlob)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// joining a group you're already in shouldn't demote you
+		_, err = tx.Exec(`INSERT INTO group_members(group_id, user_id, role) VALUES(?, ?, ?)
+			ON CONFLICT(group_id, user_id) DO NOTHING`, groupId.Int64, userId, groupRoleMember)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(JoinResponse{uint64(groupId.Int64)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Admins can change anyone's role.
+func handleGroupMemberPatch(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type MemberPatch struct {
+			Role string `json:"role"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req MemberPatch
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		if !validGroupRole(req.Role) {
+			http.Error(w, "role must be admin or member", http.StatusBadRequest)
+			return
+		}
+
+		memberId, err := strconv.ParseUint(r.PathValue("userId"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed user id", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		groupId, role, err := groupRole(tx, r, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if role != groupRoleAdmin {
+			http.Error(w, "only group admins can change roles", http.StatusUnauthorized)
+			return
+		}
+
+		previousRole, err := memberRole(tx, groupId, memberId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previousRole == "" {
+			http.Error(w, "not a member of this group", http.StatusNotFound)
+			return
+		}
+
+		_, err = tx.Exec("UPDATE group_members SET role = ? WHERE group_id = ? AND user_id = ?",
+			req.Role, groupId, memberId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = checkLastAdmin(tx, groupId, previousRole)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Members can leave, admins can also remove other people.
+func handleGroupMemberDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		memberId, err := strconv.ParseUint(r.PathValue("userId"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed user id", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		groupId, role, err := groupRole(tx, r, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if role == "" || (memberId != userId && role != groupRoleAdmin) {
+			http.Error(w, "only group admins can remove other members", http.StatusUnauthorized)
+			return
+		}
+
+		previousRole, err := memberRole(tx, groupId, memberId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previousRole == "" {
+			http.Error(w, "not a member of this group", http.StatusNotFound)
+			return
+		}
+
+		_, err = tx.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupId, memberId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = checkLastAdmin(tx, groupId, previousRole)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
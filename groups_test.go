@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ericm1024/wishlist/admin_rpc"
+)
+
+func groupPath(groupId uint64, memberId uint64) map[string]string {
+	return map[string]string{"id": fmt.Sprint(groupId), "userId": fmt.Sprint(memberId)}
+}
+
+func TestGroupVisibility(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+
+	// Alice and Bob are family, Carol only knows Bob from work
+	if _, err := db.Exec("DELETE FROM group_members"); err != nil {
+		t.Fatal(err)
+	}
+	var family, work struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleGroupPost(logger, db), alice, "POST", "/api/groups",
+		`{"name": "Family"}`, &family); code != http.StatusOK {
+		t.Fatalf("failed to create group: %d", code)
+	}
+	if code := doJson(t, handleGroupPost(logger, db), carol, "POST", "/api/groups",
+		`{"name": "Work"}`, &work); code != http.StatusOK {
+		t.Fatalf("failed to create group: %d", code)
+	}
+	for _, member := range []struct{ group, user uint64 }{{family.Id, bob}, {work.Id, bob}} {
+		if err := addGroupMember(db, member.group, member.user, groupRoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, user := range []uint64{alice, carol} {
+		if code := doJson(t, post, user, "POST", "/api/wishlist",
+			`{"description": "bicycle", "source": "", "cost": ""}`, nil); code != http.StatusOK {
+			t.Fatalf("failed to add item: %d", code)
+		}
+	}
+
+	users := func(viewer uint64) string {
+		t.Helper()
+		var response struct {
+			Users []User `json:"users"`
+		}
+		if code := doJson(t, handleUsersGet(logger, db), viewer, "GET", "/api/users?sort=name", "", &response); code != http.StatusOK {
+			t.Fatalf("failed to get users: %d", code)
+		}
+		names := []string{}
+		for _, user := range response.Users {
+			names = append(names, user.FirstName)
+		}
+		return strings.Join(names, ",")
+	}
+	for _, tc := range []struct {
+		viewer   uint64
+		expected string
+	}{{alice, "Alice,Bob"}, {bob, "Alice,Bob,Carol"}, {carol, "Bob,Carol"}} {
+		if got := users(tc.viewer); got != tc.expected {
+			t.Errorf("user %d sees %s, expected %s", tc.viewer, got, tc.expected)
+		}
+	}
+
+	get := handleWishlistGet(logger, db)
+	if code := doJson(t, get, alice, "GET", fmt.Sprintf("/api/wishlist?userId=%d", carol), "", nil); code != http.StatusNotFound {
+		t.Errorf("alice could load carol's list: %d", code)
+	}
+	if code := doJson(t, get, bob, "GET", fmt.Sprintf("/api/wishlist?userId=%d", carol), "", nil); code != http.StatusOK {
+		t.Errorf("bob couldn't load carol's list: %d", code)
+	}
+
+	// item 2 is carol's
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), alice, "POST", "/api/wishlist/claim",
+		`{"id": 2}`, nil); code != http.StatusNotFound {
+		t.Errorf("alice could claim carol's item: %d", code)
+	}
+
+	var search struct {
+		Entries []struct {
+			Id uint64 `json:"id"`
+		} `json:"entries"`
+	}
+	doJson(t, handleSearchGet(logger, db), alice, "GET", "/api/search?q=bicycle", "", &search)
+	if len(search.Entries) != 1 || search.Entries[0].Id != 1 {
+		t.Errorf("alice's search found %+v", search.Entries)
+	}
+	doJson(t, handleSearchGet(logger, db), bob, "GET", "/api/search?q=bicycle", "", &search)
+	if len(search.Entries) != 2 {
+		t.Errorf("bob's search found %+v", search.Entries)
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	var group struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleGroupPost(logger, db), alice, "POST", "/api/groups",
+		`{"name": "Book club"}`, &group); code != http.StatusOK {
+		t.Fatalf("failed to create group: %d", code)
+	}
+
+	invite := handleGroupInvitePost(logger, db)
+	if code := doJsonPath(t, invite, bob, "POST", "/api/groups", groupPath(group.Id, 0), "", nil); code != http.StatusUnauthorized {
+		t.Errorf("non-member could invite people: %d", code)
+	}
+	var code struct {
+		Code string `json:"code"`
+	}
+	if status := doJsonPath(t, invite, alice, "POST", "/api/groups", groupPath(group.Id, 0), "", &code); status != http.StatusOK {
+		t.Fatalf("failed to create invite: %d", status)
+	}
+
+	join := handleGroupJoin(logger, db)
+	body := fmt.Sprintf(`{"invite_code": %q}`, code.Code)
+	if status := doJson(t, join, bob, "POST", "/api/groups/join", body, nil); status != http.StatusOK {
+		t.Fatalf("failed to join: %d", status)
+	}
+	if status := doJson(t, join, bob, "POST", "/api/groups/join", body, nil); status != http.StatusBadRequest {
+		t.Errorf("invite code was reusable: %d", status)
+	}
+
+	roles := func() map[uint64]string {
+		t.Helper()
+		var response struct {
+			Groups []struct {
+				Id      uint64 `json:"id"`
+				Members []struct {
+					Id   uint64 `json:"id"`
+					Role string `json:"role"`
+				} `json:"members"`
+			} `json:"groups"`
+		}
+		if status := doJson(t, handleGroupsGet(logger, db), alice, "GET", "/api/groups", "", &response); status != http.StatusOK {
+			t.Fatalf("failed to get groups: %d", status)
+		}
+		ret := map[uint64]string{}
+		for _, g := range response.Groups {
+			if g.Id != group.Id {
+				continue
+			}
+			for _, member := range g.Members {
+				ret[member.Id] = member.Role
+			}
+		}
+		return ret
+	}
+	if got := roles(); got[alice] != groupRoleAdmin || got[bob] != groupRoleMember {
+		t.Errorf("unexpected roles after join: %v", got)
+	}
+
+	patch := handleGroupMemberPatch(logger, db)
+	remove := handleGroupMemberDelete(logger, db)
+	if status := doJsonPath(t, patch, bob, "PATCH", "/api/groups", groupPath(group.Id, bob), `{"role": "admin"}`, nil); status != http.StatusUnauthorized {
+		t.Errorf("member promoted themselves: %d", status)
+	}
+	if status := doJsonPath(t, remove, bob, "DELETE", "/api/groups", groupPath(group.Id, alice), "", nil); status != http.StatusUnauthorized {
+		t.Errorf("member removed an admin: %d", status)
+	}
+	if status := doJsonPath(t, patch, alice, "PATCH", "/api/groups", groupPath(group.Id, alice), `{"role": "member"}`, nil); status != http.StatusConflict {
+		t.Errorf("last admin demoted themselves: %d", status)
+	}
+	if status := doJsonPath(t, remove, alice, "DELETE", "/api/groups", groupPath(group.Id, alice), "", nil); status != http.StatusConflict {
+		t.Errorf("last admin left: %d", status)
+	}
+	if status := doJsonPath(t, patch, alice, "PATCH", "/api/groups", groupPath(group.Id, bob), `{"role": "admin"}`, nil); status != http.StatusOK {
+		t.Fatalf("failed to promote: %d", status)
+	}
+	if status := doJsonPath(t, remove, alice, "DELETE", "/api/groups", groupPath(group.Id, alice), "", nil); status != http.StatusOK {
+		t.Fatalf("admin couldn't leave once there's another: %d", status)
+	}
+	if got := roles(); len(got) != 0 {
+		t.Errorf("alice still sees the group: %v", got)
+	}
+}
+
+// Existing users all went into an Everyone group as members when groups came
+// in, so it has no admin until someone is given the role.
+func TestGroupWithoutAdmin(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+
+	result, err := db.Exec("INSERT INTO user_groups(name) VALUES('Everyone')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupId, _ := result.LastInsertId()
+	_, err = db.Exec(`INSERT INTO group_members(group_id, user_id, role) SELECT ?, id, 'member' FROM users
+		WHERE id IN (?, ?)`, groupId, alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	everyone := uint64(groupId)
+
+	if status := doJsonPath(t, handleGroupMemberDelete(logger, db), bob, "DELETE", "/api/groups",
+		groupPath(everyone, bob), "", nil); status != http.StatusOK {
+		t.Errorf("member couldn't leave a group without an admin: %d", status)
+	}
+
+	admin := &adminGrpcServer{Logger: logger, Db: db}
+	ctx := context.Background()
+	if _, err := admin.AddGroupMember(ctx, &admin_rpc.GroupMemberRequest{GroupId: everyone, UserId: carol,
+		Role: groupRoleMember}); err != nil {
+		t.Errorf("couldn't add a member to a group without an admin: %v", err)
+	}
+	if _, err := admin.AddGroupMember(ctx, &admin_rpc.GroupMemberRequest{GroupId: everyone, UserId: alice,
+		Role: groupRoleAdmin}); err != nil {
+		t.Fatalf("couldn't give the group an admin: %v", err)
+	}
+
+	// once it has one, it keeps one
+	if status := doJsonPath(t, handleGroupMemberPatch(logger, db), alice, "PATCH", "/api/groups",
+		groupPath(everyone, alice), `{"role": "member"}`, nil); status != http.StatusConflict {
+		t.Errorf("last admin demoted themselves: %d", status)
+	}
+}
+
+func TestSignupGroup(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	admin := &adminGrpcServer{Logger: logger, Db: db}
+	ctx := context.Background()
+
+	signup := func(first string, groupId uint64) uint64 {
+		t.Helper()
+		reply, err := admin.GenerateInviteCode(ctx, &admin_rpc.InviteCodeRequest{GroupId: groupId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := fmt.Sprintf(`{"first": %q, "last": "Test", "email": "%s@example.com", "password": "mypassword",
+			"invite_code": %q}`, first, strings.ToLower(first), reply.Code)
+		req := httptest.NewRequest("POST", "/signup", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handleSignup(logger, &Config{AllowInsecure: true}, db)(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to sign up %s: %d %s", first, rr.Code, rr.Body.String())
+		}
+		var user User
+		if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+		return user.Id
+	}
+
+	// on a fresh install there's no Everyone group until someone needs one
+	alice := signup("Alice", 0)
+	bob := signup("Bob", 0)
+	if visible, err := canSeeUser(db, alice, bob); err != nil || !visible {
+		t.Errorf("people signing up without a group can't see each other: %v %v", visible, err)
+	}
+	everyone, err := defaultGroupId(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, err := memberRole(db, everyone, alice); err != nil || role != groupRoleMember {
+		t.Errorf("expected alice to be a member of everyone, got %q %v", role, err)
+	}
+
+	// an invite to a group is just to that group
+	group, err := admin.CreateGroup(ctx, &admin_rpc.CreateGroupRequest{Name: "Swim team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol := signup("Carol", group.GroupId)
+	if visible, err := canSeeUser(db, carol, alice); err != nil || visible {
+		t.Errorf("group invite also joined everyone: %v %v", visible, err)
+	}
+	var groups int
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_groups WHERE name = ?", defaultGroupName).Scan(&groups); err != nil || groups != 1 {
+		t.Errorf("expected one everyone group, got %d %v", groups, err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The columns of a wishlist row that show up in its history. Buyer notes are
+// in here too, but only non-owners can change them, so their changes are
+// always buyer-side and filtered out for the owner.
+const historyColumns = `description,source,cost,price_amount,price_currency,owner_notes,buyer_notes,
+	quantity_desired,quantity_received,archived_time IS NOT NULL,deleted_time IS NOT NULL,priority,
+	list_id`
+
+var historyFields = []string{"description", "source", "cost", "price_amount", "price_currency",
+	"owner_notes", "buyer_notes", "quantity_desired", "quantity_received", "archived", "deleted",
+	"priority", "list_id"}
+
+type itemSnapshot struct {
+	Id     uint64
+	UserId uint64
+	Seq    uint64
+	Fields map[string]interface{}
+}
+
+type fieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// loadItemSnapshot reads the current state of an item for diffing. Returns
+// nil if there's no such item.
+func loadItemSnapshot(tx dbtx, itemId uint64) (*itemSnapshot, error) {
+	values := make([]interface{}, len(historyFields))
+	scanArgs := []interface{}{new(uint64), new(uint64)}
+	for i := range values {
+		scanArgs = append(scanArgs, &values[i])
+	}
+
+	err := tx.QueryRow("SELECT user_id,sequence_number,"+historyColumns+" FROM wishlist WHERE id = ?",
+		itemId).Scan(scanArgs...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := &itemSnapshot{
+		Id:     itemId,
+		UserId: *scanArgs[0].(*uint64),
+		Seq:    *scanArgs[1].(*uint64),
+		Fields: make(map[string]interface{}),
+	}
+	for i, field := range historyFields {
+		switch v := values[i].(type) {
+		case []byte:
+			ret.Fields[field] = string(v)
+		case int64:
+			if field == "archived" || field == "deleted" {
+				ret.Fields[field] = v != 0
+			} else {
+				ret.Fields[field] = v
+			}
+		default:
+			ret.Fields[field] = v
+		}
+	}
+
+	tags, err := tx.Query(`SELECT tags.name FROM wishlist_tags JOIN tags ON tags.id = wishlist_tags.tag_id
+		WHERE wishlist_tags.item_id = ? ORDER BY tags.name`, itemId)
+	if err != nil {
+		return nil, err
+	}
+	defer tags.Close()
+
+	itemTags := []string{}
+	for tags.Next() {
+		var name string
+		err = tags.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		itemTags = append(itemTags, name)
+	}
+	ret.Fields["tags"] = itemTags
+	return ret, tags.Err()
+}
+
+// recordItemChange diffs two snapshots of an item and writes a history row
+// with whatever changed. before is nil for newly created items. Nothing is
+// recorded if nothing changed.
+func recordItemChange(tx dbtx, actorId uint64, action string, before *itemSnapshot, after *itemSnapshot) error {
+	changes := make(map[string]fieldChange)
+	for field, newValue := range after.Fields {
+		var oldValue interface{}
+		if before != nil {
+			oldValue = before.Fields[field]
+		} else if newValue == nil {
+			continue
+		}
+
+		oldJson, err := json.Marshal(oldValue)
+		if err != nil {
+			return err
+		}
+		newJson, err := json.Marshal(newValue)
+		if err != nil {
+			return err
+		}
+		if before != nil && bytes.Equal(oldJson, newJson) {
+			continue
+		}
+		changes[field] = fieldChange{oldValue, newValue}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	changesJson, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO wishlist_history(item_id, version, actor_id, action, buyer_side, changes)
+		VALUES(?, ?, ?, ?, ?, ?)`,
+		after.Id, after.Seq, actorId, action, actorId != after.UserId, string(changesJson))
+	return err
+}
+
+func handleWishlistHistory(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type HistoryEntry struct {
+			Version uint64                 `json:"version"`
+			Action  string                 `json:"action"`
+			Actor   *User                  `json:"actor"`
+			Time    time.Time              `json:"time"`
+			Changes map[string]fieldChange `json:"changes"`
+		}
+
+		type HistoryResponse struct {
+			Entries []HistoryEntry `json:"entries"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		itemId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed item id", http.StatusBadRequest)
+			return
+		}
+
+		var ownerId uint64
+		var deleted, visible bool
+		err = db.QueryRow("SELECT user_id,deleted_time IS NOT NULL,"+listVisibleTo("wishlist.list_id")+
+			" FROM wishlist WHERE id = ?", userId, itemId).Scan(&ownerId, &deleted, &visible)
+		if err == sql.ErrNoRows || (err == nil && ((deleted && ownerId != userId) || !visible)) {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// owners never get to see what buyers have been up to
+		rows, err := db.Query(`SELECT wishlist_history.version, wishlist_history.action,
+			wishlist_history.creation_time, wishlist_history.changes, users.id, users.first_name,
+			users.last_name
+			FROM wishlist_history LEFT JOIN users ON users.id = wishlist_history.actor_id
+			WHERE wishlist_history.item_id = ? AND (? OR NOT wishlist_history.buyer_side)
+			ORDER BY wishlist_history.id`, itemId, ownerId != userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := HistoryResponse{Entries: []HistoryEntry{}}
+		for rows.Next() {
+			var entry HistoryEntry
+			var changes string
+			var actorId sql.NullInt64
+			var actorFirst, actorLast sql.NullString
+			err = rows.Scan(&entry.Version, &entry.Action, &entry.Time, &changes, &actorId, &actorFirst,
+				&actorLast)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			err = json.Unmarshal([]byte(changes), &entry.Changes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if actorId.Valid {
+				entry.Actor = &User{uint64(actorId.Int64), actorFirst.String, actorLast.String}
+			}
+			response.Entries = append(response.Entries, entry)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how many events we keep around for clients resuming with Last-Event-ID
+	hubReplaySize = 1000
+	// how far a subscriber can fall behind before we drop it, it can resume
+	// from the replay buffer when it reconnects
+	hubSubscriberBuffer = 64
+	streamKeepalive     = 30 * time.Second
+)
+
+// ItemEvent is a change to a wishlist item. Buyer side events (claims and
+// buyer notes) are never sent to the item's owner.
+type ItemEvent struct {
+	Type   string `json:"type"`
+	ItemId uint64 `json:"item_id"`
+	UserId uint64 `json:"user_id"`
+	ListId uint64 `json:"list_id"`
+	Seq    uint64 `json:"seq"`
+
+	buyerSide bool
+	id        uint64
+}
+
+// Hub is an in-process pub/sub of item events. Event ids are only
+// meaningful to the process that handed them out, so they carry an epoch
+// and a client resuming from a different one gets told to start over.
+type Hub struct {
+	mu          sync.Mutex
+	epoch       string
+	nextId      uint64
+	replay      []ItemEvent
+	subscribers map[chan ItemEvent]struct{}
+}
+
+func newHub() *Hub {
+	return &Hub{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		nextId:      1,
+		subscribers: make(map[chan ItemEvent]struct{}),
+	}
+}
+
+func (h *Hub) eventId(event ItemEvent) string {
+	return fmt.Sprintf("%s-%d", h.epoch, event.id)
+}
+
+func (h *Hub) Publish(event ItemEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event.id = h.nextId
+	h.nextId++
+	h.replay = append(h.replay, event)
+	if len(h.replay) > hubReplaySize {
+		h.replay = h.replay[len(h.replay)-hubReplaySize:]
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// too slow, make it reconnect and catch up from the replay buffer
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe starts delivering events to the returned channel. If lastEventId
+// is set, whatever was published after it is returned as well. If that can't
+// be done (it's from before a restart or has fallen out of the replay
+// buffer) the client has missed events, and resetId is the id to carry on
+// from once it has reloaded.
+func (h *Hub) Subscribe(lastEventId string) (ch chan ItemEvent, replay []ItemEvent, resetId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch = make(chan ItemEvent, hubSubscriberBuffer)
+	h.subscribers[ch] = struct{}{}
+	if lastEventId == "" {
+		return ch, nil, ""
+	}
+
+	resetId = fmt.Sprintf("%s-%d", h.epoch, h.nextId-1)
+	epoch, idStr, _ := strings.Cut(lastEventId, "-")
+	lastId, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil || epoch != h.epoch || lastId >= h.nextId {
+		return ch, nil, resetId
+	}
+	// the oldest event we still have has to directly follow the last one
+	// the client saw, otherwise something was dropped in between
+	if lastId+1 < h.nextId && (len(h.replay) == 0 || h.replay[0].id > lastId+1) {
+		return ch, nil, resetId
+	}
+	for _, event := range h.replay {
+		if event.id > lastId {
+			replay = append(replay, event)
+		}
+	}
+	return ch, replay, ""
+}
+
+func (h *Hub) Unsubscribe(ch chan ItemEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Close ends every subscription, streams don't otherwise finish on their own
+// so this needs to happen for the http server to shut down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishItems publishes an event for each of the given items, and queues
+// calls to any webhooks that want it. Call it after the change has been
+// committed, it reads the items back to find out whose they are and where
+// they live. Failures are only logged, the change itself already happened.
+func publishItems(logger *log.Logger, db *sql.DB, hub *Hub, eventType string, buyerSide bool, itemIds ...uint64) {
+	for _, itemId := range itemIds {
+		event := ItemEvent{Type: eventType, ItemId: itemId, buyerSide: buyerSide}
+		err := db.QueryRow("SELECT user_id,list_id,sequence_number FROM wishlist WHERE id = ?",
+			itemId).Scan(&event.UserId, &event.ListId, &event.Seq)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			logger.Printf("failed to load item %d for %s event: %v", itemId, eventType, err)
+			continue
+		}
+		hub.Publish(event)
+
+		err = queueWebhooks(db, event)
+		if err != nil {
+			logger.Printf("failed to queue webhooks for %s of item %d: %v", eventType, itemId, err)
+		}
+	}
+}
+
+// streamVisible reports whether an event should go to userId's stream.
+func streamVisible(db *sql.DB, userId uint64, event ItemEvent) (bool, error) {
+	if event.UserId == userId {
+		return !event.buyerSide, nil
+	}
+	var visible bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM lists WHERE id = ? AND "+listVisibleTo("lists.id"),
+		event.ListId, userId).Scan(&visible)
+	return visible, err
+}
+
+// handleEventStream is a server-sent events stream of changes to items the
+// user can see. A client that reconnects with a Last-Event-ID we can't
+// resume from gets a reset event and should reload everything.
+func handleEventStream(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		ch, replay, resetId := hub.Subscribe(r.Header.Get("Last-Event-ID"))
+		defer hub.Unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		// don't let a reverse proxy sit on the events
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		controller := http.NewResponseController(w)
+		send := func(event ItemEvent) error {
+			visible, err := streamVisible(db, userId, event)
+			if err != nil || !visible {
+				return err
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: item\ndata: %s\n\n", hub.eventId(event), data)
+			return err
+		}
+
+		if resetId != "" {
+			fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {}\n\n", resetId)
+		}
+		for _, event := range replay {
+			if err := send(event); err != nil {
+				logger.Printf("event stream for user %d: %v", userId, err)
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			logger.Printf("event stream for user %d: %v", userId, err)
+			return
+		}
+
+		keepalive := time.NewTicker(streamKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := send(event); err != nil {
+					logger.Printf("event stream for user %d: %v", userId, err)
+					return
+				}
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHubResume(t *testing.T) {
+	hub := newHub()
+	for i := uint64(1); i <= 3; i++ {
+		hub.Publish(ItemEvent{Type: "create", ItemId: i})
+	}
+
+	ch, replay, resetId := hub.Subscribe(hub.epoch + "-1")
+	if resetId != "" || len(replay) != 2 || replay[0].ItemId != 2 || replay[1].ItemId != 3 {
+		t.Errorf("unexpected replay %+v %q", replay, resetId)
+	}
+	hub.Publish(ItemEvent{Type: "patch", ItemId: 1})
+	if event := <-ch; event.Type != "patch" || hub.eventId(event) != hub.epoch+"-4" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	hub.Unsubscribe(ch)
+
+	// ids from before a restart, or from the future, can't be resumed
+	for _, lastEventId := range []string{"old-1", hub.epoch + "-99", "garbage"} {
+		_, replay, resetId := hub.Subscribe(lastEventId)
+		if resetId != hub.epoch+"-4" || replay != nil {
+			t.Errorf("resumed from %s: %+v %q", lastEventId, replay, resetId)
+		}
+	}
+
+	// nor can ones that have fallen out of the replay buffer
+	for i := 0; i < hubReplaySize; i++ {
+		hub.Publish(ItemEvent{Type: "patch", ItemId: 1})
+	}
+	if _, _, resetId := hub.Subscribe(hub.epoch + "-1"); resetId == "" {
+		t.Errorf("resumed from an event that was dropped")
+	}
+	if _, replay, resetId := hub.Subscribe(fmt.Sprintf("%s-%d", hub.epoch, hubReplaySize+3)); resetId != "" || len(replay) != 1 {
+		t.Errorf("failed to resume from the end of the buffer: %d %q", len(replay), resetId)
+	}
+
+	// subscribers that stop reading get cut off rather than holding up everyone else
+	slow, _, _ := hub.Subscribe("")
+	for i := 0; i <= hubSubscriberBuffer; i++ {
+		hub.Publish(ItemEvent{Type: "patch", ItemId: 1})
+	}
+	for range slow {
+	}
+}
+
+type testStreamEvent struct {
+	id    string
+	event string
+	data  ItemEvent
+}
+
+// openTestStream connects userId to the event stream, the returned function
+// reads the next event off it.
+func openTestStream(t *testing.T, db *sql.DB, hub *Hub, userId uint64, lastEventId string) func() testStreamEvent {
+	t.Helper()
+	stream := handleEventStream(log.Default(), db, hub)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream(w, r, userId)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(hub.Close)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	return func() testStreamEvent {
+		t.Helper()
+		var ret testStreamEvent
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" && ret.event != "" {
+				return ret
+			}
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				ret.id = value
+			case "event":
+				ret.event = value
+			case "data":
+				if err := json.Unmarshal([]byte(value), &ret.data); err != nil {
+					t.Fatalf("bad event data %q: %v", value, err)
+				}
+			}
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	var secret struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleListPost(logger, db), alice, "POST", "/api/lists",
+		`{"name": "Secret", "visibility": "private"}`, &secret); code != http.StatusOK {
+		t.Fatalf("failed to create list: %d", code)
+	}
+
+	aliceStream := openTestStream(t, db, hub, alice, "")
+	bobStream := openTestStream(t, db, hub, bob, "")
+
+	post := handleWishlistPost(logger, db, hub)
+	for _, body := range []string{
+		fmt.Sprintf(`{"description": "surprise", "source": "", "cost": "", "list_id": %d}`, secret.Id),
+		`{"description": "kite", "source": "", "cost": ""}`,
+	} {
+		if code := doJson(t, post, alice, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+	if code := doJson(t, handleClaimPost(logger, db, hub), bob, "POST", "/api/wishlist/claim",
+		`{"id": 2}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+	if code := doJson(t, handleWishlistPatch(logger, db, hub), alice, "PATCH", "/api/wishlist",
+		`{"id": 2, "seq": 1, "description": "red kite"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to patch: %d", code)
+	}
+
+	// alice never hears about the claim
+	for _, expected := range []ItemEvent{{Type: "create", ItemId: 1}, {Type: "create", ItemId: 2}, {Type: "patch", ItemId: 2}} {
+		if event := aliceStream(); event.event != "item" || event.data.Type != expected.Type || event.data.ItemId != expected.ItemId {
+			t.Errorf("alice got %+v, expected %+v", event, expected)
+		}
+	}
+
+	// and bob never hears about the secret list
+	var lastSeen string
+	for _, expected := range []ItemEvent{{Type: "create", ItemId: 2}, {Type: "claim", ItemId: 2}} {
+		event := bobStream()
+		if event.data.Type != expected.Type || event.data.ItemId != expected.ItemId || event.data.UserId != alice {
+			t.Errorf("bob got %+v, expected %+v", event, expected)
+		}
+		lastSeen = event.id
+	}
+
+	// reconnecting picks up where bob left off
+	resumed := openTestStream(t, db, hub, bob, lastSeen)
+	if event := resumed(); event.data.Type != "patch" || event.data.Seq != 2 {
+		t.Errorf("resumed stream got %+v", event)
+	}
+	if event := openTestStream(t, db, hub, bob, "stale-1")(); event.event != "reset" {
+		t.Errorf("expected stale stream to be reset, got %+v", event)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	icsDateFormat     = "20060102"
+	icsDateTimeFormat = "20060102T150405"
+	// lines longer than this many octets get folded, RFC 5545 section 3.1
+	icsLineLimit = 75
+
+	maxIcsImportBytes  = 1 << 20
+	maxIcsImportEvents = 500
+)
+
+// icsEscape escapes TEXT values, RFC 5545 section 3.3.11.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+func icsUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// icsWriter writes content lines, folding them without splitting up UTF-8
+// sequences.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *icsWriter) line(name string, value string) {
+	if w.err != nil {
+		return
+	}
+	line := name + ":" + value
+	var folded strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > icsLineLimit {
+			folded.WriteString("\r\n ")
+			// the leading space counts towards the next line
+			width = 1
+		}
+		folded.WriteRune(r)
+		width += size
+	}
+	folded.WriteString("\r\n")
+	_, w.err = io.WriteString(w.w, folded.String())
+}
+
+// Create a calendar link for the current user, replacing any existing one so
+// old links stop working.
+func handleCalendarTokenPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type CalendarTokenResponse struct {
+			CalendarToken string `json:"calendar_token"`
+		}
+
+		token := newShareToken()
+		_, err := db.Exec(`INSERT INTO calendar_tokens(calendar_token, user_id) VALUES(?, ?)
+			ON CONFLICT(user_id) DO UPDATE SET calendar_token = excluded.calendar_token,
+			creation_time = CURRENT_TIMESTAMP`, token, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := CalendarTokenResponse{CalendarToken: base64.URLEncoding.EncodeToString(token)}
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func handleCalendarTokenDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		result, err := db.Exec("DELETE FROM calendar_tokens WHERE user_id = ?", userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "no calendar link", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// calendarEvent is one VEVENT, with the lists on it the user can see.
+type calendarEvent struct {
+	Id      uint64
+	Name    string
+	Date    time.Time
+	Created time.Time
+	Lists   []calendarList
+}
+
+type calendarList struct {
+	Id      uint64
+	Name    string
+	OwnerId uint64
+	Owner   string
+}
+
+// upcomingCalendarEvents finds the events from today on for a user's
+// calendar: the ones they're in, and the ones people they can see have put
+// on their own visible lists, like a birthday on a wishlist.
+func upcomingCalendarEvents(db *sql.DB, userId uint64, today string) ([]*calendarEvent, error) {
+	rows, err := db.Query(`SELECT events.id, events.name, events.event_date, events.creation_time FROM events
+		WHERE events.event_date >= ? AND (
+			EXISTS (SELECT 1 FROM event_participants
+				WHERE event_participants.event_id = events.id AND event_participants.user_id = ?)
+			OR EXISTS (SELECT 1 FROM event_lists JOIN lists ON lists.id = event_lists.list_id
+				WHERE event_lists.event_id = events.id AND lists.user_id = events.owner_id
+				AND `+listVisibleTo("lists.id")+`))
+		ORDER BY events.event_date, events.id`, today, userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []*calendarEvent
+	byId := make(map[uint64]*calendarEvent)
+	for rows.Next() {
+		var event calendarEvent
+		var date string
+		err = rows.Scan(&event.Id, &event.Name, &date, &event.Created)
+		if err != nil {
+			return nil, err
+		}
+		event.Date, err = time.Parse(eventDateFormat, date)
+		if err != nil {
+			return nil, err
+		}
+		byId[event.Id] = &event
+		ret = append(ret, &event)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	lists, err := db.Query(`SELECT event_lists.event_id, lists.id, lists.name, users.id,
+		users.first_name || ' ' || users.last_name FROM event_lists
+		JOIN lists ON lists.id = event_lists.list_id
+		JOIN users ON users.id = lists.user_id
+		JOIN events ON events.id = event_lists.event_id
+		WHERE events.event_date >= ? AND `+listVisibleTo("lists.id")+`
+		ORDER BY lists.id`, today, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer lists.Close()
+
+	for lists.Next() {
+		var eventId uint64
+		var list calendarList
+		err = lists.Scan(&eventId, &list.Id, &list.Name, &list.OwnerId, &list.Owner)
+		if err != nil {
+			return nil, err
+		}
+		if event, ok := byId[eventId]; ok {
+			event.Lists = append(event.Lists, list)
+		}
+	}
+	return ret, lists.Err()
+}
+
+// Upcoming events as an iCalendar (RFC 5545) feed for calendar apps, with
+// the token standing in for a login. Each event links to the lists on it.
+func handleCalendarGet(logger *log.Logger, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := base64.URLEncoding.DecodeString(strings.TrimSuffix(r.PathValue("token"), ".ics"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		var userId uint64
+		err = db.QueryRow("SELECT user_id FROM calendar_tokens WHERE calendar_token = ?", token).Scan(&userId)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		events, err := upcomingCalendarEvents(db, userId, now.Format(eventDateFormat))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		base := url.URL{Scheme: "https", Host: r.Host}
+		if r.TLS == nil {
+			base.Scheme = "http"
+		}
+		host, _, _ := strings.Cut(r.Host, ":")
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		ics := &icsWriter{w: w}
+		ics.line("BEGIN", "VCALENDAR")
+		ics.line("VERSION", "2.0")
+		ics.line("PRODID", "-//wishlist//events//EN")
+		ics.line("CALSCALE", "GREGORIAN")
+		ics.line("METHOD", "PUBLISH")
+		ics.line("X-WR-CALNAME", "Wishlist events")
+		for _, event := range events {
+			ics.line("BEGIN", "VEVENT")
+			ics.line("UID", fmt.Sprintf("event-%d@%s", event.Id, host))
+			ics.line("DTSTAMP", now.UTC().Format(icsDateTimeFormat)+"Z")
+			ics.line("CREATED", event.Created.UTC().Format(icsDateTimeFormat)+"Z")
+			ics.line("DTSTART;VALUE=DATE", event.Date.Format(icsDateFormat))
+			ics.line("DTEND;VALUE=DATE", event.Date.AddDate(0, 0, 1).Format(icsDateFormat))
+			ics.line("SUMMARY", icsEscape(event.Name))
+			ics.line("TRANSP", "TRANSPARENT")
+
+			// only one URL is allowed, the rest go in the description
+			var description []string
+			for i, list := range event.Lists {
+				link := base
+				link.Path = fmt.Sprintf("/wishlist/%d", list.OwnerId)
+				link.RawQuery = url.Values{"list": {fmt.Sprint(list.Id)}}.Encode()
+				if i == 0 {
+					ics.line("URL;VALUE=URI", link.String())
+				}
+				description = append(description, fmt.Sprintf("%s: %s %s", list.Owner, list.Name, link.String()))
+			}
+			if len(description) != 0 {
+				ics.line("DESCRIPTION", icsEscape(strings.Join(description, "\n")))
+			}
+			ics.line("END", "VEVENT")
+		}
+		ics.line("END", "VCALENDAR")
+		if ics.err != nil {
+			logger.Printf("error writing calendar for user %d: %v", userId, ics.err)
+		}
+	}
+}
+
+// icsProperty is one unfolded content line.
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+func parseIcsLine(line string) (icsProperty, error) {
+	var prop icsProperty
+	// the value can have colons in it but parameters only do when quoted
+	nameEnd := -1
+	quoted := false
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			nameEnd = i
+			break
+		}
+	}
+	if nameEnd < 0 {
+		return prop, fmt.Errorf("malformed line %q", line)
+	}
+	prop.Value = line[nameEnd+1:]
+
+	parts := strings.Split(line[:nameEnd], ";")
+	prop.Name = strings.ToUpper(parts[0])
+	prop.Params = make(map[string]string)
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		prop.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+// icsImportEvent is what we keep from a VEVENT.
+type icsImportEvent struct {
+	Name   string
+	Date   time.Time
+	Yearly bool
+}
+
+// parseIcsEvents reads the VEVENTs out of an iCalendar file. Only the date
+// of DTSTART matters, events here are whole days.
+func parseIcsEvents(r io.Reader) ([]icsImportEvent, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if len(lines) == 0 {
+				return nil, errors.New("calendar starts with a continuation line")
+			}
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []icsImportEvent
+	var current *icsImportEvent
+	seenCalendar := false
+	for _, line := range lines {
+		prop, err := parseIcsLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VCALENDAR"):
+			seenCalendar = true
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT"):
+			current = &icsImportEvent{}
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT"):
+			if current == nil {
+				return nil, errors.New("END:VEVENT without BEGIN:VEVENT")
+			}
+			if current.Name == "" || current.Date.IsZero() {
+				return nil, errors.New("event without a SUMMARY or DTSTART")
+			}
+			events = append(events, *current)
+			current = nil
+		case current == nil:
+			// calendar properties, timezones and other components
+		case prop.Name == "SUMMARY":
+			current.Name = strings.TrimSpace(icsUnescape(prop.Value))
+		case prop.Name == "DTSTART":
+			// a date, or a date-time whose date is what we want
+			value, _, _ := strings.Cut(prop.Value, "T")
+			current.Date, err = time.Parse(icsDateFormat, value)
+			if err != nil {
+				return nil, fmt.Errorf("malformed DTSTART %q", prop.Value)
+			}
+		case prop.Name == "RRULE":
+			current.Yearly = strings.Contains(strings.ToUpper(prop.Value), "FREQ=YEARLY")
+		}
+	}
+	if !seenCalendar {
+		return nil, errors.New("not an iCalendar file")
+	}
+	if current != nil {
+		return nil, errors.New("unterminated VEVENT")
+	}
+	return events, nil
+}
+
+// nextOccurrence is the first time a yearly event happens on or after today,
+// so a birthday from 1990 comes in as this year's (or next year's).
+func nextOccurrence(date time.Time, today time.Time) time.Time {
+	for years := today.Year() - date.Year(); ; years++ {
+		next := date.AddDate(years, 0, 0)
+		// AddDate turns Feb 29 into Mar 1 in other years, which is fine
+		if !next.Before(today) {
+			return next
+		}
+	}
+}
+
+// Create events from an iCalendar file, e.g. birthdays exported from a
+// calendar app. Yearly ones come in as their next occurrence, and ones that
+// are over are skipped. It's all or nothing.
+func handleEventsImport(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ImportResponse struct {
+			Ids     []uint64 `json:"ids"`
+			Skipped uint64   `json:"skipped"`
+		}
+
+		// calendar apps like to add a charset
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "text/calendar" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		events, err := parseIcsEvents(http.MaxBytesReader(w, r.Body, maxIcsImportBytes))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(events) > maxIcsImportEvents {
+			http.Error(w, fmt.Sprintf("at most %d events can be imported at once", maxIcsImportEvents),
+				http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		today, _ := time.Parse(eventDateFormat, time.Now().Format(eventDateFormat))
+		response := ImportResponse{Ids: []uint64{}}
+		for _, event := range events {
+			if event.Yearly {
+				event.Date = nextOccurrence(event.Date, today)
+			}
+			if event.Date.Before(today) {
+				response.Skipped++
+				continue
+			}
+			if len(event.Name) >= 500 {
+				http.Error(w, "event name must be between 1 and 500 characters", http.StatusBadRequest)
+				return
+			}
+
+			result, err := tx.Exec("INSERT INTO events(owner_id, name, event_date, reminder_days) VALUES(?, ?, ?, ?)",
+				userId, event.Name, event.Date.Format(eventDateFormat), defaultReminderDays)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			eventId, err := result.LastInsertId()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			_, err = tx.Exec("INSERT INTO event_participants(event_id, user_id) VALUES(?, ?)", eventId, userId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Ids = append(response.Ids, uint64(eventId))
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
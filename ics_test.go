@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkIcs checks the parts of RFC 5545 a calendar app would choke on:
+// CRLF line endings, folding at 75 octets, balanced components and the
+// properties each one requires. It returns the unfolded lines.
+func checkIcs(t *testing.T, body string) []string {
+	t.Helper()
+	if !strings.HasSuffix(body, "\r\n") {
+		t.Fatalf("calendar doesn't end with CRLF")
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n") {
+		if strings.Contains(line, "\n") || strings.Contains(line, "\r") {
+			t.Fatalf("bare line ending in %q", line)
+		}
+		if len(line) > icsLineLimit {
+			t.Errorf("line longer than %d octets: %q", icsLineLimit, line)
+		}
+		if strings.HasPrefix(line, " ") {
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	var stack []string
+	var properties []map[string]int
+	for _, line := range lines {
+		prop, err := parseIcsLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch prop.Name {
+		case "BEGIN":
+			stack = append(stack, prop.Value)
+			properties = append(properties, make(map[string]int))
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1] != prop.Value {
+				t.Fatalf("unbalanced END:%s", prop.Value)
+			}
+			var required []string
+			switch prop.Value {
+			case "VCALENDAR":
+				required = []string{"VERSION", "PRODID"}
+			case "VEVENT":
+				required = []string{"UID", "DTSTAMP", "DTSTART"}
+			}
+			counts := properties[len(properties)-1]
+			for _, name := range required {
+				if counts[name] != 1 {
+					t.Errorf("%s has %d %s properties", prop.Value, counts[name], name)
+				}
+			}
+			if counts["URL"] > 1 {
+				t.Errorf("%s has more than one URL", prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+			properties = properties[:len(properties)-1]
+		default:
+			if len(properties) == 0 {
+				t.Fatalf("%s outside of any component", prop.Name)
+			}
+			properties[len(properties)-1][prop.Name]++
+		}
+	}
+	if len(stack) != 0 || lines[0] != "BEGIN:VCALENDAR" {
+		t.Fatalf("malformed calendar structure %v", stack)
+	}
+	return lines
+}
+
+func TestCalendar(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+
+	aliceList, err := defaultListId(db, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleListPost(logger, db), alice, "POST", "/api/lists",
+		`{"name": "Secret", "visibility": "private"}`, &secret); code != http.StatusOK {
+		t.Fatalf("failed to create list: %d", code)
+	}
+
+	soon := time.Now().AddDate(0, 0, 10).Format(eventDateFormat)
+	addEvent := func(userId uint64, body string) {
+		t.Helper()
+		if code := doJson(t, handleEventPost(logger, db), userId, "POST", "/api/events", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to create event %s: %d", body, code)
+		}
+	}
+	longName := "Alice's birthday, with cake; and a name long enough to need folding — twice over, ünicode and all"
+	addEvent(alice, fmt.Sprintf(`{"name": %q, "date": %q, "list_ids": [%d]}`, longName, soon, aliceList))
+	addEvent(carol, fmt.Sprintf(`{"name": "Surprise party", "date": %q, "list_ids": [%d]}`, soon, aliceList))
+	addEvent(alice, fmt.Sprintf(`{"name": "Secret", "date": %q, "list_ids": [%d]}`, soon, secret.Id))
+	addEvent(alice, `{"name": "Last year", "date": "2000-01-01"}`)
+
+	var token struct {
+		CalendarToken string `json:"calendar_token"`
+	}
+	if code := doJson(t, handleCalendarTokenPost(logger, db), bob, "POST", "/api/calendar/token", "", &token); code != http.StatusOK {
+		t.Fatalf("failed to create calendar token: %d", code)
+	}
+	get := func() *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/public/calendars/"+token.CalendarToken+".ics", nil)
+		req.SetPathValue("token", token.CalendarToken+".ics")
+		rr := httptest.NewRecorder()
+		handleCalendarGet(logger, db)(rr, req)
+		return rr
+	}
+
+	// bob only gets alice's birthday, the others are a surprise, private or over
+	rr := get()
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Fatalf("failed to get calendar: %d %s", rr.Code, rr.Body.String())
+	}
+	lines := checkIcs(t, rr.Body.String())
+	var summaries, urls []string
+	for _, line := range lines {
+		prop, _ := parseIcsLine(line)
+		switch prop.Name {
+		case "SUMMARY":
+			summaries = append(summaries, icsUnescape(prop.Value))
+		case "URL":
+			urls = append(urls, prop.Value)
+		case "DTSTART":
+			if prop.Params["VALUE"] != "DATE" || prop.Value != strings.ReplaceAll(soon, "-", "") {
+				t.Errorf("unexpected DTSTART %q", line)
+			}
+		}
+	}
+	if len(summaries) != 1 || summaries[0] != longName {
+		t.Errorf("unexpected events %q", summaries)
+	}
+	if len(urls) != 1 || urls[0] != fmt.Sprintf("http://example.com/wishlist/%d?list=%d", alice, aliceList) {
+		t.Errorf("unexpected urls %q", urls)
+	}
+
+	if code := doJson(t, handleCalendarTokenDelete(logger, db), bob, "DELETE", "/api/calendar/token", "", nil); code != http.StatusOK {
+		t.Fatalf("failed to revoke calendar token: %d", code)
+	}
+	if rr := get(); rr.Code != http.StatusNotFound {
+		t.Errorf("revoked calendar still works: %d", rr.Code)
+	}
+}
+
+func TestEventsImport(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+
+	next := time.Now().AddDate(1, 0, 0).Format(icsDateFormat)
+	calendar := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Example//Calendar//EN",
+		"BEGIN:VTIMEZONE",
+		"TZID:America/Los_Angeles",
+		"END:VTIMEZONE",
+		"BEGIN:VEVENT",
+		"UID:1@example.com",
+		"DTSTART;VALUE=DATE:19900101",
+		"RRULE:FREQ=YEARLY",
+		"SUMMARY:Bob's birthday",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:2@example.com",
+		"DTSTART;TZID=America/Los_Angeles:" + next + "T090000",
+		"SUMMARY:Carol\\, Dan\\; and Eve's",
+		"  anniversary",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:3@example.com",
+		"DTSTART:20000101T000000Z",
+		"SUMMARY:Long over",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n") + "\r\n"
+
+	importIcs := func(contentType string, body string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/events/import", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		handleEventsImport(logger, db)(rr, req, alice)
+		return rr.Code, rr.Body.String()
+	}
+	if code, _ := importIcs("application/json", calendar); code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected unsupported media type, got %d", code)
+	}
+	for _, body := range []string{
+		"not a calendar",
+		"BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:x\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+		"BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:x\r\nDTSTART:tomorrow\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+	} {
+		if code, _ := importIcs("text/calendar", body); code != http.StatusBadRequest {
+			t.Errorf("expected %q to be rejected, got %d", body, code)
+		}
+	}
+	code, body := importIcs("text/calendar; charset=utf-8", calendar)
+	if code != http.StatusOK || !strings.Contains(body, `"skipped":1`) {
+		t.Fatalf("failed to import: %d %s", code, body)
+	}
+
+	rows, err := db.Query("SELECT name, event_date FROM events WHERE owner_id = ? ORDER BY id", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var name, date string
+		if err := rows.Scan(&name, &date); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, name+" "+date)
+	}
+	today := time.Now().Format(eventDateFormat)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "Bob's birthday ") || got[0][len("Bob's birthday "):] < today ||
+		!strings.HasSuffix(got[0], "-01-01") ||
+		got[1] != "Carol, Dan; and Eve's anniversary "+time.Now().AddDate(1, 0, 0).Format(eventDateFormat) {
+		t.Errorf("unexpected events %q", got)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxImageBytes  = 10 << 20
+	maxImagePixels = 25_000_000
+	thumbnailSize  = 320
+)
+
+// Only formats the standard library can decode, since we have to decode
+// them to make thumbnails.
+var imageContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// BlobStore holds uploaded files. Keys are generated by us (see newBlobKey),
+// never taken from users.
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	// Deleting a blob that doesn't exist is not an error.
+	Delete(key string) error
+}
+
+// fsBlobStore keeps each blob in a file named after its key.
+type fsBlobStore struct {
+	dir string
+}
+
+func newFsBlobStore(dir string) (*fsBlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &fsBlobStore{dir: dir}, nil
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	if key == "" || strings.IndexFunc(key, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-'
+	}) != -1 {
+		return "", fmt.Errorf("malformed blob key '%s'", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *fsBlobStore) Put(key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	// write somewhere else first so readers never see half a file
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *fsBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *fsBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func newBlobKey() (string, error) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func imageURL(key sql.NullString) *string {
+	if !key.Valid {
+		return nil
+	}
+	url := "/api/images/" + key.String
+	return &url
+}
+
+// deleteBlobs is best effort, anything left behind is just wasted space.
+func deleteBlobs(logger *log.Logger, blobs BlobStore, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := blobs.Delete(key); err != nil {
+			logger.Printf("error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+// thumbnail scales an image down to fit in a size x size square, averaging
+// the source pixels that land on each destination pixel. Images that already
+// fit are just copied.
+func thumbnail(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	thumbWidth, thumbHeight := width, height
+	if width > size || height > size {
+		if width >= height {
+			thumbWidth, thumbHeight = size, max(1, height*size/width)
+		} else {
+			thumbWidth, thumbHeight = max(1, width*size/height), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0 := bounds.Min.Y + y*height/thumbHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/thumbHeight)
+		for x := 0; x < thumbWidth; x++ {
+			x0 := bounds.Min.X + x*width/thumbWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/thumbWidth)
+
+			// RGBA() is alpha-premultiplied, so a plain average is right
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// readImageUpload pulls the "image" part out of a multipart upload and checks
+// that it's an image we can handle.
+func readImageUpload(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageBytes+64<<10)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.StatusBadRequest, errors.New("missing image part")
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		} else if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if part.FormName() != "image" {
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(part, maxImageBytes+1))
+		if errors.As(err, &maxBytesErr) || len(data) > maxImageBytes {
+			return nil, http.StatusRequestEntityTooLarge,
+				fmt.Errorf("images must be at most %d bytes", maxImageBytes)
+		} else if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		// never trust the client's idea of what it sent
+		contentType := http.DetectContentType(data)
+		if !imageContentTypes[contentType] {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported image type '%s'", contentType)
+		}
+		return data, http.StatusOK, nil
+	}
+}
+
+// Owner-only: upload (or replace) the picture for an item. We keep the
+// original and a thumbnail.
+func handleItemImagePost(logger *log.Logger, db *sql.DB, blobs BlobStore) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ImageResponse struct {
+			ImageURL     *string `json:"image_url"`
+			ThumbnailURL *string `json:"thumbnail_url"`
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		itemId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed item id", http.StatusBadRequest)
+			return
+		}
+
+		data, status, err := readImageUpload(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// check the dimensions before decoding so a tiny file can't make us
+		// allocate an enormous image
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error decoding image: %v", err), http.StatusBadRequest)
+			return
+		}
+		if config.Width*config.Height > maxImagePixels {
+			http.Error(w, fmt.Sprintf("images must be at most %d pixels", maxImagePixels),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error decoding image: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// photos stay jpeg, everything else might have transparency
+		var thumb bytes.Buffer
+		if format == "jpeg" {
+			err = jpeg.Encode(&thumb, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&thumb, thumbnail(img, thumbnailSize))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		var rowUserId uint64
+		var oldImage, oldThumb sql.NullString
+		err = tx.QueryRow("SELECT user_id,image_key,thumb_key FROM wishlist WHERE id = ? AND deleted_time IS NULL",
+			itemId).Scan(&rowUserId, &oldImage, &oldThumb)
+		if err == sql.ErrNoRows {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if rowUserId != userId {
+			http.Error(w, "only the wishlist owner can change item images", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := newBlobKey()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		imageKey := sql.NullString{String: key, Valid: true}
+		thumbKey := sql.NullString{String: key + "-thumb", Valid: true}
+
+		err = blobs.Put(imageKey.String, bytes.NewReader(data))
+		if err == nil {
+			err = blobs.Put(thumbKey.String, &thumb)
+		}
+		if err != nil {
+			deleteBlobs(logger, blobs, imageKey.String, thumbKey.String)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE wishlist SET image_key = ?, thumb_key = ?, sequence_number = sequence_number + 1
+			WHERE id = ?`, imageKey, thumbKey, itemId)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			deleteBlobs(logger, blobs, imageKey.String, thumbKey.String)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleteBlobs(logger, blobs, oldImage.String, oldThumb.String)
+
+		response := ImageResponse{imageURL(imageKey), imageURL(thumbKey)}
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Owner-only: remove the picture from an item.
+func handleItemImageDelete(logger *log.Logger, db *sql.DB, blobs BlobStore) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		itemId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed item id", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		var rowUserId uint64
+		var oldImage, oldThumb sql.NullString
+		err = tx.QueryRow("SELECT user_id,image_key,thumb_key FROM wishlist WHERE id = ? AND deleted_time IS NULL",
+			itemId).Scan(&rowUserId, &oldImage, &oldThumb)
+		if err == sql.ErrNoRows {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if rowUserId != userId {
+			http.Error(w, "only the wishlist owner can change item images", http.StatusUnauthorized)
+			return
+		}
+		if !oldImage.Valid {
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE wishlist SET image_key = NULL, thumb_key = NULL,
+			sequence_number = sequence_number + 1 WHERE id = ?`, itemId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleteBlobs(logger, blobs, oldImage.String, oldThumb.String)
+	}
+}
+
+// Serves images and thumbnails. Keys are never reused, so whatever is at a
+// url stays there and clients can cache it forever.
+func handleImageGet(logger *log.Logger, db *sql.DB, blobs BlobStore) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		key := r.PathValue("key")
+
+		// deleted items' images stay visible to their owner so they can be restored
+		var exists bool
+		err := db.QueryRow(`SELECT COUNT(*) > 0 FROM wishlist WHERE (image_key = ? OR thumb_key = ?)
+			AND (deleted_time IS NULL OR user_id = ?) AND `+listVisibleTo("wishlist.list_id"),
+			key, key, userId, userId).Scan(&exists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+
+		etag := `"` + key + `"`
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		blob, err := blobs.Get(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer blob.Close()
+
+		// we only ever store things that sniffed as images
+		head := make([]byte, 512)
+		n, err := io.ReadFull(blob, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(head[:n]))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		_, err = io.Copy(w, io.MultiReader(bytes.NewReader(head[:n]), blob))
+		if err != nil {
+			logger.Printf("error sending image %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBlobStore(t *testing.T) *fsBlobStore {
+	t.Helper()
+	blobs, err := newFsBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blobs
+}
+
+func TestThumbnail(t *testing.T) {
+	// left half red, right half blue
+	src := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	for y := 0; y < 500; y++ {
+		for x := 0; x < 1000; x++ {
+			if x < 500 {
+				src.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				src.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	thumb := thumbnail(src, 100)
+	if thumb.Bounds().Dx() != 100 || thumb.Bounds().Dy() != 50 {
+		t.Fatalf("unexpected thumbnail size %v", thumb.Bounds())
+	}
+	if c := thumb.RGBAAt(10, 10); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("expected red, got %v", c)
+	}
+	if c := thumb.RGBAAt(90, 40); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("expected blue, got %v", c)
+	}
+
+	small := thumbnail(image.NewRGBA(image.Rect(0, 0, 30, 20)), 100)
+	if small.Bounds().Dx() != 30 || small.Bounds().Dy() != 20 {
+		t.Errorf("small images shouldn't be scaled, got %v", small.Bounds())
+	}
+
+	tall := thumbnail(image.NewRGBA(image.Rect(0, 0, 10, 5000)), 100)
+	if tall.Bounds().Dx() != 1 || tall.Bounds().Dy() != 100 {
+		t.Errorf("unexpected thumbnail size %v", tall.Bounds())
+	}
+}
+
+func TestItemImages(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	blobs := newTestBlobStore(t)
+	owner := createTestUser(t, db, "Owner")
+	buyer := createTestUser(t, db, "Buyer")
+
+	if code := doJson(t, handleWishlistPost(logger, db, newHub()), owner, "POST", "/api/wishlist",
+		`{"description": "strap", "source": "", "cost": ""}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 640, 480))); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(userId uint64, data []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("image", "strap.png")
+		part.Write(data)
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/api/wishlist/1/image", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+		handleItemImagePost(logger, db, blobs)(rr, req, userId)
+		return rr
+	}
+
+	fetch := func(userId uint64, url string, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", url, nil)
+		req.SetPathValue("key", strings.TrimPrefix(url, "/api/images/"))
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		handleImageGet(logger, db, blobs)(rr, req, userId)
+		return rr
+	}
+
+	type imageUrls struct {
+		ImageURL     *string `json:"image_url"`
+		ThumbnailURL *string `json:"thumbnail_url"`
+	}
+
+	if rr := upload(owner, []byte("definitely not a png")); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected non-image to be rejected, got %d", rr.Code)
+	}
+	if rr := upload(owner, append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, maxImageBytes)...)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected oversized image to be rejected, got %d", rr.Code)
+	}
+	if rr := upload(buyer, pngData.Bytes()); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected non-owner upload to be rejected, got %d", rr.Code)
+	}
+
+	rr := upload(owner, pngData.Bytes())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", rr.Code, rr.Body.String())
+	}
+	var first imageUrls
+	if err := json.Unmarshal(rr.Body.Bytes(), &first); err != nil || first.ImageURL == nil || first.ThumbnailURL == nil {
+		t.Fatalf("unexpected upload response %s %v", rr.Body.String(), err)
+	}
+
+	var list struct {
+		Entries []imageUrls `json:"entries"`
+	}
+	doJson(t, handleWishlistGet(logger, db), buyer, "GET", "/api/wishlist?userId=1", "", &list)
+	if len(list.Entries) != 1 || list.Entries[0].ThumbnailURL == nil || *list.Entries[0].ThumbnailURL != *first.ThumbnailURL {
+		t.Fatalf("thumbnail missing from list %+v", list.Entries)
+	}
+
+	rr = fetch(buyer, *first.ThumbnailURL, "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" ||
+		!strings.Contains(rr.Header().Get("Cache-Control"), "immutable") {
+		t.Fatalf("unexpected thumbnail response %d %v", rr.Code, rr.Header())
+	}
+	thumb, err := png.Decode(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Bounds().Dx() != thumbnailSize || thumb.Bounds().Dy() != 240 {
+		t.Errorf("unexpected thumbnail size %v", thumb.Bounds())
+	}
+	if rr := fetch(buyer, *first.ThumbnailURL, rr.Header().Get("ETag")); rr.Code != http.StatusNotModified {
+		t.Errorf("expected not modified, got %d", rr.Code)
+	}
+	if rr := fetch(buyer, "/api/images/nonexistent", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", rr.Code)
+	}
+
+	blobCount := func() int {
+		t.Helper()
+		files, err := os.ReadDir(blobs.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	// replacing an image cleans up the old one
+	rr = upload(owner, pngData.Bytes())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if n := blobCount(); n != 2 {
+		t.Errorf("expected 2 blobs after replacing image, got %d", n)
+	}
+	if rr := fetch(owner, *first.ImageURL, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("old image still served: %d", rr.Code)
+	}
+
+	// deleted items' images stick around until the item is purged
+	if code := doJson(t, handleWishlistDelete(logger, db, newHub()), owner, "DELETE", "/api/wishlist", `{"ids": [1]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to delete: %d", code)
+	}
+	if err := cleanupDb(logger, db, blobs, time.Now(), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(); n != 2 {
+		t.Errorf("blobs removed before the item was purged, %d left", n)
+	}
+	if err := cleanupDb(logger, db, blobs, time.Now().Add(48*time.Hour), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(); n != 0 {
+		files, _ := filepath.Glob(filepath.Join(blobs.dir, "*"))
+		t.Errorf("expected blobs to be deleted with the item, found %v", files)
+	}
+}
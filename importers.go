@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ImportSource is what an importer reads from: an uploaded file, or for the
+// ones that fetch a wishlist from another site, a login there.
+type ImportSource struct {
+	Data []byte
+	// field -> column in the file, for the importers with columns
+	Columns  map[string]string
+	Username string
+	Password string
+}
+
+// An Importer turns a wishlist from somewhere else into rows keyed by the
+// fields in importFields. It only reads, runImport checks the rows and adds
+// them.
+type Importer interface {
+	Import(ctx context.Context, src ImportSource) ([]ImportRow, error)
+}
+
+// newImporters is every importer, by the name the import endpoint and RPC
+// pick them by.
+func newImporters(config *Config) map[string]Importer {
+	vistesURL := config.VistesURL
+	if vistesURL == "" {
+		vistesURL = defaultVistesURL
+	}
+	return map[string]Importer{
+		"csv":       csvImporter{},
+		"json":      jsonImporter{},
+		"amazon":    amazonImporter{},
+		"microdata": microdataImporter{},
+		"vistes":    vistesImporter{BaseURL: vistesURL},
+	}
+}
+
+func htmlAttr(node *html.Node, key string) (string, bool) {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// htmlText is the text in a node with whitespace collapsed, like a browser
+// shows it.
+func htmlText(node *html.Node) string {
+	var b strings.Builder
+	for n := range node.Descendants() {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteString(" ")
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// amazonImporter reads a wishlist page saved from amazon.com. Each item's
+// parts have ids ending in the item's id, e.g. itemName_I2X3Y4Z.
+type amazonImporter struct{}
+
+var amazonBaseURL = &url.URL{Scheme: "https", Host: "www.amazon.com"}
+
+// amazon's priorities, highest first, as ours
+var amazonPriorities = map[string]string{
+	"highest": "1",
+	"high":    "2",
+	"medium":  "3",
+	"low":     "4",
+	"lowest":  "5",
+}
+
+func (amazonImporter) Import(ctx context.Context, src ImportSource) ([]ImportRow, error) {
+	doc, err := html.Parse(bytes.NewReader(src.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	items := make(map[string]ImportRow)
+	for node := range doc.Descendants() {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		id, _ := htmlAttr(node, "id")
+		prefix, itemId, ok := strings.Cut(id, "_")
+		if !ok || itemId == "" {
+			continue
+		}
+		if prefix == "itemName" {
+			if _, ok := items[itemId]; !ok {
+				ids = append(ids, itemId)
+				items[itemId] = make(ImportRow)
+			}
+		}
+		row, ok := items[itemId]
+		if !ok {
+			continue
+		}
+
+		switch prefix {
+		case "itemName":
+			title, _ := htmlAttr(node, "title")
+			row["description"] = firstNonEmpty(strings.TrimSpace(title), htmlText(node))
+			if href, ok := htmlAttr(node, "href"); ok {
+				// the query is just where on the list it was clicked from
+				if source := resolveURL(amazonBaseURL, href); source != "" {
+					u, _ := url.Parse(source)
+					u.RawQuery = ""
+					row["source"] = u.String()
+				}
+			}
+		case "itemPrice":
+			// the price is there twice, split up for show and whole for screen readers
+			price := htmlText(node)
+			for n := range node.Descendants() {
+				if class, _ := htmlAttr(n, "class"); strings.Contains(class, "a-offscreen") {
+					price = htmlText(n)
+					break
+				}
+			}
+			row["cost"] = price
+		case "itemComment":
+			row["owner_notes"] = htmlText(node)
+		case "itemRequested":
+			row["quantity_desired"] = htmlText(node)
+		case "itemPriority":
+			row["priority"] = amazonPriorities[strings.ToLower(htmlText(node))]
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("no wishlist items found, is this a saved amazon wishlist page?")
+	}
+	rows := make([]ImportRow, len(ids))
+	for i, id := range ids {
+		rows[i] = items[id]
+	}
+	return rows, nil
+}
+
+// microdataImporter reads the schema.org Products marked up with microdata
+// in any page, e.g. a product page or a wishlist on a site that has them.
+type microdataImporter struct{}
+
+// microdataItem is an element with itemscope and the properties in it, some
+// of which may be items themselves.
+type microdataItem struct {
+	Types []string
+	Props map[string][]microdataValue
+}
+
+type microdataValue struct {
+	Text string
+	Item *microdataItem
+}
+
+func (item *microdataItem) isType(want string) bool {
+	for _, t := range item.Types {
+		if t == "http://schema.org/"+want || t == "https://schema.org/"+want {
+			return true
+		}
+	}
+	return false
+}
+
+// text is the first value of a property that isn't an item.
+func (item *microdataItem) text(prop string) string {
+	for _, value := range item.Props[prop] {
+		if value.Item == nil && value.Text != "" {
+			return value.Text
+		}
+	}
+	return ""
+}
+
+func parseMicrodataItem(node *html.Node, base *url.URL) *microdataItem {
+	itemtype, _ := htmlAttr(node, "itemtype")
+	item := &microdataItem{Types: strings.Fields(itemtype), Props: make(map[string][]microdataValue)}
+	var walk func(*html.Node)
+	walk = func(parent *html.Node) {
+		for child := range parent.ChildNodes() {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			_, scope := htmlAttr(child, "itemscope")
+			props, _ := htmlAttr(child, "itemprop")
+			if props != "" {
+				var value microdataValue
+				if scope {
+					value.Item = parseMicrodataItem(child, base)
+				} else {
+					value.Text = microdataText(child, base)
+				}
+				for _, prop := range strings.Fields(props) {
+					item.Props[prop] = append(item.Props[prop], value)
+				}
+			}
+			// a nested item's properties are its own
+			if !scope {
+				walk(child)
+			}
+		}
+	}
+	walk(node)
+	return item
+}
+
+// microdataText is a property's value, which depends on the element it's on.
+func microdataText(node *html.Node, base *url.URL) string {
+	attr := ""
+	switch node.DataAtom {
+	case atom.Meta:
+		attr = "content"
+	case atom.Audio, atom.Embed, atom.Iframe, atom.Img, atom.Source, atom.Track, atom.Video:
+		value, _ := htmlAttr(node, "src")
+		return resolveURL(base, value)
+	case atom.A, atom.Area, atom.Link:
+		value, _ := htmlAttr(node, "href")
+		return resolveURL(base, value)
+	case atom.Object:
+		value, _ := htmlAttr(node, "data")
+		return resolveURL(base, value)
+	case atom.Data, atom.Meter:
+		attr = "value"
+	case atom.Time:
+		if value, ok := htmlAttr(node, "datetime"); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	if attr != "" {
+		value, _ := htmlAttr(node, attr)
+		return strings.TrimSpace(value)
+	}
+	return htmlText(node)
+}
+
+func (microdataImporter) Import(ctx context.Context, src ImportSource) ([]ImportRow, error) {
+	doc, err := html.Parse(bytes.NewReader(src.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	// a saved page only has absolute links if it says where it's from
+	base := &url.URL{}
+	for node := range doc.Descendants() {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Base {
+			if href, ok := htmlAttr(node, "href"); ok {
+				if u, err := url.Parse(href); err == nil {
+					base = u
+				}
+			}
+			break
+		}
+	}
+
+	var rows []ImportRow
+	for node := range doc.Descendants() {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		if _, scope := htmlAttr(node, "itemscope"); !scope {
+			continue
+		}
+		// an item that's a property of another, e.g. a related product, isn't
+		// one of the page's own
+		if _, prop := htmlAttr(node, "itemprop"); prop {
+			continue
+		}
+		product := parseMicrodataItem(node, base)
+		if !product.isType("Product") {
+			continue
+		}
+
+		row := ImportRow{
+			"description": product.text("name"),
+			"source":      product.text("url"),
+		}
+		// offers can be an Offer, an AggregateOffer or a list of either
+		for _, offer := range product.Props["offers"] {
+			if offer.Item == nil {
+				continue
+			}
+			price := firstNonEmpty(offer.Item.text("price"), offer.Item.text("lowPrice"))
+			if price != "" {
+				row["cost"] = strings.TrimSpace(strings.ToUpper(offer.Item.text("priceCurrency")) + " " + price)
+				break
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("no schema.org products found in the page")
+	}
+	return rows, nil
+}
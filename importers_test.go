@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/ericm1024/wishlist/admin_rpc"
+)
+
+const amazonWishlistPage = `<html><body><ul id="g-items">
+<li data-itemid="I1ABC" class="g-item-sortable">
+  <a id="itemName_I1ABC" title="Sporti Bungee Strap" href="/dp/B00TEST/?coliid=I1ABC&amp;ref_=wl_it_dp">Sporti Bungee...</a>
+  <span id="itemPrice_I1ABC" class="a-price"><span class="a-offscreen">$2.95</span><span aria-hidden="true">$2<sup>95</sup></span></span>
+  <span id="itemComment_I1ABC">one black, one red</span>
+  <span id="itemRequested_I1ABC">2</span>
+  <span id="itemPriority_I1ABC">High</span>
+</li>
+<li data-itemid="I2DEF" class="g-item-sortable">
+  <a id="itemName_I2DEF" href="/dp/B00OTHER">  Swim   cap </a>
+  <span id="itemPriority_I2DEF">medium</span>
+</li>
+</ul></body></html>`
+
+const microdataPage = `<html><head><base href="https://shop.example.com/goggles/"></head><body>
+<div itemscope itemtype="https://schema.org/Product">
+  <h1 itemprop="name">Racing goggles</h1>
+  <a itemprop="url" href="racing">details</a>
+  <div itemprop="brand" itemscope itemtype="https://schema.org/Brand"><span itemprop="name">Speedy</span></div>
+  <div itemprop="offers" itemscope itemtype="https://schema.org/Offer">
+    <meta itemprop="priceCurrency" content="eur"><span itemprop="price">12,50</span>
+  </div>
+  <div itemprop="isRelatedTo" itemscope itemtype="https://schema.org/Product"><span itemprop="name">Anti-fog spray</span></div>
+</div>
+<div itemscope itemtype="https://schema.org/Person"><span itemprop="name">Not a product</span></div>
+</body></html>`
+
+func TestAmazonImporter(t *testing.T) {
+	rows, err := amazonImporter{}.Import(context.Background(), ImportSource{Data: []byte(amazonWishlistPage)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %+v", rows)
+	}
+	strap := rows[0]
+	if strap["description"] != "Sporti Bungee Strap" || strap["source"] != "https://www.amazon.com/dp/B00TEST/" ||
+		strap["cost"] != "$2.95" || strap["owner_notes"] != "one black, one red" ||
+		strap["quantity_desired"] != "2" || strap["priority"] != "2" {
+		t.Errorf("unexpected row %+v", strap)
+	}
+	if rows[1]["description"] != "Swim cap" || rows[1]["priority"] != "3" {
+		t.Errorf("unexpected row %+v", rows[1])
+	}
+
+	if _, err := (amazonImporter{}).Import(context.Background(), ImportSource{Data: []byte(microdataPage)}); err == nil {
+		t.Errorf("expected a page without a wishlist to be rejected")
+	}
+}
+
+func TestMicrodataImporter(t *testing.T) {
+	rows, err := microdataImporter{}.Import(context.Background(), ImportSource{Data: []byte(microdataPage)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the brand's name is the brand's, not the product's, and the related product is only
+	// a property of this one
+	if len(rows) != 1 || rows[0]["description"] != "Racing goggles" ||
+		rows[0]["source"] != "https://shop.example.com/goggles/racing" || rows[0]["cost"] != "EUR 12,50" {
+		t.Fatalf("unexpected rows %+v", rows)
+	}
+
+	item, errs := validateImportRecord(1, rows[0])
+	if len(errs) != 0 || item.PriceAmount == nil || *item.PriceAmount != 1250 || *item.PriceCurrency != "EUR" {
+		t.Errorf("unexpected item %+v %+v", item, errs)
+	}
+}
+
+func TestImportRpc(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+
+	server := newVistesServer(t, vistesPage)
+	defer server.Close()
+
+	admin := &adminGrpcServer{Logger: logger, Db: db, Importers: newImporters(&Config{VistesURL: server.URL})}
+	ctx := context.Background()
+
+	for _, in := range []*admin_rpc.GenericImportRequest{
+		{Importer: "myspace", UserId: alice},
+		{Importer: "vistes", UserId: alice},
+		{Importer: "vistes", UserId: alice, Username: "alice", Password: "wrong"},
+		{Importer: "amazon", UserId: alice, Data: []byte(amazonWishlistPage), ListId: 999},
+		{Importer: "csv", UserId: alice, Data: []byte("description,quantity_desired\nkite,0\n")},
+	} {
+		if _, err := admin.Import(ctx, in); err == nil {
+			t.Errorf("expected %+v to fail", in)
+		}
+	}
+	if count := countItems(t, db, alice); count != 0 {
+		t.Fatalf("failed imports added %d items", count)
+	}
+
+	reply, err := admin.Import(ctx, &admin_rpc.GenericImportRequest{Importer: "amazon", UserId: alice,
+		Data: []byte(amazonWishlistPage)})
+	if err != nil || len(reply.Ids) != 2 {
+		t.Fatalf("failed to import from amazon: %v %+v", err, reply)
+	}
+
+	if _, err := admin.VistesImport(ctx, &admin_rpc.ImportRequest{Username: "alice", Password: "hunter2", UserId: alice}); err != nil {
+		t.Fatalf("failed to import from vistes: %v", err)
+	}
+	var description, tag string
+	var created time.Time
+	err = db.QueryRow(`SELECT wishlist.description, wishlist.creation_time, tags.name FROM wishlist
+		JOIN wishlist_tags ON wishlist_tags.item_id = wishlist.id JOIN tags ON tags.id = wishlist_tags.tag_id
+		WHERE wishlist.user_id = ? AND wishlist.source LIKE '%swimoutlet%'`, alice).Scan(&description, &created, &tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description != "Sporti Bungee Strap" || !created.Equal(time.Date(2025, 9, 23, 21, 42, 41, 0, time.UTC)) || tag != "swim" {
+		t.Errorf("unexpected vistes item %q %q %q", description, created, tag)
+	}
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxImportBytes = 5 << 20
+	maxImportRows  = 1000
+	// matches the CHECK(length(...) < 2000) on the text columns
+	maxItemTextLength = 2000
+	// tags share a CSV column
+	csvTagSeparator = ";"
+)
+
+// The columns export writes and import reads, so an export can be imported
+// as is. Import ignores the ones it doesn't know.
+var exportColumns = []string{"id", "list", "description", "source", "cost", "price_amount", "price_currency",
+	"owner_notes", "quantity_desired", "quantity_received", "priority", "tags", "archived", "creation_time"}
+
+var importFields = []string{"description", "source", "cost", "price_amount", "price_currency", "owner_notes",
+	"quantity_desired", "priority", "tags", "creation_time"}
+
+// importItem is a validated item to be created.
+type importItem struct {
+	Row             int      `json:"row"`
+	Description     string   `json:"description"`
+	Source          string   `json:"source"`
+	Cost            string   `json:"cost"`
+	PriceAmount     *int64   `json:"price_amount"`
+	PriceCurrency   *string  `json:"price_currency"`
+	OwnerNotes      string   `json:"owner_notes"`
+	QuantityDesired uint64   `json:"quantity_desired"`
+	Priority        *uint64  `json:"priority"`
+	Tags            []string `json:"tags"`
+	// when it was first wished for, if the import knows
+	CreationTime *time.Time `json:"creation_time"`
+	// the item's id on the site it's from, if it has one
+	ExternalId string `json:"external_id,omitempty"`
+	// the row was imported before, and isn't added again
+	AlreadyImported bool `json:"already_imported,omitempty"`
+}
+
+// importError is a problem with one field of one row. Rows count from 1,
+// not counting a CSV header.
+type importError struct {
+	Row   int    `json:"row"`
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// ImportRow is one item as an importer found it, keyed by field name (see
+// importFields). Values are strings, or whatever JSON had for them.
+type ImportRow map[string]interface{}
+
+// importColumn maps a field to the column it's in, given the upload's
+// columns (field -> column in the file). Fields left out of columns are read
+// from the column with the same name.
+func importColumn(columns map[string]string, field string) string {
+	if name, ok := columns[field]; ok {
+		return name
+	}
+	return field
+}
+
+func checkImportColumns(columns map[string]string) error {
+	for field := range columns {
+		if !slices.Contains(importFields, field) {
+			return fmt.Errorf("unknown field %q in columns", field)
+		}
+	}
+	return nil
+}
+
+// csvImporter reads a CSV file with a header row, like export writes.
+type csvImporter struct{}
+
+func (csvImporter) Import(ctx context.Context, src ImportSource) ([]ImportRow, error) {
+	err := checkImportColumns(src.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(src.Data))
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty CSV file")
+	} else if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	for field, name := range src.Columns {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("column %q for %s isn't in the file", name, field)
+		}
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		row := make(ImportRow)
+		for _, field := range importFields {
+			if i, ok := index[importColumn(src.Columns, field)]; ok && i < len(record) {
+				row[field] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// jsonImporter reads a JSON array of objects, like export writes.
+type jsonImporter struct{}
+
+func (jsonImporter) Import(ctx context.Context, src ImportSource) ([]ImportRow, error) {
+	err := checkImportColumns(src.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(src.Data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, errors.New("data must be a JSON array of objects")
+	}
+
+	var rows []ImportRow
+	for _, object := range objects {
+		row := make(ImportRow)
+		for _, field := range importFields {
+			if value, ok := object[importColumn(src.Columns, field)]; ok && value != nil {
+				row[field] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (r ImportRow) text(field string) (string, error) {
+	switch value := r[field].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", errors.New("must be a string")
+}
+
+// integer returns nil for a missing or blank value.
+func (r ImportRow) integer(field string) (*int64, error) {
+	str, err := r.text(field)
+	if err != nil {
+		return nil, errors.New("must be a whole number")
+	}
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return nil, errors.New("must be a whole number")
+	}
+	return &value, nil
+}
+
+func (r ImportRow) tags() ([]string, error) {
+	switch value := r["tags"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return normalizeTags(strings.Split(value, csvTagSeparator))
+	case []interface{}:
+		tags := make([]string, len(value))
+		for i, tag := range value {
+			str, ok := tag.(string)
+			if !ok {
+				return nil, errors.New("must be a list of strings")
+			}
+			tags[i] = str
+		}
+		return normalizeTags(tags)
+	}
+	return nil, errors.New("must be a list of strings")
+}
+
+// validateImportRecord checks a record against the same rules as adding an
+// item by hand, and the database's length limits. It returns every problem
+// with the row, not just the first.
+func validateImportRecord(row int, record ImportRow) (importItem, []importError) {
+	item := importItem{Row: row, QuantityDesired: 1, Tags: []string{}}
+	var errs []importError
+	fail := func(field string, err error) {
+		errs = append(errs, importError{Row: row, Field: field, Error: err.Error()})
+	}
+
+	for _, text := range []struct {
+		field string
+		dst   *string
+	}{
+		{"description", &item.Description},
+		{"source", &item.Source},
+		{"cost", &item.Cost},
+		{"owner_notes", &item.OwnerNotes},
+	} {
+		value, err := record.text(text.field)
+		if err != nil {
+			fail(text.field, err)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if utf8.RuneCountInString(value) >= maxItemTextLength {
+			fail(text.field, fmt.Errorf("must be shorter than %d characters", maxItemTextLength))
+		}
+		*text.dst = value
+	}
+	if item.Description == "" {
+		fail("description", errors.New("must not be empty"))
+	}
+
+	amount, err := record.integer("price_amount")
+	if err != nil {
+		fail("price_amount", err)
+	}
+	currency, err := record.text("price_currency")
+	if err != nil {
+		fail("price_currency", err)
+	} else if currency = strings.TrimSpace(currency); currency != "" {
+		item.PriceCurrency = &currency
+	}
+	if amount != nil {
+		item.PriceAmount = amount
+	}
+	if priceAmount, priceCurrency, err := priceFromRequest(item.Cost, item.PriceAmount, item.PriceCurrency); err != nil {
+		fail("price_amount", err)
+	} else {
+		item.PriceAmount, item.PriceCurrency = nil, nil
+		if priceAmount.Valid {
+			item.PriceAmount = &priceAmount.Int64
+			item.PriceCurrency = &priceCurrency.String
+		}
+	}
+
+	quantity, err := record.integer("quantity_desired")
+	if err != nil {
+		fail("quantity_desired", err)
+	} else if quantity != nil {
+		if *quantity < 1 {
+			fail("quantity_desired", errors.New("must be at least 1"))
+		} else {
+			item.QuantityDesired = uint64(*quantity)
+		}
+	}
+
+	priority, err := record.integer("priority")
+	if err != nil {
+		fail("priority", err)
+	} else if priority != nil && *priority < 0 {
+		fail("priority", errors.New("must not be negative"))
+	} else if priority != nil && *priority != 0 {
+		// 0 is the same as leaving it out
+		p := uint64(*priority)
+		item.Priority = &p
+	}
+
+	tags, err := record.tags()
+	if err != nil {
+		fail("tags", err)
+	} else if tags != nil {
+		item.Tags = tags
+	}
+
+	created, err := record.text("creation_time")
+	if err != nil {
+		fail("creation_time", err)
+	} else if created = strings.TrimSpace(created); created != "" {
+		t, err := time.Parse(time.RFC3339, created)
+		if err != nil {
+			t, err = time.ParseInLocation(sqliteTimeFormat, created, time.UTC)
+		}
+		if err != nil {
+			fail("creation_time", errors.New("must be a time like 2006-01-02T15:04:05Z"))
+		} else {
+			item.CreationTime = &t
+		}
+	}
+
+	// only importers set this, it's not a column anyone uploads
+	if id, ok := record["external_id"].(string); ok {
+		item.ExternalId = id
+	}
+
+	return item, errs
+}
+
+// markImportedItems flags the items the user already has from an earlier
+// import with the same importer, or from earlier in this one.
+//
+// Items imported before import_keys existed (the old VistesImport) have no
+// key, so an item without one is matched on its description and creation
+// time instead, and given the key so it's found the usual way next time.
+func markImportedItems(tx dbtx, userId uint64, importer string, items []importItem) error {
+	seen := make(map[string]bool)
+	for i := range items {
+		id := items[i].ExternalId
+		if id == "" {
+			continue
+		}
+		if seen[id] {
+			items[i].AlreadyImported = true
+			continue
+		}
+		seen[id] = true
+
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM import_keys WHERE user_id = ? AND importer = ?
+			AND external_id = ?)`, userId, importer, id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists || items[i].CreationTime == nil {
+			items[i].AlreadyImported = exists
+			continue
+		}
+
+		var itemId uint64
+		err = tx.QueryRow(`SELECT id FROM wishlist WHERE user_id = ?
+			AND TRIM(description, ' ' || char(9, 10, 13)) = ? AND datetime(creation_time) = datetime(?)
+			AND id NOT IN (SELECT item_id FROM import_keys WHERE user_id = ?)
+			ORDER BY id LIMIT 1`, userId, items[i].Description,
+			items[i].CreationTime.UTC().Format(sqliteTimeFormat), userId).Scan(&itemId)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO import_keys(user_id, importer, external_id, item_id) VALUES(?, ?, ?, ?)",
+			userId, importer, id, itemId)
+		if err != nil {
+			return err
+		}
+		items[i].AlreadyImported = true
+	}
+	return nil
+}
+
+// insertImportedItems adds items to one of a user's lists, with history,
+// activity and notifications like any other new item, skipping ones already imported. action
+// names where they came from in the history.
+func insertImportedItems(tx dbtx, userId uint64, listId uint64, importer string, action string, items []importItem) ([]uint64, error) {
+	var ids []uint64
+	for _, item := range items {
+		if item.AlreadyImported {
+			continue
+		}
+		creationTime := time.Now()
+		if item.CreationTime != nil {
+			creationTime = *item.CreationTime
+		}
+		result, err := tx.Exec(`INSERT INTO wishlist(creation_time, user_id, list_id, description, source, cost,
+			price_amount, price_currency, owner_notes, quantity_desired, priority)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, creationTime.UTC().Format(sqliteTimeFormat), userId, listId,
+			item.Description, item.Source, item.Cost, item.PriceAmount, item.PriceCurrency, item.OwnerNotes,
+			item.QuantityDesired, item.Priority)
+		if err != nil {
+			return nil, err
+		}
+		lastId, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		itemId := uint64(lastId)
+
+		if item.ExternalId != "" {
+			_, err = tx.Exec("INSERT INTO import_keys(user_id, importer, external_id, item_id) VALUES(?, ?, ?, ?)",
+				userId, importer, item.ExternalId, itemId)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = setItemTags(tx, userId, itemId, item.Tags)
+		if err != nil {
+			return nil, err
+		}
+
+		after, err := loadItemSnapshot(tx, itemId)
+		if err != nil {
+			return nil, err
+		}
+		err = recordItemChange(tx, userId, action, nil, after)
+		if err != nil {
+			return nil, err
+		}
+		err = recordItemActivity(tx, activityItemAdded, itemId)
+		if err != nil {
+			return nil, err
+		}
+		err = notifyFollowers(tx, userId, itemId)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, itemId)
+	}
+	return ids, nil
+}
+
+var (
+	errNoSuchList        = errors.New("non-existent list")
+	errTooManyImportRows = fmt.Errorf("at most %d rows can be imported at once", maxImportRows)
+)
+
+// importListId is the list named in an import, or the user's default list if
+// there isn't one.
+func importListId(tx dbtx, userId uint64, listId *uint64) (uint64, error) {
+	if listId == nil {
+		return defaultListId(tx, userId)
+	}
+	owned, err := ownsList(tx, userId, *listId)
+	if err != nil {
+		return 0, err
+	}
+	if !owned {
+		return 0, errNoSuchList
+	}
+	return *listId, nil
+}
+
+// importResult is what an import found in the rows it was given, and what it
+// added if they were all good.
+type importResult struct {
+	DryRun bool          `json:"dry_run"`
+	Items  []importItem  `json:"items"`
+	Errors []importError `json:"errors"`
+	Ids    []uint64      `json:"ids"`
+	// how many of the items were (or for a dry run, would be) added, and how
+	// many were skipped as already imported
+	Added   int `json:"added"`
+	Skipped int `json:"skipped"`
+}
+
+// runImport checks every row before anything is added, and then adds them all
+// to the list or none of them. A dry run goes through the motions without
+// committing, so it fails where the real thing would. Nothing is added if
+// the result has errors. Rows the importer gives an id are only ever added
+// once, so importing from the same place again picks up just what's new.
+func runImport(db *sql.DB, userId uint64, listId *uint64, importer string, rows []ImportRow, dryRun bool) (*importResult, error) {
+	if len(rows) > maxImportRows {
+		return nil, errTooManyImportRows
+	}
+
+	result := &importResult{DryRun: dryRun, Items: []importItem{}, Errors: []importError{}, Ids: []uint64{}}
+	for i, row := range rows {
+		item, errs := validateImportRecord(i+1, row)
+		result.Items = append(result.Items, item)
+		result.Errors = append(result.Errors, errs...)
+	}
+	if len(result.Errors) != 0 {
+		return result, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
+
+	id, err := importListId(tx, userId, listId)
+	if err != nil {
+		return nil, err
+	}
+	err = markImportedItems(tx, userId, importer, result.Items)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := insertImportedItems(tx, userId, id, importer, "import", result.Items)
+	if err != nil {
+		return nil, err
+	}
+	result.Added = len(ids)
+	result.Skipped = len(result.Items) - len(ids)
+	if dryRun {
+		return result, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	result.Ids = ids
+	return result, nil
+}
+
+// Add items in bulk from an upload, e.g. an export from here, a spreadsheet
+// or a saved wishlist page from another site, read by the importer it names.
+// Every row is checked before anything is added, and then it's all added or
+// none of it is. A dry run shows what would be added.
+func handleWishlistImport(logger *log.Logger, db *sql.DB, hub *Hub, importers map[string]Importer) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ImportRequest struct {
+			// one of the importers, e.g. csv, json, amazon or microdata
+			Importer string `json:"importer"`
+			// same as importer, from before there were others
+			Format string `json:"format"`
+			// the file's contents, e.g. CSV with a header row or a saved web page
+			Data    string            `json:"data"`
+			Columns map[string]string `json:"columns"`
+			ListId  *uint64           `json:"list_id"`
+			DryRun  bool              `json:"dry_run"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req ImportRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		name := req.Importer
+		if name == "" {
+			name = req.Format
+		}
+		importer, ok := importers[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown importer %q", name), http.StatusBadRequest)
+			return
+		}
+
+		rows, err := importer.Import(r.Context(), ImportSource{Data: []byte(req.Data), Columns: req.Columns})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(rows) > maxImportRows {
+			http.Error(w, errTooManyImportRows.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := runImport(db, userId, req.ListId, name, rows, req.DryRun)
+		if errors.Is(err, errNoSuchList) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(result.Ids) != 0 {
+			publishItems(logger, db, hub, "create", false, result.Ids...)
+		}
+
+		status := http.StatusOK
+		if len(result.Errors) != 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(result); err != nil {
+			logger.Printf("error writing import response: %v", err)
+		}
+	}
+}
+
+// Download the current user's items, archived ones included, as CSV or JSON
+// that import can read back in. Only the owner's side of each item is in
+// it, nothing about who's buying what.
+func handleWishlistExport(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "csv" && format != "json" {
+			http.Error(w, "format must be csv or json", http.StatusBadRequest)
+			return
+		}
+
+		cond := "wishlist.user_id = ? AND wishlist.deleted_time IS NULL"
+		args := []interface{}{userId}
+		if str := r.URL.Query().Get("list_id"); str != "" {
+			listId, err := strconv.ParseUint(str, 10, 64)
+			if err != nil {
+				http.Error(w, "malformed list id", http.StatusBadRequest)
+				return
+			}
+			owned, err := ownsList(db, userId, listId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !owned {
+				http.Error(w, "non-existent list", http.StatusNotFound)
+				return
+			}
+			cond += " AND wishlist.list_id = ?"
+			args = append(args, listId)
+		}
+
+		itemTags, err := loadItemTags(db, cond, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`SELECT wishlist.id, lists.name, wishlist.description, wishlist.source,
+			wishlist.cost, wishlist.price_amount, wishlist.price_currency, COALESCE(wishlist.owner_notes, ''),
+			wishlist.quantity_desired, wishlist.quantity_received, wishlist.priority,
+			wishlist.archived_time IS NOT NULL, wishlist.creation_time
+			FROM wishlist JOIN lists ON lists.id = wishlist.list_id
+			WHERE `+cond+` ORDER BY wishlist.id`, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var records []map[string]interface{}
+		for rows.Next() {
+			var id, quantityDesired, quantityReceived uint64
+			var list, description, source, cost, ownerNotes string
+			var priceAmount, priority sql.NullInt64
+			var priceCurrency sql.NullString
+			var archived bool
+			var creationTime time.Time
+			err = rows.Scan(&id, &list, &description, &source, &cost, &priceAmount, &priceCurrency, &ownerNotes,
+				&quantityDesired, &quantityReceived, &priority, &archived, &creationTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tags := itemTags[id]
+			if tags == nil {
+				tags = []string{}
+			}
+			record := map[string]interface{}{"id": id, "list": list, "description": description,
+				"source": source, "cost": cost, "price_amount": nil, "price_currency": nil,
+				"owner_notes": ownerNotes, "quantity_desired": quantityDesired,
+				"quantity_received": quantityReceived, "priority": nil, "tags": tags, "archived": archived,
+				"creation_time": creationTime.UTC().Format(time.RFC3339)}
+			if priceAmount.Valid {
+				record["price_amount"] = priceAmount.Int64
+				record["price_currency"] = priceCurrency.String
+			}
+			if priority.Valid {
+				record["priority"] = priority.Int64
+			}
+			records = append(records, record)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="wishlist.%s"`, format))
+		if format == "json" {
+			if records == nil {
+				records = []map[string]interface{}{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			encoder := json.NewEncoder(w)
+			if err := encoder.Encode(records); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer := csv.NewWriter(w)
+		writer.Write(exportColumns)
+		for _, record := range records {
+			row := make([]string, len(exportColumns))
+			for i, column := range exportColumns {
+				switch value := record[column].(type) {
+				case nil:
+				case []string:
+					row[i] = strings.Join(value, csvTagSeparator)
+				default:
+					row[i] = fmt.Sprint(value)
+				}
+			}
+			writer.Write(row)
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			logger.Printf("error writing export: %v", err)
+		}
+	}
+}
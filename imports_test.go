@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testImportResponse struct {
+	DryRun bool          `json:"dry_run"`
+	Items  []importItem  `json:"items"`
+	Errors []importError `json:"errors"`
+	Ids    []uint64      `json:"ids"`
+}
+
+func doImport(t *testing.T, db *sql.DB, userId uint64, body string) (int, testImportResponse) {
+	t.Helper()
+	var response testImportResponse
+	req := httptest.NewRequest("POST", "/api/wishlist/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handleWishlistImport(log.Default(), db, newHub(), newImporters(&Config{}))(rr, req, userId)
+	if rr.Code == http.StatusOK || rr.Code == http.StatusUnprocessableEntity {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode response %q: %v", rr.Body.String(), err)
+		}
+	}
+	return rr.Code, response
+}
+
+func doExport(t *testing.T, db *sql.DB, userId uint64, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/wishlist/export?"+query, nil)
+	rr := httptest.NewRecorder()
+	handleWishlistExport(log.Default(), db)(rr, req, userId)
+	return rr
+}
+
+func importBody(format string, data string, extra string) string {
+	body, _ := json.Marshal(data)
+	return fmt.Sprintf(`{"format": %q, "data": %s%s}`, format, body, extra)
+}
+
+func countItems(t *testing.T, db *sql.DB, userId uint64) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM wishlist WHERE user_id = ?", userId).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestWishlistImport(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	if _, err := db.Exec("INSERT INTO follows(follower_id, followee_id) VALUES(?, ?)", bob, alice); err != nil {
+		t.Fatal(err)
+	}
+	notified := func() int {
+		t.Helper()
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM notification_outbox WHERE user_id = ? AND kind = 'followed_item'",
+			bob).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	csvData := "Item,Link,Price,How many,Labels\r\n" +
+		"kite,https://example.com/kite,$12.50,2,toys; outside\r\n" +
+		"\"string, lots\",,,,\r\n"
+	columns := `, "columns": {"description": "Item", "source": "Link", "cost": "Price", "quantity_desired": "How many", "tags": "Labels"}`
+
+	for _, body := range []string{
+		importBody("xml", csvData, columns),
+		importBody("csv", csvData, `, "columns": {"color": "Item"}`),
+		importBody("csv", csvData, `, "columns": {"description": "Name"}`),
+		importBody("json", "{}", ""),
+	} {
+		if code, _ := doImport(t, db, alice, body); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	// a dry run shows what would happen without doing it
+	code, preview := doImport(t, db, alice, importBody("csv", csvData, columns+`, "dry_run": true`))
+	if code != http.StatusOK || !preview.DryRun || len(preview.Items) != 2 || len(preview.Ids) != 0 {
+		t.Fatalf("unexpected dry run %d %+v", code, preview)
+	}
+	kite := preview.Items[0]
+	if kite.Description != "kite" || kite.QuantityDesired != 2 || kite.PriceAmount == nil || *kite.PriceAmount != 1250 ||
+		len(kite.Tags) != 2 || kite.Tags[1] != "outside" || preview.Items[1].Description != "string, lots" {
+		t.Errorf("unexpected preview %+v", preview.Items)
+	}
+	if count, notifications := countItems(t, db, alice), notified(); count != 0 || notifications != 0 {
+		t.Fatalf("dry run added %d items and %d notifications", count, notifications)
+	}
+
+	// one bad row and nothing goes in, with every problem reported
+	bad := csvData + strings.Repeat("x", maxItemTextLength) + ",,,0,\r\n"
+	code, response := doImport(t, db, alice, importBody("csv", bad, columns))
+	if code != http.StatusUnprocessableEntity || len(response.Errors) != 2 ||
+		response.Errors[0] != (importError{Row: 3, Field: "description", Error: "must be shorter than 2000 characters"}) ||
+		response.Errors[1].Field != "quantity_desired" {
+		t.Errorf("unexpected errors %d %+v", code, response.Errors)
+	}
+	if count := countItems(t, db, alice); count != 0 {
+		t.Fatalf("failed import added %d items", count)
+	}
+
+	code, response = doImport(t, db, alice, importBody("csv", csvData, columns))
+	if code != http.StatusOK || len(response.Ids) != 2 {
+		t.Fatalf("failed to import %d %+v", code, response)
+	}
+	if code, _ := doImport(t, db, alice, importBody("csv", csvData, columns+`, "list_id": 999`)); code != http.StatusNotFound {
+		t.Errorf("imported into someone else's list: %d", code)
+	}
+
+	var history int
+	db.QueryRow("SELECT COUNT(*) FROM wishlist_history WHERE action = 'import'").Scan(&history)
+	if history != 2 {
+		t.Errorf("expected 2 history entries, got %d", history)
+	}
+	// followers hear about each item, like ones added by hand
+	if count := notified(); count != 2 {
+		t.Errorf("expected 2 notifications, got %d", count)
+	}
+}
+
+func TestWishlistExport(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	for _, body := range []string{
+		`{"description": "kite", "source": "https://example.com/kite", "cost": "$12.50", "owner_notes": "red", "quantity_desired": 2, "tags": ["toys", "outside"], "priority": 1}`,
+		`{"description": "string, \"lots\"", "source": "", "cost": ""}`,
+	} {
+		if code := doJson(t, handleWishlistPost(logger, db, hub), alice, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add item: %d", code)
+		}
+	}
+	if code := doJson(t, handleWishlistPatch(logger, db, hub), bob, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 1, "buyer_notes": "bob is buying"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add buyer notes: %d", code)
+	}
+	if code := doJson(t, handleClaimPost(logger, db, hub), bob, "POST", "/api/wishlist/claim", `{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+
+	if rr := doExport(t, db, alice, "format=xml"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected bad format to be rejected, got %d", rr.Code)
+	}
+	if rr := doExport(t, db, bob, "list_id=1"); rr.Code != http.StatusNotFound {
+		t.Errorf("bob exported alice's list: %d", rr.Code)
+	}
+
+	// what comes out goes back in as is, and none of it is bob's
+	for _, format := range []string{"csv", "json"} {
+		rr := doExport(t, db, alice, "format="+format)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to export %s: %d", format, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "bob") || strings.Contains(rr.Body.String(), "claim") {
+			t.Errorf("export has buyer data: %s", rr.Body.String())
+		}
+
+		carol := createTestUser(t, db, "Carol"+format)
+		code, response := doImport(t, db, carol, importBody(format, rr.Body.String(), ""))
+		if code != http.StatusOK || len(response.Ids) != 2 {
+			t.Fatalf("failed to import %s export %d %+v", format, code, response)
+		}
+		kite := response.Items[0]
+		if kite.Description != "kite" || kite.OwnerNotes != "red" || kite.QuantityDesired != 2 || kite.Priority == nil ||
+			*kite.PriceAmount != 1250 || *kite.PriceCurrency != "USD" || len(kite.Tags) != 2 ||
+			response.Items[1].Description != `string, "lots"` {
+			t.Errorf("%s didn't round trip: %+v", format, response.Items)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultListName = "Wishlist"
+
+// Who besides the owner can see what's on a list. Everything but public is
+// still limited to people who share a group with the owner, so leaving a
+// group hides all of your lists from it. Public lists are also readable by
+// anyone with their share link.
+const (
+	listPrivate = "private"
+	listGroup   = "group"
+	listUsers   = "users"
+	listMembers = "members"
+	listPublic  = "public"
+)
+
+func validListVisibility(visibility string) bool {
+	switch visibility {
+	case listPrivate, listGroup, listUsers, listMembers, listPublic:
+		return true
+	}
+	return false
+}
+
+// listVisibleTo is a condition on a list id column that holds if the viewer
+// may see what's on the list. Bind the viewer's id to the one placeholder.
+func listVisibleTo(listColumn string) string {
+	return `EXISTS (SELECT 1 FROM lists AS list, (SELECT ? AS id) AS viewer WHERE list.id = ` + listColumn + `
+		AND (list.user_id = viewer.id OR (list.user_id IN (SELECT other.user_id FROM group_members AS mine
+			JOIN group_members AS other ON other.group_id = mine.group_id WHERE mine.user_id = viewer.id)
+		AND CASE list.visibility
+			WHEN 'members' THEN 1
+			WHEN 'public' THEN 1
+			WHEN 'group' THEN list.group_id IN (SELECT group_id FROM group_members WHERE user_id = viewer.id)
+			WHEN 'users' THEN list.id IN (SELECT list_id FROM list_viewers WHERE user_id = viewer.id)
+			ELSE 0 END)))`
+}
+
+// ownsList reports whether listId is one of userId's lists.
+func ownsList(db dbtx, userId uint64, listId uint64) (bool, error) {
+	var owned bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM lists WHERE id = ? AND user_id = ?",
+		listId, userId).Scan(&owned)
+	return owned, err
+}
+
+// setListVisibility changes who can see a list. groupId is only used for
+// group visibility and userIds only for users visibility, and either way
+// the owner has to be able to see them already. Turning a list private (or
+// anything other than public) also gets rid of its share link.
+func setListVisibility(tx dbtx, ownerId uint64, listId uint64, visibility string, groupId *uint64, userIds []uint64) error {
+	if !validListVisibility(visibility) {
+		return errors.New("visibility must be private, group, users, members or public")
+	}
+	if (groupId != nil) != (visibility == listGroup) {
+		return errors.New("group_id is needed for, and only allowed with, group visibility")
+	}
+	if (userIds != nil) != (visibility == listUsers) {
+		return errors.New("user_ids is needed for, and only allowed with, users visibility")
+	}
+
+	var listGroupId sql.NullInt64
+	if groupId != nil {
+		var member bool
+		err := tx.QueryRow("SELECT COUNT(*) > 0 FROM group_members WHERE group_id = ? AND user_id = ?",
+			*groupId, ownerId).Scan(&member)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return errors.New("lists can only be shown to groups you're in")
+		}
+		listGroupId = sql.NullInt64{Int64: int64(*groupId), Valid: true}
+	}
+
+	_, err := tx.Exec("UPDATE lists SET visibility = ?, group_id = ? WHERE id = ?", visibility, listGroupId, listId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM list_viewers WHERE list_id = ?", listId)
+	if err != nil {
+		return err
+	}
+	for _, userId := range userIds {
+		visible, err := canSeeUser(tx, ownerId, userId)
+		if err != nil {
+			return err
+		}
+		if !visible || userId == ownerId {
+			return errors.New("lists can only be shown to people you share a group with")
+		}
+		_, err = tx.Exec("INSERT INTO list_viewers(list_id, user_id) VALUES(?, ?) ON CONFLICT DO NOTHING",
+			listId, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if visibility != listPublic {
+		_, err = tx.Exec("DELETE FROM share_links WHERE list_id = ?", listId)
+		if err != nil {
+			return err
+		}
+	}
+	// feed links work whatever the visibility, except for nobody
+	if visibility == listPrivate {
+		_, err = tx.Exec("DELETE FROM feed_tokens WHERE list_id = ?", listId)
+	}
+	return err
+}
+
+// defaultListId returns the id of a user's default list (their first one),
+// creating it if they don't have one yet.
+func defaultListId(db dbtx, userId uint64) (uint64, error) {
+	_, err := db.Exec(`INSERT INTO lists(user_id, name) SELECT ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM lists WHERE user_id = ?)`, userId, defaultListName, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	var listId uint64
+	err = db.QueryRow("SELECT id FROM lists WHERE user_id = ? ORDER BY id LIMIT 1", userId).Scan(&listId)
+	return listId, err
+}
+
+// A user's lists. Other people only get the ones they're allowed to see,
+// and only the owner gets who they're shared with.
+func handleListsGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type List struct {
+			Id         uint64   `json:"id"`
+			Name       string   `json:"name"`
+			Visibility *string  `json:"visibility"`
+			GroupId    *uint64  `json:"group_id"`
+			UserIds    []uint64 `json:"user_ids"`
+			ShareToken *string  `json:"share_token"`
+			FeedToken  *string  `json:"feed_token"`
+		}
+
+		type ListsResponse struct {
+			Lists []List `json:"lists"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		queryUserId := userId
+		userStr := r.URL.Query().Get("userId")
+		if userStr != "" {
+			urlUserId, err := strconv.ParseUint(userStr, 10, 64)
+			if err != nil {
+				http.Error(w, "missing or malformed user parameter", http.StatusBadRequest)
+				return
+			}
+			queryUserId = urlUserId
+		}
+
+		if queryUserId == userId {
+			_, err := defaultListId(db, userId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			visible, err := canSeeUser(db, userId, queryUserId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				http.Error(w, "non-existent user", http.StatusNotFound)
+				return
+			}
+		}
+
+		rows, err := db.Query(`SELECT lists.id, lists.name, lists.visibility, lists.group_id,
+			share_links.share_token, feed_tokens.feed_token FROM lists
+			LEFT JOIN share_links ON share_links.list_id = lists.id
+			LEFT JOIN feed_tokens ON feed_tokens.list_id = lists.id
+			WHERE lists.user_id = ? AND `+listVisibleTo("lists.id")+` ORDER BY lists.id`, queryUserId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := ListsResponse{Lists: []List{}}
+		for rows.Next() {
+			var list List
+			var visibility string
+			var groupId sql.NullInt64
+			var token, feedToken []byte
+			err = rows.Scan(&list.Id, &list.Name, &visibility, &groupId, &token, &feedToken)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if queryUserId == userId {
+				list.Visibility = &visibility
+				if groupId.Valid {
+					id := uint64(groupId.Int64)
+					list.GroupId = &id
+				}
+				if token != nil {
+					encoded := base64.URLEncoding.EncodeToString(token)
+					list.ShareToken = &encoded
+				}
+				if feedToken != nil {
+					encoded := base64.URLEncoding.EncodeToString(feedToken)
+					list.FeedToken = &encoded
+				}
+			}
+			response.Lists = append(response.Lists, list)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if queryUserId == userId {
+			viewers, err := loadListViewers(db, userId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i := range response.Lists {
+				if *response.Lists[i].Visibility == listUsers {
+					response.Lists[i].UserIds = viewers[response.Lists[i].Id]
+					if response.Lists[i].UserIds == nil {
+						response.Lists[i].UserIds = []uint64{}
+					}
+				}
+			}
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// loadListViewers returns who each of a user's lists is shown to, for lists
+// with users visibility.
+func loadListViewers(db dbtx, ownerId uint64) (map[uint64][]uint64, error) {
+	rows, err := db.Query(`SELECT list_viewers.list_id, list_viewers.user_id FROM list_viewers
+		JOIN lists ON lists.id = list_viewers.list_id
+		WHERE lists.user_id = ? ORDER BY list_viewers.user_id`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[uint64][]uint64)
+	for rows.Next() {
+		var listId, userId uint64
+		err = rows.Scan(&listId, &userId)
+		if err != nil {
+			return nil, err
+		}
+		ret[listId] = append(ret[listId], userId)
+	}
+	return ret, rows.Err()
+}
+
+// Start another list, e.g. a baby registry next to the usual wishlist. New
+// lists are visible to everyone you share a group with unless told otherwise.
+func handleListPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ListRequest struct {
+			Name       string   `json:"name"`
+			Visibility *string  `json:"visibility"`
+			GroupId    *uint64  `json:"group_id"`
+			UserIds    []uint64 `json:"user_ids"`
+		}
+
+		type ListResponse struct {
+			Id uint64 `json:"id"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req ListRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) >= 500 {
+			http.Error(w, "list name must be between 1 and 500 characters", http.StatusBadRequest)
+			return
+		}
+
+		visibility := listMembers
+		if req.Visibility != nil {
+			visibility = *req.Visibility
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		// the first list has to be the default one, not this
+		_, err = defaultListId(tx, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result, err := tx.Exec("INSERT INTO lists(user_id, name) VALUES(?, ?)", userId, req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		listId, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = setListVisibility(tx, userId, uint64(listId), visibility, req.GroupId, req.UserIds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = recordListActivity(tx, uint64(listId))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(ListResponse{uint64(listId)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Rename a list or change who can see it. Visibility settings are replaced
+// as a whole, so group_id and user_ids only go along with a visibility.
+func handleListPatch(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ListPatch struct {
+			Name       *string  `json:"name"`
+			Visibility *string  `json:"visibility"`
+			GroupId    *uint64  `json:"group_id"`
+			UserIds    []uint64 `json:"user_ids"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req ListPatch
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		if req.Name == nil && req.Visibility == nil && req.GroupId == nil && req.UserIds == nil {
+			http.Error(w, "must provide something to patch", http.StatusBadRequest)
+			return
+		}
+
+		listId, ok := checkListOwner(w, r, db, userId)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		if req.Name != nil {
+			name := strings.TrimSpace(*req.Name)
+			if name == "" || len(name) >= 500 {
+				http.Error(w, "list name must be between 1 and 500 characters", http.StatusBadRequest)
+				return
+			}
+			_, err = tx.Exec("UPDATE lists SET name = ? WHERE id = ?", name, listId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if req.Visibility != nil {
+			err = setListVisibility(tx, userId, listId, *req.Visibility, req.GroupId, req.UserIds)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if req.GroupId != nil || req.UserIds != nil {
+			http.Error(w, "group_id and user_ids need a visibility", http.StatusBadRequest)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/ericm1024/wishlist/admin_rpc"
+)
+
+func TestListVisibility(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+	dave := createTestUser(t, db, "Dave")
+
+	var family struct {
+		Id uint64 `json:"id"`
+	}
+	if code := doJson(t, handleGroupPost(logger, db), alice, "POST", "/api/groups",
+		`{"name": "Family"}`, &family); code != http.StatusOK {
+		t.Fatalf("failed to create group: %d", code)
+	}
+	if err := addGroupMember(db, family.Id, bob, groupRoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	newList := func(body string) uint64 {
+		t.Helper()
+		var response struct {
+			Id uint64 `json:"id"`
+		}
+		if code := doJson(t, handleListPost(logger, db), alice, "POST", "/api/lists", body, &response); code != http.StatusOK {
+			t.Fatalf("failed to create list %s: %d", body, code)
+		}
+		return response.Id
+	}
+	registry := newList(fmt.Sprintf(`{"name": "Baby registry", "visibility": "users", "user_ids": [%d]}`, bob))
+	familyList := newList(fmt.Sprintf(`{"name": "Family", "visibility": "group", "group_id": %d}`, family.Id))
+	secret := newList(`{"name": "Secret", "visibility": "private"}`)
+
+	for _, body := range []string{
+		`{"name": "x", "visibility": "everyone"}`,
+		`{"name": "x", "visibility": "private", "user_ids": [2]}`,
+		`{"name": "x", "visibility": "group"}`,
+		`{"name": "x", "visibility": "group", "group_id": 999}`,
+		fmt.Sprintf(`{"name": "x", "visibility": "users", "user_ids": [%d, 999]}`, bob),
+	} {
+		if code := doJson(t, handleListPost(logger, db), alice, "POST", "/api/lists", body, nil); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	// item 1 goes on the default list, which everyone can see
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "socks", "source": "", "cost": ""}`,
+		fmt.Sprintf(`{"description": "stroller", "source": "", "cost": "", "list_id": %d}`, registry),
+		fmt.Sprintf(`{"description": "sweater", "source": "", "cost": "", "list_id": %d}`, familyList),
+		fmt.Sprintf(`{"description": "surprise", "source": "", "cost": "", "list_id": %d}`, secret),
+	} {
+		if code := doJson(t, post, alice, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+	if code := doJson(t, post, bob, "POST", "/api/wishlist",
+		fmt.Sprintf(`{"description": "x", "source": "", "cost": "", "list_id": %d}`, secret), nil); code != http.StatusNotFound {
+		t.Errorf("bob added to alice's list: %d", code)
+	}
+
+	get := handleWishlistGet(logger, db)
+	visible := func(viewer uint64, target string) uint64 {
+		t.Helper()
+		var response testWishlistResponse
+		if code := doJson(t, get, viewer, "GET", target, "", &response); code != http.StatusOK {
+			t.Fatalf("get %s as %d failed: %d", target, viewer, code)
+		}
+		return uint64(len(response.Entries))
+	}
+	aliceList := fmt.Sprintf("/api/wishlist?userId=%d", alice)
+	for _, tc := range []struct {
+		viewer   uint64
+		expected uint64
+	}{{alice, 4}, {bob, 3}, {carol, 1}} {
+		if got := visible(tc.viewer, aliceList); got != tc.expected {
+			t.Errorf("user %d sees %d of alice's items, expected %d", tc.viewer, got, tc.expected)
+		}
+	}
+	if got := visible(bob, fmt.Sprintf("%s&listId=%d", aliceList, registry)); got != 1 {
+		t.Errorf("bob sees %d items on the registry", got)
+	}
+
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), carol, "POST", "/api/wishlist/claim",
+		`{"id": 2}`, nil); code != http.StatusNotFound {
+		t.Errorf("carol claimed from the registry: %d", code)
+	}
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), bob, "POST", "/api/wishlist/claim",
+		`{"id": 2}`, nil); code != http.StatusOK {
+		t.Errorf("bob couldn't claim from the registry: %d", code)
+	}
+	if code := doJson(t, handleWishlistPatch(logger, db, newHub()), bob, "PATCH", "/api/wishlist",
+		`{"id": 4, "seq": 1, "buyer_notes": "peeking"}`, nil); code != http.StatusInternalServerError {
+		t.Errorf("bob edited an item on a private list: %d", code)
+	}
+
+	var search struct {
+		Entries []struct {
+			Id uint64 `json:"id"`
+		} `json:"entries"`
+	}
+	doJson(t, handleSearchGet(logger, db), carol, "GET", "/api/search?q=s", "", &search)
+	if len(search.Entries) != 1 || search.Entries[0].Id != 1 {
+		t.Errorf("carol's search found %+v", search.Entries)
+	}
+
+	var lists struct {
+		Lists []struct {
+			Id         uint64  `json:"id"`
+			Visibility *string `json:"visibility"`
+		} `json:"lists"`
+	}
+	doJson(t, handleListsGet(logger, db), carol, "GET", "/api/lists?userId="+fmt.Sprint(alice), "", &lists)
+	if len(lists.Lists) != 1 || lists.Lists[0].Visibility != nil {
+		t.Errorf("carol sees alice's lists as %+v", lists.Lists)
+	}
+
+	// moving the stroller onto the default list shows it to everyone
+	if code := doJson(t, handleWishlistPatch(logger, db, newHub()), alice, "PATCH", "/api/wishlist",
+		fmt.Sprintf(`{"id": 2, "seq": 1, "list_id": %d}`, lists.Lists[0].Id), nil); code != http.StatusOK {
+		t.Fatalf("failed to move item: %d", code)
+	}
+	if got := visible(carol, aliceList); got != 2 {
+		t.Errorf("carol sees %d items after the move", got)
+	}
+
+	// only site admins get to look through other people's eyes
+	viewAs := viewAsMiddlewareNew(logger, db)(get)
+	asCarol := fmt.Sprintf("%s&as=%d", aliceList, carol)
+	if code := doJson(t, viewAs, alice, "GET", asCarol, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("non-admin viewed as someone else: %d", code)
+	}
+	admin := &adminGrpcServer{Logger: logger, Db: db}
+	if _, err := admin.SetSiteAdmin(context.Background(), &admin_rpc.SiteAdminRequest{UserId: dave, Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	var response testWishlistResponse
+	if code := doJson(t, viewAs, dave, "GET", asCarol, "", &response); code != http.StatusOK || len(response.Entries) != 2 {
+		t.Errorf("admin viewing as carol got %d %+v", code, response.Entries)
+	}
+	if code := doJson(t, viewAs, dave, "GET", aliceList+"&as=999", "", nil); code != http.StatusNotFound {
+		t.Errorf("viewed as a non-existent user: %d", code)
+	}
+}
+
+func TestListVisibilityShareLinks(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+
+	listId, err := defaultListId(db, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := map[string]string{"id": fmt.Sprint(listId)}
+	patch := handleListPatch(logger, db)
+	if code := doJsonPath(t, patch, owner, "PATCH", "/api/lists", path, `{"visibility": "public"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to make list public: %d", code)
+	}
+	if code := doJsonPath(t, handleShareLinkPost(logger, db), owner, "POST", "/api/lists", path, "", nil); code != http.StatusOK {
+		t.Fatalf("failed to share list: %d", code)
+	}
+
+	// a list that stops being public loses its link for good
+	if code := doJsonPath(t, patch, owner, "PATCH", "/api/lists", path, `{"visibility": "members"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to make list members only: %d", code)
+	}
+	var shared bool
+	if err := db.QueryRow("SELECT COUNT(*) > 0 FROM share_links").Scan(&shared); err != nil {
+		t.Fatal(err)
+	}
+	if shared {
+		t.Errorf("share link survived the list going members only")
+	}
+
+	if code := doJsonPath(t, patch, owner, "PATCH", "/api/lists", path, `{"group_id": 1}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected group without visibility to be rejected, got %d", code)
+	}
+	if code := doJsonPath(t, patch, owner, "PATCH", "/api/lists", path, `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected empty patch to be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	emailChannel = "email"
+
+	notifyOff       = "off"
+	notifyImmediate = "immediate"
+	notifyDaily     = "daily"
+	notifyWeekly    = "weekly"
+
+	defaultNotifyFrequency = notifyDaily
+	notificationInterval   = 10 * time.Minute
+)
+
+// every way we can reach a user, each needs a Notifier in run
+var notificationChannels = []string{emailChannel}
+
+func validNotifyFrequency(frequency string) bool {
+	switch frequency {
+	case notifyOff, notifyImmediate, notifyDaily, notifyWeekly:
+		return true
+	}
+	return false
+}
+
+// enqueueNotification adds something to tell userId about to the outbox. Do
+// it in the same transaction as whatever it's about, the worker takes care
+// of delivering it once that commits.
+func enqueueNotification(tx dbtx, userId uint64, kind string, subject string, body string) error {
+	_, err := tx.Exec("INSERT INTO notification_outbox(user_id, kind, subject, body) VALUES(?, ?, ?, ?)",
+		userId, kind, subject, body)
+	return err
+}
+
+// notifyClaimers tells everyone else who has claimed an item about a buyer
+// note on it. The owner doesn't get buyer notes so never hears about these.
+func notifyClaimers(tx dbtx, authorId uint64, itemId uint64, notes string) error {
+	var description, author string
+	err := tx.QueryRow(`SELECT wishlist.description, users.first_name FROM wishlist, users
+		WHERE wishlist.id = ? AND users.id = ?`, itemId, authorId).Scan(&description, &author)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT user_id FROM claims WHERE item_id = ? AND user_id != ?", itemId, authorId)
+	if err != nil {
+		return err
+	}
+	var claimers []uint64
+	for rows.Next() {
+		var claimer uint64
+		err = rows.Scan(&claimer)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		claimers = append(claimers, claimer)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, claimer := range claimers {
+		err = enqueueNotification(tx, claimer, "buyer_note",
+			fmt.Sprintf("New note on %s, which you claimed", description),
+			fmt.Sprintf("%s wrote: %s", author, notes))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverNotifications sends whatever is in the outbox through each channel,
+// as often as each user asked for it. Everything pending for a user goes out
+// together as a digest. Failed deliveries are left for next time.
+func deliverNotifications(ctx context.Context, logger *log.Logger, db *sql.DB, channels map[string]Notifier, now time.Time) error {
+	type pending struct {
+		UserId    uint64
+		Email     string
+		FirstName string
+		Frequency string
+	}
+
+	for _, channel := range notificationChannels {
+		notifier, ok := channels[channel]
+		if !ok {
+			continue
+		}
+
+		// people who don't want anything on this channel never will, even
+		// if they turn it back on later
+		_, err := db.ExecContext(ctx, `INSERT INTO notification_deliveries(outbox_id, channel, skipped)
+			SELECT notification_outbox.id, ?, 1 FROM notification_outbox
+			JOIN notification_preferences ON notification_preferences.user_id = notification_outbox.user_id
+				AND notification_preferences.channel = ?
+			WHERE notification_preferences.frequency = ? AND NOT EXISTS (SELECT 1 FROM notification_deliveries
+				WHERE outbox_id = notification_outbox.id AND channel = ?)`,
+			channel, channel, notifyOff, channel)
+		if err != nil {
+			return err
+		}
+
+		rows, err := db.QueryContext(ctx, `SELECT users.id, users.email, users.first_name, frequency FROM (
+				SELECT DISTINCT notification_outbox.user_id AS user_id,
+					COALESCE(notification_preferences.frequency, ?) AS frequency,
+					notification_digests.last_sent_time AS last_sent_time
+				FROM notification_outbox
+				LEFT JOIN notification_preferences ON notification_preferences.user_id = notification_outbox.user_id
+					AND notification_preferences.channel = ?
+				LEFT JOIN notification_digests ON notification_digests.user_id = notification_outbox.user_id
+					AND notification_digests.channel = ?
+				WHERE NOT EXISTS (SELECT 1 FROM notification_deliveries
+					WHERE outbox_id = notification_outbox.id AND channel = ?))
+			JOIN users ON users.id = user_id
+			WHERE frequency = ? OR last_sent_time IS NULL
+				OR (frequency = ? AND last_sent_time <= ?) OR (frequency = ? AND last_sent_time <= ?)
+			ORDER BY users.id`,
+			defaultNotifyFrequency, channel, channel, channel, notifyImmediate,
+			notifyDaily, now.AddDate(0, 0, -1).UTC().Format(sqliteTimeFormat),
+			notifyWeekly, now.AddDate(0, 0, -7).UTC().Format(sqliteTimeFormat))
+		if err != nil {
+			return err
+		}
+		var due []pending
+		for rows.Next() {
+			var p pending
+			err = rows.Scan(&p.UserId, &p.Email, &p.FirstName, &p.Frequency)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			due = append(due, p)
+		}
+		rows.Close()
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		for _, p := range due {
+			err = deliverDigest(ctx, db, notifier, channel, p.UserId, p.Email, p.FirstName, p.Frequency, now)
+			if err != nil {
+				// try again next time around
+				logger.Printf("error delivering %s notifications to user %d: %v", channel, p.UserId, err)
+			}
+		}
+	}
+	return nil
+}
+
+func deliverDigest(ctx context.Context, db *sql.DB, notifier Notifier, channel string, userId uint64,
+	email string, firstName string, frequency string, now time.Time) error {
+	rows, err := db.QueryContext(ctx, `SELECT id, subject, body FROM notification_outbox
+		WHERE user_id = ? AND NOT EXISTS (SELECT 1 FROM notification_deliveries
+			WHERE outbox_id = notification_outbox.id AND channel = ?)
+		ORDER BY id`, userId, channel)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	var subjects, bodies []string
+	for rows.Next() {
+		var id uint64
+		var subject, body string
+		err = rows.Scan(&id, &subject, &body)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		subjects = append(subjects, subject)
+		bodies = append(bodies, body)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	notification := Notification{UserId: userId, Email: email}
+	if len(ids) == 1 && frequency == notifyImmediate {
+		notification.Subject = subjects[0]
+		notification.Body = bodies[0]
+	} else {
+		notification.Subject = fmt.Sprintf("Your %s wishlist digest", frequency)
+		if frequency == notifyImmediate {
+			notification.Subject = "Wishlist updates"
+		}
+		var body strings.Builder
+		fmt.Fprintf(&body, "Hi %s,\n\nHere's what happened:\n", firstName)
+		for i := range ids {
+			fmt.Fprintf(&body, "\n%s\n%s\n", subjects[i], bodies[i])
+		}
+		notification.Body = body.String()
+	}
+
+	err = notifier.Notify(ctx, notification)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err = tx.Exec("INSERT INTO notification_deliveries(outbox_id, channel) VALUES(?, ?)", id, channel)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO notification_digests(user_id, channel, last_sent_time) VALUES(?, ?, ?)
+		ON CONFLICT(user_id, channel) DO UPDATE SET last_sent_time = excluded.last_sent_time`,
+		userId, channel, now.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func runNotifications(ctx context.Context, logger *log.Logger, db *sql.DB, channels map[string]Notifier) {
+	ticker := time.NewTicker(notificationInterval)
+	defer ticker.Stop()
+
+	for {
+		err := deliverNotifications(ctx, logger, db, channels, time.Now())
+		if err != nil && ctx.Err() == nil {
+			logger.Printf("error delivering notifications: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// smtpNotifier sends notifications as plain text email.
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+
+	// smtp.SendMail, tests swap in something that doesn't need a server
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newSmtpNotifier(config *Config) *smtpNotifier {
+	n := &smtpNotifier{addr: config.SmtpAddr, from: config.SmtpFrom, sendMail: smtp.SendMail}
+	if config.SmtpUsername != "" {
+		host, _, _ := net.SplitHostPort(config.SmtpAddr)
+		n.auth = smtp.PlainAuth("", config.SmtpUsername, config.SmtpPassword, host)
+	}
+	return n
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, notification Notification) error {
+	to := mail.Address{Address: notification.Email}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	// names and descriptions come from users, encoding keeps them from
+	// sneaking in headers of their own
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notification.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(notification.Body, "\n", "\r\n"))
+	return n.sendMail(n.addr, n.auth, n.from, []string{notification.Email}, []byte(msg.String()))
+}
+
+func handleNotificationPreferencesGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type Preference struct {
+			Channel   string `json:"channel"`
+			Frequency string `json:"frequency"`
+		}
+
+		type PreferencesResponse struct {
+			Preferences []Preference `json:"preferences"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var response PreferencesResponse
+		for _, channel := range notificationChannels {
+			preference := Preference{Channel: channel, Frequency: defaultNotifyFrequency}
+			err := db.QueryRow("SELECT frequency FROM notification_preferences WHERE user_id = ? AND channel = ?",
+				userId, channel).Scan(&preference.Frequency)
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Preferences = append(response.Preferences, preference)
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// How often to hear about things on one channel: off, immediate, or in a
+// daily or weekly digest.
+func handleNotificationPreferencePut(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type PreferenceRequest struct {
+			Channel   string `json:"channel"`
+			Frequency string `json:"frequency"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req PreferenceRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		if !slices.Contains(notificationChannels, req.Channel) {
+			http.Error(w, "unknown channel", http.StatusBadRequest)
+			return
+		}
+		if !validNotifyFrequency(req.Frequency) {
+			http.Error(w, "frequency must be off, immediate, daily or weekly", http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`INSERT INTO notification_preferences(user_id, channel, frequency) VALUES(?, ?, ?)
+			ON CONFLICT(user_id, channel) DO UPDATE SET frequency = excluded.frequency`,
+			userId, req.Channel, req.Frequency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMail struct {
+	from string
+	to   []string
+	msg  string
+}
+
+// memoryMailer stands in for the mail server, and can be told to fail.
+type memoryMailer struct {
+	sent []testMail
+	err  error
+}
+
+func (m *memoryMailer) sendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, testMail{from: from, to: to, msg: string(msg)})
+	return nil
+}
+
+func TestNotifications(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+	carol := createTestUser(t, db, "Carol")
+
+	if code := doJson(t, handleWishlistPost(logger, db, hub), alice, "POST", "/api/wishlist",
+		`{"description": "kite", "source": "", "cost": "", "quantity_desired": 2}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+	for _, user := range []uint64{bob, carol} {
+		if code := doJson(t, handleClaimPost(logger, db, hub), user, "POST", "/api/wishlist/claim",
+			`{"id": 1}`, nil); code != http.StatusOK {
+			t.Fatalf("failed to claim: %d", code)
+		}
+	}
+
+	seq := uint64(1)
+	note := func(notes string) {
+		t.Helper()
+		if status, err := patchItem(logger, db, hub, carol, WishlistPatch{Id: 1, Seq: seq, BuyerNotes: &notes}); err != nil {
+			t.Fatalf("failed to add buyer note: %d %v", status, err)
+		}
+		seq++
+	}
+
+	mailer := &memoryMailer{}
+	channels := map[string]Notifier{emailChannel: &smtpNotifier{addr: "mail.example.com:25",
+		from: "wishlist@example.com", sendMail: mailer.sendMail}}
+	deliver := func(now time.Time) {
+		t.Helper()
+		if err := deliverNotifications(context.Background(), logger, db, channels, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only bob hears about carol's note, nobody tells alice
+	note("I'll get the string")
+	now := time.Now()
+	mailer.err = errors.New("mail server down")
+	deliver(now)
+	mailer.err = nil
+	deliver(now)
+	deliver(now)
+	if len(mailer.sent) != 1 || len(mailer.sent[0].to) != 1 || mailer.sent[0].to[0] != "bob@example.com" {
+		t.Fatalf("expected one mail to bob, got %+v", mailer.sent)
+	}
+	if msg := mailer.sent[0].msg; !strings.Contains(msg, "Subject: Your daily wishlist digest\r\n") ||
+		!strings.Contains(msg, "Carol wrote: I'll get the string") {
+		t.Errorf("unexpected mail %q", msg)
+	}
+
+	// a daily digest waits for the next day
+	note("and the tail")
+	deliver(now.Add(time.Hour))
+	if len(mailer.sent) != 1 {
+		t.Errorf("sent a second digest the same day")
+	}
+	deliver(now.AddDate(0, 0, 1))
+	if len(mailer.sent) != 2 {
+		t.Errorf("didn't send the next day's digest")
+	}
+
+	put := handleNotificationPreferencePut(logger, db)
+	for _, body := range []string{
+		`{"channel": "pigeon", "frequency": "daily"}`,
+		`{"channel": "email", "frequency": "hourly"}`,
+	} {
+		if code := doJson(t, put, bob, "PUT", "/api/notifications/preferences", body, nil); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	// weekly waits a week, immediate doesn't wait at all
+	if code := doJson(t, put, bob, "PUT", "/api/notifications/preferences",
+		`{"channel": "email", "frequency": "weekly"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to set preference: %d", code)
+	}
+	note("actually a red one")
+	deliver(now.AddDate(0, 0, 3))
+	if len(mailer.sent) != 2 {
+		t.Errorf("sent a weekly digest early")
+	}
+	deliver(now.AddDate(0, 0, 8))
+	if len(mailer.sent) != 3 || !strings.Contains(mailer.sent[2].msg, "Subject: Your weekly wishlist digest") {
+		t.Errorf("didn't send the weekly digest")
+	}
+
+	if code := doJson(t, put, bob, "PUT", "/api/notifications/preferences",
+		`{"channel": "email", "frequency": "immediate"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to set preference: %d", code)
+	}
+	note("bought it")
+	deliver(now.AddDate(0, 0, 8))
+	if len(mailer.sent) != 4 || !strings.Contains(mailer.sent[3].msg, "Subject: New note on kite, which you claimed\r\n") {
+		t.Errorf("didn't send immediately: %+v", mailer.sent)
+	}
+
+	// and off means never, even once it's turned back on
+	if code := doJson(t, put, bob, "PUT", "/api/notifications/preferences",
+		`{"channel": "email", "frequency": "off"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to set preference: %d", code)
+	}
+	note("wrapped it")
+	deliver(now.AddDate(0, 0, 9))
+	if code := doJson(t, put, bob, "PUT", "/api/notifications/preferences",
+		`{"channel": "email", "frequency": "immediate"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to set preference: %d", code)
+	}
+	deliver(now.AddDate(0, 0, 9))
+	if len(mailer.sent) != 4 {
+		t.Errorf("sent with notifications off: %+v", mailer.sent[4:])
+	}
+
+	var preferences struct {
+		Preferences []struct {
+			Channel   string `json:"channel"`
+			Frequency string `json:"frequency"`
+		} `json:"preferences"`
+	}
+	if code := doJson(t, handleNotificationPreferencesGet(logger, db), bob, "GET", "/api/notifications/preferences",
+		"", &preferences); code != http.StatusOK {
+		t.Fatalf("failed to get preferences: %d", code)
+	}
+	if len(preferences.Preferences) != 1 || preferences.Preferences[0].Frequency != notifyImmediate {
+		t.Errorf("unexpected preferences %+v", preferences.Preferences)
+	}
+}
+
+func TestSmtpNotifierHeaders(t *testing.T) {
+	mailer := &memoryMailer{}
+	notifier := &smtpNotifier{from: "wishlist@example.com", sendMail: mailer.sendMail}
+	err := notifier.Notify(context.Background(), Notification{Email: "bob@example.com",
+		Subject: "kite\r\nBcc: eve@example.com", Body: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(mailer.sent[0].msg, "\r\nBcc:") {
+		t.Errorf("subject injected a header: %q", mailer.sent[0].msg)
+	}
+}
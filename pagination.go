@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const maxPageSize = 200
+
+// listSort is an ordering for a paginated endpoint: by some column, with
+// nulls last either way, then by id so every row has a distinct position.
+type listSort struct {
+	Name   string // as given in the sort parameter, e.g. "-price"
+	Column string // empty to sort by id alone
+	Desc   bool
+}
+
+// parseListSort maps a sort parameter to one of columns, keyed by the name
+// used in the parameter. A leading "-" sorts descending. An empty parameter
+// sorts by id.
+func parseListSort(param string, columns map[string]string) (listSort, error) {
+	if param == "" {
+		return listSort{}, nil
+	}
+	name, desc := strings.CutPrefix(param, "-")
+	column, ok := columns[name]
+	if !ok {
+		return listSort{}, errors.New("malformed sort parameter")
+	}
+	return listSort{Name: param, Column: column, Desc: desc}, nil
+}
+
+// key is the expression rows are ordered by, for selecting alongside each
+// row so we can make a cursor from the last one.
+func (s listSort) key(idColumn string) string {
+	if s.Column == "" {
+		return idColumn
+	}
+	return s.Column
+}
+
+func (s listSort) orderBy(idColumn string) string {
+	if s.Column == "" {
+		if s.Desc {
+			return idColumn + " DESC"
+		}
+		return idColumn
+	}
+	direction := "ASC"
+	if s.Desc {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("%s IS NULL, %s %s, %s", s.Column, s.Column, direction, idColumn)
+}
+
+// after is the condition for rows that come after the cursor in this order.
+func (s listSort) after(cursor *listCursor, idColumn string) (string, []interface{}) {
+	cmp := ">"
+	if s.Desc {
+		cmp = "<"
+	}
+	if s.Column == "" {
+		return fmt.Sprintf("%s %s ?", idColumn, cmp), []interface{}{cursor.Id}
+	}
+	if cursor.Key == nil {
+		return fmt.Sprintf("(%s IS NULL AND %s > ?)", s.Column, idColumn), []interface{}{cursor.Id}
+	}
+	return fmt.Sprintf("(%s IS NULL OR %s %s ? OR (%s = ? AND %s > ?))", s.Column, s.Column, cmp, s.Column,
+		idColumn), []interface{}{cursor.Key, cursor.Key, cursor.Id}
+}
+
+// listCursor marks the last row of a page. Clients treat it as opaque.
+type listCursor struct {
+	Sort string      `json:"s"`
+	Id   uint64      `json:"i"`
+	Key  interface{} `json:"k"`
+}
+
+func (c *listCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseListCursor(str string, sort listSort) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("malformed cursor parameter")
+	}
+
+	var cursor listCursor
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&cursor); err != nil {
+		return nil, errors.New("malformed cursor parameter")
+	}
+	if cursor.Sort != sort.Name {
+		return nil, errors.New("cursor is for a different sort order")
+	}
+
+	// keep integer keys integers so they compare as such
+	if number, ok := cursor.Key.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			cursor.Key = i
+		} else if f, err := number.Float64(); err == nil {
+			cursor.Key = f
+		}
+	}
+	return &cursor, nil
+}
+
+// page is the pagination state for one request to a list endpoint.
+type page struct {
+	Sort   listSort
+	Cursor *listCursor
+	// zero for no limit, which is what clients that predate pagination get
+	Limit int
+}
+
+func parsePage(query url.Values, columns map[string]string) (*page, error) {
+	var ret page
+	var err error
+	ret.Sort, err = parseListSort(query.Get("sort"), columns)
+	if err != nil {
+		return nil, err
+	}
+
+	if str := query.Get("limit"); str != "" {
+		ret.Limit, err = strconv.Atoi(str)
+		if err != nil || ret.Limit < 1 || ret.Limit > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if str := query.Get("cursor"); str != "" {
+		ret.Cursor, err = parseListCursor(str, ret.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ret, nil
+}
+
+// apply adds ordering, the cursor condition and the limit to a query that
+// already has a WHERE clause. One extra row is asked for so nextCursor can
+// tell whether there's another page.
+func (p *page) apply(query string, args []interface{}, idColumn string) (string, []interface{}) {
+	if p.Cursor != nil {
+		cond, condArgs := p.Sort.after(p.Cursor, idColumn)
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += " ORDER BY " + p.Sort.orderBy(idColumn)
+	if p.Limit != 0 {
+		query += " LIMIT ?"
+		args = append(args, p.Limit+1)
+	}
+	return query, args
+}
+
+// nextCursor is called with the number of rows the query returned and the id
+// and sort key of the last row that fits in this page. It returns nil once
+// there's nothing more.
+func (p *page) nextCursor(rows int, id uint64, key interface{}) *string {
+	if p.Limit == 0 || rows <= p.Limit {
+		return nil
+	}
+	if b, ok := key.([]byte); ok {
+		key = string(b)
+	}
+	cursor := (&listCursor{Sort: p.Sort.Name, Id: id, Key: key}).String()
+	return &cursor
+}
+
+// likePattern makes a LIKE pattern (with ESCAPE '\') matching s anywhere.
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + s + "%"
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWishlistPagination(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "Joe")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "banana", "source": "", "cost": "$5", "priority": 2}`,
+		`{"description": "Apple", "source": "", "cost": ""}`,
+		`{"description": "cherry", "source": "", "cost": "$5", "priority": 1}`,
+		`{"description": "date", "source": "", "cost": "$1"}`,
+		`{"description": "elderberry", "source": "", "cost": "", "priority": 2}`,
+		`{"description": "fig", "source": "", "cost": "$12"}`,
+		`{"description": "apple pie", "source": "", "cost": "$5"}`,
+	} {
+		if code := doJson(t, post, userId, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+
+	// priorities past what sqlite can store are the caller's mistake
+	tooBig := fmt.Sprint(uint64(math.MaxUint64))
+	if code := doJson(t, post, userId, "POST", "/api/wishlist",
+		`{"description": "grape", "source": "", "cost": "", "priority": `+tooBig+`}`, nil); code != http.StatusBadRequest {
+		t.Errorf("added an item with priority %s: %d", tooBig, code)
+	}
+	if code := doJson(t, handleWishlistPatch(logger, db, newHub()), userId, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 1, "priority": `+tooBig+`}`, nil); code != http.StatusBadRequest {
+		t.Errorf("patched an item to priority %s: %d", tooBig, code)
+	}
+
+	type pageResponse struct {
+		Entries []struct {
+			Description string `json:"description"`
+		} `json:"entries"`
+		NextCursor *string `json:"next_cursor"`
+	}
+
+	get := handleWishlistGet(logger, db)
+	list := func(params string) []string {
+		t.Helper()
+		var response pageResponse
+		if code := doJson(t, get, userId, "GET", "/api/wishlist?"+params, "", &response); code != http.StatusOK {
+			t.Fatalf("get %s failed: %d", params, code)
+		}
+		if response.NextCursor != nil {
+			t.Fatalf("unpaginated get %s has a cursor", params)
+		}
+		ret := []string{}
+		for _, entry := range response.Entries {
+			ret = append(ret, entry.Description)
+		}
+		return ret
+	}
+
+	// walk the list two at a time, it should come out the same as all at once
+	paginate := func(params string) []string {
+		t.Helper()
+		ret := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("pagination of %s doesn't terminate", params)
+			}
+			var response pageResponse
+			target := "/api/wishlist?limit=2&" + params
+			if cursor != "" {
+				target += "&cursor=" + url.QueryEscape(cursor)
+			}
+			if code := doJson(t, get, userId, "GET", target, "", &response); code != http.StatusOK {
+				t.Fatalf("get %s failed: %d", target, code)
+			}
+			if len(response.Entries) > 2 {
+				t.Fatalf("page too big: %+v", response.Entries)
+			}
+			for _, entry := range response.Entries {
+				ret = append(ret, entry.Description)
+			}
+			if response.NextCursor == nil {
+				return ret
+			}
+			cursor = *response.NextCursor
+		}
+	}
+
+	type testCase struct {
+		params   string
+		expected string
+	}
+	tests := []testCase{
+		{"", "banana,Apple,cherry,date,elderberry,fig,apple pie"},
+		{"sort=created", "banana,Apple,cherry,date,elderberry,fig,apple pie"},
+		{"sort=-created", "apple pie,fig,elderberry,date,cherry,Apple,banana"},
+		{"sort=priority", "cherry,banana,elderberry,Apple,date,fig,apple pie"},
+		{"sort=-priority", "banana,elderberry,cherry,Apple,date,fig,apple pie"},
+		{"sort=price", "date,banana,cherry,apple pie,fig,Apple,elderberry"},
+		{"sort=-price", "fig,banana,cherry,apple pie,date,Apple,elderberry"},
+		{"sort=description", "Apple,apple pie,banana,cherry,date,elderberry,fig"},
+		{"sort=-description", "fig,elderberry,date,cherry,banana,apple pie,Apple"},
+		{"sort=description&q=APPLE", "Apple,apple pie"},
+		{"sort=price&maxPrice=500", "date,banana,cherry,apple pie"},
+	}
+	for _, tc := range tests {
+		if got := strings.Join(list(tc.params), ","); got != tc.expected {
+			t.Errorf("get %s: got %s, expected %s", tc.params, got, tc.expected)
+		}
+		if got := strings.Join(paginate(tc.params), ","); got != tc.expected {
+			t.Errorf("paginated get %s: got %s, expected %s", tc.params, got, tc.expected)
+		}
+	}
+
+	var first pageResponse
+	doJson(t, get, userId, "GET", "/api/wishlist?limit=2&sort=price", "", &first)
+	for _, target := range []string{
+		"/api/wishlist?sort=priority&cursor=" + url.QueryEscape(*first.NextCursor),
+		"/api/wishlist?cursor=garbage",
+		"/api/wishlist?limit=0",
+		fmt.Sprintf("/api/wishlist?limit=%d", maxPageSize+1),
+		"/api/wishlist?sort=color",
+	} {
+		if code := doJson(t, get, userId, "GET", target, "", nil); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", target, code)
+		}
+	}
+}
+
+func TestUsersPagination(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	var viewer uint64
+	for _, name := range []string{"Carol", "alice", "Bob", "Alicia"} {
+		viewer = createTestUser(t, db, name)
+	}
+
+	get := handleUsersGet(logger, db)
+	var names []string
+	cursor := ""
+	for {
+		var response struct {
+			Users      []User  `json:"users"`
+			NextCursor *string `json:"next_cursor"`
+		}
+		target := "/api/users?limit=1&sort=name&q=ali"
+		if cursor != "" {
+			target += "&cursor=" + url.QueryEscape(cursor)
+		}
+		if code := doJson(t, get, viewer, "GET", target, "", &response); code != http.StatusOK {
+			t.Fatalf("get %s failed: %d", target, code)
+		}
+		for _, user := range response.Users {
+			names = append(names, user.FirstName)
+		}
+		if response.NextCursor == nil {
+			break
+		}
+		cursor = *response.NextCursor
+	}
+	if got := strings.Join(names, ","); got != "alice,Alicia" {
+		t.Errorf("unexpected users %s", got)
+	}
+}
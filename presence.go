@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// how often we ping, and how long a client can go without saying
+	// anything (answering pings included) before we give up on it
+	socketPingInterval = 30 * time.Second
+	socketReadTimeout  = 2 * socketPingInterval
+	socketWriteTimeout = 10 * time.Second
+	// messages queued for a client that isn't keeping up, past this we drop
+	// it and it has to reconnect and reload
+	socketSendBuffer = 64
+	maxSocketMessage = 64 << 10
+)
+
+// socketMessage is everything that goes over a list socket, in either
+// direction. Clients send patch (with a ref to match up the patch_result)
+// and pong, the server sends presence, item, patch_result, error and ping.
+type socketMessage struct {
+	Type    string         `json:"type"`
+	Ref     uint64         `json:"ref,omitempty"`
+	Viewers []User         `json:"viewers,omitempty"`
+	Item    *ItemEvent     `json:"item,omitempty"`
+	Patch   *WishlistPatch `json:"patch,omitempty"`
+	Status  int            `json:"status,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+type socketClient struct {
+	user   User
+	listId uint64
+	send   chan socketMessage
+	done   chan struct{}
+	once   sync.Once
+}
+
+// enqueue hands a message to the client's writer, dropping the client
+// rather than waiting on it if it has fallen too far behind.
+func (c *socketClient) enqueue(msg socketMessage) {
+	select {
+	case <-c.done:
+	case c.send <- msg:
+	default:
+		c.drop()
+	}
+}
+
+func (c *socketClient) drop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// Presence tracks who has a socket open on which list.
+type Presence struct {
+	mu     sync.Mutex
+	lists  map[uint64]map[*socketClient]struct{}
+	closed bool
+}
+
+func newPresence() *Presence {
+	return &Presence{lists: make(map[uint64]map[*socketClient]struct{})}
+}
+
+func (p *Presence) join(client *socketClient) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("shutting down")
+	}
+	clients, ok := p.lists[client.listId]
+	if !ok {
+		clients = make(map[*socketClient]struct{})
+		p.lists[client.listId] = clients
+	}
+	clients[client] = struct{}{}
+	p.broadcastLocked(client.listId)
+	return nil
+}
+
+func (p *Presence) leave(client *socketClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	clients := p.lists[client.listId]
+	if _, ok := clients[client]; !ok {
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(p.lists, client.listId)
+		return
+	}
+	p.broadcastLocked(client.listId)
+}
+
+// Viewers is everyone looking at a list, once each no matter how many
+// sockets they have open.
+func (p *Presence) Viewers(listId uint64) []User {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.viewersLocked(listId)
+}
+
+func (p *Presence) viewersLocked(listId uint64) []User {
+	var viewers []User
+	for client := range p.lists[listId] {
+		if !slices.ContainsFunc(viewers, func(user User) bool { return user.Id == client.user.Id }) {
+			viewers = append(viewers, client.user)
+		}
+	}
+	slices.SortFunc(viewers, func(a, b User) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return viewers
+}
+
+func (p *Presence) broadcastLocked(listId uint64) {
+	msg := socketMessage{Type: "presence", Viewers: p.viewersLocked(listId)}
+	for client := range p.lists[listId] {
+		client.enqueue(msg)
+	}
+}
+
+// Close drops every client and turns away new ones. Sockets are hijacked
+// from the http server so shutting it down doesn't touch them.
+func (p *Presence) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, clients := range p.lists {
+		for client := range clients {
+			client.drop()
+		}
+	}
+}
+
+// sameOrigin only lets browsers open sockets from pages we served, since the
+// session cookie goes along with the request no matter who asks.
+func sameOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host != r.Host {
+		return errors.New("cross origin socket")
+	}
+	return nil
+}
+
+// handleListSocket is a websocket for collaborating on a list. It pushes who
+// else is looking at the list and changes to its items as they happen, and
+// takes patches to them.
+func handleListSocket(logger *log.Logger, db *sql.DB, hub *Hub, presence *Presence) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		listId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed list id", http.StatusBadRequest)
+			return
+		}
+
+		var visible bool
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM lists WHERE id = ? AND "+listVisibleTo("lists.id"),
+			listId, userId).Scan(&visible)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			http.Error(w, "non-existent list", http.StatusNotFound)
+			return
+		}
+
+		client := &socketClient{
+			user:   User{Id: userId},
+			listId: listId,
+			send:   make(chan socketMessage, socketSendBuffer),
+			done:   make(chan struct{}),
+		}
+		err = db.QueryRow("SELECT first_name,last_name FROM users WHERE id = ?",
+			userId).Scan(&client.user.FirstName, &client.user.LastName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		server := websocket.Server{
+			Handshake: sameOrigin,
+			Handler: func(conn *websocket.Conn) {
+				conn.MaxPayloadBytes = maxSocketMessage
+				serveListSocket(logger, db, hub, presence, client, conn)
+			},
+		}
+		server.ServeHTTP(w, r)
+	}
+}
+
+func serveListSocket(logger *log.Logger, db *sql.DB, hub *Hub, presence *Presence, client *socketClient, conn *websocket.Conn) {
+	defer conn.Close()
+	defer client.drop()
+
+	events, _, _ := hub.Subscribe("")
+	defer hub.Unsubscribe(events)
+
+	if err := presence.join(client); err != nil {
+		return
+	}
+	defer presence.leave(client)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// the writer owns the connection's write side, and closes it once the
+	// client is dropped so the read loop below finishes too
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+
+		ping := time.NewTicker(socketPingInterval)
+		defer ping.Stop()
+		for {
+			var msg socketMessage
+			select {
+			case <-client.done:
+				return
+			case <-ping.C:
+				msg = socketMessage{Type: "ping"}
+			case msg = <-client.send:
+			}
+			conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			if err := websocket.JSON.Send(conn, msg); err != nil {
+				client.drop()
+				return
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-client.done:
+				return
+			case event, ok := <-events:
+				if !ok {
+					// we fell behind, the client has to reload to catch up
+					client.drop()
+					return
+				}
+				if event.ListId != client.listId {
+					continue
+				}
+				visible, err := streamVisible(db, client.user.Id, event)
+				if err != nil {
+					logger.Printf("list socket for user %d: %v", client.user.Id, err)
+					client.drop()
+					return
+				}
+				if visible {
+					client.enqueue(socketMessage{Type: "item", Item: &event})
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(socketReadTimeout))
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			client.drop()
+			return
+		}
+
+		var msg socketMessage
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&msg); err != nil {
+			client.enqueue(socketMessage{Type: "error", Error: "Bad Request: Malformed JSON"})
+			continue
+		}
+
+		switch msg.Type {
+		case "pong":
+		case "patch":
+			result := socketMessage{Type: "patch_result", Ref: msg.Ref, Status: http.StatusOK}
+			if msg.Patch == nil {
+				result.Status, result.Error = http.StatusBadRequest, "missing patch"
+			} else if status, err := patchItem(logger, db, hub, client.user.Id, *msg.Patch); err != nil {
+				result.Status, result.Error = status, err.Error()
+			}
+			client.enqueue(result)
+		default:
+			client.enqueue(socketMessage{Type: "error", Ref: msg.Ref, Error: "unknown message type"})
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestListSocket(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	presence := newPresence()
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	if code := doJson(t, handleWishlistPost(logger, db, hub), alice, "POST", "/api/wishlist",
+		`{"description": "kite", "source": "", "cost": ""}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+	listId, err := defaultListId(db, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/lists/{id}/socket", authMiddlewareNew(logger, db)(handleListSocket(logger, db, hub, presence)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/lists/" + fmt.Sprint(listId) + "/socket"
+
+	sessionCookie := func(userId uint64) string {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		if err := createSession(logger, &Config{AllowInsecure: true}, db, int64(userId), "test", rr); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Result().Cookies()[0].String()
+	}
+	dial := func(cookie string, origin string) (*websocket.Conn, error) {
+		config, err := websocket.NewConfig(socketURL, origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != "" {
+			config.Header.Set("Cookie", cookie)
+		}
+		return websocket.DialConfig(config)
+	}
+	receive := func(conn *websocket.Conn) socketMessage {
+		t.Helper()
+		var msg socketMessage
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		return msg
+	}
+	viewers := func(msg socketMessage) []uint64 {
+		var ret []uint64
+		for _, viewer := range msg.Viewers {
+			ret = append(ret, viewer.Id)
+		}
+		return ret
+	}
+
+	if _, err := dial("", server.URL); err == nil {
+		t.Errorf("connected without a session")
+	}
+	if _, err := dial(sessionCookie(bob), "http://evil.example.com"); err == nil {
+		t.Errorf("connected from another origin")
+	}
+
+	aliceConn, err := dial(sessionCookie(alice), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aliceConn.Close()
+	if msg := receive(aliceConn); msg.Type != "presence" || len(msg.Viewers) != 1 || msg.Viewers[0].FirstName != "Alice" {
+		t.Errorf("unexpected presence %+v", msg)
+	}
+	bobConn, err := dial(sessionCookie(bob), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+		if msg := receive(conn); msg.Type != "presence" || len(msg.Viewers) != 2 {
+			t.Errorf("unexpected presence %+v", msg)
+		}
+	}
+
+	// patches get the same checks as over http
+	patch := func(conn *websocket.Conn, ref uint64, body string) {
+		t.Helper()
+		msg := `{"type": "patch", "ref": ` + fmt.Sprint(ref) + `, "patch": ` + body + `}`
+		if err := websocket.Message.Send(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patch(bobConn, 1, `{"id": 1, "seq": 1, "description": "mine now"}`)
+	if msg := receive(bobConn); msg.Type != "patch_result" || msg.Ref != 1 || msg.Status != http.StatusBadRequest {
+		t.Errorf("unexpected result %+v", msg)
+	}
+	patch(bobConn, 2, `{"id": 1, "seq": 1, "buyer_notes": "got it"}`)
+	got := make(map[string]socketMessage)
+	for len(got) < 2 {
+		msg := receive(bobConn)
+		got[msg.Type] = msg
+	}
+	if got["patch_result"].Ref != 2 || got["patch_result"].Status != http.StatusOK ||
+		got["item"].Item == nil || got["item"].Item.Seq != 2 {
+		t.Errorf("unexpected messages %+v", got)
+	}
+
+	// alice hears about her own change but never bob's buyer notes
+	patch(aliceConn, 3, `{"id": 1, "seq": 2, "description": "red kite"}`)
+	got = make(map[string]socketMessage)
+	for len(got) < 2 {
+		msg := receive(aliceConn)
+		got[msg.Type] = msg
+	}
+	if got["item"].Item == nil || got["item"].Item.Seq != 3 || got["patch_result"].Status != http.StatusOK {
+		t.Errorf("unexpected messages %+v", got)
+	}
+
+	bobConn.Close()
+	if msg := receive(aliceConn); msg.Type != "presence" || len(viewers(msg)) != 1 || viewers(msg)[0] != alice {
+		t.Errorf("unexpected presence after bob left %+v", msg)
+	}
+
+	// shutting down hangs up on everyone
+	presence.Close()
+	var msg socketMessage
+	aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(aliceConn, &msg); err == nil {
+		t.Errorf("still connected after shutdown, got %+v", msg)
+	}
+	if conn, err := dial(sessionCookie(alice), server.URL); err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(conn, &msg); err == nil {
+			t.Errorf("connected after shutdown, got %+v", msg)
+		}
+	}
+}
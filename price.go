@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// currency used when a free-text cost has a bare number or a "$"
+const defaultCurrency = "USD"
+
+// number of digits after the decimal point for currencies that don't use 2
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"CLP": 0,
+	"ISK": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"OMR": 3,
+	"JOD": 3,
+}
+
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+var currencySymbols = []struct {
+	Symbol   string
+	Currency string
+}{
+	// longer symbols first so "C$" isn't read as "$"
+	{"US$", "USD"},
+	{"C$", "CAD"},
+	{"CA$", "CAD"},
+	{"A$", "AUD"},
+	{"AU$", "AUD"},
+	{"NZ$", "NZD"},
+	{"HK$", "HKD"},
+	{"$", "USD"},
+	{"€", "EUR"},
+	{"£", "GBP"},
+	{"¥", "JPY"},
+	{"₩", "KRW"},
+	{"₹", "INR"},
+	{"bucks", "USD"},
+	{"dollars", "USD"},
+	{"euros", "EUR"},
+	{"pounds", "GBP"},
+}
+
+var (
+	currencyCodeRegex = regexp.MustCompile(`\b[A-Z]{3}\b`)
+	amountRegex       = regexp.MustCompile(`[0-9][0-9,.]*`)
+)
+
+// parseCost makes a best-effort attempt to pull a price out of the free-text
+// cost column, e.g. "$2.95", "~40 bucks", "EUR 12,50" or "30-40". Ranges use
+// the first number. Returns ok=false if no number could be found.
+func parseCost(cost string) (amount int64, currency string, ok bool) {
+	if code := currencyCodeRegex.FindString(strings.ToUpper(cost)); code != "" && isKnownCurrency(code) {
+		currency = code
+	}
+	if currency == "" {
+		lower := strings.ToLower(cost)
+		for _, s := range currencySymbols {
+			if strings.Contains(lower, strings.ToLower(s.Symbol)) {
+				currency = s.Currency
+				break
+			}
+		}
+	}
+	if currency == "" {
+		currency = defaultCurrency
+	}
+
+	number := amountRegex.FindString(cost)
+	if number == "" {
+		return 0, "", false
+	}
+
+	amount, ok = parsePrice(number, currency)
+	if !ok {
+		return 0, "", false
+	}
+	return amount, currency, true
+}
+
+// parsePrice converts a bare decimal number like "2.95" or "1.234,50" into
+// minor units of currency.
+func parsePrice(number string, currency string) (int64, bool) {
+	number = strings.TrimRight(strings.TrimSpace(number), ",.")
+	value, err := strconv.ParseFloat(normalizeDecimal(number), 64)
+	if err != nil || value < 0 {
+		return 0, false
+	}
+
+	scale := math.Pow10(currencyExponent(currency))
+	return int64(math.Round(value * scale)), true
+}
+
+// normalizeDecimal turns "1,234.50", "1.234,50" and "12,50" into something
+// strconv.ParseFloat understands.
+func normalizeDecimal(number string) string {
+	lastComma := strings.LastIndex(number, ",")
+	lastDot := strings.LastIndex(number, ".")
+
+	switch {
+	case lastComma >= 0 && lastDot >= 0:
+		// whichever comes last is the decimal separator
+		if lastComma > lastDot {
+			number = strings.ReplaceAll(number, ".", "")
+			number = strings.Replace(number, ",", ".", 1)
+		} else {
+			number = strings.ReplaceAll(number, ",", "")
+		}
+	case lastComma >= 0:
+		// "12,50" is a decimal, "1,250" is a thousands separator
+		if len(number)-lastComma-1 == 3 {
+			number = strings.ReplaceAll(number, ",", "")
+		} else {
+			number = strings.Replace(number, ",", ".", 1)
+		}
+	}
+	return number
+}
+
+func isKnownCurrency(code string) bool {
+	if _, ok := currencyExponents[code]; ok {
+		return true
+	}
+	for _, s := range currencySymbols {
+		if s.Currency == code {
+			return true
+		}
+	}
+	switch code {
+	case "CHF", "SEK", "NOK", "DKK", "PLN", "CZK", "MXN", "BRL", "CNY", "ZAR", "SGD":
+		return true
+	}
+	return false
+}
+
+// validCurrency checks that a client supplied currency looks like an ISO 4217
+// code.
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseCost(t *testing.T) {
+	type testCase struct {
+		cost     string
+		amount   int64
+		currency string
+		ok       bool
+	}
+
+	tests := []testCase{
+		{cost: "$2.95", amount: 295, currency: "USD", ok: true},
+		{cost: "2.95", amount: 295, currency: "USD", ok: true},
+		{cost: "~40 bucks", amount: 4000, currency: "USD", ok: true},
+		{cost: "$1,250", amount: 125000, currency: "USD", ok: true},
+		{cost: "$1,250.99", amount: 125099, currency: "USD", ok: true},
+		{cost: "EUR 12,50", amount: 1250, currency: "EUR", ok: true},
+		{cost: "1.234,50 €", amount: 123450, currency: "EUR", ok: true},
+		{cost: "£10", amount: 1000, currency: "GBP", ok: true},
+		{cost: "C$15", amount: 1500, currency: "CAD", ok: true},
+		{cost: "¥3000", amount: 3000, currency: "JPY", ok: true},
+		{cost: "30-40", amount: 3000, currency: "USD", ok: true},
+		{cost: "12 usd", amount: 1200, currency: "USD", ok: true},
+		{cost: "", ok: false},
+		{cost: "cheap", ok: false},
+		{cost: "one black, one red", ok: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.cost, func(t *testing.T) {
+			amount, currency, ok := parseCost(tc.cost)
+			if ok != tc.ok {
+				t.Fatalf("parseCost(%q) ok = %v, expected %v", tc.cost, ok, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			if amount != tc.amount || currency != tc.currency {
+				t.Errorf("parseCost(%q) = %d %s, expected %d %s", tc.cost, amount, currency,
+					tc.amount, tc.currency)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// checkTrackedPrices re-fetches the price of every tracked item that hasn't
+// been checked in the last interval and records it in price_history. The
+// latest price also updates the item's link preview.
+func checkTrackedPrices(ctx context.Context, logger *log.Logger, db *sql.DB, fetcher *linkFetcher, now time.Time, interval time.Duration) error {
+	type trackedItem struct {
+		Id     uint64
+		Source string
+	}
+
+	cutoff := now.Add(-interval).UTC().Format(sqliteTimeFormat)
+	rows, err := db.QueryContext(ctx, `SELECT id,source FROM wishlist
+		WHERE track_price AND `+liveItem+` AND (price_check_time IS NULL OR price_check_time <= ?)`, cutoff)
+	if err != nil {
+		return err
+	}
+	var due []trackedItem
+	for rows.Next() {
+		var item trackedItem
+		err = rows.Scan(&item.Id, &item.Source)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, item)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	checkTime := now.UTC().Format(sqliteTimeFormat)
+	for _, item := range due {
+		var preview *LinkPreview
+		if u, ok := parseSourceURL(item.Source); ok {
+			preview, err = fetcher.Fetch(ctx, u)
+			if err != nil {
+				logger.Printf("error checking price for item %d: %v", item.Id, err)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// either way, don't try again until the next interval
+		_, err = db.ExecContext(ctx, "UPDATE wishlist SET price_check_time = ? WHERE id = ?", checkTime, item.Id)
+		if err != nil {
+			return err
+		}
+		if preview == nil || preview.PriceAmount == nil {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, `INSERT INTO price_history(item_id, price_amount, price_currency, check_time)
+			VALUES(?, ?, ?, ?)`, item.Id, *preview.PriceAmount, preview.PriceCurrency, checkTime)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(ctx, `UPDATE wishlist SET preview_price_amount = ?, preview_price_currency = ?
+			WHERE id = ?`, *preview.PriceAmount, preview.PriceCurrency, item.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPriceTracking(ctx context.Context, logger *log.Logger, config *Config, db *sql.DB, fetcher *linkFetcher) {
+	interval := time.Duration(config.PriceCheckIntervalHours) * time.Hour
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		err := checkTrackedPrices(ctx, logger, db, fetcher, time.Now(), interval)
+		if err != nil && ctx.Err() == nil {
+			logger.Printf("error checking tracked prices: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func handlePriceHistoryGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type PricePoint struct {
+			PriceAmount   int64     `json:"price_amount"`
+			PriceCurrency string    `json:"price_currency"`
+			Time          time.Time `json:"time"`
+		}
+
+		type PriceHistoryResponse struct {
+			Entries []PricePoint `json:"entries"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		itemId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed item id", http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM wishlist WHERE id = ? AND deleted_time IS NULL AND "+
+			listVisibleTo("wishlist.list_id"), itemId, userId).Scan(&exists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		}
+
+		rows, err := db.Query(`SELECT price_amount,price_currency,check_time FROM price_history
+			WHERE item_id = ? ORDER BY check_time`, itemId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := PriceHistoryResponse{Entries: []PricePoint{}}
+		for rows.Next() {
+			var point PricePoint
+			err = rows.Scan(&point.PriceAmount, &point.PriceCurrency, &point.Time)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Entries = append(response.Entries, point)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
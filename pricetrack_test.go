@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckTrackedPrices(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "Joe")
+
+	// a product page whose price we can change between checks
+	var cents atomic.Int64
+	cents.Store(3000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><script type="application/ld+json">
+			{"@type": "Product", "name": "Goggles", "offers": {"price": "%d.%02d", "priceCurrency": "USD"}}
+			</script></head></html>`, cents.Load()/100, cents.Load()%100)
+	}))
+	defer server.Close()
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "goggles", "source": "` + server.URL + `", "cost": "", "track_price": true, "price_alert_amount": 2500}`,
+		`{"description": "untracked", "source": "` + server.URL + `", "cost": ""}`,
+	} {
+		if code := doJson(t, post, userId, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+
+	fetcher := newLinkFetcher(true)
+	start := time.Now()
+	check := func(now time.Time) {
+		t.Helper()
+		err := checkTrackedPrices(context.Background(), logger, db, fetcher, now, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type priceResponse struct {
+		Entries []struct {
+			PriceAmount   int64  `json:"price_amount"`
+			PriceCurrency string `json:"price_currency"`
+		} `json:"entries"`
+	}
+	prices := func(itemId string) priceResponse {
+		t.Helper()
+		var response priceResponse
+		req := httptest.NewRequest("GET", "/api/wishlist/"+itemId+"/prices", nil)
+		req.Header.Set("Content-Type", "application/json")
+		req.SetPathValue("id", itemId)
+		rr := httptest.NewRecorder()
+		handlePriceHistoryGet(logger, db)(rr, req, userId)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to get prices: %d", rr.Code)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	priceAlert := func() bool {
+		t.Helper()
+		var response struct {
+			Entries []struct {
+				PriceAlert bool `json:"price_alert"`
+			} `json:"entries"`
+		}
+		doJson(t, handleWishlistGet(logger, db), userId, "GET", "/api/wishlist", "", &response)
+		return response.Entries[0].PriceAlert
+	}
+
+	check(start)
+	if response := prices("1"); len(response.Entries) != 1 || response.Entries[0].PriceAmount != 3000 {
+		t.Fatalf("unexpected price history %+v", response)
+	}
+	if priceAlert() {
+		t.Errorf("price alert at 30.00 with a 25.00 threshold")
+	}
+
+	// not due yet, the price change isn't seen
+	cents.Store(2000)
+	check(start.Add(time.Hour))
+	if response := prices("1"); len(response.Entries) != 1 {
+		t.Fatalf("checked before the interval was up: %+v", response)
+	}
+
+	check(start.Add(25 * time.Hour))
+	response := prices("1")
+	if len(response.Entries) != 2 || response.Entries[1].PriceAmount != 2000 ||
+		response.Entries[1].PriceCurrency != "USD" {
+		t.Fatalf("unexpected price history %+v", response)
+	}
+	if !priceAlert() {
+		t.Errorf("expected a price alert at 20.00 with a 25.00 threshold")
+	}
+
+	if response := prices("2"); len(response.Entries) != 0 {
+		t.Errorf("untracked item has price history %+v", response)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxSearchTerms   = 10
+	maxSearchResults = 50
+)
+
+// ftsQuery turns whatever the user typed into a full-text query that every
+// item word must prefix-match. Punctuation is dropped rather than escaped so
+// nothing the user types can be read as query syntax, and terms are
+// lowercased so they can't be taken for AND/OR/NOT.
+func ftsQuery(q string) string {
+	terms := strings.FieldsFunc(strings.ToLower(q), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	for i := range terms {
+		terms[i] += "*"
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search the current items on every list we can see. Owners' own items are
+// only matched on what they can see, i.e. never on buyer notes.
+func handleSearchGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type SearchResult struct {
+			Id           uint64  `json:"id"`
+			User         User    `json:"user"`
+			Description  string  `json:"description"`
+			Source       string  `json:"source"`
+			Cost         string  `json:"cost"`
+			ThumbnailURL *string `json:"thumbnail_url"`
+		}
+
+		type SearchResponse struct {
+			Entries []SearchResult `json:"entries"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		match := ftsQuery(r.URL.Query().Get("q"))
+		if match == "" {
+			http.Error(w, "missing or empty q parameter", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`SELECT wishlist.id, users.id, users.first_name, users.last_name,
+			wishlist.description, wishlist.source, wishlist.cost, wishlist.thumb_key
+			FROM wishlist JOIN users ON users.id = wishlist.user_id
+			WHERE `+liveItem+` AND `+listVisibleTo("wishlist.list_id")+` AND (
+				wishlist.id IN (SELECT rowid FROM wishlist_fts WHERE wishlist_fts MATCH ?)
+				OR (wishlist.user_id != ? AND
+					wishlist.id IN (SELECT rowid FROM buyer_notes_fts WHERE buyer_notes_fts MATCH ?)))
+			ORDER BY wishlist.id DESC LIMIT ?`, userId, match, userId, match, maxSearchResults)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := SearchResponse{Entries: []SearchResult{}}
+		for rows.Next() {
+			var result SearchResult
+			var thumbKey sql.NullString
+			err = rows.Scan(&result.Id, &result.User.Id, &result.User.FirstName, &result.User.LastName,
+				&result.Description, &result.Source, &result.Cost, &thumbKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.ThumbnailURL = imageURL(thumbKey)
+			response.Entries = append(response.Entries, result)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+)
+
+func TestFtsQuery(t *testing.T) {
+	tests := map[string]string{
+		"board game":            "board* game*",
+		`"board" OR game*`:      "board* or* game*",
+		"  ":                    "",
+		"NEAR(a b) -c":          "near* a* b* c*",
+		"Schwimmbrille größe 2": "schwimmbrille* größe* 2*",
+	}
+	for q, expected := range tests {
+		if got := ftsQuery(q); got != expected {
+			t.Errorf("ftsQuery(%q) = %q, expected %q", q, got, expected)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+	buyer := createTestUser(t, db, "Buyer")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "Settlers board game", "source": "boardgames.example.com", "cost": ""}`,
+		`{"description": "Swim goggles", "source": "", "cost": "", "owner_notes": "the blue ones"}`,
+		`{"description": "Socks", "source": "", "cost": ""}`,
+		`{"description": "Old board game", "source": "", "cost": ""}`,
+	} {
+		if code := doJson(t, post, owner, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+
+	patch := handleWishlistPatch(logger, db, newHub())
+	if code := doJson(t, patch, buyer, "PATCH", "/api/wishlist",
+		`{"id": 3, "seq": 1, "buyer_notes": "bought the woolly ones"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to patch buyer notes: %d", code)
+	}
+	if code := doJson(t, patch, owner, "PATCH", "/api/wishlist",
+		`{"id": 2, "seq": 1, "description": "Speedo goggles"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to patch description: %d", code)
+	}
+	if code := doJson(t, handleWishlistArchive(logger, db, newHub()), owner, "POST", "/api/wishlist/archive",
+		`{"ids": [4]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to archive: %d", code)
+	}
+
+	search := func(userId uint64, q string) []uint64 {
+		t.Helper()
+		var response struct {
+			Entries []struct {
+				Id   uint64 `json:"id"`
+				User User   `json:"user"`
+			} `json:"entries"`
+		}
+		code := doJson(t, handleSearchGet(logger, db), userId, "GET", "/api/search?q="+url.QueryEscape(q), "", &response)
+		if code != http.StatusOK {
+			t.Fatalf("search for %q failed: %d", q, code)
+		}
+		ids := []uint64{}
+		for _, entry := range response.Entries {
+			if entry.User.Id != owner || entry.User.FirstName != "Owner" {
+				t.Errorf("unexpected owner %+v", entry.User)
+			}
+			ids = append(ids, entry.Id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+
+	type testCase struct {
+		userId   uint64
+		q        string
+		expected []uint64
+	}
+	tests := []testCase{
+		{buyer, "board game", []uint64{1}},
+		{buyer, "BOARDG", []uint64{1}},
+		{buyer, "blue", []uint64{2}},
+		{buyer, "speedo", []uint64{2}},
+		{buyer, "swim", []uint64{}},
+		{buyer, "woolly", []uint64{3}},
+		{owner, "woolly", []uint64{}},
+		{owner, "socks", []uint64{3}},
+		{buyer, `"settlers`, []uint64{1}},
+	}
+	for _, tc := range tests {
+		got := search(tc.userId, tc.q)
+		if len(got) != len(tc.expected) {
+			t.Errorf("search for %q by %d got %v, expected %v", tc.q, tc.userId, got, tc.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Errorf("search for %q by %d got %v, expected %v", tc.q, tc.userId, got, tc.expected)
+				break
+			}
+		}
+	}
+
+	if code := doJson(t, handleWishlistDelete(logger, db, newHub()), owner, "DELETE", "/api/wishlist", `{"ids": [1]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to delete: %d", code)
+	}
+	if got := search(buyer, "settlers"); len(got) != 0 {
+		t.Errorf("deleted item found: %v", got)
+	}
+
+	if code := doJson(t, handleSearchGet(logger, db), buyer, "GET", "/api/search?q=%22%22", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected empty query to be rejected, got %d", code)
+	}
+}
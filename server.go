@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"database/sql"
@@ -15,11 +14,10 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
-	"net/http/cookiejar"
 	"net/mail"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -31,9 +29,6 @@ import (
 
 	"github.com/ericm1024/wishlist/admin_rpc"
 	"github.com/matthewhartstonge/argon2"
-	"golang.org/x/net/html"
-	"golang.org/x/net/html/atom"
-	"golang.org/x/net/publicsuffix"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
@@ -48,6 +43,28 @@ type Config struct {
 	Port            string `json:"port"`
 	AdminSocketPath string `json:"admin_socket_path"`
 	AllowInsecure   bool   `json:"allow_insecure"`
+
+	// how long deleted wishlist items can be restored before they're purged
+	DeletedRetentionDays int `json:"deleted_retention_days"`
+
+	// let link previews fetch from loopback and private networks
+	LinkPreviewAllowPrivate bool `json:"link_preview_allow_private"`
+
+	// how often to re-check prices of items with price tracking on
+	PriceCheckIntervalHours int `json:"price_check_interval_hours"`
+
+	// where uploaded item images are kept
+	ImageDir string `json:"image_dir"`
+
+	// outgoing mail server as host:port, notification emails are only
+	// logged if this isn't set
+	SmtpAddr     string `json:"smtp_addr"`
+	SmtpFrom     string `json:"smtp_from"`
+	SmtpUsername string `json:"smtp_username"`
+	SmtpPassword string `json:"smtp_password"`
+
+	// where the vistes importer logs in and reads wishlists from
+	VistesURL string `json:"vistes_url"`
 }
 
 const sessionCookieKey = "wishlist_session_id"
@@ -320,6 +337,14 @@ func handleSignup(logger *log.Logger, config *Config, db *sql.DB) http.HandlerFu
 		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
 		defer tx.Rollback()
 
+		// invite codes may come with a group to join
+		var groupId sql.NullInt64
+		err = tx.QueryRow("SELECT group_id FROM invite_codes WHERE invite_code = ?", inviteCodeBlob).Scan(&groupId)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		stmt, err := tx.Prepare("DELETE FROM invite_codes WHERE invite_code = ?")
 		if err != nil {
 			http.Error(w, fmt.Sprintf("error creating prepared statement: %v", err), http.StatusInternalServerError)
@@ -356,15 +381,30 @@ func handleSignup(logger *log.Logger, config *Config, db *sql.DB) http.HandlerFu
 			return
 		}
 
-		err = tx.Commit()
+		lastID, err := result.LastInsertId()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error committing transaction: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("error getting id: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		lastID, err := result.LastInsertId()
+		// without a group nobody could see them, so they go in the one for everyone
+		if !groupId.Valid {
+			everyone, err := defaultGroupId(tx)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("error finding default group: %v", err), http.StatusInternalServerError)
+				return
+			}
+			groupId = sql.NullInt64{Int64: int64(everyone), Valid: true}
+		}
+		err = addGroupMember(tx, uint64(groupId.Int64), uint64(lastID), groupRoleMember)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error getting id: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("error joining group: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error committing transaction: %v", err), http.StatusInternalServerError)
 			return
 		}
 		logger.Printf("Added user '%s %s' (%s) %d", reqBody.FirstName, reqBody.LastName, reqBody.Email, lastID)
@@ -384,23 +424,57 @@ func handleSignup(logger *log.Logger, config *Config, db *sql.DB) http.HandlerFu
 	}
 }
 
+// sort parameters for handleWishlistGet, priority 1 is the most wanted
+var wishlistSorts = map[string]string{
+	"created":     "",
+	"priority":    "priority",
+	"price":       "price_amount",
+	"description": "description COLLATE NOCASE",
+}
+
 func handleWishlistGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
 	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
 		type WishlistEntry struct {
-			Id           uint64    `json:"id"`
-			Seq          uint64    `json:"seq"`
-			Description  string    `json:"description"`
-			Source       string    `json:"source"`
-			Cost         string    `json:"cost"`
-			OwnerNotes   *string   `json:"owner_notes"`
-			BuyerNotes   *string   `json:"buyer_notes"`
-			CreationTime time.Time `json:"creation_time"`
+			Id            uint64    `json:"id"`
+			Seq           uint64    `json:"seq"`
+			ListId        uint64    `json:"list_id"`
+			Description   string    `json:"description"`
+			Source        string    `json:"source"`
+			Cost          string    `json:"cost"`
+			PriceAmount   *int64    `json:"price_amount"`
+			PriceCurrency *string   `json:"price_currency"`
+			OwnerNotes    *string   `json:"owner_notes"`
+			BuyerNotes    *string   `json:"buyer_notes"`
+			CreationTime  time.Time `json:"creation_time"`
+
+			QuantityDesired  uint64  `json:"quantity_desired"`
+			QuantityReceived uint64  `json:"quantity_received"`
+			QuantityClaimed  *uint64 `json:"quantity_claimed"`
+			ClaimedByMe      *uint64 `json:"claimed_by_me"`
+
+			Tags []string `json:"tags"`
+
+			ArchivedTime *time.Time `json:"archived_time"`
+			DeletedTime  *time.Time `json:"deleted_time"`
+
+			Preview *LinkPreview `json:"preview"`
+
+			TrackPrice       bool   `json:"track_price"`
+			PriceAlertAmount *int64 `json:"price_alert_amount"`
+			PriceAlert       bool   `json:"price_alert"`
+
+			ImageURL     *string `json:"image_url"`
+			ThumbnailURL *string `json:"thumbnail_url"`
+
+			Priority *uint64 `json:"priority"`
 		}
 
 		type WishlistGetResponse struct {
-			Headers WishlistEntry   `json:"headers"`
-			Entries []WishlistEntry `json:"entries"`
-			User    `json:"user"`
+			Headers    WishlistEntry   `json:"headers"`
+			Entries    []WishlistEntry `json:"entries"`
+			User       `json:"user"`
+			TagCounts  []TagCount `json:"tag_counts"`
+			NextCursor *string    `json:"next_cursor"`
 		}
 
 		if r.Header.Get("Content-Type") != "application/json" {
@@ -421,17 +495,121 @@ func handleWishlistGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter,
 			queryUserId = userId
 		}
 
+		// people outside our groups may as well not exist
+		if queryUserId != userId {
+			visible, err := canSeeUser(db, userId, queryUserId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				http.Error(w, "non-existent user", http.StatusNotFound)
+				return
+			}
+		}
+
+		// The archived view also has deleted items that haven't been purged
+		// yet so they can be restored. Only the owner gets to see those.
+		state := liveItem
+		switch r.URL.Query().Get("archived") {
+		case "", "false":
+		case "true":
+			if queryUserId == userId {
+				state = "(archived_time IS NOT NULL OR deleted_time IS NOT NULL)"
+			} else {
+				state = "archived_time IS NOT NULL AND deleted_time IS NULL"
+			}
+		default:
+			http.Error(w, "malformed archived parameter", http.StatusBadRequest)
+			return
+		}
+
+		// everything we're allowed to see, optionally narrowed to one list
+		listCond := " AND " + listVisibleTo("wishlist.list_id")
+		listArgs := []interface{}{userId}
+		if listStr := r.URL.Query().Get("listId"); listStr != "" {
+			listId, err := strconv.ParseUint(listStr, 10, 64)
+			if err != nil {
+				http.Error(w, "malformed listId parameter", http.StatusBadRequest)
+				return
+			}
+			listCond += " AND wishlist.list_id = ?"
+			listArgs = append(listArgs, listId)
+		}
+
+		// items without a price or priority always sort last
+		page, err := parsePage(r.URL.Query(), wishlistSorts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := `SELECT id,sequence_number,list_id,description,source,cost,price_amount,price_currency,owner_notes,
+			buyer_notes,creation_time,quantity_desired,quantity_received,archived_time,deleted_time,
+			preview_title,preview_image_url,preview_site_name,preview_price_amount,preview_price_currency,
+			track_price,price_alert_amount,image_key,thumb_key,priority,
+			` + claimedQuantity + `,
+			(SELECT COALESCE(SUM(quantity), 0) FROM claims WHERE item_id = wishlist.id AND user_id = ?),
+			` + page.Sort.key("id") + `
+			FROM wishlist WHERE user_id = ? AND ` + state + listCond
+		args := append([]interface{}{userId, queryUserId}, listArgs...)
+
+		// price filters are in minor units (e.g. cents), matching price_amount
+		for _, filter := range []struct {
+			Param string
+			Cond  string
+		}{
+			{"minPrice", "price_amount >= ?"},
+			{"maxPrice", "price_amount <= ?"},
+		} {
+			str := r.URL.Query().Get(filter.Param)
+			if str == "" {
+				continue
+			}
+			value, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("malformed %s parameter", filter.Param), http.StatusBadRequest)
+				return
+			}
+			query += " AND " + filter.Cond
+			args = append(args, value)
+		}
+
+		currency := r.URL.Query().Get("currency")
+		if currency != "" {
+			if !validCurrency(currency) {
+				http.Error(w, "malformed currency parameter", http.StatusBadRequest)
+				return
+			}
+			query += " AND price_currency = ?"
+			args = append(args, currency)
+		}
+
+		// multiple tags narrow the list to items that have all of them
+		for _, tag := range r.URL.Query()["tag"] {
+			query += ` AND id IN (SELECT wishlist_tags.item_id FROM wishlist_tags
+				JOIN tags ON tags.id = wishlist_tags.tag_id WHERE tags.name = ?)`
+			args = append(args, strings.TrimSpace(tag))
+		}
+
+		if q := r.URL.Query().Get("q"); q != "" {
+			query += ` AND description LIKE ? ESCAPE '\'`
+			args = append(args, likePattern(q))
+		}
+
+		query, args = page.apply(query, args, "id")
+
 		// Make sure the request body stream is closed.
 		defer r.Body.Close()
 
-		stmt, err := db.Prepare("SELECT id,sequence_number,description,source,cost,owner_notes,buyer_notes,creation_time FROM wishlist WHERE user_id = ?")
+		stmt, err := db.Prepare(query)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer stmt.Close()
 
-		rows, err := stmt.Query(queryUserId)
+		rows, err := stmt.Query(args...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -439,21 +617,62 @@ func handleWishlistGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter,
 		defer rows.Close()
 
 		var response WishlistGetResponse
+		var rowCount int
+		var lastId uint64
+		var lastKey interface{}
 		for rows.Next() {
+			rowCount++
+			if page.Limit != 0 && rowCount > page.Limit {
+				// just checking there's more
+				continue
+			}
+
 			response.Entries = append(response.Entries, WishlistEntry{})
 			entry := &response.Entries[len(response.Entries)-1]
 
-			err = rows.Scan(&entry.Id, &entry.Seq, &entry.Description, &entry.Source, &entry.Cost,
-				&entry.OwnerNotes, &entry.BuyerNotes, &entry.CreationTime)
+			var claimed, claimedByMe uint64
+			var previewTitle, previewImage, previewSite, previewCurrency sql.NullString
+			var previewPrice sql.NullInt64
+			var imageKey, thumbKey sql.NullString
+			var sortKey interface{}
+			err = rows.Scan(&entry.Id, &entry.Seq, &entry.ListId, &entry.Description, &entry.Source, &entry.Cost,
+				&entry.PriceAmount, &entry.PriceCurrency, &entry.OwnerNotes, &entry.BuyerNotes,
+				&entry.CreationTime, &entry.QuantityDesired, &entry.QuantityReceived, &entry.ArchivedTime,
+				&entry.DeletedTime, &previewTitle, &previewImage, &previewSite, &previewPrice,
+				&previewCurrency, &entry.TrackPrice, &entry.PriceAlertAmount, &imageKey, &thumbKey,
+				&entry.Priority, &claimed, &claimedByMe, &sortKey)
 
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			lastId, lastKey = entry.Id, sortKey
+
+			if previewTitle.Valid || previewImage.Valid || previewPrice.Valid {
+				entry.Preview = &LinkPreview{
+					Title:         previewTitle.String,
+					ImageURL:      previewImage.String,
+					SiteName:      previewSite.String,
+					PriceCurrency: previewCurrency.String,
+				}
+				if previewPrice.Valid {
+					entry.Preview.PriceAmount = &previewPrice.Int64
+				}
+			}
+
+			entry.ImageURL = imageURL(imageKey)
+			entry.ThumbnailURL = imageURL(thumbKey)
 
-			// requesting our own wishlist, we don't get to see the buyer notes
+			// the latest tracked price is at or below what the owner is waiting for
+			entry.PriceAlert = entry.TrackPrice && entry.PriceAlertAmount != nil && previewPrice.Valid &&
+				previewPrice.Int64 <= *entry.PriceAlertAmount
+
+			// requesting our own wishlist, we don't get to see the buyer notes or claims
 			if queryUserId == userId {
 				entry.BuyerNotes = nil
+			} else {
+				entry.QuantityClaimed = &claimed
+				entry.ClaimedByMe = &claimedByMe
 			}
 		}
 		err = rows.Err()
@@ -461,6 +680,23 @@ func handleWishlistGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter,
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		response.NextCursor = page.nextCursor(rowCount, lastId, lastKey)
+
+		// counts cover the whole list, not just what the tag filter matched,
+		// so the UI can offer every tag as a filter
+		itemTags, err := loadItemTags(db, "wishlist.user_id = ? AND "+state+listCond,
+			append([]interface{}{queryUserId}, listArgs...)...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range response.Entries {
+			response.Entries[i].Tags = itemTags[response.Entries[i].Id]
+			if response.Entries[i].Tags == nil {
+				response.Entries[i].Tags = []string{}
+			}
+		}
+		response.TagCounts = countTags(itemTags)
 
 		stmt, err = db.Prepare("SELECT first_name,last_name FROM users WHERE id = ?")
 		if err != nil {
@@ -484,14 +720,27 @@ func handleWishlistGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter,
 	}
 }
 
-func handleWishlistPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+func handleWishlistPost(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
 	return func(w http.ResponseWriter, r *http.Request, id uint64) {
 
 		type WishlistEntry struct {
-			Description string `json:"description"`
-			Source      string `json:"source"`
-			Cost        string `json:"cost"`
-			OwnerNotes  string `json:"owner_notes"`
+			Description   string  `json:"description"`
+			Source        string  `json:"source"`
+			Cost          string  `json:"cost"`
+			PriceAmount   *int64  `json:"price_amount"`
+			PriceCurrency *string `json:"price_currency"`
+			OwnerNotes    string  `json:"owner_notes"`
+
+			QuantityDesired *uint64  `json:"quantity_desired"`
+			Tags            []string `json:"tags"`
+
+			TrackPrice       bool   `json:"track_price"`
+			PriceAlertAmount *int64 `json:"price_alert_amount"`
+
+			Priority *uint64 `json:"priority"`
+
+			// the default list if left out
+			ListId *uint64 `json:"list_id"`
 		}
 
 		type WishlistResponse struct {
@@ -514,14 +763,73 @@ func handleWishlistPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter
 		// Make sure the request body stream is closed.
 		defer r.Body.Close()
 
-		stmt, err := db.Prepare("INSERT INTO wishlist(user_id, description, source, cost, owner_notes) VALUES(?, ?, ?, ?, ?)")
+		priceAmount, priceCurrency, err := priceFromRequest(reqBody.Cost, reqBody.PriceAmount, reqBody.PriceCurrency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var quantityDesired uint64 = 1
+		if reqBody.QuantityDesired != nil {
+			if *reqBody.QuantityDesired == 0 {
+				http.Error(w, "quantity_desired must be at least 1", http.StatusBadRequest)
+				return
+			}
+			quantityDesired = *reqBody.QuantityDesired
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		if reqBody.PriceAlertAmount != nil && *reqBody.PriceAlertAmount < 0 {
+			http.Error(w, "price_alert_amount must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		// 0 is the same as leaving it out
+		if reqBody.Priority != nil && *reqBody.Priority == 0 {
+			reqBody.Priority = nil
+		}
+		if reqBody.Priority != nil && *reqBody.Priority > math.MaxInt64 {
+			http.Error(w, "priority is too large", http.StatusBadRequest)
+			return
+		}
+
+		var listId uint64
+		if reqBody.ListId != nil {
+			owned, err := ownsList(tx, id, *reqBody.ListId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !owned {
+				http.Error(w, "non-existent list", http.StatusNotFound)
+				return
+			}
+			listId = *reqBody.ListId
+		} else {
+			listId, err = defaultListId(tx, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		stmt, err := tx.Prepare("INSERT INTO wishlist(user_id, list_id, description, source, cost, price_amount, price_currency, owner_notes, quantity_desired, track_price, price_alert_amount, priority) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer stmt.Close()
 
-		result, err := stmt.Exec(id, reqBody.Description, reqBody.Source, reqBody.Cost, reqBody.OwnerNotes)
+		result, err := stmt.Exec(id, listId, reqBody.Description, reqBody.Source, reqBody.Cost, priceAmount,
+			priceCurrency, reqBody.OwnerNotes, quantityDesired, reqBody.TrackPrice, reqBody.PriceAlertAmount,
+			reqBody.Priority)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -533,6 +841,41 @@ func handleWishlistPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter
 			return
 		}
 
+		err = setItemTags(tx, id, uint64(lastID), reqBody.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		after, err := loadItemSnapshot(tx, uint64(lastID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = recordItemChange(tx, id, "create", nil, after)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = recordItemActivity(tx, activityItemAdded, uint64(lastID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = notifyFollowers(tx, id, uint64(lastID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		publishItems(logger, db, hub, "create", false, uint64(lastID))
+
 		response := WishlistResponse{Id: uint64(lastID)}
 
 		// Encode the data and write it to the response
@@ -543,9 +886,29 @@ func handleWishlistPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter
 	}
 }
 
-func handleWishlistDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+func handleWishlistDelete(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	// rows stick around (along with their claims and buyer notes) so they can
+	// be restored until the background cleanup purges them
+	return handleWishlistBulkUpdate(logger, db, hub, "delete",
+		"deleted_time = CURRENT_TIMESTAMP", "deleted_time IS NULL")
+}
+
+func handleWishlistArchive(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return handleWishlistBulkUpdate(logger, db, hub, "archive",
+		"archived_time = CURRENT_TIMESTAMP", "deleted_time IS NULL AND archived_time IS NULL")
+}
+
+// Undo for both delete and archive.
+func handleWishlistRestore(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return handleWishlistBulkUpdate(logger, db, hub, "restore",
+		"deleted_time = NULL, archived_time = NULL", "(deleted_time IS NOT NULL OR archived_time IS NOT NULL)")
+}
+
+// handleWishlistBulkUpdate applies set to every row in a list of ids owned by
+// the caller that matches cond.
+func handleWishlistBulkUpdate(logger *log.Logger, db *sql.DB, hub *Hub, verb string, set string, cond string) func(http.ResponseWriter, *http.Request, uint64) {
 	return func(w http.ResponseWriter, r *http.Request, id uint64) {
-		type DeleteRequest struct {
+		type BulkRequest struct {
 			Ids []uint64 `json:"ids"`
 		}
 
@@ -554,7 +917,7 @@ func handleWishlistDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWrit
 			return
 		}
 
-		var reqBody DeleteRequest
+		var reqBody BulkRequest
 		decoder := json.NewDecoder(r.Body)
 		decoder.DisallowUnknownFields()
 		if err := decoder.Decode(&reqBody); err != nil {
@@ -597,31 +960,66 @@ func handleWishlistDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWrit
 		args[len(reqBody.Ids)] = id
 
 		var count uint
-		selectStmt.QueryRow(args...).Scan(&count)
+		err = selectStmt.QueryRow(args...).Scan(&count)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		if count != 0 {
-			http.Error(w, "Attempt to delete wishlist rows not owned by user", http.StatusUnauthorized)
+			http.Error(w, fmt.Sprintf("Attempt to %s wishlist rows not owned by user", verb),
+				http.StatusUnauthorized)
 			return
 		}
 
-		deleteStmt, err := tx.Prepare(
-			fmt.Sprintf("DELETE FROM wishlist WHERE id IN (%s) AND user_id == ?", placeholdersStr))
+		var before []*itemSnapshot
+		for _, itemId := range reqBody.Ids {
+			snapshot, err := loadItemSnapshot(tx, itemId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if snapshot != nil {
+				before = append(before, snapshot)
+			}
+		}
+
+		updateStmt, err := tx.Prepare(
+			fmt.Sprintf("UPDATE wishlist SET %s, sequence_number = sequence_number + 1 WHERE id IN (%s) AND user_id == ? AND %s",
+				set, placeholdersStr, cond))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer deleteStmt.Close()
+		defer updateStmt.Close()
 
-		result, err := deleteStmt.Exec(args...)
+		result, err := updateStmt.Exec(args...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		for _, snapshot := range before {
+			after, err := loadItemSnapshot(tx, snapshot.Id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			err = recordItemChange(tx, id, verb, snapshot, after)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// rows that were already archived don't change and don't count
+			if verb == "archive" && after != nil && after.Seq != snapshot.Seq {
+				err = recordItemActivity(tx, activityItemArchived, snapshot.Id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
 		err = tx.Commit()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -633,21 +1031,39 @@ func handleWishlistDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWrit
 			http.Error(w, "non-existent row", http.StatusNotFound)
 			return
 		}
+
+		for _, snapshot := range before {
+			publishItems(logger, db, hub, verb, false, snapshot.Id)
+		}
 	}
 }
 
-func handleWishlistPatch(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
-	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
-		type WishlistPatch struct {
-			Id          uint64  `json:"id"`
-			Seq         uint64  `json:"seq"`
-			Description *string `json:"description"`
-			Source      *string `json:"source"`
-			Cost        *string `json:"cost"`
-			OwnerNotes  *string `json:"owner_notes"`
-			BuyerNotes  *string `json:"buyer_notes"`
-		}
+type WishlistPatch struct {
+	Id            uint64  `json:"id"`
+	Seq           uint64  `json:"seq"`
+	Description   *string `json:"description"`
+	Source        *string `json:"source"`
+	Cost          *string `json:"cost"`
+	PriceAmount   *int64  `json:"price_amount"`
+	PriceCurrency *string `json:"price_currency"`
+	OwnerNotes    *string `json:"owner_notes"`
+	BuyerNotes    *string `json:"buyer_notes"`
+
+	QuantityDesired *uint64  `json:"quantity_desired"`
+	Tags            []string `json:"tags"`
+
+	TrackPrice       *bool  `json:"track_price"`
+	PriceAlertAmount *int64 `json:"price_alert_amount"`
 
+	// 0 clears it
+	Priority *uint64 `json:"priority"`
+
+	// moves the item to another of the owner's lists
+	ListId *uint64 `json:"list_id"`
+}
+
+func handleWishlistPatch(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
 		var req WishlistPatch
 		decoder := json.NewDecoder(r.Body)
 		decoder.DisallowUnknownFields()
@@ -659,108 +1075,488 @@ func handleWishlistPatch(logger *log.Logger, db *sql.DB) func(http.ResponseWrite
 		// Make sure the request body stream is closed.
 		defer r.Body.Close()
 
-		if req.Id == 0 || req.Seq == 0 {
-			http.Error(w, "missing id or seq", http.StatusBadRequest)
-			return
+		if status, err := patchItem(logger, db, hub, userId, req); err != nil {
+			http.Error(w, err.Error(), status)
 		}
+	}
+}
 
-		tx, err := db.Begin()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// patchItem applies a patch on behalf of userId, returning the http status
+// to report if it fails. Owners can edit anything but buyer notes and
+// everyone else can only edit buyer notes.
+func patchItem(logger *log.Logger, db *sql.DB, hub *Hub, userId uint64, req WishlistPatch) (int, error) {
+	if req.Id == 0 || req.Seq == 0 {
+		return http.StatusBadRequest, errors.New("missing id or seq")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
+
+	// Prepare a statement for insertion within the transaction
+	selectStmt, err := tx.Prepare("SELECT user_id,sequence_number,price_currency FROM wishlist WHERE id == ? AND deleted_time IS NULL AND " +
+		listVisibleTo("wishlist.list_id"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer selectStmt.Close()
+
+	// rows on lists we can't see look the same as ones that don't exist
+	var rowUserId int64
+	var sequenceNumber int64
+	var storedCurrency sql.NullString
+	err = selectStmt.QueryRow(req.Id, userId).Scan(&rowUserId, &sequenceNumber, &storedCurrency)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("error loading row")
+	}
+
+	if uint64(sequenceNumber) != req.Seq {
+		return http.StatusConflict, fmt.Errorf("client seq %d does not match server seq %d, try again",
+			req.Seq, sequenceNumber)
+	}
+
+	if uint64(rowUserId) == userId {
+		if req.BuyerNotes != nil {
+			return http.StatusBadRequest, errors.New("wishlist owner can not edit buyer notes")
 		}
-		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
-		defer tx.Rollback()
+		if req.Description == nil && req.Source == nil && req.Cost == nil && req.PriceAmount == nil &&
+			req.PriceCurrency == nil && req.OwnerNotes == nil && req.QuantityDesired == nil &&
+			req.Tags == nil && req.TrackPrice == nil && req.PriceAlertAmount == nil && req.Priority == nil &&
+			req.ListId == nil {
+			return http.StatusBadRequest, errors.New("must provide something to patch")
+		}
+	} else {
+		if req.Description != nil || req.Source != nil || req.Cost != nil || req.PriceAmount != nil ||
+			req.PriceCurrency != nil || req.OwnerNotes != nil || req.QuantityDesired != nil ||
+			req.Tags != nil || req.TrackPrice != nil || req.PriceAlertAmount != nil || req.Priority != nil ||
+			req.ListId != nil {
+			return http.StatusBadRequest, errors.New("non-owner can only edit buyer notes")
+		}
+		if req.BuyerNotes == nil {
+			return http.StatusBadRequest, errors.New("must provide something to patch")
+		}
+	}
 
-		// Prepare a statement for insertion within the transaction
-		selectStmt, err := tx.Prepare("SELECT user_id,sequence_number FROM wishlist WHERE id == ?")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	var fields = []struct {
+		RequestField *string
+		DbColumn     string
+	}{
+		{req.Description, "description"},
+		{req.Source, "source"},
+		{req.Cost, "cost"},
+		{req.OwnerNotes, "owner_notes"},
+		{req.BuyerNotes, "buyer_notes"},
+	}
+
+	var arguments []interface{}
+	var fieldsToSet []string
+	for _, mapping := range fields {
+		if mapping.RequestField != nil {
+			arguments = append(arguments, *mapping.RequestField)
+			fieldsToSet = append(fieldsToSet, fmt.Sprintf("%s = ?", mapping.DbColumn))
 		}
-		defer selectStmt.Close()
+	}
 
-		var rowUserId int64
-		var sequenceNumber int64
-		err = selectStmt.QueryRow(req.Id).Scan(&rowUserId, &sequenceNumber)
+	// an explicit price wins, otherwise keep the price in sync with a new cost string
+	if req.PriceAmount != nil || req.PriceCurrency != nil || req.Cost != nil {
+		var cost string
+		if req.Cost != nil {
+			cost = *req.Cost
+		}
+		// a new amount alone is in the currency the item already has
+		currency := req.PriceCurrency
+		if req.PriceAmount != nil && currency == nil && storedCurrency.Valid {
+			currency = &storedCurrency.String
+		}
+		priceAmount, priceCurrency, err := priceFromRequest(cost, req.PriceAmount, currency)
 		if err != nil {
-			http.Error(w, "error loading row", http.StatusInternalServerError)
-			return
+			return http.StatusBadRequest, err
 		}
+		arguments = append(arguments, priceAmount, priceCurrency)
+		fieldsToSet = append(fieldsToSet, "price_amount = ?", "price_currency = ?")
+	}
 
-		if uint64(sequenceNumber) != req.Seq {
-			http.Error(w, fmt.Sprintf("client seq %d does not match server seq %d, try again",
-				req.Seq, sequenceNumber), http.StatusConflict)
-			return
+	if req.QuantityDesired != nil {
+		if *req.QuantityDesired == 0 {
+			return http.StatusBadRequest, errors.New("quantity_desired must be at least 1")
 		}
+		// asking for no more than has already come in finishes the item off,
+		// like receiving the last one does
+		arguments = append(arguments, *req.QuantityDesired, *req.QuantityDesired)
+		fieldsToSet = append(fieldsToSet, "quantity_desired = ?", `archived_time = CASE
+			WHEN archived_time IS NULL AND quantity_received >= ? THEN CURRENT_TIMESTAMP ELSE archived_time END`)
+	}
 
-		if uint64(rowUserId) == userId {
-			if req.BuyerNotes != nil {
-				http.Error(w, "wishlist owner can not edit buyer notes", http.StatusBadRequest)
-				return
-			}
-			if req.Description == nil && req.Source == nil && req.Cost == nil && req.OwnerNotes == nil {
-				http.Error(w, "must provide something to patch", http.StatusBadRequest)
-				return
-			}
-		} else {
-			if req.Description != nil || req.Source != nil || req.Cost != nil || req.OwnerNotes != nil {
-				http.Error(w, "non-owner can only edit buyer notes", http.StatusBadRequest)
-				return
-			}
-			if req.BuyerNotes == nil {
-				http.Error(w, "must provide something to patch", http.StatusBadRequest)
-				return
-			}
-		}
+	if req.TrackPrice != nil {
+		arguments = append(arguments, *req.TrackPrice)
+		fieldsToSet = append(fieldsToSet, "track_price = ?")
+	}
 
-		var fields = []struct {
-			RequestField *string
-			DbColumn     string
-		}{
-			{req.Description, "description"},
-			{req.Source, "source"},
-			{req.Cost, "cost"},
-			{req.OwnerNotes, "owner_notes"},
-			{req.BuyerNotes, "buyer_notes"},
-		}
-
-		var arguments []interface{}
-		var fieldsToSet []string
-		for _, mapping := range fields {
-			if mapping.RequestField != nil {
-				arguments = append(arguments, *mapping.RequestField)
-				fieldsToSet = append(fieldsToSet, fmt.Sprintf("%s = ?", mapping.DbColumn))
-			}
+	if req.PriceAlertAmount != nil {
+		if *req.PriceAlertAmount < 0 {
+			return http.StatusBadRequest, errors.New("price_alert_amount must not be negative")
 		}
-		fieldsToSet = append(fieldsToSet, "sequence_number = ?")
-		arguments = append(arguments, req.Seq+1)
-
-		arguments = append(arguments, req.Id)
+		arguments = append(arguments, *req.PriceAlertAmount)
+		fieldsToSet = append(fieldsToSet, "price_alert_amount = ?")
+	}
 
-		preparedStr := fmt.Sprintf("UPDATE wishlist SET %s WHERE id = ?", strings.Join(fieldsToSet, ", "))
-		logger.Printf("update statement: %s", preparedStr)
-		updateStmt, err := tx.Prepare(preparedStr)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if req.Priority != nil {
+		if *req.Priority > math.MaxInt64 {
+			return http.StatusBadRequest, errors.New("priority is too large")
 		}
-		defer updateStmt.Close()
+		priority := sql.NullInt64{Int64: int64(*req.Priority), Valid: *req.Priority != 0}
+		arguments = append(arguments, priority)
+		fieldsToSet = append(fieldsToSet, "priority = ?")
+	}
 
-		_, err = updateStmt.Exec(arguments...)
+	if req.ListId != nil {
+		owned, err := ownsList(tx, userId, *req.ListId)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return http.StatusInternalServerError, err
+		}
+		if !owned {
+			return http.StatusNotFound, errors.New("non-existent list")
 		}
+		arguments = append(arguments, *req.ListId)
+		fieldsToSet = append(fieldsToSet, "list_id = ?")
+	}
+	fieldsToSet = append(fieldsToSet, "sequence_number = ?")
+	arguments = append(arguments, req.Seq+1)
 
-		err = tx.Commit()
+	arguments = append(arguments, req.Id)
+
+	before, err := loadItemSnapshot(tx, req.Id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	preparedStr := fmt.Sprintf("UPDATE wishlist SET %s WHERE id = ?", strings.Join(fieldsToSet, ", "))
+	logger.Printf("update statement: %s", preparedStr)
+	updateStmt, err := tx.Prepare(preparedStr)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer updateStmt.Close()
+
+	_, err = updateStmt.Exec(arguments...)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if req.Tags != nil {
+		err = setItemTags(tx, userId, req.Id, req.Tags)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	after, err := loadItemSnapshot(tx, req.Id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = recordItemChange(tx, userId, "patch", before, after)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if before.Fields["archived"] != after.Fields["archived"] {
+		err = recordItemActivity(tx, activityItemArchived, req.Id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if req.BuyerNotes != nil {
+		err = notifyClaimers(tx, userId, req.Id, *req.BuyerNotes)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// anyone other than the owner can only have touched buyer notes
+	publishItems(logger, db, hub, "patch", uint64(rowUserId) != userId, req.Id)
+	return http.StatusOK, nil
+}
+
+// Owner-only: record that some number of an item showed up. Once everything
+// that was asked for has been received the item is archived.
+func handleWishlistReceived(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ReceivedRequest struct {
+			Id       uint64  `json:"id"`
+			Quantity *uint64 `json:"quantity"`
+		}
+
+		type ReceivedResponse struct {
+			QuantityReceived uint64 `json:"quantity_received"`
+			Archived         bool   `json:"archived"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req ReceivedRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		var quantity uint64 = 1
+		if req.Quantity != nil {
+			quantity = *req.Quantity
+		}
+		if req.Id == 0 || quantity == 0 {
+			http.Error(w, "missing id or quantity", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		var rowUserId uint64
+		var desired, received uint64
+		err = tx.QueryRow("SELECT user_id,quantity_desired,quantity_received FROM wishlist WHERE id = ? AND "+liveItem,
+			req.Id).Scan(&rowUserId, &desired, &received)
+		if err == sql.ErrNoRows {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if rowUserId != userId {
+			http.Error(w, "only the wishlist owner can mark items received", http.StatusUnauthorized)
+			return
+		}
+
+		var response ReceivedResponse
+		response.QuantityReceived = received + quantity
+		response.Archived = response.QuantityReceived >= desired
+
+		before, err := loadItemSnapshot(tx, req.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE wishlist SET quantity_received = ?, sequence_number = sequence_number + 1,
+			archived_time = CASE WHEN ? THEN CURRENT_TIMESTAMP ELSE NULL END WHERE id = ?`,
+			response.QuantityReceived, response.Archived, req.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		after, err := loadItemSnapshot(tx, req.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = recordItemChange(tx, userId, "received", before, after)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if response.Archived {
+			err = recordItemActivity(tx, activityItemArchived, req.Id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		publishItems(logger, db, hub, "received", false, req.Id)
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 	}
 }
 
+// Non-owners claim some quantity of an item they plan to buy. Posting again
+// replaces the previous quantity. An item can only be claimed up to whatever
+// hasn't already been received or claimed by someone else.
+func handleClaimPost(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ClaimRequest struct {
+			Id       uint64  `json:"id"`
+			Quantity *uint64 `json:"quantity"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req ClaimRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		var quantity uint64 = 1
+		if req.Quantity != nil {
+			quantity = *req.Quantity
+		}
+		if req.Id == 0 || quantity == 0 {
+			http.Error(w, "missing id or quantity", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		var rowUserId uint64
+		var desired, received, otherClaims uint64
+		err = tx.QueryRow(`SELECT user_id,quantity_desired,quantity_received,
+			(SELECT COALESCE(SUM(quantity), 0) FROM claims WHERE item_id = wishlist.id AND user_id != ?) +
+			(SELECT COALESCE(SUM(quantity), 0) FROM anonymous_claims WHERE item_id = wishlist.id)
+			FROM wishlist WHERE id = ? AND `+liveItem+` AND `+listVisibleTo("wishlist.list_id"),
+			userId, req.Id, userId).Scan(&rowUserId, &desired, &received, &otherClaims)
+		if err == sql.ErrNoRows {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if rowUserId == userId {
+			http.Error(w, "wishlist owner can not claim their own items", http.StatusBadRequest)
+			return
+		}
+
+		// what's been received is taken to be what was claimed, see quantityTaken
+		if max(received, otherClaims+quantity) > desired {
+			http.Error(w, "not enough of this item left to claim", http.StatusConflict)
+			return
+		}
+
+		_, err = tx.Exec(`INSERT INTO claims(item_id, user_id, quantity) VALUES(?, ?, ?)
+			ON CONFLICT(item_id, user_id) DO UPDATE SET quantity = excluded.quantity`,
+			req.Id, userId, quantity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		publishItems(logger, db, hub, "claim", true, req.Id)
+	}
+}
+
+func handleClaimDelete(logger *log.Logger, db *sql.DB, hub *Hub) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type UnclaimRequest struct {
+			Id uint64 `json:"id"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req UnclaimRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		result, err := db.Exec("DELETE FROM claims WHERE item_id = ? AND user_id = ?", req.Id, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "no claim on this item", http.StatusNotFound)
+			return
+		}
+
+		publishItems(logger, db, hub, "unclaim", true, req.Id)
+	}
+}
+
+// priceFromRequest works out the structured price to store for an item. A
+// client supplied amount is used as-is, otherwise we try to parse the cost.
+func priceFromRequest(cost string, amount *int64, currency *string) (sql.NullInt64, sql.NullString, error) {
+	if amount == nil {
+		if currency != nil {
+			return sql.NullInt64{}, sql.NullString{}, errors.New("price_currency requires price_amount")
+		}
+		parsedAmount, parsedCurrency, ok := parseCost(cost)
+		if !ok {
+			return sql.NullInt64{}, sql.NullString{}, nil
+		}
+		return sql.NullInt64{Int64: parsedAmount, Valid: true},
+			sql.NullString{String: parsedCurrency, Valid: true}, nil
+	}
+
+	if *amount < 0 {
+		return sql.NullInt64{}, sql.NullString{}, errors.New("price_amount must not be negative")
+	}
+	priceCurrency := defaultCurrency
+	if currency != nil {
+		if !validCurrency(*currency) {
+			return sql.NullInt64{}, sql.NullString{}, errors.New("price_currency must be an ISO 4217 code")
+		}
+		priceCurrency = *currency
+	}
+	return sql.NullInt64{Int64: *amount, Valid: true}, sql.NullString{String: priceCurrency, Valid: true}, nil
+}
+
 func authMiddlewareNew(logger *log.Logger, db *sql.DB) func(func(http.ResponseWriter, *http.Request, uint64)) http.HandlerFunc {
 	return func(nextHandler func(http.ResponseWriter, *http.Request, uint64)) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -773,6 +1569,57 @@ func authMiddlewareNew(logger *log.Logger, db *sql.DB) func(func(http.ResponseWr
 	}
 }
 
+// viewAsMiddlewareNew lets site admins load a read-only endpoint as someone
+// else with ?as=<user id>, to see exactly what that user would see.
+func viewAsMiddlewareNew(logger *log.Logger, db *sql.DB) func(func(http.ResponseWriter, *http.Request, uint64)) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(nextHandler func(http.ResponseWriter, *http.Request, uint64)) func(http.ResponseWriter, *http.Request, uint64) {
+		return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+			asStr := r.URL.Query().Get("as")
+			if asStr == "" {
+				nextHandler(w, r, userId)
+				return
+			}
+
+			asUserId, err := strconv.ParseUint(asStr, 10, 64)
+			if err != nil {
+				http.Error(w, "malformed as parameter", http.StatusBadRequest)
+				return
+			}
+
+			var siteAdmin bool
+			err = db.QueryRow("SELECT site_admin FROM users WHERE id = ?", userId).Scan(&siteAdmin)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !siteAdmin {
+				http.Error(w, "only site admins can view as other users", http.StatusUnauthorized)
+				return
+			}
+
+			var exists bool
+			err = db.QueryRow("SELECT COUNT(*) > 0 FROM users WHERE id = ?", asUserId).Scan(&exists)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "non-existent user", http.StatusNotFound)
+				return
+			}
+
+			logger.Printf("user %d viewing %s as user %d", userId, r.URL.Path, asUserId)
+			nextHandler(w, r, asUserId)
+		}
+	}
+}
+
+// sort parameters for handleUsersGet
+var userSorts = map[string]string{
+	"created": "",
+	"name":    "(first_name || ' ' || last_name) COLLATE NOCASE",
+}
+
 func handleUsersGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
 	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
 		if r.Header.Get("Content-Type") != "application/json" {
@@ -781,17 +1628,36 @@ func handleUsersGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *h
 		}
 
 		type UsersResponse struct {
-			Entries []User `json:"users"`
+			Entries    []User  `json:"users"`
+			NextCursor *string `json:"next_cursor"`
 		}
 
-		stmt, err := db.Prepare("SELECT id,first_name,last_name FROM users")
+		page, err := parsePage(r.URL.Query(), userSorts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := "SELECT id,first_name,last_name," + page.Sort.key("id") + " FROM users WHERE " + visibleTo("id")
+		args := []interface{}{userId, userId}
+		if r.URL.Query().Get("following") == "true" {
+			query += " AND id IN (SELECT followee_id FROM follows WHERE follower_id = ?)"
+			args = append(args, userId)
+		}
+		if q := r.URL.Query().Get("q"); q != "" {
+			query += ` AND (first_name || ' ' || last_name) LIKE ? ESCAPE '\'`
+			args = append(args, likePattern(q))
+		}
+		query, args = page.apply(query, args, "id")
+
+		stmt, err := db.Prepare(query)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer stmt.Close()
 
-		rows, err := stmt.Query()
+		rows, err := stmt.Query(args...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -799,11 +1665,19 @@ func handleUsersGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *h
 		defer rows.Close()
 
 		var response UsersResponse
+		var rowCount int
+		var lastKey interface{}
 		for rows.Next() {
+			rowCount++
+			if page.Limit != 0 && rowCount > page.Limit {
+				// just checking there's more
+				continue
+			}
+
 			response.Entries = append(response.Entries, User{})
 			entry := &response.Entries[len(response.Entries)-1]
 
-			err = rows.Scan(&entry.Id, &entry.FirstName, &entry.LastName)
+			err = rows.Scan(&entry.Id, &entry.FirstName, &entry.LastName, &lastKey)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -814,110 +1688,826 @@ func handleUsersGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *h
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if len(response.Entries) != 0 {
+			response.NextCursor = page.nextCursor(rowCount, response.Entries[len(response.Entries)-1].Id, lastKey)
+		}
+
+		// Encode the data and write it to the response
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// condition for wishlist rows that haven't been archived or deleted
+const liveItem = "archived_time IS NULL AND deleted_time IS NULL"
+
+// dbtx is the subset of methods shared by *sql.DB and *sql.Tx, for helpers
+// that may or may not be part of a larger transaction.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func initDb(logger *log.Logger, dbPath string) *sql.DB {
+	// Open (or create) the SQLite database file
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		logger.Fatalf("Error opening database: %v", err)
+	}
+
+	// Create users table
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		first_name TEXT NOT NULL CHECK(length(first_name) < 500),
+		last_name TEXT NOT NULL CHECK(length(last_name) < 500),
+        email TEXT NOT NULL UNIQUE CHECK(length(email) < 500),
+        password_hash TEXT NOT NULL,
+        registration_date DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		logger.Fatalf("Error creating users table: %v", err)
+	}
+
+	sqlStmt = `
+    PRAGMA foreign_keys = ON;
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		session_cookie BLOB PRIMARY KEY UNIQUE,
+        id INTEGER NOT NULL,
+        creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+        expiry_time DATETIME NOT NULL,
+        user_agent TEXT,
+        FOREIGN KEY (id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		logger.Fatalf("Error creating sessions table: %v", err)
+	}
+
+	sqlStmt = `
+	CREATE TABLE IF NOT EXISTS wishlist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+        sequence_number INTEGER DEFAULT 1,
+        user_id INTEGER NOT NULL,
+        description TEXT NOT NULL CHECK(length(description) < 2000),
+        source TEXT NOT NULL CHECK(length(source) < 2000),
+        cost TEXT NOT NULL CHECK(length(cost) < 2000),
+        owner_notes TEXT CHECK(length(owner_notes) < 2000),
+        buyer_notes TEXT CHECK(length(buyer_notes) < 2000),
+        creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		logger.Fatalf("Error creating wishlist table: %v", err)
+	}
+
+	sqlStmt = `
+	CREATE INDEX IF NOT EXISTS idx_wishlist_user ON wishlist (user_id)
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		logger.Fatalf("Error creating wishlist index: %v", err)
+	}
+
+	// user_id may be null if code was created via admin rpc
+	sqlStmt = `
+	CREATE TABLE IF NOT EXISTS invite_codes (
+        invite_code BLOB PRIMARY KEY UNIQUE,
+        user_id INTEGER,
+        creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+        expiry_time DATETIME NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		logger.Fatalf("Error creating invite_codes table: %v", err)
+	}
+
+	sqlStmt = `
+	CREATE INDEX IF NOT EXISTS idx_invite_codes_user ON invite_codes (user_id)
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		logger.Fatalf("Error creating wishlist index: %v", err)
+	}
+
+	err = migrateDb(logger, db)
+	if err != nil {
+		logger.Fatalf("Error migrating database: %v", err)
+	}
+
+	return db
+}
+
+// Schema changes made after the tables above were first created. Each one runs
+// exactly once, in order, in its own transaction. PRAGMA user_version records
+// how many have been applied, so new entries must only ever be appended.
+var migrations = []func(tx *sql.Tx) error{
+	migrateWishlistPrice,
+	migrateWishlistQuantity,
+	migrateTags,
+	migrateSoftDelete,
+	migrateHistory,
+	migrateLinkPreviews,
+	migratePriceTracking,
+	migrateItemImages,
+	migrateSearch,
+	migratePriority,
+	migrateLists,
+	migrateShareLinks,
+	migrateGroups,
+	migrateListVisibility,
+	migrateSiteAdmins,
+	migrateEvents,
+	migrateExchanges,
+	migrateNotifications,
+	migrateWebhooks,
+	migrateFollows,
+	migrateFeedTokens,
+	migrateCalendarTokens,
+	migrateImportKeys,
+	migrateExchangePreviousPairings,
+}
+
+func migrateDb(logger *log.Logger, db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		err = migrations[version](tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+
+		// pragmas can't take bound parameters
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		logger.Printf("applied database migration %d", version+1)
+	}
+	return nil
+}
+
+// Add a structured price next to the free-text cost and fill it in from the
+// existing cost strings where we can make sense of them.
+func migrateWishlistPrice(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN price_amount INTEGER;
+	ALTER TABLE wishlist ADD COLUMN price_currency TEXT CHECK(price_currency IS NULL OR length(price_currency) == 3);
+	CREATE INDEX IF NOT EXISTS idx_wishlist_price ON wishlist (user_id, price_amount);
+	`
+	_, err := tx.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id,cost FROM wishlist")
+	if err != nil {
+		return err
+	}
+	type parsedCost struct {
+		Id       int64
+		Amount   int64
+		Currency string
+	}
+	var parsed []parsedCost
+	for rows.Next() {
+		var id int64
+		var cost string
+		err = rows.Scan(&id, &cost)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		amount, currency, ok := parseCost(cost)
+		if ok {
+			parsed = append(parsed, parsedCost{id, amount, currency})
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE wishlist SET price_amount = ?, price_currency = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range parsed {
+		_, err = stmt.Exec(p.Amount, p.Currency, p.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//go:embed my-app/build
+var WebAssets embed.FS
+
+// Track how many of an item are wanted and how many have shown up, plus the
+// claims buyers make against them. Fully received items get archived.
+func migrateWishlistQuantity(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN quantity_desired INTEGER NOT NULL DEFAULT 1 CHECK(quantity_desired >= 1);
+	ALTER TABLE wishlist ADD COLUMN quantity_received INTEGER NOT NULL DEFAULT 0 CHECK(quantity_received >= 0);
+	ALTER TABLE wishlist ADD COLUMN archived_time DATETIME;
+
+	CREATE TABLE IF NOT EXISTS claims (
+		item_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		quantity INTEGER NOT NULL DEFAULT 1 CHECK(quantity >= 1),
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (item_id, user_id),
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_claims_user ON claims (user_id);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Free-form tags per item. Each user has their own tag vocabulary.
+func migrateTags(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL COLLATE NOCASE CHECK(length(name) < 100),
+		UNIQUE (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS wishlist_tags (
+		item_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (item_id, tag_id),
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE,
+		FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_wishlist_tags_tag ON wishlist_tags (tag_id);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+func migrateSoftDelete(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN deleted_time DATETIME;
+	CREATE INDEX IF NOT EXISTS idx_wishlist_deleted ON wishlist (deleted_time) WHERE deleted_time IS NOT NULL;
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// One row per version of a wishlist item. changes is a json object mapping
+// each changed field to its old and new values. buyer_side rows were made by
+// someone other than the owner and are hidden from them.
+func migrateHistory(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS wishlist_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		actor_id INTEGER,
+		action TEXT NOT NULL,
+		buyer_side BOOLEAN NOT NULL DEFAULT 0,
+		changes TEXT NOT NULL,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE,
+		FOREIGN KEY (actor_id) REFERENCES users (id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_wishlist_history_item ON wishlist_history (item_id, version);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Metadata scraped from the page an item's source links to. preview_source
+// is the source the preview was made from, so edits to the source can be
+// picked up.
+func migrateLinkPreviews(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN preview_source TEXT;
+	ALTER TABLE wishlist ADD COLUMN preview_title TEXT CHECK(length(preview_title) < 2000);
+	ALTER TABLE wishlist ADD COLUMN preview_image_url TEXT CHECK(length(preview_image_url) < 2000);
+	ALTER TABLE wishlist ADD COLUMN preview_site_name TEXT CHECK(length(preview_site_name) < 2000);
+	ALTER TABLE wishlist ADD COLUMN preview_price_amount INTEGER;
+	ALTER TABLE wishlist ADD COLUMN preview_price_currency TEXT;
+	ALTER TABLE wishlist ADD COLUMN preview_fetch_time DATETIME;
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Owners can opt items in to having their price re-checked periodically, and
+// set an amount (in minor units) they'd like to hear about it dropping to.
+func migratePriceTracking(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN track_price BOOLEAN NOT NULL DEFAULT 0;
+	ALTER TABLE wishlist ADD COLUMN price_alert_amount INTEGER CHECK(price_alert_amount >= 0);
+	ALTER TABLE wishlist ADD COLUMN price_check_time DATETIME;
+
+	CREATE TABLE IF NOT EXISTS price_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		price_amount INTEGER NOT NULL,
+		price_currency TEXT NOT NULL,
+		check_time DATETIME NOT NULL,
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_price_history_item ON price_history (item_id, check_time);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Blob store keys for an item's uploaded image and its thumbnail.
+func migrateItemImages(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN image_key TEXT;
+	ALTER TABLE wishlist ADD COLUMN thumb_key TEXT;
+	CREATE INDEX IF NOT EXISTS idx_wishlist_image ON wishlist (image_key);
+	CREATE INDEX IF NOT EXISTS idx_wishlist_thumb ON wishlist (thumb_key);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Full-text indexes for search, kept in sync with wishlist by triggers. Buyer
+// notes get their own index since owners must never match on them.
+//
+// go-sqlite3 only includes FTS5 when built with -tags sqlite_fts5. Refuse to
+// migrate without it rather than make some other index that user_version would
+// then keep for good.
+func migrateSearch(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE VIRTUAL TABLE wishlist_fts USING fts5(description, source, owner_notes)")
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		return fmt.Errorf("full-text search needs FTS5, build with -tags sqlite_fts5: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	sqlStmt := `
+	CREATE VIRTUAL TABLE buyer_notes_fts USING fts5(buyer_notes);
+
+	INSERT INTO wishlist_fts(rowid, description, source, owner_notes)
+		SELECT id, description, source, owner_notes FROM wishlist;
+	INSERT INTO buyer_notes_fts(rowid, buyer_notes) SELECT id, buyer_notes FROM wishlist;
+
+	CREATE TRIGGER wishlist_fts_insert AFTER INSERT ON wishlist BEGIN
+		INSERT INTO wishlist_fts(rowid, description, source, owner_notes)
+			VALUES(new.id, new.description, new.source, new.owner_notes);
+		INSERT INTO buyer_notes_fts(rowid, buyer_notes) VALUES(new.id, new.buyer_notes);
+	END;
+
+	CREATE TRIGGER wishlist_fts_update AFTER UPDATE OF description, source, owner_notes ON wishlist BEGIN
+		DELETE FROM wishlist_fts WHERE rowid = old.id;
+		INSERT INTO wishlist_fts(rowid, description, source, owner_notes)
+			VALUES(new.id, new.description, new.source, new.owner_notes);
+	END;
+
+	CREATE TRIGGER buyer_notes_fts_update AFTER UPDATE OF buyer_notes ON wishlist BEGIN
+		DELETE FROM buyer_notes_fts WHERE rowid = old.id;
+		INSERT INTO buyer_notes_fts(rowid, buyer_notes) VALUES(new.id, new.buyer_notes);
+	END;
+
+	CREATE TRIGGER wishlist_fts_delete AFTER DELETE ON wishlist BEGIN
+		DELETE FROM wishlist_fts WHERE rowid = old.id;
+		DELETE FROM buyer_notes_fts WHERE rowid = old.id;
+	END;
+	`
+	_, err = tx.Exec(sqlStmt)
+	return err
+}
+
+// An optional ranking owners can give items, 1 being the one they want most.
+func migratePriority(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE wishlist ADD COLUMN priority INTEGER CHECK(priority >= 1);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Lists group a user's items. For now everyone has exactly one, made here for
+// existing users and on demand (see defaultListId) for new ones.
+func migrateLists(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS lists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL CHECK(length(name) < 500),
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_lists_user ON lists (user_id);
+
+	INSERT INTO lists(user_id, name) SELECT id, 'Wishlist' FROM users;
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Read-only links to a list for people without accounts, and the claims they
+// make through them.
+func migrateShareLinks(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		share_token BLOB PRIMARY KEY UNIQUE,
+		list_id INTEGER NOT NULL UNIQUE,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (list_id) REFERENCES lists (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS anonymous_claims (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		claim_token BLOB NOT NULL UNIQUE,
+		item_id INTEGER NOT NULL,
+		name TEXT NOT NULL CHECK(length(name) < 500),
+		email TEXT NOT NULL CHECK(length(email) < 500),
+		quantity INTEGER NOT NULL CHECK(quantity >= 1),
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_anonymous_claims_item ON anonymous_claims (item_id);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Groups limit who can see whose lists: users only see people they share a
+// group with. Everyone who already has an account goes in one group so
+// nothing changes for them until an admin splits them up.
+func migrateGroups(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS user_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL CHECK(length(name) < 500),
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL CHECK(role IN ('admin', 'member')),
+		join_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (group_id, user_id),
+		FOREIGN KEY (group_id) REFERENCES user_groups (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members (user_id);
+
+	ALTER TABLE invite_codes ADD COLUMN group_id INTEGER REFERENCES user_groups (id) ON DELETE CASCADE;
+	`
+	_, err := tx.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
 
-		// Encode the data and write it to the response
-		encoder := json.NewEncoder(w)
-		if err := encoder.Encode(response); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	var users int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+	if err != nil || users == 0 {
+		return err
 	}
+
+	sqlStmt = `
+	INSERT INTO user_groups(name) VALUES('Everyone');
+	INSERT INTO group_members(group_id, user_id, role) SELECT last_insert_rowid(), id, 'member' FROM users;
+	`
+	_, err = tx.Exec(sqlStmt)
+	return err
 }
 
-func initDb(logger *log.Logger, dbPath string) *sql.DB {
-	// Open (or create) the SQLite database file
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		logger.Fatalf("Error opening database: %v", err)
-	}
+// Per-list visibility, and items move from hanging off a user to hanging
+// off one of their lists. Existing items go on their owner's default list,
+// and lists that already have a share link become public so it keeps working.
+func migrateListVisibility(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE lists ADD COLUMN visibility TEXT NOT NULL DEFAULT 'members'
+		CHECK(visibility IN ('private', 'group', 'users', 'members', 'public'));
+	ALTER TABLE lists ADD COLUMN group_id INTEGER REFERENCES user_groups (id) ON DELETE SET NULL;
+	UPDATE lists SET visibility = 'public' WHERE id IN (SELECT list_id FROM share_links);
+
+	CREATE TABLE IF NOT EXISTS list_viewers (
+		list_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (list_id, user_id),
+		FOREIGN KEY (list_id) REFERENCES lists (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_list_viewers_user ON list_viewers (user_id);
 
-	// Create users table
+	INSERT INTO lists(user_id, name) SELECT DISTINCT user_id, 'Wishlist' FROM wishlist
+		WHERE user_id IN (SELECT id FROM users) AND user_id NOT IN (SELECT user_id FROM lists);
+
+	ALTER TABLE wishlist ADD COLUMN list_id INTEGER REFERENCES lists (id) ON DELETE CASCADE;
+	UPDATE wishlist SET list_id = (SELECT MIN(id) FROM lists WHERE lists.user_id = wishlist.user_id);
+	CREATE INDEX IF NOT EXISTS idx_wishlist_list ON wishlist (list_id);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Site admins are set through the admin rpc, and can load pages as other
+// users to debug who can see what.
+func migrateSiteAdmins(tx *sql.Tx) error {
 	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS users (
+	ALTER TABLE users ADD COLUMN site_admin BOOLEAN NOT NULL DEFAULT 0;
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Birthdays, holidays and so on: who's in them, which lists they're for, and
+// who has already been reminded about them.
+func migrateEvents(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS events (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		first_name TEXT NOT NULL CHECK(length(first_name) < 500),
-		last_name TEXT NOT NULL CHECK(length(last_name) < 500),
-        email TEXT NOT NULL UNIQUE CHECK(length(email) < 500),
-        password_hash TEXT NOT NULL,
-        registration_date DATETIME DEFAULT CURRENT_TIMESTAMP
+		owner_id INTEGER NOT NULL,
+		name TEXT NOT NULL CHECK(length(name) < 500),
+		event_date TEXT NOT NULL CHECK(date(event_date) = event_date),
+		reminder_days INTEGER NOT NULL CHECK(reminder_days >= 0),
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_events_date ON events (event_date);
+
+	CREATE TABLE IF NOT EXISTS event_participants (
+		event_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (event_id, user_id),
+		FOREIGN KEY (event_id) REFERENCES events (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_event_participants_user ON event_participants (user_id);
+
+	CREATE TABLE IF NOT EXISTS event_lists (
+		event_id INTEGER NOT NULL,
+		list_id INTEGER NOT NULL,
+		PRIMARY KEY (event_id, list_id),
+		FOREIGN KEY (event_id) REFERENCES events (id) ON DELETE CASCADE,
+		FOREIGN KEY (list_id) REFERENCES lists (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS event_reminders (
+		event_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		sent_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (event_id, user_id),
+		FOREIGN KEY (event_id) REFERENCES events (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 	);
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		logger.Fatalf("Error creating users table: %v", err)
-	}
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
-	sqlStmt = `
-    PRAGMA foreign_keys = ON;
+// Secret Santa style gift exchanges. Exclusions are directed, giver can't
+// draw receiver, and there's at most one draw per exchange at a time.
+func migrateExchanges(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS exchanges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		name TEXT NOT NULL CHECK(length(name) < 500),
+		reveal_date TEXT NOT NULL CHECK(date(reveal_date) = reveal_date),
+		draw_time DATETIME,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE
+	);
 
-	CREATE TABLE IF NOT EXISTS sessions (
-		session_cookie BLOB PRIMARY KEY UNIQUE,
-        id INTEGER NOT NULL,
-        creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
-        expiry_time DATETIME NOT NULL,
-        user_agent TEXT,
-        FOREIGN KEY (id) REFERENCES users (id) ON DELETE CASCADE
+	CREATE TABLE IF NOT EXISTS exchange_participants (
+		exchange_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (exchange_id, user_id),
+		FOREIGN KEY (exchange_id) REFERENCES exchanges (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_exchange_participants_user ON exchange_participants (user_id);
+
+	CREATE TABLE IF NOT EXISTS exchange_exclusions (
+		exchange_id INTEGER NOT NULL,
+		giver_id INTEGER NOT NULL,
+		receiver_id INTEGER NOT NULL,
+		PRIMARY KEY (exchange_id, giver_id, receiver_id),
+		FOREIGN KEY (exchange_id) REFERENCES exchanges (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS exchange_assignments (
+		exchange_id INTEGER NOT NULL,
+		giver_id INTEGER NOT NULL,
+		receiver_id INTEGER NOT NULL,
+		PRIMARY KEY (exchange_id, giver_id),
+		UNIQUE (exchange_id, receiver_id),
+		FOREIGN KEY (exchange_id) REFERENCES exchanges (id) ON DELETE CASCADE
 	);
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		logger.Fatalf("Error creating sessions table: %v", err)
-	}
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
-	sqlStmt = `
-	CREATE TABLE IF NOT EXISTS wishlist (
+func migrateNotifications(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS notification_outbox (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-        sequence_number INTEGER DEFAULT 1,
-        user_id INTEGER NOT NULL,
-        description TEXT NOT NULL CHECK(length(description) < 2000),
-        source TEXT NOT NULL CHECK(length(source) < 2000),
-        cost TEXT NOT NULL CHECK(length(cost) < 2000),
-        owner_notes TEXT CHECK(length(owner_notes) < 2000),
-        buyer_notes TEXT CHECK(length(buyer_notes) < 2000),
-        creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
-        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_notification_outbox_user ON notification_outbox (user_id);
+
+	CREATE TABLE IF NOT EXISTS notification_deliveries (
+		outbox_id INTEGER NOT NULL,
+		channel TEXT NOT NULL,
+		skipped BOOLEAN NOT NULL DEFAULT 0,
+		delivered_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (outbox_id, channel),
+		FOREIGN KEY (outbox_id) REFERENCES notification_outbox (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id INTEGER NOT NULL,
+		channel TEXT NOT NULL,
+		frequency TEXT NOT NULL CHECK(frequency IN ('off', 'immediate', 'daily', 'weekly')),
+		PRIMARY KEY (user_id, channel),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notification_digests (
+		user_id INTEGER NOT NULL,
+		channel TEXT NOT NULL,
+		last_sent_time TEXT NOT NULL,
+		PRIMARY KEY (user_id, channel),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 	);
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		logger.Fatalf("Error creating wishlist table: %v", err)
-	}
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
-	sqlStmt = `
-	CREATE INDEX IF NOT EXISTS idx_wishlist_user ON wishlist (user_id)
+func migrateWebhooks(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		url TEXT NOT NULL CHECK(length(url) < 2000),
+		events TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		failure_count INTEGER NOT NULL DEFAULT 0,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_user ON webhooks (user_id);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'delivered', 'failed')),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_time DATETIME NOT NULL,
+		last_status_code INTEGER,
+		last_error TEXT,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		delivered_time DATETIME,
+		FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries (status, next_attempt_time);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id);
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		logger.Fatalf("Error creating wishlist index: %v", err)
-	}
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
-	// user_id may be null if code was created via admin rpc
-	sqlStmt = `
-	CREATE TABLE IF NOT EXISTS invite_codes (
-        invite_code BLOB PRIMARY KEY UNIQUE,
-        user_id INTEGER,
-        creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
-        expiry_time DATETIME NOT NULL,
-        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+func migrateFollows(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS follows (
+		follower_id INTEGER NOT NULL,
+		followee_id INTEGER NOT NULL,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (follower_id, followee_id),
+		FOREIGN KEY (follower_id) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY (followee_id) REFERENCES users (id) ON DELETE CASCADE
 	);
+	CREATE INDEX IF NOT EXISTS idx_follows_followee ON follows (followee_id);
+
+	CREATE TABLE IF NOT EXISTS activity (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL CHECK(kind IN ('item_added', 'item_archived', 'list_created')),
+		list_id INTEGER NOT NULL,
+		item_id INTEGER,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY (list_id) REFERENCES lists (id) ON DELETE CASCADE,
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_activity_user ON activity (user_id);
+
+	-- existing items show up in feeds from the start
+	INSERT INTO activity(user_id, kind, list_id, item_id, creation_time)
+		SELECT user_id, 'item_added', list_id, id, creation_time FROM wishlist
+		WHERE deleted_time IS NULL AND list_id IS NOT NULL ORDER BY creation_time, id;
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		logger.Fatalf("Error creating invite_codes table: %v", err)
-	}
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
-	sqlStmt = `
-	CREATE INDEX IF NOT EXISTS idx_invite_codes_user ON invite_codes (user_id)
+// Feed reader links to a list, separate from share links since they're
+// for people who can see the list anyway.
+func migrateFeedTokens(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS feed_tokens (
+		feed_token BLOB PRIMARY KEY UNIQUE,
+		list_id INTEGER NOT NULL UNIQUE,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (list_id) REFERENCES lists (id) ON DELETE CASCADE
+	);
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		logger.Fatalf("Error creating wishlist index: %v", err)
-	}
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
-	return db
+func migrateCalendarTokens(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS calendar_tokens (
+		calendar_token BLOB PRIMARY KEY UNIQUE,
+		user_id INTEGER NOT NULL UNIQUE,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
 }
 
-//go:embed my-app/build
-var WebAssets embed.FS
+// import_keys remembers which item each row from another site became, so
+// importing from it again only adds what's new. Deleting the item for good
+// forgets it.
+func migrateImportKeys(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS import_keys (
+		user_id INTEGER NOT NULL,
+		importer TEXT NOT NULL,
+		external_id TEXT NOT NULL,
+		item_id INTEGER NOT NULL,
+		PRIMARY KEY (user_id, importer, external_id),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY (item_id) REFERENCES wishlist (id) ON DELETE CASCADE
+	);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// Exclusions copied from a previous exchange's pairings are only avoided
+// where possible, unlike ones the organizer gives. Ones copied before this
+// can't be told apart and stay as they are.
+func migrateExchangePreviousPairings(tx *sql.Tx) error {
+	sqlStmt := `
+	ALTER TABLE exchange_exclusions ADD COLUMN previous BOOLEAN NOT NULL DEFAULT FALSE;
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
 
 func handleOther(logger *log.Logger) http.HandlerFunc {
 	var (
@@ -963,8 +2553,13 @@ func addRoutes(
 	logger *log.Logger,
 	config *Config,
 	db *sql.DB,
+	blobs BlobStore,
+	hub *Hub,
+	presence *Presence,
 ) {
 	authMiddleware := authMiddlewareNew(logger, db)
+	viewAs := viewAsMiddlewareNew(logger, db)
+	importers := newImporters(config)
 
 	mux.Handle("GET /api/session", authMiddleware(handleSessionGet(logger, db)))
 	mux.Handle("POST /api/session", handleSessionPost(logger, config, db))
@@ -972,12 +2567,77 @@ func addRoutes(
 
 	mux.Handle("POST /api/signup", handleSignup(logger, config, db))
 
-	mux.Handle("GET /api/wishlist", authMiddleware(handleWishlistGet(logger, db)))
-	mux.Handle("POST /api/wishlist", authMiddleware(handleWishlistPost(logger, db)))
-	mux.Handle("DELETE /api/wishlist", authMiddleware(handleWishlistDelete(logger, db)))
-	mux.Handle("PATCH /api/wishlist", authMiddleware(handleWishlistPatch(logger, db)))
-
-	mux.Handle("GET /api/users", authMiddleware(handleUsersGet(logger, db)))
+	mux.Handle("GET /api/wishlist", authMiddleware(viewAs(handleWishlistGet(logger, db))))
+	mux.Handle("POST /api/wishlist", authMiddleware(handleWishlistPost(logger, db, hub)))
+	mux.Handle("DELETE /api/wishlist", authMiddleware(handleWishlistDelete(logger, db, hub)))
+	mux.Handle("PATCH /api/wishlist", authMiddleware(handleWishlistPatch(logger, db, hub)))
+	mux.Handle("POST /api/wishlist/archive", authMiddleware(handleWishlistArchive(logger, db, hub)))
+	mux.Handle("POST /api/wishlist/restore", authMiddleware(handleWishlistRestore(logger, db, hub)))
+	mux.Handle("GET /api/wishlist/export", authMiddleware(handleWishlistExport(logger, db)))
+	mux.Handle("POST /api/wishlist/import", authMiddleware(handleWishlistImport(logger, db, hub, importers)))
+	mux.Handle("POST /api/wishlist/received", authMiddleware(handleWishlistReceived(logger, db, hub)))
+	mux.Handle("GET /api/wishlist/{id}/history", authMiddleware(viewAs(handleWishlistHistory(logger, db))))
+	mux.Handle("GET /api/wishlist/{id}/prices", authMiddleware(viewAs(handlePriceHistoryGet(logger, db))))
+	mux.Handle("POST /api/wishlist/claim", authMiddleware(handleClaimPost(logger, db, hub)))
+	mux.Handle("DELETE /api/wishlist/claim", authMiddleware(handleClaimDelete(logger, db, hub)))
+	mux.Handle("POST /api/wishlist/{id}/image", authMiddleware(handleItemImagePost(logger, db, blobs)))
+	mux.Handle("DELETE /api/wishlist/{id}/image", authMiddleware(handleItemImageDelete(logger, db, blobs)))
+
+	mux.Handle("GET /api/images/{key}", authMiddleware(viewAs(handleImageGet(logger, db, blobs))))
+
+	mux.Handle("GET /api/tags", authMiddleware(viewAs(handleTagsGet(logger, db))))
+
+	mux.Handle("GET /api/search", authMiddleware(viewAs(handleSearchGet(logger, db))))
+
+	mux.Handle("GET /api/groups", authMiddleware(handleGroupsGet(logger, db)))
+	mux.Handle("POST /api/groups", authMiddleware(handleGroupPost(logger, db)))
+	mux.Handle("POST /api/groups/join", authMiddleware(handleGroupJoin(logger, db)))
+	mux.Handle("POST /api/groups/{id}/invites", authMiddleware(handleGroupInvitePost(logger, db)))
+	mux.Handle("PATCH /api/groups/{id}/members/{userId}", authMiddleware(handleGroupMemberPatch(logger, db)))
+	mux.Handle("DELETE /api/groups/{id}/members/{userId}", authMiddleware(handleGroupMemberDelete(logger, db)))
+
+	mux.Handle("GET /api/lists", authMiddleware(viewAs(handleListsGet(logger, db))))
+	mux.Handle("POST /api/lists", authMiddleware(handleListPost(logger, db)))
+	mux.Handle("PATCH /api/lists/{id}", authMiddleware(handleListPatch(logger, db)))
+	mux.Handle("POST /api/lists/{id}/share", authMiddleware(handleShareLinkPost(logger, db)))
+	mux.Handle("DELETE /api/lists/{id}/share", authMiddleware(handleShareLinkDelete(logger, db)))
+	mux.Handle("POST /api/lists/{id}/feed", authMiddleware(handleFeedTokenPost(logger, db)))
+	mux.Handle("DELETE /api/lists/{id}/feed", authMiddleware(handleFeedTokenDelete(logger, db)))
+	mux.Handle("GET /api/lists/{id}/socket", authMiddleware(handleListSocket(logger, db, hub, presence)))
+
+	// no account needed for these, the token is the credential
+	mux.Handle("GET /api/public/lists/{token}", handlePublicListGet(logger, db))
+	mux.Handle("POST /api/public/lists/{token}/claims", handlePublicClaimPost(logger, db, hub))
+	mux.Handle("DELETE /api/public/claims/{token}", handlePublicClaimDelete(logger, db, hub))
+	mux.Handle("GET /api/public/feeds/{token}", handleAtomFeedGet(logger, db))
+	mux.Handle("GET /api/public/calendars/{token}", handleCalendarGet(logger, db))
+
+	mux.Handle("GET /api/events/stream", authMiddleware(handleEventStream(logger, db, hub)))
+	mux.Handle("GET /api/events/upcoming", authMiddleware(viewAs(handleEventsUpcomingGet(logger, db))))
+	mux.Handle("POST /api/events", authMiddleware(handleEventPost(logger, db)))
+	mux.Handle("DELETE /api/events/{id}", authMiddleware(handleEventDelete(logger, db)))
+	mux.Handle("POST /api/events/import", authMiddleware(handleEventsImport(logger, db)))
+	mux.Handle("POST /api/calendar/token", authMiddleware(handleCalendarTokenPost(logger, db)))
+	mux.Handle("DELETE /api/calendar/token", authMiddleware(handleCalendarTokenDelete(logger, db)))
+
+	mux.Handle("GET /api/exchanges", authMiddleware(handleExchangesGet(logger, db)))
+	mux.Handle("POST /api/exchanges", authMiddleware(handleExchangePost(logger, db)))
+	mux.Handle("POST /api/exchanges/{id}/draw", authMiddleware(handleExchangeDraw(logger, db)))
+	mux.Handle("DELETE /api/exchanges/{id}", authMiddleware(handleExchangeDelete(logger, db)))
+
+	mux.Handle("GET /api/notifications/preferences", authMiddleware(handleNotificationPreferencesGet(logger, db)))
+	mux.Handle("PUT /api/notifications/preferences", authMiddleware(handleNotificationPreferencePut(logger, db)))
+
+	mux.Handle("GET /api/webhooks", authMiddleware(handleWebhooksGet(logger, db)))
+	mux.Handle("POST /api/webhooks", authMiddleware(handleWebhookPost(logger, db)))
+	mux.Handle("PATCH /api/webhooks/{id}", authMiddleware(handleWebhookPatch(logger, db)))
+	mux.Handle("DELETE /api/webhooks/{id}", authMiddleware(handleWebhookDelete(logger, db)))
+	mux.Handle("GET /api/webhooks/{id}/deliveries", authMiddleware(handleWebhookDeliveriesGet(logger, db)))
+
+	mux.Handle("GET /api/users", authMiddleware(viewAs(handleUsersGet(logger, db))))
+	mux.Handle("POST /api/users/{id}/follow", authMiddleware(handleFollowPost(logger, db)))
+	mux.Handle("DELETE /api/users/{id}/follow", authMiddleware(handleFollowDelete(logger, db)))
+	mux.Handle("GET /api/feed", authMiddleware(viewAs(handleFeedGet(logger, db))))
 
 	mux.Handle("GET /{pathname...}", handleOther(logger))
 }
@@ -1002,6 +2662,9 @@ func NewServer(
 	logger *log.Logger,
 	config *Config,
 	db *sql.DB,
+	blobs BlobStore,
+	hub *Hub,
+	presence *Presence,
 ) http.Handler {
 	mux := http.NewServeMux()
 	addRoutes(
@@ -1009,6 +2672,9 @@ func NewServer(
 		logger,
 		config,
 		db,
+		blobs,
+		hub,
+		presence,
 	)
 	handler := loggingMiddleware(logger, mux)
 	return handler
@@ -1016,17 +2682,14 @@ func NewServer(
 
 type adminGrpcServer struct {
 	admin_rpc.UnimplementedWishlistAdminServer
-	Logger *log.Logger
-	Db     *sql.DB
+	Logger    *log.Logger
+	Db        *sql.DB
+	Importers map[string]Importer
 }
 
-func generateInviteCodeHelper(db *sql.DB) ([]byte, error) {
-	stmt, err := db.Prepare("INSERT INTO invite_codes(invite_code, expiry_time) VALUES(?, ?)")
-	if err != nil {
-		return nil, err
-	}
-	defer stmt.Close()
-
+// userId is who made the invite and groupId the group it joins people to,
+// either may be null.
+func generateInviteCodeHelper(db dbtx, userId sql.NullInt64, groupId sql.NullInt64) ([]byte, error) {
 	// Note that no error handling is necessary, as Read always succeeds.
 	inviteCode := make([]byte, 32)
 	rand.Read(inviteCode)
@@ -1034,16 +2697,21 @@ func generateInviteCodeHelper(db *sql.DB) ([]byte, error) {
 	// invite codes good for 7 days
 	expiryTime := time.Now().Add(time.Duration(7*24) * time.Hour)
 
-	_, err = stmt.Exec(inviteCode, expiryTime)
+	_, err := db.Exec("INSERT INTO invite_codes(invite_code, user_id, group_id, expiry_time) VALUES(?, ?, ?, ?)",
+		inviteCode, userId, groupId, expiryTime)
 	if err != nil {
 		return nil, err
 	}
 	return inviteCode, nil
 }
 
-func (s *adminGrpcServer) GenerateInviteCode(ctx context.Context, in *emptypb.Empty) (*admin_rpc.IvniteCodeReply, error) {
+func (s *adminGrpcServer) GenerateInviteCode(ctx context.Context, in *admin_rpc.InviteCodeRequest) (*admin_rpc.IvniteCodeReply, error) {
+	var groupId sql.NullInt64
+	if in.GroupId != 0 {
+		groupId = sql.NullInt64{Int64: int64(in.GroupId), Valid: true}
+	}
 
-	inviteCode, err := generateInviteCodeHelper(s.Db)
+	inviteCode, err := generateInviteCodeHelper(s.Db, sql.NullInt64{}, groupId)
 	if err != nil {
 		return nil, err
 	}
@@ -1051,250 +2719,239 @@ func (s *adminGrpcServer) GenerateInviteCode(ctx context.Context, in *emptypb.Em
 	return &admin_rpc.IvniteCodeReply{Code: base64.URLEncoding.EncodeToString(inviteCode)}, nil
 }
 
-func findNode(node *html.Node, visitor func(*html.Node) bool) *html.Node {
-	if node == nil {
-		return nil
+func (s *adminGrpcServer) CreateGroup(ctx context.Context, in *admin_rpc.CreateGroupRequest) (*admin_rpc.CreateGroupReply, error) {
+	name := strings.TrimSpace(in.Name)
+	if name == "" || len(name) >= 500 {
+		return nil, errors.New("group name must be between 1 and 500 characters")
 	}
-	if visitor(node) {
-		return node
-	}
-	for node := node.FirstChild; node != nil; node = node.NextSibling {
-		ret := findNode(node, visitor)
-		if ret != nil {
-			return ret
-		}
-	}
-	return nil
-}
 
-func parseCreateTime(node *html.Node, ret *time.Time) error {
-	if node == nil {
-		return errors.New("nill node parsing time")
-	}
-	parsedTime, err := time.Parse("1/2/2006 3:04:05 PM", node.Data)
+	result, err := s.Db.Exec("INSERT INTO user_groups(name) VALUES(?)", name)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error parsing timestamp: %s, %v", node.Data, err))
+		return nil, err
 	}
-	*ret = parsedTime
-	return nil
-}
-
-func parseString(node *html.Node, ret *string) error {
-	if node == nil {
-		// allowed to be empty
-		*ret = ""
-		return nil
+	groupId, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
 	}
-	*ret = node.Data
-	return nil
-}
-
-type VistesWishlistRow struct {
-	CreateTime  time.Time
-	Description string
-	Source      string
-	Cost        string
-	Comments    string
+	s.Logger.Printf("created group '%s' %d", name, groupId)
+	return &admin_rpc.CreateGroupReply{GroupId: uint64(groupId)}, nil
 }
 
-func (r VistesWishlistRow) String() string {
-	return fmt.Sprintf("time='%v', desc='%v', source='%v', cost='%v', comments='%v'",
-		r.CreateTime, r.Description, r.Source, r.Cost, r.Comments)
-}
-
-// parse e.g. one of these
-// <tr>
-//
-//	<td><a href=
-//	"item.asp?Action=Edit&amp;Item=3730">3730</a></td>
-//	<td>eric</td>
-//	<td>9/23/2025 9:42:41 PM</td>
-//	<td>swim</td>
-//	<td>Sporti Bungee Strap</td>
-//	<td>
-//	https://www.swimoutlet.com/products/sporti-bungee-strap-21092/?color=black</td>
-//	<td>$2.95</td>
-//	<td>could use one black, one red</td>
-//
-// </tr>
-func parseVistesRow(node *html.Node) (*VistesWishlistRow, error) {
-	if node.Type != html.ElementNode || node.DataAtom != atom.Tr {
-		return nil, errors.New("node is not a <tr>")
-	}
-
-	// cols are edit link, owner, create time, category, decription, source, cost, comments
-	ret := &VistesWishlistRow{}
-	col := 0
-	for child := range node.ChildNodes() {
-		if child.Type != html.ElementNode || child.DataAtom != atom.Td {
-			continue
-		}
-		switch col {
-		case 0, 1, 3: // edit link, owner, category
-			break
-		case 2: // create time
-			err := parseCreateTime(child.FirstChild, &ret.CreateTime)
-			if err != nil {
-				return nil, err
-			}
-		case 4: // description
-			err := parseString(child.FirstChild, &ret.Description)
-			if err != nil {
-				return nil, err
-			}
-		case 5: // source
-			err := parseString(child.FirstChild, &ret.Source)
-			if err != nil {
-				return nil, err
-			}
-		case 6: // cost
-			err := parseString(child.FirstChild, &ret.Cost)
-			if err != nil {
-				return nil, err
-			}
-		case 7: // comments
-			err := parseString(child.FirstChild, &ret.Comments)
-			if err != nil {
-				return nil, err
-			}
-		}
-		col++
+// Adds a user to a group or changes their role, e.g. to give a group its
+// first admin.
+func (s *adminGrpcServer) AddGroupMember(ctx context.Context, in *admin_rpc.GroupMemberRequest) (*emptypb.Empty, error) {
+	if !validGroupRole(in.Role) {
+		return nil, errors.New("role must be admin or member")
 	}
-	return ret, nil
-}
 
-// curl -c cookies.txt -d "username=eric&password=tonimu" "http://vistes.com/sqlwishlist/verify_user_name_and_password.asp"
-// curl -X GET -b cookies.txt 'http://vistes.com/sqlwishlist/get_wishlist.asp?Item=eric'
-// curl -X GET -b cookies.txt 'http://vistes.com/sqlwishlist/Database1_interface/wishlists/editor/list.asp'
-func (s *adminGrpcServer) VistesImport(ctx context.Context, in *admin_rpc.ImportRequest) (*emptypb.Empty, error) {
-	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	tx, err := s.Db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
 
-	client := &http.Client{Timeout: 10 * time.Second, Jar: jar}
-
-	// Login
-	u, err := url.Parse("http://vistes.com/sqlwishlist/verify_user_name_and_password.asp")
+	var exists bool
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM user_groups WHERE id = ?) > 0 AND
+		(SELECT COUNT(*) FROM users WHERE id = ?) > 0`, in.GroupId, in.UserId).Scan(&exists)
 	if err != nil {
 		return nil, err
 	}
-	q := u.Query()
-	q.Set("username", in.Username)
-	q.Set("password", in.Password)
-	u.RawQuery = q.Encode()
+	if !exists {
+		return nil, errors.New("no such group or user")
+	}
 
-	req, err := http.NewRequest("POST", u.String(), strings.NewReader(""))
+	previousRole, err := memberRole(tx, in.GroupId, in.UserId)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "text/plain")
-
-	resp, err := client.Do(req)
+	err = addGroupMember(tx, in.GroupId, in.UserId, in.Role)
 	if err != nil {
 		return nil, err
 	}
-	resp.Body.Close()
-
-	// Fetch wishlist
-	u, err = url.Parse("http://vistes.com/sqlwishlist/get_wishlist.asp")
+	err = checkLastAdmin(tx, in.GroupId, previousRole)
 	if err != nil {
 		return nil, err
 	}
-	q = u.Query()
-	q.Set("Item", in.Username)
-	u.RawQuery = q.Encode()
+	return &emptypb.Empty{}, tx.Commit()
+}
 
-	req, err = http.NewRequest("GET", u.String(), strings.NewReader(""))
-	if err != nil {
+// Re-draw an exchange for its organizer, e.g. when someone has peeked. Like
+// drawing over http, this only works before the reveal date.
+func (s *adminGrpcServer) RedrawExchange(ctx context.Context, in *admin_rpc.ExchangeRequest) (*emptypb.Empty, error) {
+	err := drawExchange(s.Db, in.ExchangeId, time.Now(), shuffleDraw)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no such exchange")
+	} else if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "text/plain")
+	return &emptypb.Empty{}, nil
+}
 
-	resp, err = client.Do(req)
+func (s *adminGrpcServer) SetSiteAdmin(ctx context.Context, in *admin_rpc.SiteAdminRequest) (*emptypb.Empty, error) {
+	result, err := s.Db.Exec("UPDATE users SET site_admin = ? WHERE id = ?", in.Admin, in.UserId)
 	if err != nil {
 		return nil, err
 	}
-	resp.Body.Close()
-
-	// Read wishlist
-	u, err = url.Parse("http://vistes.com/sqlwishlist/Database1_interface/wishlists/editor/list.asp")
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return nil, err
 	}
+	if rowsAffected == 0 {
+		return nil, errors.New("no such user")
+	}
+	return &emptypb.Empty{}, nil
+}
 
-	req, err = http.NewRequest("GET", u.String(), strings.NewReader(""))
+// Import items for a user with one of the importers, into their default list
+// unless it says otherwise. It's all added or none of it is, and rows already
+// imported from the same place are skipped. A dry run only says what would
+// be added.
+func (s *adminGrpcServer) Import(ctx context.Context, in *admin_rpc.GenericImportRequest) (*admin_rpc.ImportReply, error) {
+	importer, ok := s.Importers[in.Importer]
+	if !ok {
+		return nil, fmt.Errorf("unknown importer %q", in.Importer)
+	}
+	rows, err := importer.Import(ctx, ImportSource{Data: in.Data, Username: in.Username, Password: in.Password})
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "text/plain")
 
-	resp, err = client.Do(req)
+	var listId *uint64
+	if in.ListId != 0 {
+		listId = &in.ListId
+	}
+	result, err := runImport(s.Db, in.UserId, listId, in.Importer, rows, in.DryRun)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	if len(result.Errors) != 0 {
+		var errs []string
+		for _, e := range result.Errors {
+			errs = append(errs, fmt.Sprintf("row %d %s: %s", e.Row, e.Field, e.Error))
+		}
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
 
-	buf, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	reply := &admin_rpc.ImportReply{Ids: result.Ids, Added: uint32(result.Added), Skipped: uint32(result.Skipped)}
+	for _, item := range result.Items {
+		reply.Items = append(reply.Items, &admin_rpc.ImportedItem{
+			Row:             uint32(item.Row),
+			ExternalId:      item.ExternalId,
+			Description:     item.Description,
+			Source:          item.Source,
+			Cost:            item.Cost,
+			OwnerNotes:      item.OwnerNotes,
+			Tags:            item.Tags,
+			AlreadyImported: item.AlreadyImported,
+		})
 	}
+	return reply, nil
+}
 
-	s.Logger.Printf("response %s", string(buf))
+func (s *adminGrpcServer) VistesImport(ctx context.Context, in *admin_rpc.ImportRequest) (*admin_rpc.ImportReply, error) {
+	return s.Import(ctx, &admin_rpc.GenericImportRequest{Importer: "vistes", UserId: in.UserId,
+		Username: in.Username, Password: in.Password, DryRun: in.DryRun})
+}
+
+// The format sqlite's CURRENT_TIMESTAMP uses, for comparing against columns
+// that default to it.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
 
-	doc, err := html.Parse(bytes.NewReader(buf))
+// cleanupDb removes expired sessions and invite codes, and purges deleted
+// wishlist items (and everything hanging off them, including their images)
+// once they've been deleted for longer than retention.
+func cleanupDb(logger *log.Logger, db *sql.DB, blobs BlobStore, now time.Time, retention time.Duration) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+	defer tx.Rollback()
 
-	wishlistTable := findNode(doc, func(n *html.Node) bool {
-		return n.Type == html.ElementNode && n.DataAtom == atom.Table &&
-			len(n.Attr) >= 3 && n.Attr[0].Key == "border" && n.Attr[0].Val == "1" &&
-			n.Attr[1].Key == "cellspacing" && n.Attr[1].Val == "3" &&
-			n.Attr[2].Key == "cellpadding" && n.Attr[2].Val == "3"
-	})
-	if wishlistTable == nil {
-		return nil, errors.New("could not find wishlist table in response")
+	result, err := tx.Exec("DELETE FROM sessions WHERE expiry_time < ?", now)
+	if err != nil {
+		return err
+	}
+	sessions, _ := result.RowsAffected()
+
+	result, err = tx.Exec("DELETE FROM invite_codes WHERE expiry_time < ?", now)
+	if err != nil {
+		return err
 	}
+	inviteCodes, _ := result.RowsAffected()
 
-	s.Logger.Printf("wishlistTable %v", *wishlistTable)
+	cutoff := now.Add(-retention).UTC().Format(sqliteTimeFormat)
+	purged := "SELECT id FROM wishlist WHERE deleted_time IS NOT NULL AND deleted_time < ?"
 
-	startingRow := wishlistTable.FirstChild.FirstChild
-	if startingRow != nil {
-		s.Logger.Printf("startingRow %v", *startingRow)
-		startingRow = startingRow.NextSibling
+	var blobKeys []string
+	rows, err := tx.Query(`SELECT image_key,thumb_key FROM wishlist
+		WHERE image_key IS NOT NULL AND id IN (`+purged+")", cutoff)
+	if err != nil {
+		return err
 	}
-	if startingRow != nil {
-		s.Logger.Printf("startingRow %v", *startingRow)
-		startingRow = startingRow.NextSibling
+	for rows.Next() {
+		var imageKey, thumbKey string
+		err = rows.Scan(&imageKey, &thumbKey)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		blobKeys = append(blobKeys, imageKey, thumbKey)
 	}
-	if startingRow == nil {
-		return nil, errors.New("could not find starting row")
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
 	}
 
-	var parsedRows []VistesWishlistRow
-	for row := startingRow; row != nil; row = row.NextSibling {
-		parsedRow, err := parseVistesRow(row)
+	// not left to ON DELETE CASCADE, initDb's foreign_keys pragma is only on
+	// whichever pooled connection it ran on
+	for _, table := range []string{"claims", "anonymous_claims", "wishlist_tags", "wishlist_history",
+		"price_history", "import_keys", "activity"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE item_id IN (%s)", table, purged), cutoff)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		parsedRows = append(parsedRows, *parsedRow)
 	}
 
-	stmt, err := s.Db.Prepare("INSERT INTO wishlist(creation_time, user_id, description, source, cost, owner_notes) VALUES(?, ?, ?, ?, ?, ?)")
+	result, err = tx.Exec("DELETE FROM wishlist WHERE deleted_time IS NOT NULL AND deleted_time < ?", cutoff)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer stmt.Close()
+	items, _ := result.RowsAffected()
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// only once the rows are gone, so nothing can point at a missing blob
+	deleteBlobs(logger, blobs, blobKeys...)
 
-	for _, row := range parsedRows {
-		_, err := stmt.Exec(row.CreateTime, in.UserId, row.Description, row.Source, row.Cost, row.Comments)
+	if sessions != 0 || inviteCodes != 0 || items != 0 {
+		logger.Printf("cleanup removed %d sessions, %d invite codes, %d wishlist items", sessions,
+			inviteCodes, items)
+	}
+	return nil
+}
+
+func runCleanup(ctx context.Context, logger *log.Logger, config *Config, db *sql.DB, blobs BlobStore) {
+	retention := time.Duration(config.DeletedRetentionDays) * 24 * time.Hour
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		err := cleanupDb(logger, db, blobs, time.Now(), retention)
 		if err != nil {
-			return nil, err
+			logger.Printf("error cleaning up database: %v", err)
 		}
-	}
 
-	return &emptypb.Empty{}, nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func run(ctx context.Context, w io.Writer, args []string) error {
@@ -1317,7 +2974,8 @@ func run(ctx context.Context, w io.Writer, args []string) error {
 
 	// default values
 	config := Config{DbPath: "wishlist.db", HostName: "localhost", Port: "80",
-		AdminSocketPath: "wishlist_admin.sock", AllowInsecure: false}
+		AdminSocketPath: "wishlist_admin.sock", AllowInsecure: false, DeletedRetentionDays: 30,
+		PriceCheckIntervalHours: 24, ImageDir: "images"}
 
 	err = json.Unmarshal(configFile, &config)
 	if err != nil {
@@ -1339,11 +2997,20 @@ func run(ctx context.Context, w io.Writer, args []string) error {
 	db := initDb(logger, config.DbPath)
 	defer db.Close()
 
-	srv := NewServer(logger, &config, db)
+	blobs, err := newFsBlobStore(config.ImageDir)
+	if err != nil {
+		logger.Fatalf("Error opening image directory: %v", err)
+	}
+
+	hub := newHub()
+	presence := newPresence()
+	srv := NewServer(logger, &config, db, blobs, hub, presence)
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort(config.HostName, config.Port),
 		Handler: srv,
 	}
+	// event streams never finish by themselves
+	httpServer.RegisterOnShutdown(hub.Close)
 	go func() {
 		logger.Printf("http listening on %s\n", httpServer.Addr)
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -1351,10 +3018,44 @@ func run(ctx context.Context, w io.Writer, args []string) error {
 		}
 	}()
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(8)
+	go func() {
+		defer wg.Done()
+		runCleanup(ctx, logger, &config, db, blobs)
+	}()
+	fetcher := newLinkFetcher(config.LinkPreviewAllowPrivate)
+	go func() {
+		defer wg.Done()
+		runLinkPreviews(ctx, logger, db, fetcher)
+	}()
+	go func() {
+		defer wg.Done()
+		runPriceTracking(ctx, logger, &config, db, fetcher)
+	}()
+	go func() {
+		defer wg.Done()
+		// webhook urls come from users just like links do, so they get
+		// the same protection against reaching into our network
+		runWebhooks(ctx, logger, db, fetcher.client)
+	}()
+	go func() {
+		defer wg.Done()
+		runReminders(ctx, logger, db)
+	}()
+	var email Notifier = &logNotifier{logger: logger}
+	if config.SmtpAddr != "" {
+		email = newSmtpNotifier(&config)
+	}
+	channels := map[string]Notifier{emailChannel: email}
+	go func() {
+		defer wg.Done()
+		runNotifications(ctx, logger, db, channels)
+	}()
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
+		// sockets are hijacked, so Shutdown neither waits on nor closes them
+		presence.Close()
 		shutdownCtx := context.Background()
 		shutdownCtx, cancel := context.WithTimeout(shutdownCtx, 10*time.Second)
 		defer cancel()
@@ -1364,7 +3065,7 @@ func run(ctx context.Context, w io.Writer, args []string) error {
 	}()
 
 	grpcServer := grpc.NewServer()
-	admin_rpc.RegisterWishlistAdminServer(grpcServer, &adminGrpcServer{Logger: logger, Db: db})
+	admin_rpc.RegisterWishlistAdminServer(grpcServer, &adminGrpcServer{Logger: logger, Db: db, Importers: newImporters(&config)})
 	reflection.Register(grpcServer)
 	go func() {
 		log.Printf("grpc server listening at %v", lis.Addr())
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 func TestSignup(t *testing.T) {
@@ -178,7 +185,7 @@ func TestSignup(t *testing.T) {
 			var body map[string]string
 			err := json.Unmarshal([]byte(bodyCopy), &body)
 			if err == nil {
-				inviteCode, err := generateInviteCodeHelper(db)
+				inviteCode, err := generateInviteCodeHelper(db, sql.NullInt64{}, sql.NullInt64{})
 				if err != nil {
 					t.Errorf("failed to generate invite code: %v", err)
 					return
@@ -206,3 +213,585 @@ func TestSignup(t *testing.T) {
 }
 
 // TODO: test invite code reuse, test that invite codes are not used up by invalid requests
+
+// newTestDb opens a fresh on-disk database. Unlike ":memory:", every pooled
+// connection sees the same data, so handlers can hold more than one
+// connection at a time.
+func newTestDb(t *testing.T) *sql.DB {
+	t.Helper()
+	db := initDb(log.Default(), filepath.Join(t.TempDir(), "wishlist.db"))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func createTestUser(t *testing.T, db *sql.DB, first string) uint64 {
+	t.Helper()
+	result, err := db.Exec("INSERT INTO users(first_name, last_name, email, password_hash) VALUES(?, ?, ?, ?)",
+		first, "Test", strings.ToLower(first)+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get user id: %v", err)
+	}
+
+	// everyone can see each other unless a test sets up groups of its own
+	_, err = db.Exec(`INSERT INTO user_groups(id, name) VALUES(1, 'Test') ON CONFLICT(id) DO NOTHING;
+		INSERT INTO group_members(group_id, user_id, role) VALUES(1, ?, 'admin')`, id)
+	if err != nil {
+		t.Fatalf("failed to add user to test group: %v", err)
+	}
+	return uint64(id)
+}
+
+// doJson runs an authenticated handler against a json request body and
+// decodes the json response into out (if non-nil).
+func doJson(t *testing.T, handler func(http.ResponseWriter, *http.Request, uint64), userId uint64,
+	method string, target string, body string, out interface{}) int {
+	t.Helper()
+	return doJsonPath(t, handler, userId, method, target, nil, body, out)
+}
+
+// doJsonPath is doJson for handlers that take values from the request path,
+// which the test has to fill in since there's no mux to do it.
+func doJsonPath(t *testing.T, handler func(http.ResponseWriter, *http.Request, uint64), userId uint64,
+	method string, target string, pathValues map[string]string, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range pathValues {
+		req.SetPathValue(name, value)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req, userId)
+	if out != nil && rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), out); err != nil {
+			t.Fatalf("failed to decode response %q: %v", rr.Body.String(), err)
+		}
+	}
+	return rr.Code
+}
+
+type testWishlistEntry struct {
+	Id            uint64  `json:"id"`
+	Seq           uint64  `json:"seq"`
+	Description   string  `json:"description"`
+	Cost          string  `json:"cost"`
+	PriceAmount   *int64  `json:"price_amount"`
+	PriceCurrency *string `json:"price_currency"`
+	BuyerNotes    *string `json:"buyer_notes"`
+}
+
+type testWishlistResponse struct {
+	Entries []testWishlistEntry `json:"entries"`
+}
+
+func TestWishlistPrice(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "Joe")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "strap", "source": "", "cost": "$2.95"}`,
+		`{"description": "goggles", "source": "", "cost": "about 20 bucks"}`,
+		`{"description": "socks", "source": "", "cost": "cheap"}`,
+		`{"description": "towel", "source": "", "cost": "", "price_amount": 1500, "price_currency": "EUR"}`,
+	} {
+		if code := doJson(t, post, userId, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+
+	code := doJson(t, post, userId, "POST", "/api/wishlist",
+		`{"description": "x", "source": "", "cost": "", "price_currency": "EUR"}`, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("currency without amount: unexpected status %d", code)
+	}
+
+	type testCase struct {
+		name  string
+		query string
+		code  int
+		items []string
+	}
+
+	tests := []testCase{
+		{name: "sort by price", query: "sort=price", items: []string{"strap", "towel", "goggles", "socks"}},
+		{name: "sort by price desc", query: "sort=-price", items: []string{"goggles", "towel", "strap", "socks"}},
+		{name: "min price", query: "minPrice=1000&sort=price", items: []string{"towel", "goggles"}},
+		{name: "max price", query: "maxPrice=1500&sort=price", items: []string{"strap", "towel"}},
+		{name: "currency", query: "currency=USD&sort=price", items: []string{"strap", "goggles"}},
+		{name: "bad sort", query: "sort=color", code: http.StatusBadRequest},
+		{name: "bad min price", query: "minPrice=cheap", code: http.StatusBadRequest},
+	}
+
+	get := handleWishlistGet(logger, db)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.code == 0 {
+				tc.code = http.StatusOK
+			}
+			var response testWishlistResponse
+			code := doJson(t, get, userId, "GET", "/api/wishlist?"+tc.query, "", &response)
+			if code != tc.code {
+				t.Fatalf("unexpected status %d (expected %d)", code, tc.code)
+			}
+			var got []string
+			for _, entry := range response.Entries {
+				got = append(got, entry.Description)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.items, ",") {
+				t.Errorf("got items %v, expected %v", got, tc.items)
+			}
+		})
+	}
+
+	// a new amount keeps the item's currency, or gets the default if it had none
+	patch := handleWishlistPatch(logger, db, newHub())
+	for _, body := range []string{`{"id": 4, "seq": 1, "price_amount": 1800}`, `{"id": 3, "seq": 1, "price_amount": 300}`} {
+		if code := doJson(t, patch, userId, "PATCH", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to patch %s: %d", body, code)
+		}
+	}
+	for id, want := range map[int]string{4: "EUR", 3: defaultCurrency} {
+		var currency string
+		if err := db.QueryRow("SELECT price_currency FROM wishlist WHERE id = ?", id).Scan(&currency); err != nil || currency != want {
+			t.Errorf("item %d: expected %s, got %q %v", id, want, currency, err)
+		}
+	}
+}
+
+func TestMigrateWishlistPrice(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "wishlist.db")
+
+	// a database from before the price columns existed
+	old, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+	CREATE TABLE wishlist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sequence_number INTEGER DEFAULT 1,
+		user_id INTEGER NOT NULL,
+		description TEXT NOT NULL,
+		source TEXT NOT NULL,
+		cost TEXT NOT NULL,
+		owner_notes TEXT,
+		buyer_notes TEXT,
+		creation_time DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO wishlist(user_id, description, source, cost) VALUES(1, 'strap', '', '$2.95');
+	INSERT INTO wishlist(user_id, description, source, cost) VALUES(1, 'socks', '', 'cheap');
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := initDb(log.Default(), dbPath)
+	defer db.Close()
+
+	var amount sql.NullInt64
+	var currency sql.NullString
+	err = db.QueryRow("SELECT price_amount,price_currency FROM wishlist WHERE description = 'strap'").Scan(&amount, &currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount.Int64 != 295 || currency.String != "USD" {
+		t.Errorf("unexpected migrated price %v %v", amount, currency)
+	}
+
+	err = db.QueryRow("SELECT price_amount,price_currency FROM wishlist WHERE description = 'socks'").Scan(&amount, &currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount.Valid || currency.Valid {
+		t.Errorf("unparseable cost should have no price, got %v %v", amount, currency)
+	}
+}
+
+func TestWishlistQuantity(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	var created struct {
+		Id uint64 `json:"id"`
+	}
+	code := doJson(t, handleWishlistPost(logger, db, newHub()), owner, "POST", "/api/wishlist",
+		`{"description": "socks", "source": "", "cost": "", "quantity_desired": 3}`, &created)
+	if code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+
+	claim := handleClaimPost(logger, db, newHub())
+	claimBody := func(quantity int) string {
+		return `{"id": ` + strconv.FormatUint(created.Id, 10) + `, "quantity": ` + strconv.Itoa(quantity) + `}`
+	}
+
+	if code := doJson(t, claim, owner, "POST", "/api/wishlist/claim", claimBody(1), nil); code != http.StatusBadRequest {
+		t.Errorf("owner claim: unexpected status %d", code)
+	}
+	if code := doJson(t, claim, alice, "POST", "/api/wishlist/claim", claimBody(2), nil); code != http.StatusOK {
+		t.Errorf("alice claim: unexpected status %d", code)
+	}
+	if code := doJson(t, claim, bob, "POST", "/api/wishlist/claim", claimBody(2), nil); code != http.StatusConflict {
+		t.Errorf("bob over-claim: unexpected status %d", code)
+	}
+	if code := doJson(t, claim, bob, "POST", "/api/wishlist/claim", claimBody(1), nil); code != http.StatusOK {
+		t.Errorf("bob claim: unexpected status %d", code)
+	}
+
+	get := handleWishlistGet(logger, db)
+	type quantityEntry struct {
+		QuantityDesired  uint64  `json:"quantity_desired"`
+		QuantityReceived uint64  `json:"quantity_received"`
+		QuantityClaimed  *uint64 `json:"quantity_claimed"`
+		ClaimedByMe      *uint64 `json:"claimed_by_me"`
+	}
+	type quantityResponse struct {
+		Entries []quantityEntry `json:"entries"`
+	}
+
+	var response quantityResponse
+	doJson(t, get, owner, "GET", "/api/wishlist", "", &response)
+	if len(response.Entries) != 1 || response.Entries[0].QuantityDesired != 3 {
+		t.Fatalf("unexpected owner view %+v", response)
+	}
+	if response.Entries[0].QuantityClaimed != nil || response.Entries[0].ClaimedByMe != nil {
+		t.Errorf("owner should not see claims")
+	}
+
+	response = quantityResponse{}
+	doJson(t, get, alice, "GET", "/api/wishlist?userId="+strconv.FormatUint(owner, 10), "", &response)
+	if len(response.Entries) != 1 || *response.Entries[0].QuantityClaimed != 3 || *response.Entries[0].ClaimedByMe != 2 {
+		t.Errorf("unexpected buyer view %+v", response)
+	}
+
+	received := handleWishlistReceived(logger, db, newHub())
+	var receivedResponse struct {
+		QuantityReceived uint64 `json:"quantity_received"`
+		Archived         bool   `json:"archived"`
+	}
+	if code := doJson(t, received, alice, "POST", "/api/wishlist/received", claimBody(1), nil); code != http.StatusUnauthorized {
+		t.Errorf("non-owner received: unexpected status %d", code)
+	}
+	doJson(t, received, owner, "POST", "/api/wishlist/received", claimBody(1), &receivedResponse)
+	if receivedResponse.QuantityReceived != 1 || receivedResponse.Archived {
+		t.Errorf("unexpected received response %+v", receivedResponse)
+	}
+	doJson(t, received, owner, "POST", "/api/wishlist/received", claimBody(2), &receivedResponse)
+	if receivedResponse.QuantityReceived != 3 || !receivedResponse.Archived {
+		t.Errorf("unexpected received response %+v", receivedResponse)
+	}
+
+	response = quantityResponse{}
+	doJson(t, get, owner, "GET", "/api/wishlist", "", &response)
+	if len(response.Entries) != 0 {
+		t.Errorf("fully received item should be archived, got %+v", response)
+	}
+}
+
+// A present that came in and its claim are the same present, not two.
+func TestClaimAfterReceived(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	if code := doJson(t, handleWishlistPost(logger, db, newHub()), owner, "POST", "/api/wishlist",
+		`{"description": "socks", "source": "", "cost": "", "quantity_desired": 3}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add item: %d", code)
+	}
+	claim := handleClaimPost(logger, db, newHub())
+	if code := doJson(t, claim, alice, "POST", "/api/wishlist/claim", `{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("alice claim: unexpected status %d", code)
+	}
+	if code := doJson(t, handleWishlistReceived(logger, db, newHub()), owner, "POST", "/api/wishlist/received",
+		`{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to receive: %d", code)
+	}
+	if code := doJson(t, claim, bob, "POST", "/api/wishlist/claim", `{"id": 1, "quantity": 2}`, nil); code != http.StatusOK {
+		t.Errorf("bob couldn't claim what's left: %d", code)
+	}
+	if code := doJson(t, claim, bob, "POST", "/api/wishlist/claim", `{"id": 1, "quantity": 3}`, nil); code != http.StatusConflict {
+		t.Errorf("bob over-claim: unexpected status %d", code)
+	}
+
+	// wanting no more than came in is as good as receiving the rest
+	if code := doJson(t, handleWishlistPatch(logger, db, newHub()), owner, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 2, "quantity_desired": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to patch: %d", code)
+	}
+	var archived bool
+	if err := db.QueryRow("SELECT archived_time IS NOT NULL FROM wishlist WHERE id = 1").Scan(&archived); err != nil || !archived {
+		t.Errorf("expected the item to be archived, got %v %v", archived, err)
+	}
+}
+
+func TestWishlistTags(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "Joe")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "strap", "source": "", "cost": "", "tags": ["swim", " gear "]}`,
+		`{"description": "goggles", "source": "", "cost": "", "tags": ["Swim", "swim"]}`,
+		`{"description": "book", "source": "", "cost": ""}`,
+	} {
+		if code := doJson(t, post, userId, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+
+	type tagsResponse struct {
+		Entries []struct {
+			Description string   `json:"description"`
+			Tags        []string `json:"tags"`
+		} `json:"entries"`
+		TagCounts []TagCount `json:"tag_counts"`
+	}
+
+	get := handleWishlistGet(logger, db)
+	var response tagsResponse
+	doJson(t, get, userId, "GET", "/api/wishlist?tag=swim", "", &response)
+	if len(response.Entries) != 2 {
+		t.Errorf("expected 2 swim items, got %+v", response.Entries)
+	}
+	if len(response.TagCounts) != 2 || response.TagCounts[0] != (TagCount{"swim", 2}) ||
+		response.TagCounts[1] != (TagCount{"gear", 1}) {
+		t.Errorf("unexpected tag counts %+v", response.TagCounts)
+	}
+
+	response = tagsResponse{}
+	doJson(t, get, userId, "GET", "/api/wishlist?tag=swim&tag=gear", "", &response)
+	if len(response.Entries) != 1 || response.Entries[0].Description != "strap" ||
+		strings.Join(response.Entries[0].Tags, ",") != "gear,swim" {
+		t.Errorf("unexpected entries %+v", response.Entries)
+	}
+
+	// patching tags replaces them
+	code := doJson(t, handleWishlistPatch(logger, db, newHub()), userId, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 1, "tags": ["books"]}`, nil)
+	if code != http.StatusOK {
+		t.Fatalf("failed to patch tags: %d", code)
+	}
+	response = tagsResponse{}
+	doJson(t, get, userId, "GET", "/api/wishlist?tag=gear", "", &response)
+	if len(response.Entries) != 0 {
+		t.Errorf("expected no gear items after patch, got %+v", response.Entries)
+	}
+
+	// the vocabulary remembers tags that are no longer used
+	var vocabulary struct {
+		Tags []string `json:"tags"`
+	}
+	doJson(t, handleTagsGet(logger, db), userId, "GET", "/api/tags", "", &vocabulary)
+	if strings.Join(vocabulary.Tags, ",") != "books,gear,swim" {
+		t.Errorf("unexpected vocabulary %v", vocabulary.Tags)
+	}
+}
+
+func TestParseVistesRow(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<table><tr>
+	<td><a href="item.asp?Action=Edit&amp;Item=3730">3730</a></td>
+	<td>eric</td>
+	<td>9/23/2025 9:42:41 PM</td>
+	<td>swim</td>
+	<td>Sporti Bungee Strap</td>
+	<td>https://www.swimoutlet.com/products/sporti-bungee-strap-21092/?color=black</td>
+	<td>$2.95</td>
+	<td>could use one black, one red</td>
+	</tr></table>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := findNode(doc, func(n *html.Node) bool {
+		return n.Type == html.ElementNode && n.DataAtom == atom.Tr
+	})
+	row, err := parseVistesRow(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row.Category != "swim" || row.Description != "Sporti Bungee Strap" || row.Cost != "$2.95" ||
+		row.Comments != "could use one black, one red" {
+		t.Errorf("unexpected row %v", row)
+	}
+}
+
+func TestWishlistSoftDelete(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	blobs := newTestBlobStore(t)
+	owner := createTestUser(t, db, "Owner")
+	buyer := createTestUser(t, db, "Buyer")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "strap", "source": "", "cost": ""}`,
+		`{"description": "goggles", "source": "", "cost": ""}`,
+	} {
+		if code := doJson(t, post, owner, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), buyer, "POST", "/api/wishlist/claim", `{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+
+	get := handleWishlistGet(logger, db)
+	listItems := func(userId uint64, query string) []string {
+		t.Helper()
+		var response testWishlistResponse
+		code := doJson(t, get, userId, "GET", "/api/wishlist?userId="+strconv.FormatUint(owner, 10)+query, "", &response)
+		if code != http.StatusOK {
+			t.Fatalf("failed to get wishlist: %d", code)
+		}
+		var ret []string
+		for _, entry := range response.Entries {
+			ret = append(ret, entry.Description)
+		}
+		return ret
+	}
+
+	if code := doJson(t, handleWishlistDelete(logger, db, newHub()), buyer, "DELETE", "/api/wishlist", `{"ids": [1]}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("non-owner delete: unexpected status %d", code)
+	}
+	if code := doJson(t, handleWishlistDelete(logger, db, newHub()), owner, "DELETE", "/api/wishlist", `{"ids": [1]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to delete: %d", code)
+	}
+	if code := doJson(t, handleWishlistArchive(logger, db, newHub()), owner, "POST", "/api/wishlist/archive", `{"ids": [2]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to archive: %d", code)
+	}
+
+	if items := listItems(owner, ""); len(items) != 0 {
+		t.Errorf("expected empty list, got %v", items)
+	}
+	if items := listItems(owner, "&archived=true"); strings.Join(items, ",") != "strap,goggles" {
+		t.Errorf("owner archived view: got %v", items)
+	}
+	if items := listItems(buyer, "&archived=true"); strings.Join(items, ",") != "goggles" {
+		t.Errorf("buyer archived view: got %v", items)
+	}
+
+	// restoring brings the claim back with it
+	if code := doJson(t, handleWishlistRestore(logger, db, newHub()), owner, "POST", "/api/wishlist/restore", `{"ids": [1]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to restore: %d", code)
+	}
+	var claimed uint64
+	if err := db.QueryRow("SELECT COUNT(*) FROM claims WHERE item_id = 1").Scan(&claimed); err != nil || claimed != 1 {
+		t.Errorf("expected claim to survive delete and restore, got %d %v", claimed, err)
+	}
+	if items := listItems(owner, ""); strings.Join(items, ",") != "strap" {
+		t.Errorf("expected restored item, got %v", items)
+	}
+
+	// only deleted items past the retention period get purged
+	if code := doJson(t, handleWishlistDelete(logger, db, newHub()), owner, "DELETE", "/api/wishlist", `{"ids": [1, 2]}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to delete: %d", code)
+	}
+	if err := cleanupDb(logger, db, blobs, time.Now(), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if items := listItems(owner, "&archived=true"); len(items) != 2 {
+		t.Errorf("items purged too early: %v", items)
+	}
+	if err := cleanupDb(logger, db, blobs, time.Now().Add(48*time.Hour), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if items := listItems(owner, "&archived=true"); len(items) != 0 {
+		t.Errorf("expected items to be purged, got %v", items)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM claims").Scan(&claimed); err != nil || claimed != 0 {
+		t.Errorf("expected claims to be purged, got %d %v", claimed, err)
+	}
+}
+
+func TestWishlistHistory(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+	buyer := createTestUser(t, db, "Buyer")
+
+	steps := []struct {
+		handler func(http.ResponseWriter, *http.Request, uint64)
+		userId  uint64
+		method  string
+		body    string
+	}{
+		{handleWishlistPost(logger, db, newHub()), owner, "POST", `{"description": "strap", "source": "", "cost": "$2"}`},
+		{handleWishlistPatch(logger, db, newHub()), owner, "PATCH", `{"id": 1, "seq": 1, "cost": "$3"}`},
+		{handleWishlistPatch(logger, db, newHub()), buyer, "PATCH", `{"id": 1, "seq": 2, "buyer_notes": "got it"}`},
+		{handleWishlistArchive(logger, db, newHub()), owner, "POST", `{"ids": [1]}`},
+	}
+	for _, step := range steps {
+		if code := doJson(t, step.handler, step.userId, step.method, "/api/wishlist", step.body, nil); code != http.StatusOK {
+			t.Fatalf("%s failed: %d", step.body, code)
+		}
+	}
+
+	type historyResponse struct {
+		Entries []struct {
+			Version uint64                 `json:"version"`
+			Action  string                 `json:"action"`
+			Actor   *User                  `json:"actor"`
+			Changes map[string]fieldChange `json:"changes"`
+		} `json:"entries"`
+	}
+
+	history := func(userId uint64) historyResponse {
+		t.Helper()
+		var response historyResponse
+		req := httptest.NewRequest("GET", "/api/wishlist/1/history", nil)
+		req.Header.Set("Content-Type", "application/json")
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+		handleWishlistHistory(logger, db)(rr, req, userId)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to get history: %d", rr.Code)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := history(buyer)
+	var actions []string
+	for _, entry := range response.Entries {
+		actions = append(actions, entry.Action+":"+strconv.FormatUint(entry.Version, 10))
+	}
+	if strings.Join(actions, ",") != "create:1,patch:2,patch:3,archive:4" {
+		t.Fatalf("unexpected buyer history %v", actions)
+	}
+	if change := response.Entries[1].Changes["cost"]; change.Old != "$2" || change.New != "$3" {
+		t.Errorf("unexpected cost change %+v", change)
+	}
+	if change := response.Entries[1].Changes["price_amount"]; change.Old != float64(200) || change.New != float64(300) {
+		t.Errorf("unexpected price change %+v", change)
+	}
+	if response.Entries[2].Actor == nil || response.Entries[2].Actor.Id != buyer {
+		t.Errorf("unexpected actor %+v", response.Entries[2].Actor)
+	}
+
+	response = history(owner)
+	actions = nil
+	for _, entry := range response.Entries {
+		actions = append(actions, entry.Action+":"+strconv.FormatUint(entry.Version, 10))
+		if _, ok := entry.Changes["buyer_notes"]; ok {
+			t.Errorf("owner can see buyer notes in %+v", entry)
+		}
+	}
+	if strings.Join(actions, ",") != "create:1,patch:2,archive:4" {
+		t.Errorf("unexpected owner history %v", actions)
+	}
+}
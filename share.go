@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// total quantity claimed on a wishlist row, by members and through share links
+const claimedQuantity = `((SELECT COALESCE(SUM(quantity), 0) FROM claims WHERE item_id = wishlist.id) +
+	(SELECT COALESCE(SUM(quantity), 0) FROM anonymous_claims WHERE item_id = wishlist.id))`
+
+// quantityTaken is how much of a wishlist row is spoken for. The owner can't
+// tell which claim a present that came in was for, so what's been received
+// is taken to be what was claimed, rather than counting a gift twice while
+// its claim is still around.
+const quantityTaken = `MAX(quantity_received, ` + claimedQuantity + `)`
+
+// Share tokens and anonymous claim tokens are random blobs, handed out base64
+// encoded like invite codes.
+func newShareToken() []byte {
+	// Note that no error handling is necessary, as Read always succeeds.
+	token := make([]byte, 32)
+	rand.Read(token)
+	return token
+}
+
+// checkListOwner loads the list named in the request path and makes sure it
+// belongs to userId. It writes an error response and returns false if not.
+func checkListOwner(w http.ResponseWriter, r *http.Request, db *sql.DB, userId uint64) (uint64, bool) {
+	listId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "malformed list id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var ownerId uint64
+	err = db.QueryRow("SELECT user_id FROM lists WHERE id = ?", listId).Scan(&ownerId)
+	if err == sql.ErrNoRows || (err == nil && ownerId != userId) {
+		http.Error(w, "non-existent list", http.StatusNotFound)
+		return 0, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return listId, true
+}
+
+// Create a share link for a public list, replacing any existing one so old
+// links stop working.
+func handleShareLinkPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type ShareLinkResponse struct {
+			ShareToken string `json:"share_token"`
+		}
+
+		listId, ok := checkListOwner(w, r, db, userId)
+		if !ok {
+			return
+		}
+
+		var visibility string
+		err := db.QueryRow("SELECT visibility FROM lists WHERE id = ?", listId).Scan(&visibility)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if visibility != listPublic {
+			http.Error(w, "only public lists can be shared by link", http.StatusConflict)
+			return
+		}
+
+		token := newShareToken()
+		_, err = db.Exec(`INSERT INTO share_links(share_token, list_id) VALUES(?, ?)
+			ON CONFLICT(list_id) DO UPDATE SET share_token = excluded.share_token,
+			creation_time = CURRENT_TIMESTAMP`, token, listId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := ShareLinkResponse{ShareToken: base64.URLEncoding.EncodeToString(token)}
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func handleShareLinkDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		listId, ok := checkListOwner(w, r, db, userId)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM share_links WHERE list_id = ?", listId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "list is not shared", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// lookupShareToken finds the list a share token from the request path is
+// for. It writes an error response and returns false if there isn't one, or
+// the list isn't public anymore.
+func lookupShareToken(w http.ResponseWriter, r *http.Request, db dbtx) (listId uint64, ok bool) {
+	token, err := base64.URLEncoding.DecodeString(r.PathValue("token"))
+	if err != nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+
+	err = db.QueryRow(`SELECT lists.id FROM share_links
+		JOIN lists ON lists.id = share_links.list_id
+		WHERE share_links.share_token = ? AND lists.visibility = 'public'`,
+		token).Scan(&listId)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return 0, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return listId, true
+}
+
+// isSignedInAs reports whether the request comes with a live session for
+// userId, for public pages that show its owner less.
+func isSignedInAs(db dbtx, r *http.Request, userId uint64) (bool, error) {
+	cookie := extractCookie(r)
+	if cookie == nil {
+		return false, nil
+	}
+	var expiryTime time.Time
+	var id uint64
+	err := db.QueryRow("SELECT expiry_time, id FROM sessions WHERE session_cookie = ?", cookie).Scan(&expiryTime, &id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return id == userId && expiryTime.After(time.Now()), nil
+}
+
+// Unauthenticated, read-only view of a shared list. Nothing about notes or
+// who has claimed what, just how many of each item are still wanted.
+//
+// That's the one thing here that comes from claims, and anonymous buyers
+// need it to not all get the same thing. It's left out when the owner looks
+// at their own link while signed in, like claims are everywhere else, but
+// anyone with the link can see it, so an owner who signs out can too. That's
+// the price of letting people without accounts claim things.
+func handlePublicListGet(logger *log.Logger, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type PublicEntry struct {
+			Id                uint64   `json:"id"`
+			Description       string   `json:"description"`
+			Source            string   `json:"source"`
+			Cost              string   `json:"cost"`
+			PriceAmount       *int64   `json:"price_amount"`
+			PriceCurrency     *string  `json:"price_currency"`
+			QuantityDesired   uint64   `json:"quantity_desired"`
+			QuantityAvailable *uint64  `json:"quantity_available"`
+			Tags              []string `json:"tags"`
+		}
+
+		type Owner struct {
+			FirstName string `json:"first_name"`
+			LastName  string `json:"last_name"`
+		}
+
+		type PublicListResponse struct {
+			Name    string        `json:"name"`
+			Owner   Owner         `json:"owner"`
+			Entries []PublicEntry `json:"entries"`
+		}
+
+		listId, ok := lookupShareToken(w, r, db)
+		if !ok {
+			return
+		}
+
+		var response PublicListResponse
+		var ownerId uint64
+		err := db.QueryRow(`SELECT lists.name, users.id, users.first_name, users.last_name FROM lists
+			JOIN users ON users.id = lists.user_id WHERE lists.id = ?`,
+			listId).Scan(&response.Name, &ownerId, &response.Owner.FirstName, &response.Owner.LastName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		isOwner, err := isSignedInAs(db, r, ownerId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`SELECT id,description,source,cost,price_amount,price_currency,quantity_desired,
+			MAX(0, quantity_desired - `+quantityTaken+`)
+			FROM wishlist WHERE list_id = ? AND `+liveItem+` ORDER BY id`, listId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response.Entries = []PublicEntry{}
+		for rows.Next() {
+			var entry PublicEntry
+			err = rows.Scan(&entry.Id, &entry.Description, &entry.Source, &entry.Cost, &entry.PriceAmount,
+				&entry.PriceCurrency, &entry.QuantityDesired, &entry.QuantityAvailable)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if isOwner {
+				entry.QuantityAvailable = nil
+			}
+			response.Entries = append(response.Entries, entry)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		itemTags, err := loadItemTags(db, "wishlist.list_id = ? AND "+liveItem, listId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range response.Entries {
+			response.Entries[i].Tags = itemTags[response.Entries[i].Id]
+			if response.Entries[i].Tags == nil {
+				response.Entries[i].Tags = []string{}
+			}
+		}
+
+		// the list can change at any time, and a revoked link has to stop working
+		w.Header().Set("Cache-Control", "no-store")
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Claims from people without an account, through a share link. They're kept
+// apart from member claims since there's no user to hang them off. The
+// returned claim token is the only way to take the claim back.
+func handlePublicClaimPost(logger *log.Logger, db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type AnonymousClaimRequest struct {
+			Id       uint64  `json:"id"`
+			Quantity *uint64 `json:"quantity"`
+			Name     string  `json:"name"`
+			Email    string  `json:"email"`
+		}
+
+		type AnonymousClaimResponse struct {
+			ClaimToken string `json:"claim_token"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req AnonymousClaimRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		var quantity uint64 = 1
+		if req.Quantity != nil {
+			quantity = *req.Quantity
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Id == 0 || quantity == 0 || req.Name == "" || req.Email == "" {
+			http.Error(w, "missing id, quantity, name or email", http.StatusBadRequest)
+			return
+		}
+		if len(req.Name) >= 500 || len(req.Email) >= 500 {
+			http.Error(w, "name and email must be shorter than 500 characters", http.StatusBadRequest)
+			return
+		}
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			http.Error(w, "malformed email", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Defer a rollback in case of errors, this will be skipped if Commit() is successful
+		defer tx.Rollback()
+
+		listId, ok := lookupShareToken(w, r, tx)
+		if !ok {
+			return
+		}
+
+		var desired, received, claimed uint64
+		err = tx.QueryRow(`SELECT quantity_desired,quantity_received,`+claimedQuantity+`
+			FROM wishlist WHERE id = ? AND list_id = ? AND `+liveItem,
+			req.Id, listId).Scan(&desired, &received, &claimed)
+		if err == sql.ErrNoRows {
+			http.Error(w, "non-existent row", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// what's been received is taken to be what was claimed, see quantityTaken
+		if max(received, claimed+quantity) > desired {
+			http.Error(w, "not enough of this item left to claim", http.StatusConflict)
+			return
+		}
+
+		claimToken := newShareToken()
+		_, err = tx.Exec(`INSERT INTO anonymous_claims(claim_token, item_id, name, email, quantity)
+			VALUES(?, ?, ?, ?, ?)`, claimToken, req.Id, req.Name, req.Email, quantity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		publishItems(logger, db, hub, "claim", true, req.Id)
+
+		response := AnonymousClaimResponse{ClaimToken: base64.URLEncoding.EncodeToString(claimToken)}
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func handlePublicClaimDelete(logger *log.Logger, db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claimToken, err := base64.URLEncoding.DecodeString(r.PathValue("token"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		var itemId uint64
+		err = db.QueryRow("DELETE FROM anonymous_claims WHERE claim_token = ? RETURNING item_id",
+			claimToken).Scan(&itemId)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		publishItems(logger, db, hub, "unclaim", true, itemId)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShareLinks(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	owner := createTestUser(t, db, "Owner")
+	member := createTestUser(t, db, "Member")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "strap", "source": "", "cost": "$2.95", "owner_notes": "secret", "quantity_desired": 2, "tags": ["swim"]}`,
+		`{"description": "socks", "source": "", "cost": ""}`,
+	} {
+		if code := doJson(t, post, owner, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+	if code := doJson(t, handleWishlistPatch(logger, db, newHub()), member, "PATCH", "/api/wishlist",
+		`{"id": 1, "seq": 1, "buyer_notes": "buying one"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to add buyer notes: %d", code)
+	}
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), member, "POST", "/api/wishlist/claim",
+		`{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+
+	var lists struct {
+		Lists []struct {
+			Id         uint64  `json:"id"`
+			ShareToken *string `json:"share_token"`
+		} `json:"lists"`
+	}
+	doJson(t, handleListsGet(logger, db), owner, "GET", "/api/lists", "", &lists)
+	if len(lists.Lists) != 1 || lists.Lists[0].ShareToken != nil {
+		t.Fatalf("expected one unshared list, got %+v", lists)
+	}
+	listId := fmt.Sprint(lists.Lists[0].Id)
+
+	share := func(handler func(http.ResponseWriter, *http.Request, uint64), method string, userId uint64) (int, string) {
+		t.Helper()
+		var response struct {
+			ShareToken string `json:"share_token"`
+		}
+		req := httptest.NewRequest(method, "/api/lists/"+listId+"/share", nil)
+		req.SetPathValue("id", listId)
+		rr := httptest.NewRecorder()
+		handler(rr, req, userId)
+		if rr.Code == http.StatusOK && method == "POST" {
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, response.ShareToken
+	}
+
+	public := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetPathValue("token", token)
+		rr := httptest.NewRecorder()
+		switch {
+		case method == "GET":
+			handlePublicListGet(logger, db)(rr, req)
+		case method == "POST":
+			handlePublicClaimPost(logger, db, newHub())(rr, req)
+		default:
+			handlePublicClaimDelete(logger, db, newHub())(rr, req)
+		}
+		return rr
+	}
+
+	if code, _ := share(handleShareLinkPost(logger, db), "POST", member); code != http.StatusNotFound {
+		t.Errorf("non-owner shared a list: %d", code)
+	}
+
+	if code, _ := share(handleShareLinkPost(logger, db), "POST", owner); code != http.StatusConflict {
+		t.Errorf("shared a list that isn't public: %d", code)
+	}
+	if code := doJsonPath(t, handleListPatch(logger, db), owner, "PATCH", "/api/lists/"+listId,
+		map[string]string{"id": listId}, `{"visibility": "public"}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to make list public: %d", code)
+	}
+
+	code, token := share(handleShareLinkPost(logger, db), "POST", owner)
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("failed to share list: %d", code)
+	}
+
+	rr := public("GET", "/api/public/lists/"+token, token, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to get shared list: %d", rr.Code)
+	}
+	for _, leak := range []string{"secret", "buying one", "Member", "owner_notes", "buyer_notes"} {
+		if strings.Contains(rr.Body.String(), leak) {
+			t.Errorf("shared list leaks %q: %s", leak, rr.Body.String())
+		}
+	}
+	var list struct {
+		Name    string `json:"name"`
+		Entries []struct {
+			Id                uint64   `json:"id"`
+			QuantityAvailable uint64   `json:"quantity_available"`
+			Tags              []string `json:"tags"`
+		} `json:"entries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Name != defaultListName || len(list.Entries) != 2 || list.Entries[0].QuantityAvailable != 1 ||
+		len(list.Entries[0].Tags) != 1 {
+		t.Errorf("unexpected shared list %+v", list)
+	}
+
+	// the owner doesn't get to see how much is claimed through their own link,
+	// while anyone else signed in does
+	for _, viewer := range []uint64{owner, member} {
+		rr := httptest.NewRecorder()
+		if err := createSession(logger, &Config{AllowInsecure: true}, db, int64(viewer), "test", rr); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/api/public/lists/"+token, nil)
+		req.AddCookie(rr.Result().Cookies()[0])
+		req.SetPathValue("token", token)
+		rr = httptest.NewRecorder()
+		handlePublicListGet(logger, db)(rr, req)
+		hidden := strings.Contains(rr.Body.String(), `"quantity_available":null`)
+		if rr.Code != http.StatusOK || hidden != (viewer == owner) {
+			t.Errorf("unexpected availability for %d: %d %s", viewer, rr.Code, rr.Body.String())
+		}
+	}
+
+	// anonymous claims count against what members can claim, and vice versa
+	claimBody := `{"id": 1, "name": "Aunt May", "email": "may@example.com"}`
+	rr = public("POST", "/api/public/lists/"+token+"/claims", token, claimBody)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to claim anonymously: %d %s", rr.Code, rr.Body.String())
+	}
+	var claim struct {
+		ClaimToken string `json:"claim_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &claim); err != nil {
+		t.Fatal(err)
+	}
+	if rr := public("POST", "/api/public/lists/"+token+"/claims", token, claimBody); rr.Code != http.StatusConflict {
+		t.Errorf("expected over-claim to conflict, got %d", rr.Code)
+	}
+	if code := doJson(t, handleClaimPost(logger, db, newHub()), member, "POST", "/api/wishlist/claim",
+		`{"id": 1, "quantity": 2}`, nil); code != http.StatusConflict {
+		t.Errorf("expected member over-claim to conflict, got %d", code)
+	}
+	if rr := public("POST", "/api/public/lists/"+token+"/claims", token,
+		`{"id": 2, "name": "Aunt May", "email": "not an email"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected bad email to be rejected, got %d", rr.Code)
+	}
+
+	if rr := public("DELETE", "/api/public/claims/"+claim.ClaimToken, claim.ClaimToken, ""); rr.Code != http.StatusOK {
+		t.Errorf("failed to remove anonymous claim: %d", rr.Code)
+	}
+	if rr := public("DELETE", "/api/public/claims/"+claim.ClaimToken, claim.ClaimToken, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected second removal to fail, got %d", rr.Code)
+	}
+
+	// rotating invalidates the old token
+	_, rotated := share(handleShareLinkPost(logger, db), "POST", owner)
+	if rotated == token {
+		t.Fatalf("token didn't change on rotation")
+	}
+	if rr := public("GET", "/api/public/lists/"+token, token, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("old token still works: %d", rr.Code)
+	}
+	if rr := public("GET", "/api/public/lists/"+rotated, rotated, ""); rr.Code != http.StatusOK {
+		t.Errorf("rotated token doesn't work: %d", rr.Code)
+	}
+
+	if code, _ := share(handleShareLinkDelete(logger, db), "DELETE", owner); code != http.StatusOK {
+		t.Errorf("failed to revoke: %d", code)
+	}
+	if rr := public("GET", "/api/public/lists/"+rotated, rotated, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoked token still works: %d", rr.Code)
+	}
+	if rr := public("GET", "/api/public/lists/garbage!", "garbage!", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected malformed token to 404, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxTagsPerItem = 20
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count uint64 `json:"count"`
+}
+
+// normalizeTags trims whitespace and drops empty and duplicate tags (tags
+// compare case-insensitively, the first spelling wins).
+func normalizeTags(tags []string) ([]string, error) {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		if len(tag) >= 100 {
+			return nil, errors.New("tags must be shorter than 100 characters")
+		}
+		seen[strings.ToLower(tag)] = true
+		ret = append(ret, tag)
+	}
+	if len(ret) > maxTagsPerItem {
+		return nil, fmt.Errorf("items can have at most %d tags", maxTagsPerItem)
+	}
+	return ret, nil
+}
+
+// setItemTags replaces the tags on an item, adding any new ones to the owner's
+// tag vocabulary.
+func setItemTags(tx dbtx, userId uint64, itemId uint64, tags []string) error {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM wishlist_tags WHERE item_id = ?", itemId)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO tags(user_id, name) VALUES(?, ?) ON CONFLICT(user_id, name) DO NOTHING",
+			userId, tag)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO wishlist_tags(item_id, tag_id)
+			SELECT ?, id FROM tags WHERE user_id = ? AND name = ?`, itemId, userId, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadItemTags returns the tags for every wishlist item matching cond (e.g.
+// liveItem), keyed by item id. args are bound to cond's placeholders.
+func loadItemTags(db dbtx, cond string, args ...interface{}) (map[uint64][]string, error) {
+	rows, err := db.Query(`SELECT wishlist_tags.item_id, tags.name FROM wishlist_tags
+		JOIN tags ON tags.id = wishlist_tags.tag_id
+		JOIN wishlist ON wishlist.id = wishlist_tags.item_id
+		WHERE `+cond+`
+		ORDER BY tags.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[uint64][]string)
+	for rows.Next() {
+		var itemId uint64
+		var name string
+		err = rows.Scan(&itemId, &name)
+		if err != nil {
+			return nil, err
+		}
+		ret[itemId] = append(ret[itemId], name)
+	}
+	return ret, rows.Err()
+}
+
+// countTags turns the output of loadItemTags into the per-tag summary the UI
+// uses for filter chips, most used first.
+func countTags(itemTags map[uint64][]string) []TagCount {
+	counts := make(map[string]uint64)
+	var order []string
+	for _, tags := range itemTags {
+		for _, tag := range tags {
+			if counts[tag] == 0 {
+				order = append(order, tag)
+			}
+			counts[tag]++
+		}
+	}
+
+	ret := make([]TagCount, 0, len(order))
+	for _, tag := range order {
+		ret = append(ret, TagCount{tag, counts[tag]})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Tag < ret[j].Tag
+	})
+	return ret
+}
+
+// The tag vocabulary for a user, for autocomplete when editing items.
+func handleTagsGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type TagsResponse struct {
+			Tags []string `json:"tags"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		queryUserId := userId
+		userStr := r.URL.Query().Get("userId")
+		if userStr != "" {
+			urlUserId, err := strconv.ParseUint(userStr, 10, 64)
+			if err != nil {
+				http.Error(w, "missing or malformed user parameter", http.StatusBadRequest)
+				return
+			}
+			queryUserId = urlUserId
+		}
+
+		if queryUserId != userId {
+			visible, err := canSeeUser(db, userId, queryUserId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				http.Error(w, "non-existent user", http.StatusNotFound)
+				return
+			}
+		}
+
+		// someone else's vocabulary only includes tags on items we can see
+		rows, err := db.Query(`SELECT name FROM tags WHERE user_id = ? AND (user_id = ? OR id IN
+			(SELECT wishlist_tags.tag_id FROM wishlist_tags JOIN wishlist ON wishlist.id = wishlist_tags.item_id
+			WHERE `+listVisibleTo("wishlist.list_id")+`)) ORDER BY name`, queryUserId, userId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := TagsResponse{Tags: []string{}}
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Tags = append(response.Tags, name)
+		}
+		err = rows.Err()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// What we could work out about the product behind an item's source url.
+type LinkPreview struct {
+	Title         string `json:"title"`
+	ImageURL      string `json:"image_url"`
+	SiteName      string `json:"site_name"`
+	PriceAmount   *int64 `json:"price_amount"`
+	PriceCurrency string `json:"price_currency"`
+}
+
+var errBlockedAddress = errors.New("refusing to connect to a private address")
+
+// linkFetcher downloads pages that users link to. Those urls come straight
+// from users, so by default it refuses to connect to anything on a private
+// network, and it caps how long and how much it will read.
+type linkFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func newLinkFetcher(allowPrivate bool) *linkFetcher {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		// checked at connect time, after dns resolution, so redirects and
+		// hostnames that resolve to internal addresses are caught too
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivateIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		}
+	}
+
+	transport := &http.Transport{
+		// no proxy, it would hide the real destination from the check above
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+	return &linkFetcher{client: client, maxBytes: 2 << 20}
+}
+
+var carrierGradeNat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		carrierGradeNat.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme '%s'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("url has no host")
+	}
+	return nil
+}
+
+// parseSourceURL returns the url in an item's source, if it is one.
+func parseSourceURL(source string) (*url.URL, bool) {
+	u, err := url.Parse(strings.TrimSpace(source))
+	if err != nil || checkFetchURL(u) != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// Fetch downloads a page and pulls a preview out of its metadata.
+func (f *linkFetcher) Fetch(ctx context.Context, u *url.URL) (*LinkPreview, error) {
+	err := checkFetchURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "wishlist-link-preview/1.0")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "html") {
+		return nil, fmt.Errorf("fetching %s: unexpected content type '%s'", u, contentType)
+	}
+
+	// a truncated page still parses, and the metadata is normally in <head>
+	doc, err := html.Parse(io.LimitReader(resp.Body, f.maxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return extractLinkPreview(doc, resp.Request.URL), nil
+}
+
+// extractLinkPreview reads JSON-LD Product, OpenGraph and Twitter card
+// metadata, in that order of preference, falling back to <title>.
+func extractLinkPreview(doc *html.Node, base *url.URL) *LinkPreview {
+	meta := make(map[string]string)
+	var title string
+	var product map[string]interface{}
+
+	for node := range doc.Descendants() {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		switch node.DataAtom {
+		case atom.Meta:
+			var key, content string
+			for _, attr := range node.Attr {
+				switch attr.Key {
+				case "property", "name":
+					key = strings.ToLower(attr.Val)
+				case "content":
+					content = strings.TrimSpace(attr.Val)
+				}
+			}
+			// first one wins, e.g. og:image is often repeated
+			if _, ok := meta[key]; key != "" && content != "" && !ok {
+				meta[key] = content
+			}
+		case atom.Title:
+			if title == "" && node.FirstChild != nil {
+				title = strings.TrimSpace(node.FirstChild.Data)
+			}
+		case atom.Script:
+			if product != nil || node.FirstChild == nil {
+				continue
+			}
+			for _, attr := range node.Attr {
+				if attr.Key == "type" && strings.EqualFold(attr.Val, "application/ld+json") {
+					var data interface{}
+					if json.Unmarshal([]byte(node.FirstChild.Data), &data) == nil {
+						product = findJsonLdProduct(data)
+					}
+				}
+			}
+		}
+	}
+
+	preview := &LinkPreview{}
+	preview.Title = truncateRunes(firstNonEmpty(jsonLdString(product["name"]), meta["og:title"],
+		meta["twitter:title"], title), maxPreviewLength)
+	preview.ImageURL = resolveURL(base, firstNonEmpty(jsonLdImage(product["image"]), meta["og:image"],
+		meta["og:image:url"], meta["og:image:secure_url"], meta["twitter:image"], meta["twitter:image:src"]))
+	if utf8.RuneCountInString(preview.ImageURL) > maxPreviewLength {
+		// a cut off url is just a broken image
+		preview.ImageURL = ""
+	}
+	preview.SiteName = truncateRunes(firstNonEmpty(meta["og:site_name"], meta["application-name"],
+		strings.TrimPrefix(base.Hostname(), "www.")), maxPreviewLength)
+
+	price, currency := jsonLdPrice(product["offers"])
+	if price == "" {
+		price = firstNonEmpty(meta["product:price:amount"], meta["og:price:amount"])
+		currency = firstNonEmpty(meta["product:price:currency"], meta["og:price:currency"])
+	}
+	if price != "" {
+		currency = strings.ToUpper(currency)
+		if !validCurrency(currency) {
+			currency = defaultCurrency
+		}
+		if amount, ok := parsePrice(price, currency); ok {
+			preview.PriceAmount = &amount
+			preview.PriceCurrency = currency
+		}
+	}
+	return preview
+}
+
+// the most a preview column holds, see migrateLinkPreviews
+const maxPreviewLength = 1999
+
+// truncateRunes cuts s to at most n characters, not bytes, like sqlite's
+// length() counts them.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// findJsonLdProduct looks for an object with "@type": "Product" in a JSON-LD
+// document, which may be a single object, an array of them, or an @graph.
+func findJsonLdProduct(data interface{}) map[string]interface{} {
+	switch v := data.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if product := findJsonLdProduct(item); product != nil {
+				return product
+			}
+		}
+	case map[string]interface{}:
+		if jsonLdIsType(v["@type"], "Product") {
+			return v
+		}
+		if graph, ok := v["@graph"]; ok {
+			return findJsonLdProduct(graph)
+		}
+	}
+	return nil
+}
+
+func jsonLdIsType(value interface{}, want string) bool {
+	switch v := value.(type) {
+	case string:
+		return v == want || v == "http://schema.org/"+want || v == "https://schema.org/"+want
+	case []interface{}:
+		for _, item := range v {
+			if jsonLdIsType(item, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonLdString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// images can be a url, a list of urls or an ImageObject
+func jsonLdImage(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		for _, item := range v {
+			if image := jsonLdImage(item); image != "" {
+				return image
+			}
+		}
+	case map[string]interface{}:
+		return jsonLdString(v["url"])
+	}
+	return ""
+}
+
+// offers can be an Offer, an AggregateOffer or a list of either
+func jsonLdPrice(value interface{}) (price string, currency string) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if price, currency := jsonLdPrice(item); price != "" {
+				return price, currency
+			}
+		}
+	case map[string]interface{}:
+		price = firstNonEmpty(jsonLdString(v["price"]), jsonLdString(v["lowPrice"]))
+		currency = jsonLdString(v["priceCurrency"])
+		if price == "" {
+			if spec, ok := v["priceSpecification"].(map[string]interface{}); ok {
+				price = jsonLdString(spec["price"])
+				currency = firstNonEmpty(currency, jsonLdString(spec["priceCurrency"]))
+			}
+		}
+	}
+	return price, currency
+}
+
+// updateLinkPreviews fetches previews for items whose source changed since
+// we last looked at it. Sources that aren't urls, or that fail to fetch, are
+// marked as looked at with an empty preview so we don't keep retrying them.
+func updateLinkPreviews(ctx context.Context, logger *log.Logger, db *sql.DB, fetcher *linkFetcher) error {
+	type pendingItem struct {
+		Id     uint64
+		Source string
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id,source FROM wishlist
+		WHERE deleted_time IS NULL AND source != '' AND (preview_source IS NULL OR preview_source != source)
+		LIMIT 50`)
+	if err != nil {
+		return err
+	}
+	var pending []pendingItem
+	for rows.Next() {
+		var item pendingItem
+		err = rows.Scan(&item.Id, &item.Source)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, item)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range pending {
+		preview := &LinkPreview{}
+		if u, ok := parseSourceURL(item.Source); ok {
+			fetched, err := fetcher.Fetch(ctx, u)
+			if err != nil {
+				logger.Printf("error fetching preview for item %d: %v", item.Id, err)
+			} else {
+				preview = fetched
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// the source may have been edited while we were fetching
+		_, err = db.ExecContext(ctx, `UPDATE wishlist SET preview_source = ?, preview_title = ?,
+			preview_image_url = ?, preview_site_name = ?, preview_price_amount = ?,
+			preview_price_currency = ?, preview_fetch_time = CURRENT_TIMESTAMP
+			WHERE id = ? AND source = ?`,
+			item.Source, nullString(preview.Title), nullString(preview.ImageURL), nullString(preview.SiteName),
+			preview.PriceAmount, nullString(preview.PriceCurrency), item.Id, item.Source)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			// don't let one item hold up the rest, it'll be tried again next time
+			logger.Printf("error saving preview for item %d: %v", item.Id, err)
+		}
+	}
+	return nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func runLinkPreviews(ctx context.Context, logger *log.Logger, db *sql.DB, fetcher *linkFetcher) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		err := updateLinkPreviews(ctx, logger, db, fetcher)
+		if err != nil && ctx.Err() == nil {
+			logger.Printf("error updating link previews: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtureServer serves the pages in testdata/unfurl, plus a few misbehaving
+// endpoints.
+func fixtureServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.Dir("testdata/unfurl")))
+	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("GET /huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>" + strings.Repeat("x", 3<<20) +
+			`</title><meta property="og:title" content="too far down"></head></html>`))
+	})
+	mux.HandleFunc("GET /long", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>" + strings.Repeat("ü", 3000) + `</title>` +
+			`<meta property="og:image" content="/` + strings.Repeat("x", 3000) + `.png"></head></html>`))
+	})
+	mux.HandleFunc("GET /image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	})
+	mux.HandleFunc("GET /redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/opengraph.html", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLinkFetcher(t *testing.T) {
+	server := fixtureServer(t)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	price := func(amount int64) *int64 { return &amount }
+
+	type testCase struct {
+		path    string
+		preview LinkPreview
+		err     bool
+	}
+
+	tests := []testCase{
+		{
+			path: "/opengraph.html",
+			preview: LinkPreview{
+				Title:         "Sporti Bungee Strap",
+				ImageURL:      server.URL + "/images/sporti-bungee-strap.jpg",
+				SiteName:      "SwimOutlet.com",
+				PriceAmount:   price(295),
+				PriceCurrency: "USD",
+			},
+		},
+		{
+			path: "/twitter.html",
+			preview: LinkPreview{
+				Title:    "Some Board Game",
+				ImageURL: "https://cdn.example.com/board-game.png",
+				SiteName: strings.Split(host, ":")[0],
+			},
+		},
+		{
+			path: "/jsonld.html",
+			preview: LinkPreview{
+				Title:         "Speedo Vanquisher 2.0 Goggles",
+				ImageURL:      server.URL + "/images/goggles-front.jpg",
+				SiteName:      "Example Store",
+				PriceAmount:   price(2250),
+				PriceCurrency: "EUR",
+			},
+		},
+		{
+			path:    "/title.html",
+			preview: LinkPreview{Title: "Just A Title", SiteName: strings.Split(host, ":")[0]},
+		},
+		{
+			path: "/redirect",
+			preview: LinkPreview{
+				Title:         "Sporti Bungee Strap",
+				ImageURL:      server.URL + "/images/sporti-bungee-strap.jpg",
+				SiteName:      "SwimOutlet.com",
+				PriceAmount:   price(295),
+				PriceCurrency: "USD",
+			},
+		},
+		{path: "/missing.html", err: true},
+		{path: "/image", err: true},
+		{path: "/slow", err: true},
+	}
+
+	// fixtures live on loopback, which is exactly what the default fetcher blocks
+	fetcher := newLinkFetcher(true)
+	fetcher.client.Timeout = 200 * time.Millisecond
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			u, _ := url.Parse(server.URL + tc.path)
+			preview, err := fetcher.Fetch(context.Background(), u)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got %+v", preview)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if preview.Title != tc.preview.Title || preview.ImageURL != tc.preview.ImageURL ||
+				preview.SiteName != tc.preview.SiteName || preview.PriceCurrency != tc.preview.PriceCurrency {
+				t.Errorf("got %+v, expected %+v", preview, tc.preview)
+			}
+			if (preview.PriceAmount == nil) != (tc.preview.PriceAmount == nil) ||
+				(preview.PriceAmount != nil && *preview.PriceAmount != *tc.preview.PriceAmount) {
+				t.Errorf("got price %v, expected %v", preview.PriceAmount, tc.preview.PriceAmount)
+			}
+		})
+	}
+
+	t.Run("size cap", func(t *testing.T) {
+		u, _ := url.Parse(server.URL + "/huge")
+		preview, err := fetcher.Fetch(context.Background(), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preview.Title == "too far down" {
+			t.Errorf("read past the response size cap")
+		}
+	})
+
+	t.Run("private addresses blocked", func(t *testing.T) {
+		u, _ := url.Parse(server.URL + "/opengraph.html")
+		_, err := newLinkFetcher(false).Fetch(context.Background(), u)
+		if !errors.Is(err, errBlockedAddress) {
+			t.Errorf("expected blocked address error, got %v", err)
+		}
+	})
+
+	t.Run("non-http scheme", func(t *testing.T) {
+		u, _ := url.Parse("file:///etc/passwd")
+		_, err := fetcher.Fetch(context.Background(), u)
+		if err == nil {
+			t.Errorf("expected error for file url")
+		}
+	})
+}
+
+func TestUpdateLinkPreviews(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	server := fixtureServer(t)
+	userId := createTestUser(t, db, "Joe")
+
+	post := handleWishlistPost(logger, db, newHub())
+	for _, body := range []string{
+		`{"description": "strap", "source": "\n` + server.URL + `/opengraph.html", "cost": ""}`,
+		`{"description": "socks", "source": "the sock store", "cost": ""}`,
+		`{"description": "essay", "source": "` + server.URL + `/long", "cost": ""}`,
+	} {
+		if code := doJson(t, post, userId, "POST", "/api/wishlist", body, nil); code != http.StatusOK {
+			t.Fatalf("failed to add %s: %d", body, code)
+		}
+	}
+
+	err := updateLinkPreviews(context.Background(), logger, db, newLinkFetcher(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Entries []struct {
+			Description string       `json:"description"`
+			Preview     *LinkPreview `json:"preview"`
+		} `json:"entries"`
+	}
+	doJson(t, handleWishlistGet(logger, db), userId, "GET", "/api/wishlist", "", &response)
+	if len(response.Entries) != 3 {
+		t.Fatalf("unexpected entries %+v", response.Entries)
+	}
+	if preview := response.Entries[0].Preview; preview == nil || preview.Title != "Sporti Bungee Strap" ||
+		preview.PriceAmount == nil || *preview.PriceAmount != 295 {
+		t.Errorf("unexpected preview %+v", preview)
+	}
+	if response.Entries[1].Preview != nil {
+		t.Errorf("non-url source should have no preview, got %+v", response.Entries[1].Preview)
+	}
+	// too long for the columns, but it doesn't stop the preview being saved
+	if preview := response.Entries[2].Preview; preview == nil || preview.Title != strings.Repeat("ü", maxPreviewLength) ||
+		preview.ImageURL != "" {
+		t.Errorf("unexpected long preview %+v", preview)
+	}
+
+	// nothing is refetched until a source changes
+	var pending int
+	err = db.QueryRow("SELECT COUNT(*) FROM wishlist WHERE preview_source IS NULL OR preview_source != source").Scan(&pending)
+	if err != nil || pending != 0 {
+		t.Errorf("expected no pending previews, got %d %v", pending, err)
+	}
+}
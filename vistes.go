@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/publicsuffix"
+)
+
+const defaultVistesURL = "http://vistes.com/sqlwishlist"
+
+func findNode(node *html.Node, visitor func(*html.Node) bool) *html.Node {
+	if node == nil {
+		return nil
+	}
+	if visitor(node) {
+		return node
+	}
+	for node := node.FirstChild; node != nil; node = node.NextSibling {
+		ret := findNode(node, visitor)
+		if ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+func parseCreateTime(node *html.Node, ret *time.Time) error {
+	if node == nil {
+		return errors.New("nill node parsing time")
+	}
+	parsedTime, err := time.Parse("1/2/2006 3:04:05 PM", node.Data)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error parsing timestamp: %s, %v", node.Data, err))
+	}
+	*ret = parsedTime
+	return nil
+}
+
+func parseString(node *html.Node, ret *string) error {
+	if node == nil {
+		// allowed to be empty
+		*ret = ""
+		return nil
+	}
+	*ret = node.Data
+	return nil
+}
+
+type VistesWishlistRow struct {
+	// vistes's id for the item, from the edit link
+	Id          string
+	CreateTime  time.Time
+	Category    string
+	Description string
+	Source      string
+	Cost        string
+	Comments    string
+}
+
+func (r VistesWishlistRow) String() string {
+	return fmt.Sprintf("id='%v', time='%v', category='%v', desc='%v', source='%v', cost='%v', comments='%v'",
+		r.Id, r.CreateTime, r.Category, r.Description, r.Source, r.Cost, r.Comments)
+}
+
+// parseVistesId reads the item id from the edit link's Item parameter, e.g.
+// <a href="item.asp?Action=Edit&amp;Item=3730">3730</a>
+func parseVistesId(node *html.Node, ret *string) error {
+	link := findNode(node, func(n *html.Node) bool {
+		return n.Type == html.ElementNode && n.DataAtom == atom.A
+	})
+	if link == nil {
+		return errors.New("no edit link in vistes row")
+	}
+	href, _ := htmlAttr(link, "href")
+	u, err := url.Parse(href)
+	if err != nil {
+		return fmt.Errorf("error parsing edit link %q: %v", href, err)
+	}
+	*ret = u.Query().Get("Item")
+	if *ret == "" {
+		return fmt.Errorf("no item id in edit link %q", href)
+	}
+	return nil
+}
+
+// parse e.g. one of these
+// <tr>
+//
+//	<td><a href=
+//	"item.asp?Action=Edit&amp;Item=3730">3730</a></td>
+//	<td>eric</td>
+//	<td>9/23/2025 9:42:41 PM</td>
+//	<td>swim</td>
+//	<td>Sporti Bungee Strap</td>
+//	<td>
+//	https://www.swimoutlet.com/products/sporti-bungee-strap-21092/?color=black</td>
+//	<td>$2.95</td>
+//	<td>could use one black, one red</td>
+//
+// </tr>
+func parseVistesRow(node *html.Node) (*VistesWishlistRow, error) {
+	if node.Type != html.ElementNode || node.DataAtom != atom.Tr {
+		return nil, errors.New("node is not a <tr>")
+	}
+
+	// cols are edit link, owner, create time, category, decription, source, cost, comments
+	ret := &VistesWishlistRow{}
+	col := 0
+	for child := range node.ChildNodes() {
+		if child.Type != html.ElementNode || child.DataAtom != atom.Td {
+			continue
+		}
+		switch col {
+		case 0: // edit link
+			err := parseVistesId(child, &ret.Id)
+			if err != nil {
+				return nil, err
+			}
+		case 1: // owner
+			break
+		case 2: // create time
+			err := parseCreateTime(child.FirstChild, &ret.CreateTime)
+			if err != nil {
+				return nil, err
+			}
+		case 3: // category
+			err := parseString(child.FirstChild, &ret.Category)
+			if err != nil {
+				return nil, err
+			}
+		case 4: // description
+			err := parseString(child.FirstChild, &ret.Description)
+			if err != nil {
+				return nil, err
+			}
+		case 5: // source
+			err := parseString(child.FirstChild, &ret.Source)
+			if err != nil {
+				return nil, err
+			}
+		case 6: // cost
+			err := parseString(child.FirstChild, &ret.Cost)
+			if err != nil {
+				return nil, err
+			}
+		case 7: // comments
+			err := parseString(child.FirstChild, &ret.Comments)
+			if err != nil {
+				return nil, err
+			}
+		}
+		col++
+	}
+	return ret, nil
+}
+
+// vistesImporter logs in to vistes.com as the user and reads their wishlist
+// from the editor's table.
+//
+// curl -c cookies.txt -d "username=eric&password=..." "http://vistes.com/sqlwishlist/verify_user_name_and_password.asp"
+// curl -X GET -b cookies.txt 'http://vistes.com/sqlwishlist/get_wishlist.asp?Item=eric'
+// curl -X GET -b cookies.txt 'http://vistes.com/sqlwishlist/Database1_interface/wishlists/editor/list.asp'
+type vistesImporter struct {
+	BaseURL string
+}
+
+func (v vistesImporter) get(ctx context.Context, client *http.Client, method string, path string, query url.Values) ([]byte, error) {
+	u, err := url.Parse(strings.TrimSuffix(v.BaseURL, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vistes %s: %s", path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (v vistesImporter) Import(ctx context.Context, src ImportSource) ([]ImportRow, error) {
+	if src.Username == "" {
+		return nil, errors.New("importing from vistes needs a vistes username and password")
+	}
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Jar: jar}
+
+	// Login
+	_, err = v.get(ctx, client, "POST", "/verify_user_name_and_password.asp",
+		url.Values{"username": {src.Username}, "password": {src.Password}})
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch wishlist
+	_, err = v.get(ctx, client, "GET", "/get_wishlist.asp", url.Values{"Item": {src.Username}})
+	if err != nil {
+		return nil, err
+	}
+
+	// Read wishlist
+	buf, err := v.get(ctx, client, "GET", "/Database1_interface/wishlists/editor/list.asp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := html.Parse(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	wishlistTable := findNode(doc, func(n *html.Node) bool {
+		if n.Type != html.ElementNode || n.DataAtom != atom.Table {
+			return false
+		}
+		border, _ := htmlAttr(n, "border")
+		cellspacing, _ := htmlAttr(n, "cellspacing")
+		cellpadding, _ := htmlAttr(n, "cellpadding")
+		return border == "1" && cellspacing == "3" && cellpadding == "3"
+	})
+	if wishlistTable == nil {
+		return nil, errors.New("could not find wishlist table in response")
+	}
+
+	// the first two rows are the headings
+	var rows []ImportRow
+	headings := 2
+	for node := range wishlistTable.Descendants() {
+		if node.Type != html.ElementNode || node.DataAtom != atom.Tr {
+			continue
+		}
+		if headings > 0 {
+			headings--
+			continue
+		}
+		parsedRow, err := parseVistesRow(node)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, ImportRow{
+			"description":   parsedRow.Description,
+			"source":        parsedRow.Source,
+			"cost":          parsedRow.Cost,
+			"owner_notes":   parsedRow.Comments,
+			"tags":          parsedRow.Category, // vistes categories become tags
+			"creation_time": parsedRow.CreateTime.Format(time.RFC3339),
+			"external_id":   parsedRow.Id,
+		})
+	}
+	if headings > 0 {
+		return nil, errors.New("could not find starting row")
+	}
+	return rows, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericm1024/wishlist/admin_rpc"
+)
+
+// vistesPage is the editor's table, with a row for each item after two rows
+// of headings
+const vistesPage = `<html><body><table border="1" cellspacing="3" cellpadding="3">
+<tr><td colspan="8">Wishlist</td></tr>
+<tr><td>Edit</td><td>Owner</td><td>Created</td><td>Category</td><td>Description</td><td>Source</td><td>Cost</td><td>Comments</td></tr>
+<tr>
+  <td><a href="item.asp?Action=Edit&amp;Item=3730">3730</a></td>
+  <td>eric</td>
+  <td>9/23/2025 9:42:41 PM</td>
+  <td>swim</td>
+  <td>Sporti Bungee Strap</td>
+  <td>
+https://www.swimoutlet.com/products/sporti-bungee-strap-21092/?color=black</td>
+  <td>$2.95</td>
+  <td>could use one black, one red</td>
+</tr>
+</table></body></html>`
+
+func vistesRow(id int, description string) string {
+	return fmt.Sprintf(`<tr><td><a href="item.asp?Action=Edit&amp;Item=%d">%d</a></td><td>eric</td>
+<td>10/1/2025 8:00:00 AM</td><td>books</td><td>%s</td><td></td><td></td><td></td></tr>
+`, id, id, description)
+}
+
+// newVistesServer stands in for vistes.com, serving page to alice once she's
+// logged in with hunter2.
+func newVistesServer(t *testing.T, page string) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	var loggedIn bool
+	vistes := http.NewServeMux()
+	vistes.HandleFunc("POST /verify_user_name_and_password.asp", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("username") == "alice" && r.URL.Query().Get("password") == "hunter2" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "alice"})
+		}
+	})
+	vistes.HandleFunc("GET /get_wishlist.asp", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		mu.Lock()
+		defer mu.Unlock()
+		loggedIn = err == nil && cookie.Value == r.URL.Query().Get("Item")
+	})
+	vistes.HandleFunc("GET /Database1_interface/wishlists/editor/list.asp", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !loggedIn {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, page)
+	})
+	return httptest.NewServer(vistes)
+}
+
+func TestVistesImport(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+	ctx := context.Background()
+
+	page := strings.Replace(vistesPage, "</table>", vistesRow(3731, "Kickboard")+"</table>", 1)
+	importFrom := func(page string, dryRun bool) (*admin_rpc.ImportReply, error) {
+		t.Helper()
+		server := newVistesServer(t, page)
+		defer server.Close()
+		admin := &adminGrpcServer{Logger: logger, Db: db, Importers: newImporters(&Config{VistesURL: server.URL})}
+		return admin.VistesImport(ctx, &admin_rpc.ImportRequest{Username: "alice", Password: "hunter2",
+			UserId: alice, DryRun: dryRun})
+	}
+
+	// a dry run shows what it read without adding anything
+	reply, err := importFrom(page, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Added != 2 || reply.Skipped != 0 || len(reply.Ids) != 0 || len(reply.Items) != 2 ||
+		reply.Items[0].ExternalId != "3730" || reply.Items[0].Description != "Sporti Bungee Strap" ||
+		reply.Items[0].Tags[0] != "swim" || reply.Items[1].ExternalId != "3731" {
+		t.Errorf("unexpected dry run %+v", reply)
+	}
+	if count := countItems(t, db, alice); count != 0 {
+		t.Fatalf("dry run added %d items", count)
+	}
+
+	// one bad row and none of them go in
+	bad := strings.Replace(page, "</table>", vistesRow(3732, "")+"</table>", 1)
+	if _, err := importFrom(bad, false); err == nil || !strings.Contains(err.Error(), "row 3 description") {
+		t.Errorf("expected the empty description to fail the import, got %v", err)
+	}
+	if count := countItems(t, db, alice); count != 0 {
+		t.Fatalf("failed import added %d items", count)
+	}
+
+	reply, err = importFrom(page, false)
+	if err != nil || reply.Added != 2 || len(reply.Ids) != 2 {
+		t.Fatalf("failed to import: %v %+v", err, reply)
+	}
+
+	// importing again only adds what's new, even if it's been deleted since
+	if code := doJson(t, handleWishlistDelete(logger, db, newHub()), alice, "DELETE", "/api/wishlist",
+		fmt.Sprintf(`{"ids": [%d]}`, reply.Ids[1]), nil); code != http.StatusOK {
+		t.Fatalf("failed to delete: %d", code)
+	}
+	page = strings.Replace(page, "</table>", vistesRow(3733, "Fins")+"</table>", 1)
+	reply, err = importFrom(page, false)
+	if err != nil || reply.Added != 1 || reply.Skipped != 2 || len(reply.Ids) != 1 ||
+		!reply.Items[0].AlreadyImported || reply.Items[2].AlreadyImported {
+		t.Fatalf("unexpected re-import: %v %+v", err, reply)
+	}
+	if count := countItems(t, db, alice); count != 3 {
+		t.Errorf("expected 3 items, got %d", count)
+	}
+
+	// once it's purged it can be imported again, even on a connection
+	// without foreign keys
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanupDb(logger, db, newTestBlobStore(t), time.Now().Add(48*time.Hour), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	reply, err = importFrom(page, false)
+	if err != nil || reply.Added != 1 || reply.Skipped != 2 || reply.Items[1].AlreadyImported {
+		t.Fatalf("unexpected import after purge: %v %+v", err, reply)
+	}
+	if count := countItems(t, db, alice); count != 3 {
+		t.Errorf("expected 3 items, got %d", count)
+	}
+}
+
+func TestVistesImportLegacyItems(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "Alice")
+
+	// the old import kept the cell's text as it was, and bound the time
+	_, err := db.Exec("INSERT INTO wishlist(creation_time, user_id, description, source, cost, owner_notes) VALUES(?, ?, ?, ?, ?, ?)",
+		time.Date(2025, 9, 23, 21, 42, 41, 0, time.UTC), alice, "Sporti Bungee Strap\n",
+		"https://www.swimoutlet.com/products/sporti-bungee-strap-21092/?color=black", "$2.95", "could use one black, one red")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newVistesServer(t, strings.Replace(vistesPage, "</table>", vistesRow(3731, "Kickboard")+"</table>", 1))
+	defer server.Close()
+	admin := &adminGrpcServer{Logger: logger, Db: db, Importers: newImporters(&Config{VistesURL: server.URL})}
+	in := &admin_rpc.ImportRequest{Username: "alice", Password: "hunter2", UserId: alice}
+
+	for _, dryRun := range []bool{true, false} {
+		in.DryRun = dryRun
+		reply, err := admin.VistesImport(context.Background(), in)
+		if err != nil || reply.Added != 1 || reply.Skipped != 1 || !reply.Items[0].AlreadyImported {
+			t.Fatalf("unexpected first import (dry run %v): %v %+v", dryRun, err, reply)
+		}
+	}
+	if count := countItems(t, db, alice); count != 2 {
+		t.Errorf("expected 2 items, got %d", count)
+	}
+
+	// and it's found by its key from then on
+	in.DryRun = false
+	reply, err := admin.VistesImport(context.Background(), in)
+	if err != nil || reply.Added != 0 || reply.Skipped != 2 {
+		t.Fatalf("unexpected re-import: %v %+v", err, reply)
+	}
+	var keys int
+	if err := db.QueryRow("SELECT COUNT(*) FROM import_keys WHERE user_id = ?", alice).Scan(&keys); err != nil || keys != 2 {
+		t.Errorf("expected 2 import keys, got %d %v", keys, err)
+	}
+}
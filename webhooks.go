@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxWebhooksPerUser = 20
+	// attempts are spaced webhookBackoff, twice that, four times that and
+	// so on, up to webhookMaxBackoff apart
+	webhookBackoff     = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookMaxAttempts = 10
+	// failed attempts in a row, across all deliveries, before we stop
+	// calling a webhook until its owner turns it back on
+	webhookDisableAfter = 25
+	webhookBatchSize    = 100
+	webhookInterval     = 10 * time.Second
+	webhookLogSize      = 100
+)
+
+// every type of item event a webhook can ask for
+var webhookEvents = []string{"create", "patch", "delete", "archive", "restore", "received", "claim", "unclaim"}
+
+// parseWebhookEvents checks an event filter, an empty one means everything.
+func parseWebhookEvents(events []string) (string, error) {
+	for _, event := range events {
+		if !slices.Contains(webhookEvents, event) {
+			return "", fmt.Errorf("unknown event '%s'", event)
+		}
+	}
+	return strings.Join(events, ","), nil
+}
+
+func checkWebhookURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if len(target) >= 2000 {
+		return errors.New("url must be shorter than 2000 characters")
+	}
+	return checkFetchURL(u)
+}
+
+// WebhookPayload is the body of every webhook call.
+type WebhookPayload struct {
+	Type string    `json:"type"`
+	Item ItemEvent `json:"item"`
+	Time string    `json:"time"`
+}
+
+// queueWebhooks records a delivery of event to every enabled webhook that
+// wants it and whose owner could see it happen.
+func queueWebhooks(db *sql.DB, event ItemEvent) error {
+	rows, err := db.Query(`SELECT id, user_id FROM webhooks
+		WHERE enabled AND (events = '' OR ',' || events || ',' LIKE '%,' || ? || ',%')`, event.Type)
+	if err != nil {
+		return err
+	}
+	type webhook struct {
+		Id     uint64
+		UserId uint64
+	}
+	var webhooks []webhook
+	for rows.Next() {
+		var w webhook
+		err = rows.Scan(&w.Id, &w.UserId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		webhooks = append(webhooks, w)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(WebhookPayload{Type: event.Type, Item: event,
+		Time: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	for _, w := range webhooks {
+		visible, err := streamVisible(db, w.UserId, event)
+		if err != nil {
+			return err
+		}
+		if !visible {
+			continue
+		}
+		_, err = db.Exec(`INSERT INTO webhook_deliveries(webhook_id, event_type, payload, next_attempt_time)
+			VALUES(?, ?, ?, ?)`, w.Id, event.Type, payload, time.Now().UTC().Format(sqliteTimeFormat))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signWebhook is what goes in X-Wishlist-Signature, receivers compute the
+// same over the raw body with their secret to check a call came from us.
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxBackoff)
+}
+
+// deliverWebhooks makes every webhook call that's due. Failures are retried
+// with exponential backoff until webhookMaxAttempts, and a webhook that keeps
+// failing gets disabled.
+func deliverWebhooks(ctx context.Context, logger *log.Logger, db *sql.DB, client *http.Client, now time.Time) error {
+	type delivery struct {
+		Id        uint64
+		WebhookId uint64
+		URL       string
+		Secret    string
+		EventType string
+		Payload   []byte
+		Attempts  int
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT webhook_deliveries.id, webhooks.id, webhooks.url, webhooks.secret,
+		webhook_deliveries.event_type, webhook_deliveries.payload, webhook_deliveries.attempts
+		FROM webhook_deliveries JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+		WHERE webhooks.enabled AND webhook_deliveries.status = 'pending' AND webhook_deliveries.next_attempt_time <= ?
+		ORDER BY webhook_deliveries.id LIMIT ?`, now.UTC().Format(sqliteTimeFormat), webhookBatchSize)
+	if err != nil {
+		return err
+	}
+	var due []delivery
+	for rows.Next() {
+		var d delivery
+		err = rows.Scan(&d.Id, &d.WebhookId, &d.URL, &d.Secret, &d.EventType, &d.Payload, &d.Attempts)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		// an earlier delivery in this batch may have gotten it disabled
+		var enabled bool
+		err = db.QueryRowContext(ctx, "SELECT enabled FROM webhooks WHERE id = ?", d.WebhookId).Scan(&enabled)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			continue
+		}
+
+		statusCode, callErr := callWebhook(ctx, client, d.URL, d.Secret, d.Id, d.EventType, d.Payload)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if callErr == nil {
+			_, err = db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1,
+				last_status_code = ?, last_error = NULL, delivered_time = ? WHERE id = ?`,
+				statusCode, now.UTC().Format(sqliteTimeFormat), d.Id)
+			if err != nil {
+				return err
+			}
+			_, err = db.ExecContext(ctx, "UPDATE webhooks SET failure_count = 0 WHERE id = ?", d.WebhookId)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := d.Attempts + 1
+		status := "pending"
+		if attempts >= webhookMaxAttempts {
+			status = "failed"
+		}
+		_, err = db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?,
+			last_error = ?, next_attempt_time = ? WHERE id = ?`,
+			status, attempts, sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}, callErr.Error(),
+			now.Add(webhookRetryDelay(attempts)).UTC().Format(sqliteTimeFormat), d.Id)
+		if err != nil {
+			return err
+		}
+
+		var disabled bool
+		err = db.QueryRowContext(ctx, `UPDATE webhooks SET failure_count = failure_count + 1,
+			enabled = failure_count + 1 < ? WHERE id = ? RETURNING NOT enabled`,
+			webhookDisableAfter, d.WebhookId).Scan(&disabled)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			logger.Printf("disabled webhook %d after %d failures in a row", d.WebhookId, webhookDisableAfter)
+		}
+	}
+	return nil
+}
+
+// callWebhook posts one payload, anything but a 2xx counts as a failure.
+func callWebhook(ctx context.Context, client *http.Client, target string, secret string, deliveryId uint64,
+	eventType string, payload []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wishlist-webhooks")
+	req.Header.Set("X-Wishlist-Event", eventType)
+	req.Header.Set("X-Wishlist-Delivery", strconv.FormatUint(deliveryId, 10))
+	req.Header.Set("X-Wishlist-Signature", signWebhook(secret, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func runWebhooks(ctx context.Context, logger *log.Logger, db *sql.DB, client *http.Client) {
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	for {
+		err := deliverWebhooks(ctx, logger, db, client, time.Now())
+		if err != nil && ctx.Err() == nil {
+			logger.Printf("error delivering webhooks: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type Webhook struct {
+	Id           uint64   `json:"id"`
+	URL          string   `json:"url"`
+	Events       []string `json:"events"`
+	Enabled      bool     `json:"enabled"`
+	FailureCount uint64   `json:"failure_count"`
+}
+
+func handleWebhooksGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type WebhooksResponse struct {
+			Webhooks []Webhook `json:"webhooks"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rows, err := db.Query(`SELECT id, url, events, enabled, failure_count FROM webhooks
+			WHERE user_id = ? ORDER BY id`, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := WebhooksResponse{Webhooks: []Webhook{}}
+		for rows.Next() {
+			var webhook Webhook
+			var events string
+			err = rows.Scan(&webhook.Id, &webhook.URL, &events, &webhook.Enabled, &webhook.FailureCount)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			webhook.Events = []string{}
+			if events != "" {
+				webhook.Events = strings.Split(events, ",")
+			}
+			response.Webhooks = append(response.Webhooks, webhook)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Subscribe a url to changes the user can see. The secret for checking
+// signatures is only ever handed out here.
+func handleWebhookPost(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type WebhookRequest struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+
+		type WebhookResponse struct {
+			Id     uint64 `json:"id"`
+			Secret string `json:"secret"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req WebhookRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		if err := checkWebhookURL(req.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events, err := parseWebhookEvents(req.Events)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE user_id = ?", userId).Scan(&count)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count >= maxWebhooksPerUser {
+			http.Error(w, fmt.Sprintf("no more than %d webhooks", maxWebhooksPerUser), http.StatusBadRequest)
+			return
+		}
+
+		response := WebhookResponse{Secret: base64.URLEncoding.EncodeToString(newShareToken())}
+		err = db.QueryRow("INSERT INTO webhooks(user_id, url, events, secret) VALUES(?, ?, ?, ?) RETURNING id",
+			userId, req.URL, events, response.Secret).Scan(&response.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Change a webhook's url or events, or turn it on or off. Turning it back on
+// forgets about past failures.
+func handleWebhookPatch(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type WebhookPatch struct {
+			URL     *string  `json:"url"`
+			Events  []string `json:"events"`
+			Enabled *bool    `json:"enabled"`
+		}
+
+		webhookId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed webhook id", http.StatusBadRequest)
+			return
+		}
+
+		var req WebhookPatch
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Bad Request: Malformed JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Make sure the request body stream is closed.
+		defer r.Body.Close()
+
+		var fieldsToSet []string
+		var arguments []interface{}
+		if req.URL != nil {
+			if err := checkWebhookURL(*req.URL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fieldsToSet = append(fieldsToSet, "url = ?")
+			arguments = append(arguments, *req.URL)
+		}
+		if req.Events != nil {
+			events, err := parseWebhookEvents(req.Events)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fieldsToSet = append(fieldsToSet, "events = ?")
+			arguments = append(arguments, events)
+		}
+		if req.Enabled != nil {
+			fieldsToSet = append(fieldsToSet, "enabled = ?")
+			arguments = append(arguments, *req.Enabled)
+			if *req.Enabled {
+				fieldsToSet = append(fieldsToSet, "failure_count = 0")
+			}
+		}
+		if len(fieldsToSet) == 0 {
+			http.Error(w, "must provide something to patch", http.StatusBadRequest)
+			return
+		}
+
+		arguments = append(arguments, webhookId, userId)
+		result, err := db.Exec(fmt.Sprintf("UPDATE webhooks SET %s WHERE id = ? AND user_id = ?",
+			strings.Join(fieldsToSet, ", ")), arguments...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "non-existent webhook", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+func handleWebhookDelete(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		webhookId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed webhook id", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", webhookId, userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected == 0 {
+			http.Error(w, "non-existent webhook", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// The most recent deliveries for a webhook, newest first.
+func handleWebhookDeliveriesGet(logger *log.Logger, db *sql.DB) func(http.ResponseWriter, *http.Request, uint64) {
+	return func(w http.ResponseWriter, r *http.Request, userId uint64) {
+		type Delivery struct {
+			Id              uint64     `json:"id"`
+			EventType       string     `json:"event_type"`
+			Status          string     `json:"status"`
+			Attempts        uint64     `json:"attempts"`
+			LastStatusCode  *int64     `json:"last_status_code"`
+			LastError       *string    `json:"last_error"`
+			NextAttemptTime *time.Time `json:"next_attempt_time"`
+			CreationTime    time.Time  `json:"creation_time"`
+			DeliveredTime   *time.Time `json:"delivered_time"`
+		}
+
+		type DeliveriesResponse struct {
+			Deliveries []Delivery `json:"deliveries"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		webhookId, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "malformed webhook id", http.StatusBadRequest)
+			return
+		}
+
+		var owned bool
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM webhooks WHERE id = ? AND user_id = ?",
+			webhookId, userId).Scan(&owned)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !owned {
+			http.Error(w, "non-existent webhook", http.StatusNotFound)
+			return
+		}
+
+		rows, err := db.Query(`SELECT id, event_type, status, attempts, last_status_code, last_error,
+			next_attempt_time, creation_time, delivered_time
+			FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`, webhookId, webhookLogSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		response := DeliveriesResponse{Deliveries: []Delivery{}}
+		for rows.Next() {
+			var d Delivery
+			var lastStatusCode sql.NullInt64
+			var lastError sql.NullString
+			var nextAttemptTime time.Time
+			var deliveredTime sql.NullTime
+			err = rows.Scan(&d.Id, &d.EventType, &d.Status, &d.Attempts, &lastStatusCode, &lastError,
+				&nextAttemptTime, &d.CreationTime, &deliveredTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if lastStatusCode.Valid {
+				d.LastStatusCode = &lastStatusCode.Int64
+			}
+			if lastError.Valid {
+				d.LastError = &lastError.String
+			}
+			if d.Status == "pending" {
+				d.NextAttemptTime = &nextAttemptTime
+			}
+			if deliveredTime.Valid {
+				d.DeliveredTime = &deliveredTime.Time
+			}
+			response.Deliveries = append(response.Deliveries, d)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
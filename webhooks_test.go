@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWebhookCall struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestWebhooks(t *testing.T) {
+	logger := log.Default()
+	db := newTestDb(t)
+	hub := newHub()
+	alice := createTestUser(t, db, "Alice")
+	bob := createTestUser(t, db, "Bob")
+
+	var mu sync.Mutex
+	var calls []testWebhookCall
+	status := http.StatusOK
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, testWebhookCall{event: r.Header.Get("X-Wishlist-Event"),
+			signature: r.Header.Get("X-Wishlist-Signature"), body: body})
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	type webhookResponse struct {
+		Id     uint64 `json:"id"`
+		Secret string `json:"secret"`
+	}
+	post := handleWebhookPost(logger, db)
+	for _, body := range []string{
+		`{"url": "ftp://example.com/hook"}`,
+		fmt.Sprintf(`{"url": %q, "events": ["explode"]}`, receiver.URL),
+	} {
+		if code := doJson(t, post, alice, "POST", "/api/webhooks", body, nil); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+	var aliceHook, bobHook webhookResponse
+	if code := doJson(t, post, alice, "POST", "/api/webhooks",
+		fmt.Sprintf(`{"url": %q, "events": ["create", "claim"]}`, receiver.URL), &aliceHook); code != http.StatusOK {
+		t.Fatalf("failed to create webhook: %d", code)
+	}
+	if code := doJson(t, post, bob, "POST", "/api/webhooks",
+		fmt.Sprintf(`{"url": %q}`, receiver.URL), &bobHook); code != http.StatusOK {
+		t.Fatalf("failed to create webhook: %d", code)
+	}
+
+	addItem := func() {
+		t.Helper()
+		if code := doJson(t, handleWishlistPost(logger, db, hub), alice, "POST", "/api/wishlist",
+			`{"description": "kite", "source": "", "cost": ""}`, nil); code != http.StatusOK {
+			t.Fatalf("failed to add item: %d", code)
+		}
+	}
+	addItem()
+	if code := doJson(t, handleClaimPost(logger, db, hub), bob, "POST", "/api/wishlist/claim",
+		`{"id": 1}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to claim: %d", code)
+	}
+
+	client := newLinkFetcher(true).client
+	now := time.Now()
+	deliver := func(at time.Time) {
+		t.Helper()
+		if err := deliverWebhooks(context.Background(), logger, db, client, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice never hears about the claim on her own item
+	deliver(now)
+	if len(calls) != 3 {
+		t.Fatalf("expected 3 calls, got %d", len(calls))
+	}
+	var claims int
+	for _, call := range calls {
+		if call.signature != signWebhook(aliceHook.Secret, call.body) && call.signature != signWebhook(bobHook.Secret, call.body) {
+			t.Errorf("bad signature on %s", call.body)
+		}
+		if call.event == "claim" {
+			claims++
+			if call.signature != signWebhook(bobHook.Secret, call.body) {
+				t.Errorf("claim went to alice")
+			}
+		}
+	}
+	if claims != 1 {
+		t.Errorf("expected one claim call, got %d", claims)
+	}
+	deliver(now)
+	if len(calls) != 3 {
+		t.Errorf("delivered twice")
+	}
+
+	// failures back off and show up in the log
+	status = http.StatusInternalServerError
+	addItem()
+	deliver(now)
+	deliver(now.Add(time.Second))
+	type deliveriesResponse struct {
+		Deliveries []struct {
+			Status         string `json:"status"`
+			Attempts       uint64 `json:"attempts"`
+			LastStatusCode *int64 `json:"last_status_code"`
+		} `json:"deliveries"`
+	}
+	var deliveries deliveriesResponse
+	path := map[string]string{"id": fmt.Sprint(aliceHook.Id)}
+	if code := doJsonPath(t, handleWebhookDeliveriesGet(logger, db), alice, "GET", "/api/webhooks",
+		path, "", &deliveries); code != http.StatusOK {
+		t.Fatalf("failed to get deliveries: %d", code)
+	}
+	if len(deliveries.Deliveries) != 2 || deliveries.Deliveries[0].Status != "pending" ||
+		deliveries.Deliveries[0].Attempts != 1 || *deliveries.Deliveries[0].LastStatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected deliveries %+v", deliveries.Deliveries)
+	}
+	if code := doJsonPath(t, handleWebhookDeliveriesGet(logger, db), bob, "GET", "/api/webhooks",
+		path, "", nil); code != http.StatusNotFound {
+		t.Errorf("bob read alice's deliveries: %d", code)
+	}
+
+	status = http.StatusOK
+	deliver(now.Add(webhookBackoff))
+	doJsonPath(t, handleWebhookDeliveriesGet(logger, db), alice, "GET", "/api/webhooks", path, "", &deliveries)
+	if deliveries.Deliveries[0].Status != "delivered" || deliveries.Deliveries[0].Attempts != 2 {
+		t.Errorf("retry wasn't delivered %+v", deliveries.Deliveries[0])
+	}
+
+	// a webhook that keeps failing gets turned off
+	status = http.StatusInternalServerError
+	for i := 0; i < 3; i++ {
+		addItem()
+	}
+	at := now
+	for i := 0; i < webhookMaxAttempts; i++ {
+		at = at.Add(webhookMaxBackoff)
+		deliver(at)
+	}
+	type webhooksResponse struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	var webhooks webhooksResponse
+	doJson(t, handleWebhooksGet(logger, db), alice, "GET", "/api/webhooks", "", &webhooks)
+	if len(webhooks.Webhooks) != 1 || webhooks.Webhooks[0].Enabled || webhooks.Webhooks[0].FailureCount != webhookDisableAfter {
+		t.Errorf("expected webhook to be disabled, got %+v", webhooks.Webhooks)
+	}
+
+	patch := handleWebhookPatch(logger, db)
+	if code := doJsonPath(t, patch, bob, "PATCH", "/api/webhooks", path, `{"enabled": true}`, nil); code != http.StatusNotFound {
+		t.Errorf("bob enabled alice's webhook: %d", code)
+	}
+	if code := doJsonPath(t, patch, alice, "PATCH", "/api/webhooks", path, `{"enabled": true}`, nil); code != http.StatusOK {
+		t.Fatalf("failed to enable webhook: %d", code)
+	}
+	doJson(t, handleWebhooksGet(logger, db), alice, "GET", "/api/webhooks", "", &webhooks)
+	if !webhooks.Webhooks[0].Enabled || webhooks.Webhooks[0].FailureCount != 0 {
+		t.Errorf("expected webhook to be enabled, got %+v", webhooks.Webhooks)
+	}
+
+	if code := doJsonPath(t, handleWebhookDelete(logger, db), alice, "DELETE", "/api/webhooks", path, "", nil); code != http.StatusOK {
+		t.Errorf("failed to delete webhook: %d", code)
+	}
+}